@@ -0,0 +1,210 @@
+package cablastp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultAlphabet is the name of the reduced alphabet used when none is
+// given. It is the four class reduction that CaBLASTP has always used.
+const DefaultAlphabet = "cablastp4"
+
+// nuclLetters are the letters used for the classes of an alphabet with at
+// most four classes, so that reduced sequences can be searched with
+// nucleotide BLAST.
+const nuclLetters = "ACGT"
+
+// An Alphabet is a reduction of the amino acid alphabet to a smaller set of
+// classes. Every residue is mapped to the letter representing its class.
+// Residues that aren't in any class (like 'X', '*', 'O' or 'U') are mapped to
+// the alphabet's wildcard.
+//
+// Alphabets with at most four classes use the letters A, C, G and T for their
+// classes (and N as the wildcard), so that the coarse database is a
+// nucleotide database. Larger alphabets use the first residue of each class
+// as its letter (and X as the wildcard).
+type Alphabet struct {
+	// Name is either the name of a preset alphabet, or the specification of
+	// a custom alphabet as given to ParseAlphabet.
+	Name string
+
+	// Classes is the set of residues in each class.
+	Classes []string
+
+	// Letters is the letter used for each class. It has the same length as
+	// Classes.
+	Letters string
+
+	// Wildcard is the letter used for residues that aren't in any class.
+	Wildcard byte
+
+	reduced [256]byte
+
+	// index is the position of each class letter in Letters, and -1 for
+	// every other byte (including the wildcard).
+	index [256]int
+}
+
+// presetAlphabets are the classes of each named alphabet. B, Z and J are put
+// in the class of the residues they may stand for.
+//
+// The Murphy alphabets are from Murphy, Wallqvist and Levy, "Simplified amino
+// acid alphabets for protein fold recognition and implications for folding"
+// (2000). SE-B(6) is from Peterson et al., "Reduced amino acid alphabets
+// exhibit an improved sensitivity and selectivity in fold assignment" (2009).
+var presetAlphabets = map[string][]string{
+	"cablastp4": {"FWY", "CILMVJ", "AGPST", "DENQKRHBZ"},
+	"murphy4":   {"LVIMCJ", "AGSTP", "FYW", "EDNQKRHBZ"},
+	"murphy8": {"LVIMCJ", "AG", "ST", "P", "FYW", "EDNQBZ", "KR",
+		"H"},
+	"murphy10": {"LVIMJ", "C", "A", "G", "ST", "P", "FYW", "EDNQBZ",
+		"KR", "H"},
+	"seb6": {"AST", "CFILMVYJ", "DNB", "EKQRZ", "GP", "HW"},
+}
+
+// AlphabetNames returns the names of all preset alphabets in alphabetical
+// order.
+func AlphabetNames() []string {
+	names := make([]string, 0, len(presetAlphabets))
+	for name := range presetAlphabets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseAlphabet returns the alphabet described by 'spec'. 'spec' is either
+// the name of a preset alphabet (see AlphabetNames) or a custom alphabet,
+// given as a comma separated list of residue classes, e.g.,
+// "LVIMC,AGSTP,FYW,EDNQKRH".
+func ParseAlphabet(spec string) (*Alphabet, error) {
+	if classes, ok := presetAlphabets[spec]; ok {
+		return NewAlphabet(spec, classes)
+	}
+	if !strings.Contains(spec, ",") {
+		return nil, fmt.Errorf("Unknown reduced alphabet '%s'. Valid "+
+			"alphabets are %v, or a comma separated list of residue "+
+			"classes.", spec, AlphabetNames())
+	}
+	return NewAlphabet(spec, strings.Split(spec, ","))
+}
+
+// NewAlphabet creates a new alphabet called 'name' from a list of residue
+// classes. Every class must be non-empty, and no residue may be in more than
+// one class.
+func NewAlphabet(name string, classes []string) (*Alphabet, error) {
+	if len(classes) < 2 {
+		return nil, fmt.Errorf("The reduced alphabet '%s' must have at "+
+			"least two classes.", name)
+	}
+
+	alpha := &Alphabet{
+		Name:    name,
+		Classes: make([]string, len(classes)),
+	}
+	if len(classes) <= len(nuclLetters) {
+		alpha.Letters = nuclLetters[:len(classes)]
+		alpha.Wildcard = 'N'
+	} else {
+		alpha.Wildcard = 'X'
+	}
+
+	letters := make([]byte, len(classes))
+	for i, class := range classes {
+		class = strings.ToUpper(strings.TrimSpace(class))
+		if len(class) == 0 {
+			return nil, fmt.Errorf("The reduced alphabet '%s' has an "+
+				"empty class.", name)
+		}
+		alpha.Classes[i] = class
+		if len(alpha.Letters) > 0 {
+			letters[i] = alpha.Letters[i]
+		} else if class[0] == alpha.Wildcard {
+			return nil, fmt.Errorf("The class '%s' of the reduced alphabet "+
+				"'%s' cannot start with the wildcard '%c'.",
+				class, name, alpha.Wildcard)
+		} else {
+			letters[i] = class[0]
+		}
+		for j := 0; j < len(class); j++ {
+			residue := class[j]
+			if residue < 'A' || residue > 'Z' {
+				return nil, fmt.Errorf("The reduced alphabet '%s' contains "+
+					"'%c', which is not an amino acid.", name, residue)
+			}
+			if alpha.reduced[residue] != 0 {
+				return nil, fmt.Errorf("The residue '%c' is in more than "+
+					"one class of the reduced alphabet '%s'.", residue, name)
+			}
+			alpha.reduced[residue] = letters[i]
+			alpha.reduced[residue-'A'+'a'] = letters[i]
+		}
+	}
+	alpha.Letters = string(letters)
+
+	for i := range alpha.reduced {
+		if alpha.reduced[i] == 0 {
+			alpha.reduced[i] = alpha.Wildcard
+		}
+		alpha.index[i] = strings.IndexByte(alpha.Letters, byte(i))
+	}
+	return alpha, nil
+}
+
+// Size returns the number of classes in the alphabet (not including the
+// wildcard).
+func (alpha *Alphabet) Size() int {
+	return len(alpha.Classes)
+}
+
+// IsNucleotide returns true if reduced sequences in this alphabet are written
+// with nucleotide letters.
+func (alpha *Alphabet) IsNucleotide() bool {
+	return alpha.Wildcard == 'N'
+}
+
+// BlastDBType returns the type of BLAST database ("nucl" or "prot") that
+// reduced sequences in this alphabet must be stored in.
+func (alpha *Alphabet) BlastDBType() string {
+	if alpha.IsNucleotide() {
+		return "nucl"
+	}
+	return "prot"
+}
+
+// Index returns the position of the class letter 'letter' in Letters, or -1
+// if 'letter' isn't a class letter (e.g., if it is the wildcard).
+func (alpha *Alphabet) Index(letter byte) int {
+	return alpha.index[letter]
+}
+
+// HasWildcard returns true if any letter in the reduced sequence 'rseq' is
+// not a class letter.
+func (alpha *Alphabet) HasWildcard(rseq []byte) bool {
+	for _, letter := range rseq {
+		if alpha.index[letter] == -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Reduce1 returns the letter of the class containing 'residue', or the
+// wildcard if it isn't in any class.
+func (alpha *Alphabet) Reduce1(residue byte) byte {
+	return alpha.reduced[residue]
+}
+
+// Reduce translates a sequence of amino acid residues to the alphabet.
+func (alpha *Alphabet) Reduce(seq []byte) []byte {
+	dest := make([]byte, len(seq))
+	for i, residue := range seq {
+		dest[i] = alpha.reduced[residue]
+	}
+	return dest
+}
+
+func (alpha *Alphabet) String() string {
+	return fmt.Sprintf("%s (%s)", alpha.Name, strings.Join(alpha.Classes, ","))
+}
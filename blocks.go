@@ -0,0 +1,225 @@
+package cablastp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Block compression of the 'compressed' and 'coarse.fasta' files.
+//
+// When a database has a block size, records in those files are grouped into
+// blocks of at most that many records, and every block is compressed as a
+// separate flate stream. A file is simply its blocks one after the other.
+//
+// Instead of the byte offset of every record, the index of a block compressed
+// file holds the address of every record: the byte offset of its block in the
+// file (the upper 40 bits), and the byte offset of the record in the
+// decompressed block (the lower 24 bits).
+const (
+	// blockIntraBits is the number of bits in an address used for the
+	// offset of a record inside its block.
+	blockIntraBits = 24
+
+	// blockMaxBytes is the most uncompressed bytes in a block before the
+	// next record is put in a new block, regardless of the block size. (So
+	// that the offset of every record in a block fits in its address.)
+	blockMaxBytes = 1 << 20
+
+	// blockCacheSize is the number of decompressed blocks kept in memory
+	// while reading.
+	blockCacheSize = 8
+)
+
+func blockAddr(blockOff int64, intraOff int) int64 {
+	return blockOff<<blockIntraBits | int64(intraOff)
+}
+
+func splitBlockAddr(addr int64) (blockOff int64, intraOff int) {
+	return addr >> blockIntraBits, int(addr & (1<<blockIntraBits - 1))
+}
+
+// A blockWriter groups records into blocks, and writes every full block to
+// the underlying writer.
+type blockWriter struct {
+	w        *countWriter
+	perBlock int
+	records  int
+	buf      *bytes.Buffer
+	flater   *flate.Writer
+}
+
+// newBlockWriter creates a writer of blocks of 'perBlock' records each. 'off'
+// is the byte offset in the file that 'w' writes to.
+func newBlockWriter(w io.Writer, off int64, perBlock int) *blockWriter {
+	return newBlockWriterDict(w, off, perBlock, nil)
+}
+
+// newBlockWriterDict is like newBlockWriter, except that every block is
+// compressed with the preset dictionary 'dict'. The blocks must be read with
+// the same dictionary.
+func newBlockWriterDict(
+	w io.Writer, off int64, perBlock int, dict []byte) *blockWriter {
+
+	cw := &countWriter{w: w, n: off}
+	flater, err := flate.NewWriterDict(cw, flate.DefaultCompression, dict)
+	if err != nil {
+		panic(err) // only happens with an invalid compression level
+	}
+	return &blockWriter{
+		w:        cw,
+		perBlock: perBlock,
+		buf:      new(bytes.Buffer),
+		flater:   flater,
+	}
+}
+
+// add puts a record in the current block, and returns its address. The
+// record is only written once its block is full (or flush is called).
+func (bw *blockWriter) add(record []byte) (int64, error) {
+	if bw.records == bw.perBlock || bw.buf.Len() >= blockMaxBytes {
+		if err := bw.flush(); err != nil {
+			return 0, err
+		}
+	}
+	addr := blockAddr(bw.w.n, bw.buf.Len())
+	bw.buf.Write(record)
+	bw.records++
+	return addr, nil
+}
+
+// flush compresses and writes the current block, if it has any records.
+func (bw *blockWriter) flush() error {
+	if bw.records == 0 {
+		return nil
+	}
+	bw.flater.Reset(bw.w)
+	if _, err := bw.flater.Write(bw.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := bw.flater.Close(); err != nil {
+		return err
+	}
+	bw.buf.Reset()
+	bw.records = 0
+	return nil
+}
+
+// countWriter keeps track of the offset in the file it writes to.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// A blockReader reads records by their addresses, and keeps the most recently
+// used blocks in memory.
+type blockReader struct {
+	r    io.ReaderAt
+	dict []byte
+
+	// cache holds decompressed blocks, most recently used first.
+	cache []cachedBlock
+}
+
+type cachedBlock struct {
+	off  int64
+	data []byte
+}
+
+func newBlockReader(r io.ReaderAt) *blockReader {
+	return newBlockReaderDict(r, nil)
+}
+
+// newBlockReaderDict creates a reader of blocks that were compressed with the
+// preset dictionary 'dict'.
+func newBlockReaderDict(r io.ReaderAt, dict []byte) *blockReader {
+	return &blockReader{
+		r:     r,
+		dict:  dict,
+		cache: make([]cachedBlock, 0, blockCacheSize),
+	}
+}
+
+// record returns a reader that starts at the record with address 'addr', and
+// ends at the end of its block.
+func (br *blockReader) record(addr int64) (*bytes.Reader, error) {
+	blockOff, intraOff := splitBlockAddr(addr)
+	data, err := br.block(blockOff)
+	if err != nil {
+		return nil, err
+	}
+	if intraOff >= len(data) {
+		return nil, fmt.Errorf("The block at offset %d has %d bytes, but a "+
+			"record is supposed to start at byte %d.",
+			blockOff, len(data), intraOff)
+	}
+	return bytes.NewReader(data[intraOff:]), nil
+}
+
+// block returns the decompressed block that starts at byte offset 'off'.
+func (br *blockReader) block(off int64) ([]byte, error) {
+	for i, cached := range br.cache {
+		if cached.off == off {
+			copy(br.cache[1:i+1], br.cache[:i])
+			br.cache[0] = cached
+			return cached.data, nil
+		}
+	}
+
+	inflater := flate.NewReaderDict(
+		bufio.NewReader(io.NewSectionReader(br.r, off, 1<<62)), br.dict)
+	data, err := ioutil.ReadAll(inflater)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decompress the block at offset "+
+			"%d: %s", off, err)
+	}
+	if len(br.cache) < blockCacheSize {
+		br.cache = append(br.cache, cachedBlock{})
+	}
+	copy(br.cache[1:], br.cache)
+	br.cache[0] = cachedBlock{off: off, data: data}
+	return data, nil
+}
+
+// A blockStream decompresses every block of a block compressed file in order,
+// so that the file can be read from start to finish like a plain file.
+type blockStream struct {
+	r        *bufio.Reader
+	inflater io.ReadCloser
+}
+
+func newBlockStream(r io.Reader) *blockStream {
+	return &blockStream{r: bufio.NewReader(r)}
+}
+
+func (bs *blockStream) Read(p []byte) (int, error) {
+	for {
+		if bs.inflater == nil {
+			if _, err := bs.r.Peek(1); err != nil {
+				return 0, err
+			}
+			// Since bs.r is an io.ByteReader, the inflater doesn't read
+			// past the end of its block.
+			bs.inflater = flate.NewReader(bs.r)
+		}
+		n, err := bs.inflater.Read(p)
+		if err == io.EOF {
+			bs.inflater.Close()
+			bs.inflater = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
@@ -2,7 +2,12 @@ package cablastp
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -11,15 +16,23 @@ func TestSeedHashing(t *testing.T) {
 	seedLowComplexity := 6
 
 	type test struct {
-		kmer string
-		hash int
+		alphabet string
+		kmer     string
+		hash     int
 	}
 	tests := []test{
-		{"ABCD", 578},
-		{"AAAA", 0},
+		{"cablastp4", "ACGT", 27},
+		{"cablastp4", "AAAA", 0},
+		{"murphy10", "LCAG", 123},
+		{"murphy10", "HHHH", 9999},
 	}
-	seeds := NewSeeds(seedSize, seedLowComplexity)
 	for _, test := range tests {
+		alpha, err := ParseAlphabet(test.alphabet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shape := testSeedShape(t, seedSize, "", "all", 0)
+		seeds := NewSeeds(alpha, shape, seedLowComplexity)
 		thash := seeds.hashKmer([]byte(test.kmer))
 		tkmer := seeds.unhashKmer(test.hash)
 		if thash != test.hash {
@@ -42,7 +55,7 @@ func TestDBConfIO(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if dbConf != dbConfTest {
+	if *dbConf != *dbConfTest {
 		t.Fatalf("%v != %v", dbConf, dbConfTest)
 	}
 }
@@ -134,3 +147,771 @@ but should be
 		}
 	}
 }
+
+func TestTranslateAmbiguity(t *testing.T) {
+	type test struct {
+		codon string
+		amino byte
+	}
+	tests := []test{
+		{"ATG", 'M'},
+		{"aug", 'M'},
+		{"CTN", 'L'}, // every expansion is leucine
+		{"TAR", '*'}, // TAA and TAG are both stops
+		{"YTG", 'L'}, // CTG and TTG
+		{"ATN", 'X'}, // ATG is methionine, the rest are isoleucine
+		{"AT-", 'X'},
+	}
+	gc, err := GetGeneticCode(DefaultGeneticCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if amino := gc.translate1([]byte(test.codon)); amino != test.amino {
+			t.Fatalf("The codon '%s' translated to '%c' but should have "+
+				"translated to '%c'.", test.codon, amino, test.amino)
+		}
+	}
+
+	normal, ambiguous := NormalizeNucleotides([]byte("acgUNRx"))
+	if string(normal) != "ACGTNRN" || ambiguous != 3 {
+		t.Fatalf("Normalizing 'acgUNRx' resulted in '%s' with %d ambiguous "+
+			"bases, but should be 'ACGTNRN' with 3 ambiguous bases.",
+			normal, ambiguous)
+	}
+	for _, pair := range []string{"AT", "CG", "RY", "KM", "SS", "WW", "BV",
+		"DH", "NN"} {
+		if c := complement(pair[0]); c != pair[1] {
+			t.Fatalf("The complement of '%c' is '%c', but should be '%c'.",
+				pair[0], c, pair[1])
+		}
+		if c := complement(pair[1] - 'A' + 'a'); c != pair[0] {
+			t.Fatalf("The complement of '%c' is '%c', but should be '%c'.",
+				pair[1]-'A'+'a', c, pair[0])
+		}
+	}
+}
+
+func TestTranslateFrames(t *testing.T) {
+	gc, _ := GetGeneticCode(DefaultGeneticCode)
+
+	// ATG AAA TAA GGG TTT CC
+	frames, _ := gc.Translate([]byte("ATGAAATAAGGGTTTCC"))
+	if len(frames) != 6 {
+		t.Fatalf("Expected 6 frames, but got %d.", len(frames))
+	}
+	plus1 := frames[0]
+	if plus1.Frame != 1 || string(plus1.Residues) != "MK*GF" ||
+		plus1.NucStart != 0 || plus1.NucEnd != 15 {
+		t.Fatalf("Frame +1 is %+d '%s' [%d, %d), but should be "+
+			"+1 'MK*GF' [0, 15).", plus1.Frame, plus1.Residues,
+			plus1.NucStart, plus1.NucEnd)
+	}
+	orfs := plus1.ORFs(2)
+	if len(orfs) != 2 || string(orfs[1].Residues) != "GF" ||
+		orfs[1].NucStart != 9 || orfs[1].NucEnd != 15 {
+		t.Fatalf("Expected ORFs 'MK' and 'GF' [9, 15), but got %v.", orfs)
+	}
+
+	// Frame -1 reads the reverse complement (GGAAACCCTTATTTCAT) from its
+	// start, which is the end of the forward strand.
+	minus1 := frames[1]
+	if minus1.Frame != -1 || minus1.NucStart != 2 || minus1.NucEnd != 17 {
+		t.Fatalf("Frame -1 covers [%d, %d), but should cover [2, 17).",
+			minus1.NucStart, minus1.NucEnd)
+	}
+	if s, e := minus1.NucRange(0, 1); s != 14 || e != 17 {
+		t.Fatalf("The first residue of frame -1 comes from [%d, %d), but "+
+			"should come from [14, 17).", s, e)
+	}
+
+	name := orfs[1].Name("read7 some description")
+	id, frame, start, end, err := ParseFrameName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "read7" || frame != 1 || start != 9 || end != 15 {
+		t.Fatalf("Parsing '%s' resulted in (%s, %+d, %d, %d), but should "+
+			"be (read7, +1, 9, 15).", name, id, frame, start, end)
+	}
+}
+
+func TestAlphabets(t *testing.T) {
+	for _, name := range AlphabetNames() {
+		alpha, err := ParseAlphabet(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, residue := range []byte("ACDEFGHIKLMNPQRSTVWYBZJ") {
+			if alpha.Reduce1(residue) == alpha.Wildcard {
+				t.Fatalf("'%c' is not in any class of '%s'.", residue, name)
+			}
+		}
+	}
+
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reduced := string(alpha.Reduce([]byte("FCADXOU*")))
+	if reduced != "ACGTNNNN" {
+		t.Fatalf("Reducing 'FCADXOU*' resulted in '%s', but should be "+
+			"'ACGTNNNN'.", reduced)
+	}
+
+	alpha, err = ParseAlphabet("LVIMC,AG,ST,P,FYW,EDNQ,KR,H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpha.Size() != 8 || alpha.Letters != "LASPFEKH" ||
+		alpha.IsNucleotide() {
+		t.Fatalf("Unexpected custom alphabet %s with letters '%s'.",
+			alpha, alpha.Letters)
+	}
+	for _, bad := range []string{"nosuchalphabet", "ACD", "AC,CD", "AC,,D"} {
+		if _, err := ParseAlphabet(bad); err == nil {
+			t.Fatalf("'%s' should not be a valid alphabet.", bad)
+		}
+	}
+}
+
+func TestSeedsLookup(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := NewSeeds(alpha, testSeedShape(t, 4, "", "all", 0), 0)
+	seeds.Add(0, NewCoarseSeq(0, "a", []byte("ACGTNACGTA")))
+	seeds.Add(1, NewCoarseSeq(1, "b", []byte("GGACGTT")))
+
+	mem := make([][2]uint, 0)
+	locs := seeds.Lookup([]byte("ACGT"), &mem)
+	expected := [][2]uint{{0, 0}, {0, 5}, {1, 2}}
+	if len(locs) != len(expected) {
+		t.Fatalf("Expected seed locations %v, but got %v.", expected, locs)
+	}
+	for i := range expected {
+		if locs[i] != expected[i] {
+			t.Fatalf("Expected seed locations %v, but got %v.", expected, locs)
+		}
+	}
+	if locs := seeds.Lookup([]byte("TTTT"), &mem); locs != nil {
+		t.Fatalf("Expected no seed locations for TTTT, but got %v.", locs)
+	}
+	if n := seeds.NumSeeds(); n != 5 {
+		t.Fatalf("Expected 5 seeds in the table, but there are %d.", n)
+	}
+
+	seeds.MaybeEvict(EvictWipe, 0)
+	if locs := seeds.Lookup([]byte("ACGT"), &mem); locs != nil {
+		t.Fatalf("Expected an empty table after wiping, but got %v.", locs)
+	}
+}
+
+func TestSeedsFull(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds := NewSeeds(alpha, testSeedShape(t, 4, "", "all", 0), 0)
+
+	// Leave room for a single chunk in the last block.
+	seeds.chunks.next = 1<<32 - 8
+	err = seeds.Add(0, NewCoarseSeq(0, "a", []byte("ACGTTACG")))
+	if err == nil {
+		t.Fatal("Adding seeds to a full table should fail.")
+	}
+	if n := seeds.NumSeeds(); n != 1 {
+		t.Fatalf("Expected 1 seed in the table, but there are %d.", n)
+	}
+	mem := make([][2]uint, 0)
+	locs := seeds.Lookup([]byte("ACGT"), &mem)
+	if len(locs) != 1 || locs[0] != [2]uint{0, 0} {
+		t.Fatalf("Expected the seed location (0, 0), but got %v.", locs)
+	}
+}
+
+func TestSeedEviction(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSeeds := func() Seeds {
+		seeds := NewSeeds(alpha, testSeedShape(t, 4, "", "all", 0), 0)
+		for i := 0; i < 4; i++ {
+			seeds.Add(i, NewCoarseSeq(i, "", []byte("ACGTTACGTT")))
+		}
+		return seeds
+	}
+	mem := make([][2]uint, 0)
+
+	// Each sequence has 6 seeds, and 'ACGT' occurs twice in each. Allowing
+	// 16 seeds means evicting down to 12, so the two oldest sequences
+	// without matches must be evicted.
+	maxGB := float64(16*seedLocSize) / (1024 * 1024 * 1024)
+	seeds := newSeeds()
+	seeds.Hit(0)
+	if evicted := seeds.MaybeEvict(EvictOldest, maxGB); evicted != 12 {
+		t.Fatalf("Expected 12 evicted seeds, but %d were evicted.", evicted)
+	}
+	locs := seeds.Lookup([]byte("ACGT"), &mem)
+	for _, loc := range locs {
+		if loc[0] == 1 || loc[0] == 2 {
+			t.Fatalf("Seeds of sequence %d should have been evicted: %v",
+				loc[0], locs)
+		}
+	}
+	if stats := seeds.EvictionStats(); stats.Protected != 6 {
+		t.Fatalf("Expected 6 protected seeds, but got %s.", stats)
+	}
+
+	// Capping every K-mer at two locations leaves 10 seeds.
+	seeds = newSeeds()
+	if evicted := seeds.MaybeEvict(EvictCap, maxGB); evicted != 14 {
+		t.Fatalf("Expected 14 evicted seeds, but %d were evicted.", evicted)
+	}
+	locs = seeds.Lookup([]byte("ACGT"), &mem)
+	if len(locs) != 2 || locs[0] != [2]uint{3, 0} || locs[1] != [2]uint{3, 5} {
+		t.Fatalf("Expected only the newest locations of ACGT, but got %v.",
+			locs)
+	}
+}
+
+func testSeedShape(t *testing.T, size int, pattern, sampling string,
+	window int) SeedShape {
+
+	conf := DefaultDBConf.DeepCopy()
+	conf.MapSeedSize = size
+	conf.SeedPattern = pattern
+	conf.SeedSampling = sampling
+	conf.SeedWindow = window
+	shape, err := NewSeedShape(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shape
+}
+
+func TestSeedShapes(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Spaced seeds ignore the residues at '0's in the pattern.
+	spaced := NewSeeds(alpha, testSeedShape(t, 0, "1101", "all", 0), 0)
+	if spaced.SeedSize != 4 || len(spaced.rows) != 64 {
+		t.Fatalf("A '1101' seed should span 4 residues and have 64 rows, "+
+			"but it spans %d with %d rows.", spaced.SeedSize, len(spaced.rows))
+	}
+	if spaced.hashKmer([]byte("ACTT")) != spaced.hashKmer([]byte("ACGT")) {
+		t.Fatalf("'ACTT' and 'ACGT' should be the same '1101' seed.")
+	}
+	if spaced.HasWildcard([]byte("ACNT")) {
+		t.Fatalf("A wildcard at a '0' in the pattern should be ignored.")
+	}
+
+	residues := []byte("ACGTTGCAAGCTTACGGATCCATGNNACGTACGT")
+	for _, sampling := range []string{"minimizer", "syncmer"} {
+		seeds := NewSeeds(alpha, testSeedShape(t, 6, "", sampling, 3), 0)
+		sampled := seeds.Sample(residues)
+		count := 0
+		for i, s := range sampled {
+			if !s {
+				continue
+			}
+			count++
+			if seeds.HasWildcard(residues[i : i+6]) {
+				t.Fatalf("%s sampling picked a seed with a wildcard at %d.",
+					sampling, i)
+			}
+		}
+		if count == 0 || count >= len(residues)-5 {
+			t.Fatalf("%s sampling picked %d of %d seeds.",
+				sampling, count, len(residues)-5)
+		}
+
+		// Sampling only depends on the residues near each seed, so an equal
+		// region in another sequence has the same samples.
+		other := append([]byte("TTTT"), residues[:20]...)
+		osampled := seeds.Sample(other)
+		for i := 3; i+6 <= 20-3; i++ {
+			if sampled[i] != osampled[i+4] {
+				t.Fatalf("%s sampling of position %d differs between "+
+					"sequences.", sampling, i)
+			}
+		}
+	}
+
+	for _, bad := range []string{"0110", "1121"} {
+		conf := DefaultDBConf.DeepCopy()
+		conf.SeedPattern = bad
+		if _, err := NewSeedShape(conf); err == nil {
+			t.Fatalf("'%s' should not be a valid seed pattern.", bad)
+		}
+	}
+}
+
+func TestResidueCoding(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := []byte("MKTAYIAKQRQISFVKSHFSRQLEERLGLIEVQAPILSRVGDGTQDNLSGAEKAVQV")
+	tests := []struct {
+		name         string
+		coarse, orig []byte
+	}{
+		{"match", alpha.Reduce(orig), orig},
+		{"mismatches", alpha.Reduce([]byte("MKTAYIWKQRQISFVKSHFSRQL")),
+			orig[:23]},
+		{"insertion", alpha.Reduce(orig[:30]),
+			append(append([]byte{}, orig[:12]...), orig[5:30]...)},
+		{"deletion", alpha.Reduce(orig),
+			append(append([]byte{}, orig[:20]...), orig[27:]...)},
+		{"wildcards", alpha.Reduce([]byte("MKTAYIAKQRQIS")),
+			[]byte("MKXAY*AkQRQUSB")},
+		{"empty", []byte{}, []byte{}},
+		{"unrelated", alpha.Reduce(orig[:10]), orig[30:]},
+	}
+	for _, test := range tests {
+		encoded := encodeResidues(newResidueModels(alpha),
+			test.coarse, test.orig)
+		if !IsEncodedResidues(encoded) {
+			t.Fatalf("%s: '%s' is not marked as encoded.", test.name, encoded)
+		}
+		decoded, err := NewResidueCoder(alpha).Decode(test.coarse, encoded)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !bytes.Equal(decoded, test.orig) {
+			t.Fatalf("%s: decoded '%s' from '%s', but expected '%s'.",
+				test.name, decoded, encoded, test.orig)
+		}
+	}
+
+	// The coded residues of a long match should be much smaller than the
+	// residues themselves.
+	long := bytes.Repeat(orig, 20)
+	encoded := NewResidueCoder(alpha).Encode(alpha.Reduce(long), long)
+	if len(encoded) >= len(long)/2 {
+		t.Fatalf("Coding %d residues took %d bytes.", len(long), len(encoded))
+	}
+
+	// Links that don't get smaller are stored plainly.
+	if encoded := NewResidueCoder(alpha).Encode(
+		alpha.Reduce(orig[:10]), orig[30:]); encoded != string(orig[30:]) {
+		t.Fatalf("Unrelated residues were stored as '%s'.", encoded)
+	}
+
+	if _, err := NewResidueCoder(alpha).Decode(alpha.Reduce(orig[:5]),
+		"~d10-----~AAAA"); err == nil {
+		t.Fatalf("An edit script past the end of the coarse residues " +
+			"should not decode.")
+	}
+}
+
+func TestResidueCodingShortLinks(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := bytes.Repeat(
+		[]byte("MKTAYIAKQRQISFVKSHFSRQLEERLGLIEVQAPILSRVGDGTQDNLSGAEKAVQV"),
+		30)
+
+	// Code the residues in short links with one coder, the way they're
+	// coded for a compressed sequence, and compare them to plain links.
+	const linkLen = 25
+	enc := NewResidueCoder(alpha)
+	var links []string
+	plainSize, storedSize := 0, 0
+	for start := 0; start < len(orig); start += linkLen {
+		end := min(start+linkLen, len(orig))
+		stored := enc.Encode(alpha.Reduce(orig[start:end]), orig[start:end])
+		links = append(links, stored)
+		plainSize += end - start
+		storedSize += len(stored)
+	}
+	if storedSize >= plainSize*3/4 {
+		t.Fatalf("Coding %d residues in links of %d took %d bytes.",
+			plainSize, linkLen, storedSize)
+	}
+
+	dec := NewResidueCoder(alpha)
+	for i, stored := range links {
+		start := i * linkLen
+		end := min(start+linkLen, len(orig))
+		decoded, err := dec.Decode(alpha.Reduce(orig[start:end]), stored)
+		if err != nil {
+			t.Fatalf("Link %d: %s", i, err)
+		}
+		if !bytes.Equal(decoded, orig[start:end]) {
+			t.Fatalf("Link %d decoded to '%s', but expected '%s'.",
+				i, decoded, orig[start:end])
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	var file bytes.Buffer
+	file.WriteString("header")
+	bw := newBlockWriter(&file, int64(file.Len()), 4)
+
+	var records [][]byte
+	var addrs []int64
+	for i := 0; i < 50; i++ {
+		record := bytes.Repeat([]byte{byte('a' + i%26)}, i+1)
+		addr, err := bw.add(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, addrs = append(records, record), append(addrs, addr)
+	}
+	if err := bw.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	br := newBlockReader(bytes.NewReader(file.Bytes()))
+	for i := len(records) - 1; i >= 0; i-- {
+		r, err := br.record(addrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(records[i]))
+		if _, err := r.Read(got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, records[i]) {
+			t.Fatalf("Record %d is %s, but should be %s.", i, got, records[i])
+		}
+	}
+
+	var all bytes.Buffer
+	if _, err := all.ReadFrom(newBlockStream(
+		bytes.NewReader(file.Bytes()[len("header"):]))); err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Join(records, nil); !bytes.Equal(all.Bytes(), want) {
+		t.Fatalf("Streaming all blocks gave %d bytes, but should have "+
+			"given %d bytes.", all.Len(), len(want))
+	}
+}
+
+func TestPackedCoarseSeqs(t *testing.T) {
+	for _, name := range []string{"cablastp4", "murphy8", "murphy10"} {
+		alpha, err := ParseAlphabet(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := string(alpha.Wildcard)
+		seqs := []string{
+			"",
+			w,
+			alpha.Letters,
+			w + w + alpha.Letters + w + alpha.Letters[:1] + w + w + w,
+			strings.Repeat(alpha.Letters[1:]+w, 13),
+		}
+
+		var packed []byte
+		for _, seq := range seqs {
+			packed = packCoarseSeq(packed, alpha, []byte(seq))
+		}
+		r := bytes.NewReader(packed)
+		for _, seq := range seqs {
+			residues, err := unpackCoarseSeq(r, alpha)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if string(residues) != seq {
+				t.Fatalf("%s: unpacked %s, but should have unpacked %s.",
+					name, residues, seq)
+			}
+		}
+		if r.Len() != 0 {
+			t.Fatalf("%s: %d bytes were left after unpacking.", name, r.Len())
+		}
+	}
+
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := bytes.Repeat([]byte("ACGT"), 100)
+	if n := len(packCoarseSeq(nil, alpha, seq)); n > len(seq)/4+4 {
+		t.Fatalf("Packing %d residues took %d bytes.", len(seq), n)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	entries := []string{
+		"\n>plain\nMKTAYIAKQR\nQISFVKS\n",
+		">lower  \nmktaYIAKqrqisfvksh\n",
+		">stops\nMKT*AY**\nIAK*\n*\n",
+		">substituted\nMKJOUaxjB\n",
+		">uneven\nMKTA\nYIAKQR\nQ\n",
+		">empty\n",
+		">blank lines\nMKTA\n\nYIAK\n\n",
+		">crlf\r\nMKTA\r\nYIAK\r\n",
+		">no newline\nMKTA",
+	}
+	input := strings.Join(entries, "")
+
+	f, err := ioutil.TempFile("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	seqChan, err := ReadOriginalSeqsLossless(f.Name(), []byte("JOU"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record []byte
+	var seqs []*OriginalSeq
+	for readSeq := range seqChan {
+		if readSeq.Err != nil {
+			t.Fatal(readSeq.Err)
+		}
+		record = readSeq.Exceptions.encode(record)
+		seqs = append(seqs, readSeq.Seq)
+	}
+	if len(seqs) != len(entries) {
+		t.Fatalf("Read %d sequences, but there are %d.",
+			len(seqs), len(entries))
+	}
+	if string(seqs[3].Residues) != "MKXXXAXXB" {
+		t.Fatalf("Read %s, but should have read MKXXXAXXB.", seqs[3].Residues)
+	}
+
+	r := bytes.NewReader(record)
+	output := new(bytes.Buffer)
+	for i, oseq := range seqs {
+		exc, err := decodeExceptions(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && i < 5 && exc.raw != nil {
+			t.Fatalf("The exceptions of %q are the whole entry.", entries[i])
+		}
+		entry, err := exc.Restore(oseq.Name, oseq.Residues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output.Write(entry)
+	}
+	if output.String() != input {
+		t.Fatalf("Restored\n%q\nbut should have restored\n%q", output, input)
+	}
+}
+
+func TestHeaderTokens(t *testing.T) {
+	headers := []string{
+		"",
+		"plain",
+		"gi|15674171|ref|NP_268346.1| 30S ribosomal protein L7 " +
+			"[Lactococcus lactis]\x01gi|116513137|ref|YP_812044.1| " +
+			"hypothetical protein [Homo sapiens]",
+		"sp|P69905|HBA_HUMAN Hemoglobin subunit alpha OS=Homo sapiens " +
+			"OX=9606 GN=HBA1 PE=1 SV=2",
+		"control \x02\x09\x1e\x1f bytes \xff",
+	}
+	for _, header := range headers {
+		tokenized := tokenizeHeader(nil, header)
+		got, err := detokenizeHeader(tokenized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != header {
+			t.Fatalf("Detokenized %q, but should have detokenized %q.",
+				got, header)
+		}
+	}
+	if n := len(tokenizeHeader(nil, headers[2])); n > len(headers[2])*3/4 {
+		t.Fatalf("Tokenizing %d bytes took %d bytes.", len(headers[2]), n)
+	}
+}
+
+func TestParseSeqIds(t *testing.T) {
+	tests := []struct {
+		header string
+		names  string
+	}{
+		{"", ""},
+		{"YAL001C TFC3 SGDID:S000000001", "YAL001C"},
+		{"gi|15674171|ref|NP_268346.1| 30S ribosomal protein " +
+			"[Lactococcus lactis]\x01gi|116513137|gb|ABJ01212.1| hypothetical",
+			"gi|15674171|ref|NP_268346.1|,gi|15674171|ref|NP_268346.1," +
+				"15674171,gi|15674171,NP_268346.1,ref|NP_268346.1," +
+				"NP_268346,gi|116513137|gb|ABJ01212.1|," +
+				"gi|116513137|gb|ABJ01212.1,116513137,gi|116513137," +
+				"ABJ01212.1,gb|ABJ01212.1,ABJ01212"},
+		{"sp|P69905|HBA_HUMAN Hemoglobin",
+			"sp|P69905|HBA_HUMAN,P69905,sp|P69905,HBA_HUMAN"},
+		{"gnl|taxon|9606 human", "gnl|taxon|9606,taxon,9606,gnl|9606"},
+	}
+	for _, test := range tests {
+		got := strings.Join(ParseSeqIds(test.header), ",")
+		if got != test.names {
+			t.Fatalf("The names of %q are\n%s\nbut should be\n%s",
+				test.header, got, test.names)
+		}
+	}
+}
+
+func TestOriginalRanges(t *testing.T) {
+	alpha, err := ParseAlphabet(DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := []byte("MKTAYIAKQRQISFVKSHFSRQLEERLGLIEVQAPILSRVGDGTQDNLSGAEKAVQV")
+	deleted := append(append([]byte{}, orig[:20]...), orig[27:]...)
+
+	cseq := NewCompressedSeq(0, "ranges")
+	cseq.Add(NewLinkToCoarse(0, 0, 5, string(orig[:5])))
+	cseq.Add(NewLinkToCoarse(1, 0, uint(len(orig)),
+		encodeResidues(newResidueModels(alpha), alpha.Reduce(orig), deleted)))
+	cseq.Add(NewLinkToCoarse(2, 10, 13, string(orig[10:13])))
+
+	ranges, err := cseq.OriginalRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := 5 + len(deleted)
+	want := [][2]int{{0, 5}, {5, end}, {end, end + 3}}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Fatalf("The links cover %v, but should cover %v.", ranges, want)
+	}
+	length, err := cseq.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != end+3 {
+		t.Fatalf("The sequence has %d residues, but its length is %d.",
+			end+3, length)
+	}
+}
+
+func TestDecompressRangeBlocks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := DefaultDBConf.DeepCopy()
+	conf.ResidueCoding = CodingRange
+	dbDir := filepath.Join(tmpDir, "db")
+	createTestDB(t, dbDir, "data/small.fasta", conf)
+	db, err := NewReadDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.ReadClose()
+
+	tested := 0
+	for id := 0; id < db.ComDB.NumSequences(); id++ {
+		cseq, err := db.ComDB.ReadCompressedSeq(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cseq.Links) <= 2*residueCodingBlock {
+			continue
+		}
+		tested++
+		full, err := cseq.Decompress(db.CoarseDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges, err := cseq.OriginalRanges()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Break the first block, so that decoding any of its links fails.
+		for i := 0; i < residueCodingBlock; i++ {
+			cseq.Links[i].CoarseSeqId = uint(db.CoarseDB.NumSequences())
+		}
+		second := ranges[residueCodingBlock][0]
+		for _, r := range [][2]int{
+			{second, second + 1},
+			{second + 3, ranges[2*residueCodingBlock][1]},
+			{ranges[residueCodingBlock+5][0] + 1, len(full.Residues) + 10},
+		} {
+			oseq, err := cseq.DecompressRange(db.CoarseDB, r[0], r[1])
+			if err != nil {
+				t.Fatalf("Decompressing [%d, %d) of sequence %d decoded "+
+					"links of the first block: %s", r[0], r[1], id, err)
+			}
+			want := full.Residues[r[0]:min(r[1], len(full.Residues))]
+			if !bytes.Equal(oseq.Residues, want) {
+				t.Fatalf("Residues [%d, %d) of sequence %d decompressed to "+
+					"%s, but should be %s.", r[0], r[1], id, oseq.Residues,
+					want)
+			}
+		}
+		if _, err := cseq.DecompressRange(db.CoarseDB, 0, 1); err == nil {
+			t.Fatalf("Decompressing the start of sequence %d didn't decode "+
+				"its first link.", id)
+		}
+	}
+	if tested == 0 {
+		t.Fatalf("No sequence has more than %d links.", 2*residueCodingBlock)
+	}
+}
+
+func TestSearchShards(t *testing.T) {
+	shards := make([]*DB, 5)
+	for i := range shards {
+		shards[i] = &DB{Path: ShardName(i)}
+	}
+
+	// With 4 threads, at most 4 of the 5 shards are searched at once, with
+	// a thread each.
+	lock := &sync.Mutex{}
+	running, most := 0, 0
+	oseqs, err := SearchShards(shards, 4,
+		func(db *DB, threads int) ([]OriginalSeq, error) {
+			if threads != 1 {
+				return nil, fmt.Errorf("%d threads instead of 1", threads)
+			}
+			lock.Lock()
+			running++
+			most = max(most, running)
+			lock.Unlock()
+
+			oseq := NewOriginalSeq(0, db.Path, nil)
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return []OriginalSeq{*oseq}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most > 4 {
+		t.Fatalf("%d shards were searched at once, but only 4 may be.", most)
+	}
+	for i, oseq := range oseqs {
+		if oseq.Name != ShardName(i) {
+			t.Fatalf("Sequence %d was found in %s instead of %s.",
+				i, oseq.Name, ShardName(i))
+		}
+	}
+
+	// Two shards get 2 threads each.
+	_, err = SearchShards(shards[:2], 4,
+		func(db *DB, threads int) ([]OriginalSeq, error) {
+			if threads != 2 {
+				return nil, fmt.Errorf("%d threads instead of 2", threads)
+			}
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"strings"
 	"testing"
 
@@ -221,3 +228,803 @@ func TestUngappedExtension(t *testing.T) {
 		}
 	}
 }
+
+func TestDeterministicCompression(t *testing.T) {
+	var first map[string][]byte
+	for _, procs := range []int{1, 2, 4} {
+		files := compressFasta(t, "../../data/small.fasta", procs)
+		if first == nil {
+			first = files
+			continue
+		}
+		for name, contents := range first {
+			if !bytes.Equal(files[name], contents) {
+				t.Fatalf("Compressing with %d workers wrote a different "+
+					"'%s' than compressing with 1 worker.", procs, name)
+			}
+		}
+	}
+}
+
+// compressFasta compresses the sequences in 'fasta' into a new database in
+// deterministic mode with 'procs' workers, and returns the contents of every
+// file in the database. The extension times in the diagnostics table are
+// left out.
+func compressFasta(t *testing.T, fasta string, procs int) map[string][]byte {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbDir := filepath.Join(tmpDir, "db")
+	createDB(t, dbDir, fasta, nil, procs, true, false)
+
+	infos, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, info := range infos {
+		contents, err := ioutil.ReadFile(filepath.Join(dbDir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name() == cablastp.FileDiagnostics {
+			contents = dropLastColumn(contents)
+		}
+		files[info.Name()] = contents
+	}
+	return files
+}
+
+// dropLastColumn removes the last column of a table of tab separated values.
+// (The time spent in extension is the only column of the diagnostics table
+// that depends on more than the input.)
+func dropLastColumn(table []byte) []byte {
+	lines := bytes.Split(table, []byte("\n"))
+	for i, line := range lines {
+		if tab := bytes.LastIndexByte(line, '\t'); tab >= 0 {
+			lines[i] = line[:tab]
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// createDB compresses the sequences in 'fasta' into a new database in
+// 'dbDir' with 'procs' workers, the same way cablastp-compress does. If
+// 'conf' is nil, the default configuration is used.
+func createDB(t *testing.T, dbDir, fasta string, conf *cablastp.DBConf,
+	procs int, deterministic, dedupe bool) {
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+	if conf == nil {
+		conf = cablastp.DefaultDBConf.DeepCopy()
+	}
+	conf.BlastMakeBlastDB = "true"
+	db, err := cablastp.NewWriteDB(conf, dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StartDiagnostics(); err != nil {
+		t.Fatal(err)
+	}
+
+	exceptions, err := cablastp.OpenExceptions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dups *dedup
+	if dedupe {
+		dups = newDedup()
+	}
+	pool := StartCompressWorkers(db, deterministic, cablastp.EvictOldest)
+	orgSeqId := 0
+	for in := range readInput([]string{fasta}, 0, exceptions) {
+		if in.err != nil {
+			t.Fatal(in.err)
+		}
+		if dups == nil {
+			orgSeqId = pool.Compress(orgSeqId, in.seq)
+		} else if aliasOf, ok := dups.add(orgSeqId, in.seq); ok {
+			orgSeqId = pool.Alias(orgSeqId, in.seq, aliasOf)
+		} else {
+			orgSeqId = pool.Compress(orgSeqId, in.seq)
+		}
+	}
+	pool.done()
+	if exceptions != nil {
+		if err := exceptions.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	db.WriteClose()
+
+	// Every database has its own seeds table and worker memory, which add
+	// up quickly with the race detector on.
+	debug.FreeOSMemory()
+}
+
+func TestDedup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	seqA := "MKTAYIAKQRQISFVKSHFSRQLEERLGLIEVQAPILSRVGDGTQDNLSGAEKAVQVKVKALPDAQ"
+	seqB := "MSDNGPQNQRNAPRITFGGPSDSTGSNQNGERSGARSKQRRPQGLPNNTASWFTALTQHGKEDLK"
+	fasta := filepath.Join(tmpDir, "dups.fasta")
+	contents := ">a\n" + seqA + "\n>b\n" + seqB + "\n>a2 copy\n" + seqA +
+		"\n>a3\n" + seqA + "\n"
+	if err := ioutil.WriteFile(fasta, []byte(contents), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, deterministic := range []bool{false, true} {
+		dbDir := filepath.Join(tmpDir, fmt.Sprintf("db-%v", deterministic))
+		createDB(t, dbDir, fasta, nil, 2, deterministic, true)
+		testDedupDB(t, dbDir, seqA)
+	}
+}
+
+func testDedupDB(t *testing.T, dbDir, seqA string) {
+	db, err := cablastp.NewReadDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.ReadClose()
+
+	if n := db.ComDB.NumSequences(); n != 4 {
+		t.Fatalf("The compressed database has %d sequences, but should "+
+			"have 4.", n)
+	}
+	if n := db.CoarseDB.NumSequences(); n != 2 {
+		t.Fatalf("The coarse database has %d sequences, but duplicates "+
+			"should not have been compressed.", n)
+	}
+	names := []string{"a", "b", "a2 copy", "a3"}
+	for id, name := range names {
+		oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := oseq.LoadName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != name {
+			t.Fatalf("Sequence %d is named '%s', but should be named '%s'.",
+				id, got, name)
+		}
+		if id != 1 && string(oseq.Residues) != seqA {
+			t.Fatalf("Sequence %d is %s, but should be %s.",
+				id, oseq.Residues, seqA)
+		}
+	}
+
+	oseqs, err := db.CoarseDB.Expand(db.ComDB, 0, 0, len(seqA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded := make([]string, len(oseqs))
+	for i, oseq := range oseqs {
+		if expanded[i], err = oseq.LoadName(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(expanded, ","); got != "a,a2 copy,a3" {
+		t.Fatalf("Expanding the first coarse sequence gave %s, but should "+
+			"have given its aliases too.", got)
+	}
+}
+
+func TestInputOrder(t *testing.T) {
+	alpha, err := cablastp.ParseAlphabet(cablastp.DefaultAlphabet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &cablastp.DB{
+		DBConf:   cablastp.DefaultDBConf.DeepCopy(),
+		Alphabet: alpha,
+	}
+	spillDir, err := ioutil.TempDir("", "cablastp-order-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spillDir)
+
+	order := func(strategy string, seed int64, chunkSize int) []inputSeq {
+		ord, err := newOrderer(strategy, seed, chunkSize, spillDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fastas := []string{"../../data/small.fasta"}
+		input, err := ord.sort(readInput(fastas, 0, nil), db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Spill files are removed as soon as they are created, so that
+		// nothing is left behind if compression is interrupted.
+		if left, _ := ioutil.ReadDir(spillDir); len(left) > 0 {
+			t.Fatalf("Spill files were left in %s: %d files.",
+				spillDir, len(left))
+		}
+		var seqs []inputSeq
+		for in := range input {
+			if in.err != nil {
+				t.Fatal(in.err)
+			}
+			seqs = append(seqs, in)
+		}
+		return seqs
+	}
+	positions := func(seqs []inputSeq) string {
+		s := make([]string, len(seqs))
+		for i, in := range seqs {
+			s[i] = fmt.Sprintf("%d", in.pos)
+		}
+		return strings.Join(s, ",")
+	}
+
+	input := order(orderInput, 0, 1)
+	strategies := []string{orderLongest, orderSignature, orderRandom}
+	for _, strategy := range strategies {
+		inMemory := order(strategy, 42, len(input))
+		spilled := order(strategy, 42, 7)
+		if positions(inMemory) != positions(spilled) {
+			t.Fatalf("The '%s' order with spill files is %s, but it is %s "+
+				"when sorted in memory.",
+				strategy, positions(spilled), positions(inMemory))
+		}
+
+		seen := make(map[int]bool)
+		for i, in := range spilled {
+			if seen[in.pos] || in.pos < 0 || in.pos >= len(input) {
+				t.Fatalf("The '%s' order has an invalid or repeated input "+
+					"position %d.", strategy, in.pos)
+			}
+			seen[in.pos] = true
+			if string(in.seq.Residues) != string(input[in.pos].seq.Residues) {
+				t.Fatalf("The '%s' order changed the residues of the "+
+					"sequence at input position %d.", strategy, in.pos)
+			}
+			if strategy == orderLongest && i > 0 &&
+				spilled[i-1].seq.Len() < in.seq.Len() {
+				t.Fatalf("The '%s' order put a sequence of length %d "+
+					"before a sequence of length %d.",
+					strategy, spilled[i-1].seq.Len(), in.seq.Len())
+			}
+		}
+		if len(seen) != len(input) {
+			t.Fatalf("The '%s' order has %d sequences, but the input has %d.",
+				strategy, len(seen), len(input))
+		}
+	}
+
+	random1, random2 := order(orderRandom, 1, 7), order(orderRandom, 2, 7)
+	if positions(random1) == positions(random2) {
+		t.Fatalf("The 'random' order should depend on the seed.")
+	}
+}
+
+func TestRangeResidueCoding(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "../../data/small.fasta"
+	sizes := make(map[string]int64)
+	codings := []string{cablastp.CodingPlain, cablastp.CodingRange}
+	for _, coding := range codings {
+		conf := cablastp.DefaultDBConf.DeepCopy()
+		conf.ResidueCoding = coding
+		dbDir := filepath.Join(tmpDir, coding)
+		createDB(t, dbDir, fasta, conf, 2, false, false)
+
+		info, err := os.Stat(filepath.Join(dbDir, cablastp.FileCompressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[coding] = info.Size()
+
+		db, err := cablastp.NewReadDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqChan, err := cablastp.ReadOriginalSeqs(fasta, ignoredResidues)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := 0
+		for readSeq := range seqChan {
+			if readSeq.Err != nil {
+				t.Fatal(readSeq.Err)
+			}
+			oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(oseq.Residues, readSeq.Seq.Residues) {
+				t.Fatalf("Sequence %d decompressed to %s with %s coding, "+
+					"but should be %s.", id, oseq.Residues, coding,
+					readSeq.Seq.Residues)
+			}
+			id++
+		}
+		db.ReadClose()
+	}
+	if sizes[cablastp.CodingRange] >= sizes[cablastp.CodingPlain] {
+		t.Fatalf("Range coded residues take %d bytes, but plain residues "+
+			"only take %d bytes.",
+			sizes[cablastp.CodingRange], sizes[cablastp.CodingPlain])
+	}
+}
+
+func TestBlockCompression(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "../../data/small.fasta"
+	plainDir := filepath.Join(tmpDir, "plain")
+	createDB(t, plainDir, fasta, nil, 2, true, true)
+	plain, err := cablastp.NewReadDB(plainDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.ReadClose()
+
+	conf := cablastp.DefaultDBConf.DeepCopy()
+	conf.CompressBlockSize = 7
+	blockDir := filepath.Join(tmpDir, "blocks")
+	createDB(t, blockDir, fasta, conf, 2, true, true)
+	blocks, err := cablastp.NewReadDB(blockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocks.ReadClose()
+
+	// (Packed coarse sequences are too dense for block compression to make
+	// them much smaller, so only the compressed sequences are compared.)
+	plainInfo, err := os.Stat(filepath.Join(plainDir, cablastp.FileCompressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockInfo, err := os.Stat(filepath.Join(blockDir, cablastp.FileCompressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockInfo.Size() >= plainInfo.Size() {
+		t.Fatalf("The block compressed sequences take %d bytes, but the "+
+			"plain ones only take %d bytes.",
+			blockInfo.Size(), plainInfo.Size())
+	}
+
+	// Read sequences out of order, so that blocks are evicted from the
+	// cache and read again.
+	numSeqs := plain.ComDB.NumSequences()
+	if n := blocks.ComDB.NumSequences(); n != numSeqs {
+		t.Fatalf("The block compressed database has %d sequences, but "+
+			"should have %d.", n, numSeqs)
+	}
+	for i := 0; i < numSeqs; i++ {
+		id := (i * 37) % numSeqs
+		want, err := plain.ComDB.ReadSeq(plain.CoarseDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := blocks.ComDB.ReadSeq(blocks.CoarseDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := want.LoadName(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := got.LoadName(); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != want.Name || !bytes.Equal(got.Residues, want.Residues) {
+			t.Fatalf("Sequence %d is '%s' %s, but should be '%s' %s.",
+				id, got.Name, got.Residues, want.Name, want.Residues)
+		}
+	}
+	for id := blocks.CoarseDB.NumSequences() - 1; id >= 0; id-- {
+		want, err := plain.CoarseDB.ReadCoarseSeq(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := blocks.CoarseDB.ReadCoarseSeq(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Residues, want.Residues) {
+			t.Fatalf("Coarse sequence %d is %s, but should be %s.",
+				id, got.Residues, want.Residues)
+		}
+	}
+}
+
+func TestLossless(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fastas, err := filepath.Glob("../../data/*.fasta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fastas) == 0 {
+		t.Fatal("There are no FASTA files in the data directory.")
+	}
+	for _, fasta := range fastas {
+		input, err := ioutil.ReadFile(fasta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conf := cablastp.DefaultDBConf.DeepCopy()
+		conf.Lossless = true
+		dbDir := filepath.Join(tmpDir, filepath.Base(fasta))
+		createDB(t, dbDir, fasta, conf, 2, true, true)
+		db, err := cablastp.NewReadDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := new(bytes.Buffer)
+		if err := db.WriteExact(output); err != nil {
+			t.Fatalf("%s: %s", fasta, err)
+		}
+		db.ReadClose()
+
+		if !bytes.Equal(output.Bytes(), input) {
+			t.Fatalf("%s: the exact decompressed output (%d bytes) is not "+
+				"the input (%d bytes).", fasta, output.Len(), len(input))
+		}
+	}
+}
+
+func TestHeaderStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "../../data/small.fasta"
+	var names []string
+	headerBytes := 0
+	seqChan, err := cablastp.ReadOriginalSeqs(fasta, ignoredResidues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for readSeq := range seqChan {
+		if readSeq.Err != nil {
+			t.Fatal(readSeq.Err)
+		}
+		names = append(names, readSeq.Seq.Name)
+		headerBytes += len(readSeq.Seq.Name)
+	}
+
+	dbDir := filepath.Join(tmpDir, "db")
+	createDB(t, dbDir, fasta, nil, 2, true, true)
+	db, err := cablastp.NewReadDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.ReadClose()
+
+	info, err := os.Stat(filepath.Join(dbDir, cablastp.FileHeaders))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= int64(headerBytes)/2 {
+		t.Fatalf("The header store takes %d bytes for %d bytes of headers.",
+			info.Size(), headerBytes)
+	}
+
+	// Residues are read without headers, and headers without residues.
+	for id := len(names) - 1; id >= 0; id-- {
+		oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oseq.Name != "" {
+			t.Fatalf("Sequence %d was read with its name.", id)
+		}
+		name, err := db.ComDB.ReadName(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != names[id] {
+			t.Fatalf("Sequence %d is named '%s', but should be named '%s'.",
+				id, name, names[id])
+		}
+		if name, err = oseq.LoadName(); err != nil || name != names[id] {
+			t.Fatalf("Sequence %d loaded the name '%s' (%v), but should "+
+				"have loaded '%s'.", id, name, err, names[id])
+		}
+	}
+}
+
+func TestSeqRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "../../data/small.fasta"
+	codings := []string{cablastp.CodingPlain, cablastp.CodingRange}
+	for _, coding := range codings {
+		conf := cablastp.DefaultDBConf.DeepCopy()
+		conf.ResidueCoding = coding
+		dbDir := filepath.Join(tmpDir, coding)
+		createDB(t, dbDir, fasta, conf, 2, false, true)
+
+		db, err := cablastp.NewReadDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numSeqs := db.ComDB.NumSequences()
+		full := make([][]byte, numSeqs)
+		for id := range full {
+			oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			full[id] = oseq.Residues
+
+			length, err := db.ComDB.SeqLen(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if length != len(full[id]) {
+				t.Fatalf("Sequence %d has %d residues with %s coding, but "+
+					"its length was read as %d.",
+					id, len(full[id]), coding, length)
+			}
+
+			n := len(full[id])
+			ranges := [][2]int{{0, n}, {0, 1}, {n / 3, 2 * n / 3},
+				{n - 1, n}, {n / 2, n + 100}, {n, n + 1}}
+			for _, r := range ranges {
+				oseq, err := db.ComDB.ReadSeqRange(db.CoarseDB, id, r[0], r[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := full[id][min(r[0], n):min(r[1], n)]
+				if !bytes.Equal(oseq.Residues, want) {
+					t.Fatalf("Residues [%d, %d) of sequence %d decompressed "+
+						"to %s with %s coding, but should be %s.",
+						r[0], r[1], id, oseq.Residues, coding, want)
+				}
+			}
+		}
+
+		// Every sequence is linked to some coarse sequence.
+		linked := make(map[int]bool)
+		for coarseId := 0; coarseId < db.CoarseDB.NumSequences(); coarseId++ {
+			ids, err := db.CoarseDB.LinkedSeqIds(db.ComDB, coarseId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range ids {
+				linked[id] = true
+			}
+		}
+		if len(linked) != numSeqs {
+			t.Fatalf("%d of %d sequences are linked to coarse sequences.",
+				len(linked), numSeqs)
+		}
+
+		// Sequences can be read concurrently.
+		errs := make(chan error, 4)
+		for w := 0; w < 4; w++ {
+			go func(w int) {
+				for id := w; id < numSeqs; id += 4 {
+					oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(oseq.Residues, full[id]) {
+						errs <- fmt.Errorf("Sequence %d decompressed "+
+							"concurrently to %s, but should be %s.",
+							id, oseq.Residues, full[id])
+						return
+					}
+				}
+				errs <- nil
+			}(w)
+		}
+		for w := 0; w < 4; w++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.ReadClose()
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The last sequence is a duplicate of the first.
+	small, err := ioutil.ReadFile("../../data/small.fasta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := small[:bytes.Index(small[1:], []byte(">"))+1]
+	fasta := filepath.Join(tmpDir, "dup.fasta")
+	contents := append(append([]byte{}, small...), first...)
+	if err := ioutil.WriteFile(fasta, contents, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, deterministic := range []bool{false, true} {
+		dbDir := filepath.Join(tmpDir, fmt.Sprint(deterministic))
+		createDB(t, dbDir, fasta, nil, 2, deterministic, true)
+
+		db, err := cablastp.NewReadDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := ioutil.ReadFile(
+			filepath.Join(dbDir, cablastp.FileDiagnostics))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(table)), "\n")
+		if !strings.HasPrefix(lines[0], "#") {
+			t.Fatalf("The diagnostics table has no header: %s", lines[0])
+		}
+		rows := lines[1:]
+		if len(rows) != db.ComDB.NumSequences() {
+			t.Fatalf("The diagnostics table has %d rows, but there are %d "+
+				"sequences.", len(rows), db.ComDB.NumSequences())
+		}
+
+		matches := 0
+		for id, row := range rows {
+			var d cablastp.SeqDiagnostics
+			var ms float64
+			_, err := fmt.Sscanf(row, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%f",
+				&d.OrgSeqId, &d.AliasOf, &d.Residues, &d.SeedLookups,
+				&d.SeedsTried, &d.Matches, &d.LinkedResidues,
+				&d.NovelResidues, &ms)
+			if err != nil {
+				t.Fatalf("Could not parse row '%s': %s", row, err)
+			}
+			length, err := db.ComDB.SeqLen(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.OrgSeqId != id || d.Residues != length {
+				t.Fatalf("Row %d is for sequence %d with %d residues, but "+
+					"should be for sequence %d with %d residues.",
+					id, d.OrgSeqId, d.Residues, id, length)
+			}
+			if id == len(rows)-1 {
+				if d.AliasOf != 0 {
+					t.Fatalf("The last sequence is an alias of %d, but "+
+						"should be an alias of 0.", d.AliasOf)
+				}
+				continue
+			}
+			if d.LinkedResidues+d.NovelResidues != d.Residues {
+				t.Fatalf("Sequence %d has %d linked and %d novel residues, "+
+					"but has %d residues.", id, d.LinkedResidues,
+					d.NovelResidues, d.Residues)
+			}
+			if d.Matches > d.SeedsTried || d.SeedsTried > 0 && ms <= 0 {
+				t.Fatalf("Sequence %d has %d matches from %d seeds tried in "+
+					"%fms.", id, d.Matches, d.SeedsTried, ms)
+			}
+			matches += d.Matches
+		}
+		if matches == 0 {
+			t.Fatal("No sequence was matched to a coarse sequence.")
+		}
+		db.ReadClose()
+	}
+}
+
+func TestShards(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "../../data/small.fasta"
+	const numShards = 3
+	conf := cablastp.DefaultDBConf.DeepCopy()
+	conf.BlastMakeBlastDB = "true"
+	dbDir := filepath.Join(tmpDir, "sharded")
+	compressShards(conf, dbDir, []string{fasta}, numShards,
+		cablastp.EvictOldest)
+
+	if _, err := cablastp.NewReadDB(dbDir); err == nil {
+		t.Fatal("A sharded database was opened as a single database.")
+	}
+	shards, err := cablastp.NewReadShards(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cablastp.ReadCloseShards(shards)
+	if len(shards) != numShards {
+		t.Fatalf("Opened %d shards, but there should be %d.",
+			len(shards), numShards)
+	}
+
+	// Every input sequence must be in exactly one shard.
+	left := make(map[string]int)
+	residues := uint64(0)
+	seqChan, err := cablastp.ReadOriginalSeqs(fasta, ignoredResidues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for readSeq := range seqChan {
+		if readSeq.Err != nil {
+			t.Fatal(readSeq.Err)
+		}
+		left[readSeq.Seq.Name+"\n"+string(readSeq.Seq.Residues)]++
+		residues += uint64(readSeq.Seq.Len())
+	}
+	for _, db := range shards {
+		if db.ComDB.NumSequences() == 0 {
+			t.Fatalf("Shard %s is empty.", db.Path)
+		}
+		problems, err := db.CheckLinks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) > 0 {
+			t.Fatalf("Shard %s has bad links:\n%s",
+				db.Path, strings.Join(problems, "\n"))
+		}
+		for id := 0; id < db.ComDB.NumSequences(); id++ {
+			oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, err := oseq.LoadName()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := name + "\n" + string(oseq.Residues)
+			if left[key] == 0 {
+				t.Fatalf("Sequence %d of shard %s (%s) isn't in the input, "+
+					"or is in another shard too.", id, db.Path, name)
+			}
+			left[key]--
+		}
+	}
+	for key, count := range left {
+		if count > 0 {
+			t.Fatalf("Input sequence %s isn't in any shard.",
+				strings.SplitN(key, "\n", 2)[0])
+		}
+	}
+
+	// Searches use the size of the whole database.
+	if size := cablastp.ShardsBlastDBSize(shards); size != residues {
+		t.Fatalf("The shards have a database size of %d, but the input has "+
+			"%d residues.", size, residues)
+	}
+}
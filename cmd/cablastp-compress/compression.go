@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/ndaniels/cablastp2"
 )
@@ -15,6 +16,10 @@ type compressPool struct {
 	jobs   chan compressJob
 	wg     *sync.WaitGroup
 	closed bool
+
+	// When committer is set, workers only plan the compression of each
+	// sequence, and the committer applies the plans in input order.
+	committer *committer
 }
 
 // compressJob values are messages sent to the pool of workers when a new
@@ -22,6 +27,10 @@ type compressPool struct {
 type compressJob struct {
 	orgSeqId int
 	orgSeq   *cablastp.OriginalSeq
+
+	// aliasOf is the id of the sequence that orgSeq is an exact duplicate
+	// of, or -1 if it must be compressed.
+	aliasOf int
 }
 
 type reducedCompressJob struct {
@@ -32,7 +41,12 @@ type reducedCompressJob struct {
 // startCompressWorkers initializes a pool of compression workers.
 //
 // The compressPool returned can be used to compress sequences concurrently.
-func StartCompressWorkers(db *cablastp.DB) compressPool {
+// If 'deterministic' is set, the compressed database doesn't depend on the
+// number of workers or on how they are scheduled. In that case, seeds are
+// also evicted by the pool with the given policy.
+func StartCompressWorkers(db *cablastp.DB, deterministic bool,
+	eviction cablastp.EvictionPolicy) compressPool {
+
 	wg := &sync.WaitGroup{}
 	jobs := make(chan compressJob, 200)
 	pool := compressPool{
@@ -41,6 +55,9 @@ func StartCompressWorkers(db *cablastp.DB) compressPool {
 		wg:     wg,
 		closed: false,
 	}
+	if deterministic {
+		pool.committer = startCommitter(db, eviction)
+	}
 	for i := 0; i < max(1, runtime.GOMAXPROCS(0)); i++ {
 		wg.Add(1)
 		go pool.worker()
@@ -55,6 +72,22 @@ func (pool compressPool) Compress(id int, seq *cablastp.OriginalSeq) int {
 	pool.jobs <- compressJob{
 		orgSeqId: id,
 		orgSeq:   seq,
+		aliasOf:  -1,
+	}
+	return id + 1
+}
+
+// Alias stores a sequence that is an exact duplicate of the sequence with id
+// 'aliasOf' as an alias, instead of compressing it.
+//
+// Alias returns the next original sequence id to be used.
+func (pool compressPool) Alias(
+	id int, seq *cablastp.OriginalSeq, aliasOf int) int {
+
+	pool.jobs <- compressJob{
+		orgSeqId: id,
+		orgSeq:   seq,
+		aliasOf:  aliasOf,
 	}
 	return id + 1
 }
@@ -66,12 +99,40 @@ func (pool compressPool) Compress(id int, seq *cablastp.OriginalSeq) int {
 func (pool compressPool) worker() {
 	mem := newMemory()
 	for job := range pool.jobs {
-		comSeq := Compress(pool.db, job.orgSeqId, job.orgSeq, mem)
-		pool.db.ComDB.Write(comSeq)
+		switch {
+		case pool.committer != nil && job.aliasOf >= 0:
+			pool.committer.plans <- &seqPlan{
+				orgSeqId: job.orgSeqId,
+				orgSeq:   job.orgSeq,
+				aliasOf:  job.aliasOf,
+			}
+		case pool.committer != nil:
+			pool.committer.plans <- pool.committer.plan(
+				job.orgSeqId, job.orgSeq, mem)
+		case job.aliasOf >= 0:
+			pool.db.ComDB.Write(cablastp.NewAliasSeq(
+				job.orgSeqId, job.orgSeq.Name, job.aliasOf))
+			pool.db.ComDB.WriteDiagnostics(
+				aliasDiagnostics(job.orgSeqId, job.orgSeq, job.aliasOf))
+		default:
+			comSeq := Compress(pool.db, job.orgSeqId, job.orgSeq, mem)
+			pool.db.ComDB.Write(comSeq)
+			pool.db.ComDB.WriteDiagnostics(mem.diag)
+		}
 	}
 	pool.wg.Done()
 }
 
+// aliasDiagnostics returns the diagnostics of a sequence that was stored as
+// an alias.
+func aliasDiagnostics(id int, seq *cablastp.OriginalSeq,
+	aliasOf int) cablastp.SeqDiagnostics {
+
+	diag := cablastp.NewSeqDiagnostics(id, seq.Len())
+	diag.AliasOf = aliasOf
+	return diag
+}
+
 // done 'joins' the worker goroutines. (Blocks until all workers are finished
 // compressing sequences.)
 func (pool *compressPool) done() {
@@ -81,6 +142,9 @@ func (pool *compressPool) done() {
 	pool.closed = true
 	close(pool.jobs)
 	pool.wg.Wait()
+	if pool.committer != nil {
+		pool.committer.done()
+	}
 }
 
 // TODO: need to pass around a pair of nativeSeq and reducedSeq
@@ -94,16 +158,25 @@ func (pool *compressPool) done() {
 // sub-sequences to sub-sequences in the coarse database.
 //
 // N.B. `mem` is used in alignment and seed lookups to prevent allocation.
-// Think of them as goroutine-specific memory arenas.
+// Think of them as goroutine-specific memory arenas. The diagnostics of the
+// sequence are left in `mem.diag`.
 func Compress(db *cablastp.DB, orgSeqId int,
 	orgSeq *cablastp.OriginalSeq, mem *memory) cablastp.CompressedSeq {
 
+	return compress(db, directWriter{db}, orgSeqId, orgSeq, mem)
+}
+
+// compress is Compress, except that all lookups in and additions to the
+// coarse database go through 'cw'.
+func compress(db *cablastp.DB, cw coarseWriter, orgSeqId int,
+	orgSeq *cablastp.OriginalSeq, mem *memory) cablastp.CompressedSeq {
+
 	// cseqExt and oseqExt will contain `extSeedSize` residues after the end
 	// of any particular seed in coarse and original sequences, respectively.
 	// If the residues are not equivalent, that particular seed is skipped.
 	var cseqExt, oseqExt []byte
 
-	redSeq := cablastp.NewReducedSeq(orgSeq)
+	redSeq := cablastp.NewReducedSeq(db.Alphabet, orgSeq)
 
 	// Start the creation of a compressed sequence.
 	cseq := cablastp.NewCompressedSeq(orgSeqId, orgSeq.Name)
@@ -113,6 +186,7 @@ func Compress(db *cablastp.DB, orgSeqId int,
 	mapSeedSize := db.MapSeedSize
 	extSeedSize := db.ExtSeedSize
 	olen := orgSeq.Len()
+	mem.diag = cablastp.NewSeqDiagnostics(orgSeqId, olen)
 
 	// Keep track of two pointers. 'current' refers to the residue index in the
 	// original sequence that extension is currently originating from.
@@ -121,17 +195,28 @@ func Compress(db *cablastp.DB, orgSeqId int,
 	lastMatch, current := 0, 0
 
 	// Iterate through the original sequence a 'kmer' at a time.
+	// If the coarse sequences are sampled, then only the same samples of the
+	// original sequence can match, but every position must be considered.
 	skipSize := 4
+	var sampled []bool
+	if db.SeedShape.Sampling != cablastp.SampleAll {
+		skipSize = 1
+		sampled = coarsedb.Seeds.Sample(redSeq.Residues)
+	}
 	limit := olen - mapSeedSize - extSeedSize - skipSize
 	for current = 0; current <= limit; current += skipSize {
+		if sampled != nil && !sampled[current] {
+			continue
+		}
 		kmer := redSeq.Residues[current : current+mapSeedSize]
 
 		// skip wildcard-containing kmers
-		if bytes.IndexByte(kmer, 'N') > -1 {
+		if coarsedb.Seeds.HasWildcard(kmer) {
 			continue
 		}
 
-		seeds := coarsedb.Seeds.Lookup(kmer, &mem.seeds)
+		seeds := cw.lookup(kmer, mem)
+		mem.diag.SeedLookups++
 
 		// Before trying to extend this with seeds, check to see if there is
 		// a low complexity region within `db.MinMatchLen` residues from
@@ -178,11 +263,14 @@ func Compress(db *cablastp.DB, orgSeqId int,
 			// coarse and reduced sequences FROM the last match TO the current,
 			// and call extendMatch on those as well. Reverse the result, and
 			// prepend it to corMatch and redMatch here.
+			mem.diag.SeedsTried++
+			extStart := time.Now()
 			corMatch, redMatch := extendMatch(
 				corSeq.Residues[corResInd:], redSeq.Residues[current:],
 				db.GappedWindowSize, db.UngappedWindowSize,
 				db.MatchKmerSize, db.ExtSeqIdThreshold,
 				mem)
+			mem.diag.ExtensionTime += time.Since(extStart)
 
 			// TODO if this original (reduced) sequence is overall shorter than the
 			// minimum match length, we should still accept it.
@@ -195,12 +283,14 @@ func Compress(db *cablastp.DB, orgSeqId int,
 
 			// potentially extend this match back as far as the lastMatch (for redSeq)
 			// and beginning of the corSeq
+			extStart = time.Now()
 			backCorMatch, backRedMatch := extendMatch(
 				reverse(corSeq.Residues[0:corResInd]),
 				reverse(redSeq.Residues[lastMatch:current]),
 				db.GappedWindowSize, db.UngappedWindowSize,
 				db.MatchKmerSize, db.ExtSeqIdThreshold,
 				mem)
+			mem.diag.ExtensionTime += time.Since(extStart)
 
 			redMatch = append(reverse(backRedMatch), redMatch...)
 			corMatch = append(reverse(backCorMatch), corMatch...)
@@ -266,7 +356,8 @@ func Compress(db *cablastp.DB, orgSeqId int,
 					uint(lastMatch), uint(current))
 				orgSub := orgSeq.NewSubSequence(
 					uint(lastMatch), uint(current))
-				addWithoutMatch(&cseq, coarsedb, orgSeqId, orgSub, redSub)
+				cw.addWithoutMatch(&cseq, orgSeqId, orgSub, redSub)
+				mem.diag.NovelResidues += orgStart - lastMatch
 			}
 
 			// For the given match, add a LinkToCoarse to the portion of
@@ -276,10 +367,9 @@ func Compress(db *cablastp.DB, orgSeqId int,
 			// serves as a bridge to expand coarse sequences into their
 			// original sequences.
 			orgMatch := string(orgSeq.Residues[orgStart:orgEnd])
-			cseq.Add(cablastp.NewLinkToCoarse(
-				uint(corSeqId), uint(corStart), uint(corEnd), orgMatch))
-			corSeq.AddLink(cablastp.NewLinkToCompressed(
-				uint32(orgSeqId), uint16(corStart), uint16(corEnd)))
+			cw.addMatch(&cseq, orgSeqId, corSeqId, corStart, corEnd, orgMatch)
+			mem.diag.Matches++
+			mem.diag.LinkedResidues += orgEnd - orgStart
 
 			// Skip the current pointer ahead to the end of this match.
 			// Update the lastMatch pointer to point at the end of this
@@ -299,7 +389,8 @@ func Compress(db *cablastp.DB, orgSeqId int,
 	if orgSeq.Len()-lastMatch > 0 {
 		orgSub := orgSeq.NewSubSequence(uint(lastMatch), uint(orgSeq.Len()))
 		redSub := redSeq.NewSubSequence(uint(lastMatch), uint(redSeq.Len()))
-		addWithoutMatch(&cseq, coarsedb, orgSeqId, orgSub, redSub)
+		cw.addWithoutMatch(&cseq, orgSeqId, orgSub, redSub)
+		mem.diag.NovelResidues += orgSeq.Len() - lastMatch
 	}
 
 	return cseq
@@ -423,6 +514,48 @@ func skipLowComplexity(seq []byte, windowSize, regionSize int) int {
 	return i
 }
 
+// A coarseWriter is how compression looks up seeds in, and adds sequences
+// and links to, the coarse database. A directWriter changes the coarse
+// database right away, while a seqPlan only records the changes so that they
+// can be committed later. (See deterministic.go.)
+type coarseWriter interface {
+	lookup(kmer []byte, mem *memory) [][2]uint
+	addWithoutMatch(cseq *cablastp.CompressedSeq, orgSeqId int,
+		orgSub *cablastp.OriginalSeq, redSub *cablastp.ReducedSeq)
+	addMatch(cseq *cablastp.CompressedSeq, orgSeqId int,
+		corSeqId, corStart, corEnd int, orgMatch string)
+}
+
+type directWriter struct {
+	db *cablastp.DB
+}
+
+func (w directWriter) lookup(kmer []byte, mem *memory) [][2]uint {
+	return w.db.CoarseDB.Seeds.Lookup(kmer, &mem.seeds)
+}
+
+func (w directWriter) addWithoutMatch(cseq *cablastp.CompressedSeq,
+	orgSeqId int, orgSub *cablastp.OriginalSeq, redSub *cablastp.ReducedSeq) {
+
+	addWithoutMatch(cseq, w.db, orgSeqId, orgSub, redSub)
+}
+
+// addMatch links the compressed sequence and the coarse sequence matched to
+// each other, and records the hit for seed eviction.
+func (w directWriter) addMatch(cseq *cablastp.CompressedSeq, orgSeqId int,
+	corSeqId, corStart, corEnd int, orgMatch string) {
+
+	coarsedb := w.db.CoarseDB
+	corSeq := coarsedb.CoarseSeqGet(uint(corSeqId))
+	orgMatch = w.db.EncodeOrigSeq(cseq,
+		corSeq.Residues[corStart:corEnd], []byte(orgMatch))
+	cseq.Add(cablastp.NewLinkToCoarse(
+		uint(corSeqId), uint(corStart), uint(corEnd), orgMatch))
+	corSeq.AddLink(cablastp.NewLinkToCompressed(
+		uint32(orgSeqId), uint16(corStart), uint16(corEnd)))
+	coarsedb.Seeds.Hit(corSeqId)
+}
+
 // addWithoutMatch adds a portion of an original sequence that could not be
 // matched to anything in the coarse database to the coarse database.
 // A LinkToCompressed is created and automatically added to the new coarse
@@ -431,20 +564,23 @@ func skipLowComplexity(seq []byte, windowSize, regionSize int) int {
 // An appropriate link is also added to the given compressed sequence.
 // TODO we need to juggle the reduced and original seq portions
 func addWithoutMatch(cseq *cablastp.CompressedSeq,
-	coarsedb *cablastp.CoarseDB, orgSeqId int, orgSub *cablastp.OriginalSeq,
+	db *cablastp.DB, orgSeqId int, orgSub *cablastp.OriginalSeq,
 	redSub *cablastp.ReducedSeq) {
 
 	// Explicitly copy residues to avoid pinning memory.
 	redSubCpy := make([]byte, len(redSub.Residues))
 	copy(redSubCpy, redSub.Residues)
 
-	corSeqId, corSeq := coarsedb.Add(redSubCpy)
+	corSeqId, corSeq, err := db.CoarseDB.Add(redSubCpy)
+	if err != nil {
+		fatalf("%s Please set 'max-seeds'.\n", err)
+	}
 	corSeq.AddLink(
 		cablastp.NewLinkToCompressed(uint32(orgSeqId), 0, uint16(len(redSubCpy))))
 
 	cseq.Add(
 		cablastp.NewLinkToCoarse(uint(corSeqId), 0, uint(len(redSubCpy)),
-			string(orgSub.Residues)))
+			db.EncodeOrigSeq(cseq, redSubCpy, orgSub.Residues)))
 }
 
 func min(a, b int) int {
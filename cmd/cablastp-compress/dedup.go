@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+// dedupKey is the SHA-256 hash of the residues of a sequence. Sequences with
+// the same hash are taken to be duplicates, since a collision between
+// different sequences is negligibly unlikely at 256 bits.
+type dedupKey [sha256.Size]byte
+
+// A dedup finds sequences that are byte-identical to a sequence that was
+// already compressed, so that they can be stored as aliases instead of being
+// compressed again.
+//
+// Only the hash and id of every sequence that isn't a duplicate are kept, so
+// a dedup uses about 64 bytes per unique sequence.
+//
+// N.B. Only sequences compressed in the same run are considered. Duplicates
+// of sequences that were already in the database when appending are
+// compressed as usual.
+type dedup struct {
+	first      map[dedupKey]int
+	duplicates int
+}
+
+func newDedup() *dedup {
+	return &dedup{first: make(map[dedupKey]int, 100000)}
+}
+
+// add returns the id of the first sequence with the same residues as 'oseq',
+// and true. If there is no such sequence, 'oseq' is remembered as the first
+// one with id 'orgSeqId', and false is returned.
+func (d *dedup) add(orgSeqId int, oseq *cablastp.OriginalSeq) (int, bool) {
+	key := dedupKey(sha256.Sum256(oseq.Residues))
+	if first, ok := d.first[key]; ok {
+		d.duplicates++
+		return first, true
+	}
+	d.first[key] = orgSeqId
+	return 0, false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+// A committer makes compression deterministic. Workers still find matches
+// concurrently, but only 'plan' the changes to the coarse database. The
+// committer then applies the plans one at a time in input order, so that
+// coarse sequences, seeds and links are added in the same order regardless
+// of the number of workers.
+//
+// Every plan is made against the coarse sequences that were committed when
+// planning started. When a plan is committed, it is still valid if none of
+// the K-mers it looked up have gained seeds since. Otherwise, the sequence is
+// planned again with the committer's own memory arena. Either way, the result
+// only depends on the input.
+//
+// N.B. Unlike in non-deterministic mode, the unmatched regions of a sequence
+// can't match later regions of the same sequence.
+type committer struct {
+	// bound is the number of coarse sequences whose seeds have all been
+	// added to the seeds table. Plans only see coarse sequences below it.
+	// It must be accessed atomically.
+	bound int64
+
+	// epoch is incremented every time seeds are evicted, which invalidates
+	// every plan made before. It must be accessed atomically.
+	epoch int64
+
+	db       *cablastp.DB
+	eviction cablastp.EvictionPolicy
+	plans    chan *seqPlan
+	finished chan struct{}
+}
+
+// startCommitter starts a goroutine that commits plans sent to its 'plans'
+// channel in the order of their original sequence ids.
+func startCommitter(
+	db *cablastp.DB, eviction cablastp.EvictionPolicy) *committer {
+
+	c := &committer{
+		bound:    int64(db.CoarseDB.Len()),
+		db:       db,
+		eviction: eviction,
+		plans:    make(chan *seqPlan, 200),
+		finished: make(chan struct{}),
+	}
+	go c.run(db.ComDB.NumSequences())
+	return c
+}
+
+// run commits plans as soon as all plans for earlier sequences have been
+// committed. 'next' is the id of the first original sequence.
+func (c *committer) run(next int) {
+	mem := newMemory()
+	waiting := make(map[int]*seqPlan)
+	for plan := range c.plans {
+		waiting[plan.orgSeqId] = plan
+		for ready, ok := waiting[next]; ok; ready, ok = waiting[next] {
+			delete(waiting, next)
+			c.commit(ready, mem)
+			next++
+		}
+	}
+	close(c.finished)
+}
+
+// done waits for all plans sent to the committer to be committed.
+func (c *committer) done() {
+	close(c.plans)
+	<-c.finished
+}
+
+// plan finds matches for an original sequence against the committed coarse
+// sequences, without changing the coarse database.
+func (c *committer) plan(orgSeqId int, orgSeq *cablastp.OriginalSeq,
+	mem *memory) *seqPlan {
+
+	plan := &seqPlan{
+		seeds:    c.db.CoarseDB.Seeds,
+		orgSeqId: orgSeqId,
+		orgSeq:   orgSeq,
+		aliasOf:  -1,
+		epoch:    atomic.LoadInt64(&c.epoch),
+		bound:    int(atomic.LoadInt64(&c.bound)),
+	}
+	compress(c.db, plan, orgSeqId, orgSeq, mem)
+	plan.diag = mem.diag
+	return plan
+}
+
+// commit applies a plan to the coarse database (planning the sequence again
+// if the plan is stale), and queues the compressed sequence for writing.
+func (c *committer) commit(plan *seqPlan, mem *memory) {
+	if plan.aliasOf >= 0 {
+		c.db.ComDB.Write(cablastp.NewAliasSeq(
+			plan.orgSeqId, plan.orgSeq.Name, plan.aliasOf))
+		c.db.ComDB.WriteDiagnostics(
+			aliasDiagnostics(plan.orgSeqId, plan.orgSeq, plan.aliasOf))
+	} else {
+		c.apply(plan, mem)
+	}
+
+	// Seeds are evicted at the same points as in non-deterministic mode,
+	// but only between commits.
+	if flagMaxSeedsGB > 0 && (plan.orgSeqId+1)%10000 == 0 {
+		if evictSeeds(c.db, c.eviction) > 0 {
+			atomic.AddInt64(&c.epoch, 1)
+		}
+	}
+}
+
+func (c *committer) apply(plan *seqPlan, mem *memory) {
+	coarsedb := c.db.CoarseDB
+	if plan.stale(coarsedb.Len(), atomic.LoadInt64(&c.epoch)) {
+		plan = c.plan(plan.orgSeqId, plan.orgSeq, mem)
+	}
+
+	w := directWriter{c.db}
+	cseq := cablastp.NewCompressedSeq(plan.orgSeqId, plan.orgSeq.Name)
+	for _, act := range plan.actions {
+		if act.orgSub != nil {
+			w.addWithoutMatch(&cseq, plan.orgSeqId, act.orgSub, act.redSub)
+		} else {
+			w.addMatch(&cseq, plan.orgSeqId,
+				act.corSeqId, act.corStart, act.corEnd, act.orgMatch)
+		}
+	}
+	atomic.StoreInt64(&c.bound, int64(coarsedb.Len()))
+	c.db.ComDB.Write(cseq)
+	c.db.ComDB.WriteDiagnostics(plan.diag)
+}
+
+// A seqPlan is a coarseWriter that records the changes compressing a
+// sequence would make to the coarse database, so that they can be committed
+// later.
+type seqPlan struct {
+	seeds    cablastp.Seeds
+	orgSeqId int
+	orgSeq   *cablastp.OriginalSeq
+
+	// aliasOf is set when the sequence is an exact duplicate, in which case
+	// there is nothing to plan. Otherwise, it is -1.
+	aliasOf int
+
+	// Only coarse sequences with an index less than 'bound' are visible, and
+	// the plan is only valid as long as no seeds are evicted after 'epoch'.
+	bound int
+	epoch int64
+
+	// kmers is every K-mer that was looked up in the seeds table.
+	kmers [][]byte
+
+	actions []planAction
+
+	// diag is the diagnostics of planning the sequence.
+	diag cablastp.SeqDiagnostics
+}
+
+// planAction is either a region of the original sequence without a match
+// (when orgSub is set) or a match with a coarse sequence.
+type planAction struct {
+	orgSub *cablastp.OriginalSeq
+	redSub *cablastp.ReducedSeq
+
+	corSeqId, corStart, corEnd int
+	orgMatch                   string
+}
+
+func (plan *seqPlan) lookup(kmer []byte, mem *memory) [][2]uint {
+	plan.kmers = append(plan.kmers, kmer)
+	return plan.seeds.LookupBefore(kmer, plan.bound, &mem.seeds)
+}
+
+func (plan *seqPlan) addWithoutMatch(cseq *cablastp.CompressedSeq,
+	orgSeqId int, orgSub *cablastp.OriginalSeq, redSub *cablastp.ReducedSeq) {
+
+	plan.actions = append(plan.actions, planAction{
+		orgSub: orgSub,
+		redSub: redSub,
+	})
+}
+
+func (plan *seqPlan) addMatch(cseq *cablastp.CompressedSeq, orgSeqId int,
+	corSeqId, corStart, corEnd int, orgMatch string) {
+
+	plan.actions = append(plan.actions, planAction{
+		corSeqId: corSeqId,
+		corStart: corStart,
+		corEnd:   corEnd,
+		orgMatch: orgMatch,
+	})
+}
+
+// stale returns true if compressing the sequence now, with 'numCoarse'
+// coarse sequences in the database, could give a different result than the
+// plan.
+func (plan *seqPlan) stale(numCoarse int, epoch int64) bool {
+	if plan.epoch != epoch {
+		return true
+	}
+	if plan.bound == numCoarse {
+		return false
+	}
+	for _, kmer := range plan.kmers {
+		if plan.seeds.AddedSince(kmer, plan.bound) {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/ndaniels/cablastp2"
@@ -22,6 +23,14 @@ var (
 	// Used to compute the number of sequences compressed per second.
 	timer time.Time
 
+	// Records the input position of every compressed sequence, if they
+	// aren't compressed in input order.
+	inputOrder *cablastp.InputOrder
+
+	// Records what is needed to restore every input sequence exactly, if
+	// the database is lossless.
+	exceptions *cablastp.ExceptionsWriter
+
 	// Any residue in `ignoredResidues` will be replaced with an X.
 	// These should correspond to the residues NOT in blosum.Alphabet62.
 	ignoredResidues = []byte{'J', 'O', 'U'}
@@ -31,15 +40,24 @@ var (
 
 	// Flags that affect the higher level operation of compression.
 	// Flags that control algorithmic parameters are stored in `dbConf`.
-	flagGoMaxProcs  = runtime.NumCPU()
-	flagAppend      = false
-	flagOverwrite   = false
-	flagQuiet       = false
-	flagMaxSeedsGB  = 8.0
-	flagCpuProfile  = ""
-	flagMemProfile  = ""
-	flagMemStats    = ""
-	flagMemInterval = false
+	flagGoMaxProcs    = runtime.NumCPU()
+	flagAppend        = false
+	flagOverwrite     = false
+	flagQuiet         = false
+	flagMaxSeedsGB    = 8.0
+	flagEviction      = "wipe"
+	flagDeterministic = false
+	flagOrder         = orderInput
+	flagOrderSeed     = int64(1)
+	flagOrderChunk    = 500000
+	flagOrderTmp      = ""
+	flagDedup         = false
+	flagDiagnostics   = false
+	flagShards        = 0
+	flagCpuProfile    = ""
+	flagMemProfile    = ""
+	flagMemStats      = ""
+	flagMemInterval   = false
 )
 
 func init() {
@@ -73,6 +91,21 @@ func init() {
 		dbConf.MapSeedSize,
 		"The size of a seed in the K-mer map. This size combined with\n"+
 			"\t'ext-seed-size' forms the total seed size.")
+	flag.StringVar(&dbConf.SeedPattern, "seed-pattern",
+		dbConf.SeedPattern,
+		"A spaced seed pattern of '1's (residues that must match) and '0's\n"+
+			"\t(residues that are ignored), e.g., '110110111011'. When set,\n"+
+			"\tthe map seed size is the length of the pattern.")
+	flag.StringVar(&dbConf.SeedSampling, "seed-sampling",
+		dbConf.SeedSampling,
+		"Which positions of coarse sequences are indexed as seeds. 'all'\n"+
+			"\tindexes every position. 'minimizer' indexes the minimizer of\n"+
+			"\tevery window of 'seed-window' seeds. 'syncmer' indexes seeds\n"+
+			"\twhose smallest 'seed-window'-mer is at their start or end.\n"+
+			"\tSampling uses less memory, but may find fewer matches.")
+	flag.IntVar(&dbConf.SeedWindow, "seed-window",
+		dbConf.SeedWindow,
+		"The minimizer window size or the syncmer s-mer length.")
 	flag.IntVar(&dbConf.ExtSeedSize, "ext-seed-size",
 		dbConf.ExtSeedSize,
 		"The additional residues to require for each seed match.")
@@ -100,6 +133,35 @@ func init() {
 	flag.StringVar(&dbConf.BlastMakeBlastDB, "makeblastdb",
 		dbConf.BlastMakeBlastDB,
 		"The location of the 'makeblastdb' executable.")
+	flag.StringVar(&dbConf.ReducedAlphabet, "reduced-alphabet",
+		dbConf.ReducedAlphabet,
+		"The reduced alphabet used for the coarse database. This is either\n"+
+			"\tthe name of a preset ("+
+			strings.Join(cablastp.AlphabetNames(), ", ")+") or a comma\n"+
+			"\tseparated list of residue classes, e.g.,\n"+
+			"\tLVIMC,AGSTP,FYW,EDNQKRH.")
+	flag.StringVar(&dbConf.ResidueCoding, "residue-coding",
+		dbConf.ResidueCoding,
+		"How the original residues of links are stored. 'plain' stores\n"+
+			"\tthem as is, while 'range' range codes them against the\n"+
+			"\treduced coarse residues, which is smaller but slower.")
+	flag.IntVar(&dbConf.CompressBlockSize, "block-size",
+		dbConf.CompressBlockSize,
+		"When set, the compressed sequences and coarse FASTA file are\n"+
+			"\tcompressed in blocks of this many sequences each. Records\n"+
+			"\tare still read individually, but whole blocks are\n"+
+			"\tdecompressed at a time.")
+	flag.BoolVar(&dbConf.Lossless, "lossless",
+		dbConf.Lossless,
+		"When set, lower case residues, stop characters, substituted\n"+
+			"\tresidues, line widths and headers are recorded, so that\n"+
+			"\t'cablastp-decompress -exact' reproduces the input exactly.")
+	flag.BoolVar(&dbConf.NameTable, "name-table",
+		dbConf.NameTable,
+		"When set, a table of the names and accessions of every sequence\n"+
+			"\tis built, so that 'cablastp-fetch' can find sequences by\n"+
+			"\tname. Names are spilled to disk in sorted chunks while\n"+
+			"\tcompressing, and merged when the database is saved.")
 
 	flag.IntVar(&flagGoMaxProcs, "p", flagGoMaxProcs,
 		"The maximum number of CPUs that can be executing simultaneously.")
@@ -113,11 +175,56 @@ func init() {
 	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
 		"When set, the only outputs will be errors echoed to stderr.")
 	flag.Float64Var(&flagMaxSeedsGB, "max-seeds", flagMaxSeedsGB,
-		"When set, the in memory seeds table will be completely erased\n"+
+		"When set, seeds will be evicted from the in memory seeds table\n"+
 			"\twhen the memory used by seeds exceeds the specified number,\n"+
-			"\tin gigabytes.\n"+
-			"\tEach seed corresponds to 16 bytes of memory.\n"+
-			"\tSetting to zero disables this behavior.")
+			"\tin gigabytes. See 'seed-eviction'.\n"+
+			"\tEach seed corresponds to 6 bytes of memory.\n"+
+			"\tSetting to zero disables this behavior. The largest limit\n"+
+			"\tis 12, since the seeds table can't grow past 16GB.")
+	flag.StringVar(&flagEviction, "seed-eviction", flagEviction,
+		"The policy used to evict seeds when the seeds table is full.\n"+
+			"\t'wipe' erases the whole table. 'oldest' evicts the seeds of\n"+
+			"\tthe oldest coarse sequences first, but keeps sequences that\n"+
+			"\trecently produced matches. 'cap' limits the number of\n"+
+			"\tlocations kept for every K-mer.")
+	flag.BoolVar(&flagDeterministic, "deterministic", flagDeterministic,
+		"When set, the database created only depends on the input, and not\n"+
+			"\ton the number of CPUs or how sequences are scheduled on them.\n"+
+			"\tThis may be slower.")
+	flag.StringVar(&flagOrder, "order", flagOrder,
+		"The order in which input sequences are compressed. Sequences\n"+
+			"\tcompressed first are more likely to become coarse sequences.\n"+
+			"\t'input' keeps the order of the input. 'longest' compresses\n"+
+			"\tthe longest sequences first. 'signature' puts sequences\n"+
+			"\twith similar K-mers next to each other. 'random' shuffles\n"+
+			"\tsequences using 'order-seed'. When the order isn't 'input',\n"+
+			"\tthe input position of every sequence is saved.")
+	flag.Int64Var(&flagOrderSeed, "order-seed", flagOrderSeed,
+		"The seed used to shuffle sequences with the 'random' order.")
+	flag.IntVar(&flagOrderChunk, "order-chunk", flagOrderChunk,
+		"The number of sequences sorted in memory at a time. Larger\n"+
+			"\tinputs are sorted in chunks that are spilled to disk.")
+	flag.StringVar(&flagOrderTmp, "order-tmp", flagOrderTmp,
+		"The directory to spill sorted chunks to. By default, the\n"+
+			"\tsystem's temporary directory is used.")
+	flag.BoolVar(&flagDedup, "dedup", flagDedup,
+		"When set, sequences that are byte-identical to a sequence that\n"+
+			"\twas already compressed are stored as aliases of it, with\n"+
+			"\ttheir own names. The hash of every unique sequence is kept in\n"+
+			"\tmemory, which takes about 64 bytes per sequence.")
+	flag.BoolVar(&flagDiagnostics, "diagnostics", flagDiagnostics,
+		"When set, how every sequence was compressed (seed lookups,\n"+
+			"\tmatches, residues linked and added as coarse sequences, and\n"+
+			"\ttime spent extending seeds) is written to\n"+
+			"\t'"+cablastp.FileDiagnostics+"' in the database.")
+	flag.IntVar(&flagShards, "shards", flagShards,
+		"When set, a sharded database with this many shards is created.\n"+
+			"\tSequences are sent to shards by K-mer signature (so that\n"+
+			"\tsimilar sequences end up in the same shard), and shards are\n"+
+			"\tcompressed concurrently, each with its own seeds table. The\n"+
+			"\t'max-seeds' limit is split evenly between shards. Sharded\n"+
+			"\tdatabases can't be appended to, and must be compressed in\n"+
+			"\tinput order without 'lossless'.")
 	flag.StringVar(&flagCpuProfile, "cpuprofile", flagCpuProfile,
 		"When set, a CPU profile will be written to the file specified.")
 	flag.StringVar(&flagMemProfile, "memprofile", flagMemProfile,
@@ -128,12 +235,12 @@ func init() {
 		"When set, memory profile/stats will be written at some interval.")
 
 	flag.Usage = usage
-	flag.Parse()
-
-	runtime.GOMAXPROCS(flagGoMaxProcs)
 }
 
 func main() {
+	flag.Parse()
+	runtime.GOMAXPROCS(flagGoMaxProcs)
+
 	if flag.NArg() < 2 {
 		flag.Usage()
 	}
@@ -150,6 +257,26 @@ func main() {
 		cablastp.Verbose = true
 	}
 
+	if flagMaxSeedsGB < 0 || flagMaxSeedsGB > cablastp.MaxSeedsGB {
+		fatalf("The 'max-seeds' flag must be between 0 and %g.\n",
+			cablastp.MaxSeedsGB)
+	}
+	eviction, err := cablastp.ParseEvictionPolicy(flagEviction)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	ord, err := newOrderer(
+		flagOrder, flagOrderSeed, flagOrderChunk, flagOrderTmp)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+
+	if flagShards > 0 && (flagAppend || flagOrder != orderInput ||
+		dbConf.Lossless) {
+		fatalf("The 'shards' flag can't be used with the 'append', " +
+			"'order' or 'lossless' flags.\n")
+	}
+
 	// If the overwrite flag is set, remove whatever directory that may
 	// already be there.
 	if flagOverwrite {
@@ -158,8 +285,12 @@ func main() {
 				flag.Arg(0), err)
 		}
 	}
-
-	// TODO sort the input file, longest first. Or just preprocess this.
+	if flagShards > 0 {
+		flagMaxSeedsGB /= float64(flagShards)
+		compressShards(dbConf, flag.Arg(0), flag.Args()[1:], flagShards,
+			eviction)
+		return
+	}
 
 	// Create a new database for writing. If we're appending, we load
 	// the coarse database into memory, and setup the database for writing.
@@ -168,52 +299,83 @@ func main() {
 		fatalf("%s\n", err)
 	}
 	cablastp.Vprintln("")
+	if flagDiagnostics {
+		if err := db.StartDiagnostics(); err != nil {
+			fatalf("%s\n", err)
+		}
+	}
 
-	pool := StartCompressWorkers(db)
+	// Sort the input before starting to compress, and keep track of where
+	// each compressed sequence was in the input.
 	orgSeqId := db.ComDB.NumSequences()
+	exceptions, err = cablastp.OpenExceptions(db)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	input, err := ord.sort(
+		readInput(flag.Args()[1:], orgSeqId, exceptions), db)
+	if err != nil {
+		fatalf("Could not order input sequences: %s\n", err)
+	}
+	inputOrder, err = cablastp.OpenInputOrder(db, flagOrder != orderInput)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+
+	var dups *dedup
+	if flagDedup {
+		dups = newDedup()
+	}
+	pool := StartCompressWorkers(db, flagDeterministic, eviction)
 	mainQuit := make(chan struct{}, 0)
 
 	// If the process is killed, try to clean up elegantly.
 	// The idea is to preserve the integrity of the database.
-	attachSignalHandler(db, mainQuit, &pool)
+	attachSignalHandler(mainQuit, func() { cleanup(db, &pool) })
 
 	// Start the CPU profile after all of the data has been read.
-	if len(flagCpuProfile) > 0 {
-		f, err := os.Create(flagCpuProfile)
-		if err != nil {
-			fatalf("%s\n", err)
+	startCPUProfile()
+	timer = time.Now()
+	for in := range input {
+		// Do a non-blocking receive to see if main needs to quit.
+		select {
+		case <-mainQuit:
+			<-mainQuit // wait for cleanup to finish before exiting main.
+			return
+		default:
 		}
-		pprof.StartCPUProfile(f)
-	}
-	for _, arg := range flag.Args()[1:] {
-		seqChan, err := cablastp.ReadOriginalSeqs(arg, ignoredResidues) //protein seq
-		if err != nil {
-			log.Fatal(err)
-		}
-		if orgSeqId == 0 {
-			timer = time.Now()
-		}
-		for readSeq := range seqChan {
-			// Do a non-blocking receive to see if main needs to quit.
-			select {
-			case <-mainQuit:
-				<-mainQuit // wait for cleanup to finish before exiting main.
-				return
-			default:
-			}
 
-			if readSeq.Err != nil {
-				log.Fatal(err)
-			}
-			dbConf.BlastDBSize += uint64(readSeq.Seq.Len())
-			orgSeqId = pool.Compress(orgSeqId, readSeq.Seq)
-			verboseOutput(db, orgSeqId)
-			if flagMaxSeedsGB > 0 && orgSeqId%10000 == 0 {
-				db.CoarseDB.Seeds.MaybeWipe(flagMaxSeedsGB)
+		if in.err != nil {
+			log.Fatal(in.err)
+		}
+		if inputOrder != nil {
+			if err := inputOrder.Add(in.pos); err != nil {
+				fatalf("Could not write input order: %s\n", err)
 			}
 		}
+		dbConf.BlastDBSize += uint64(in.seq.Len())
+		if dups == nil {
+			orgSeqId = pool.Compress(orgSeqId, in.seq)
+		} else if aliasOf, ok := dups.add(orgSeqId, in.seq); ok {
+			orgSeqId = pool.Alias(orgSeqId, in.seq, aliasOf)
+		} else {
+			orgSeqId = pool.Compress(orgSeqId, in.seq)
+		}
+		verboseOutput(db, orgSeqId)
+		// In deterministic mode, the pool evicts seeds between commits.
+		if !flagDeterministic &&
+			flagMaxSeedsGB > 0 && orgSeqId%10000 == 0 {
+			evictSeeds(db, eviction)
+		}
 	}
 	cablastp.Vprintln("\n")
+	if dups != nil && dups.duplicates > 0 {
+		cablastp.Vprintf("Stored %d exact duplicates as aliases.\n",
+			dups.duplicates)
+	}
+	if stats := db.CoarseDB.Seeds.EvictionStats(); stats.Evictions > 0 {
+		cablastp.Vprintf("Seed eviction ('%s'): %s.\n", eviction, stats)
+	}
 	cablastp.Vprintf("Wrote %s.\n", cablastp.FileCompressed)
 	cablastp.Vprintf("Wrote %s.\n", cablastp.FileIndex)
 
@@ -225,6 +387,37 @@ func main() {
 // if they're enabled, waits for the compression workers to finish, saves
 // the database to disk and closes all file handles.
 func cleanup(db *cablastp.DB, pool *compressPool) {
+	stopProfiles()
+	pool.done()
+	if inputOrder != nil {
+		if err := inputOrder.Close(); err != nil {
+			fatalf("Could not save input order: %s\n", err)
+		}
+	}
+	if exceptions != nil {
+		if err := exceptions.Close(); err != nil {
+			fatalf("Could not save exceptions: %s\n", err)
+		}
+	}
+	if err := db.Save(); err != nil {
+		fatalf("Could not save database: %s\n", err)
+	}
+	db.WriteClose()
+}
+
+// startCPUProfile starts the CPU profile if it's enabled.
+func startCPUProfile() {
+	if len(flagCpuProfile) > 0 {
+		f, err := os.Create(flagCpuProfile)
+		if err != nil {
+			fatalf("%s\n", err)
+		}
+		pprof.StartCPUProfile(f)
+	}
+}
+
+// stopProfiles writes all CPU/memory profiles if they're enabled.
+func stopProfiles() {
 	if len(flagCpuProfile) > 0 {
 		pprof.StopCPUProfile()
 	}
@@ -234,28 +427,33 @@ func cleanup(db *cablastp.DB, pool *compressPool) {
 	if len(flagMemStats) > 0 {
 		writeMemStats(fmt.Sprintf("%s.last", flagMemStats))
 	}
-	pool.done()
-	if err := db.Save(); err != nil {
-		fatalf("Could not save database: %s\n", err)
-	}
-	db.WriteClose()
 }
 
-// Runs a goroutine to listen for SIGTERM and SIGKILL.
-func attachSignalHandler(db *cablastp.DB, mainQuit chan struct{},
-	pool *compressPool) {
-
+// Runs a goroutine to listen for SIGTERM and SIGKILL, which runs 'cleanup'.
+func attachSignalHandler(mainQuit chan struct{}, cleanup func()) {
 	sigChan := make(chan os.Signal, 1)
 	go func() {
 		<-sigChan
 		mainQuit <- struct{}{}
-		cleanup(db, pool)
+		cleanup()
 		mainQuit <- struct{}{}
 		os.Exit(0)
 	}()
 	signal.Notify(sigChan, os.Interrupt, os.Kill)
 }
 
+// evictSeeds evicts seeds from the seeds table if it has grown too large, and
+// reports and returns how many were evicted.
+func evictSeeds(db *cablastp.DB, eviction cablastp.EvictionPolicy) int64 {
+	seeds := db.CoarseDB.Seeds
+	evicted := seeds.MaybeEvict(eviction, flagMaxSeedsGB)
+	if evicted > 0 {
+		cablastp.Vprintf("\nEvicted %d seeds with the '%s' policy "+
+			"(%d seeds left).\n", evicted, eviction, seeds.NumSeeds())
+	}
+	return evicted
+}
+
 // The output generated after each sequence is compressed (or more precisely,
 // after some interval of sequences has been compressed).
 func verboseOutput(db *cablastp.DB, orgSeqId int) {
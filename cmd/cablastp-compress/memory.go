@@ -1,5 +1,9 @@
 package main
 
+import (
+	"github.com/ndaniels/cablastp2"
+)
+
 const (
 	memSeqSize       = 10000
 	dynamicTableSize = memSeqSize * memSeqSize
@@ -13,6 +17,9 @@ type memory struct {
 	table    []int
 	ref, org []byte
 	seeds    [][2]uint
+
+	// diag is the diagnostics of the last sequence compressed.
+	diag cablastp.SeqDiagnostics
 }
 
 func newMemory() *memory {
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+// The orders in which input sequences can be compressed. Sequences that
+// come first are more likely to become coarse sequences.
+const (
+	// orderInput compresses sequences in the order they are given.
+	orderInput = "input"
+
+	// orderLongest compresses the longest sequences first, so that shorter
+	// sequences can be matched against them.
+	orderLongest = "longest"
+
+	// orderSignature puts sequences with the same K-mer signature next to
+	// each other (longest first), so that similar sequences are compressed
+	// together.
+	orderSignature = "signature"
+
+	// orderRandom compresses sequences in a random order, which only
+	// depends on the seed.
+	orderRandom = "random"
+)
+
+// inputSeq is an original sequence along with its position in the input.
+type inputSeq struct {
+	pos int
+	seq *cablastp.OriginalSeq
+	err error
+}
+
+// readInput reads every sequence in 'files' and sends it to the returned
+// channel in input order. Positions are numbered starting at 'first'.
+//
+// If 'exceptions' isn't nil, the files are read losslessly, and the
+// exceptions of every sequence are written in input order.
+func readInput(files []string, first int,
+	exceptions *cablastp.ExceptionsWriter) <-chan inputSeq {
+
+	out := make(chan inputSeq, 200)
+	go func() {
+		defer close(out)
+
+		pos := first
+		for _, file := range files {
+			read := cablastp.ReadOriginalSeqs
+			if exceptions != nil {
+				read = cablastp.ReadOriginalSeqsLossless
+			}
+			seqChan, err := read(file, ignoredResidues)
+			if err != nil {
+				out <- inputSeq{err: err}
+				return
+			}
+			for readSeq := range seqChan {
+				if readSeq.Err != nil {
+					out <- inputSeq{err: readSeq.Err}
+					return
+				}
+				if exceptions != nil {
+					if err := exceptions.Add(readSeq.Exceptions); err != nil {
+						out <- inputSeq{err: err}
+						return
+					}
+				}
+				out <- inputSeq{pos: pos, seq: readSeq.Seq}
+				pos++
+			}
+		}
+	}()
+	return out
+}
+
+// An orderer sorts input sequences with one of the order strategies.
+//
+// Sorting works out-of-core: sequences are sorted in chunks of 'chunkSize'
+// sequences, each chunk is spilled to a temporary file in 'tmpDir', and the
+// spill files are merged as sequences are compressed.
+type orderer struct {
+	strategy  string
+	chunkSize int
+	tmpDir    string
+
+	// Used to compute K-mer signatures.
+	alpha    *cablastp.Alphabet
+	kmerSize int
+
+	// Used to compute random orders.
+	rng *rand.Rand
+}
+
+// newOrderer creates an orderer for the given strategy.
+func newOrderer(strategy string, seed int64, chunkSize int,
+	tmpDir string) (*orderer, error) {
+
+	switch strategy {
+	case orderInput, orderLongest, orderSignature, orderRandom:
+	default:
+		return nil, fmt.Errorf("Unknown order '%s'. Valid orders are "+
+			"'%s', '%s', '%s' and '%s'.", strategy,
+			orderInput, orderLongest, orderSignature, orderRandom)
+	}
+	if chunkSize < 1 {
+		return nil, fmt.Errorf("The order chunk size must be at least 1.")
+	}
+	return &orderer{
+		strategy:  strategy,
+		chunkSize: chunkSize,
+		tmpDir:    tmpDir,
+		rng:       rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+// orderRecord is an input sequence with its sort key. Records are sorted by
+// 'primary', then by 'secondary', and then by input position, so that the
+// order is total and doesn't depend on how records are split into chunks.
+type orderRecord struct {
+	primary, secondary uint64
+	pos                int
+	name               string
+	residues           []byte
+}
+
+func (r *orderRecord) less(r2 *orderRecord) bool {
+	if r.primary != r2.primary {
+		return r.primary < r2.primary
+	}
+	if r.secondary != r2.secondary {
+		return r.secondary < r2.secondary
+	}
+	return r.pos < r2.pos
+}
+
+func (r *orderRecord) inputSeq() inputSeq {
+	return inputSeq{
+		pos: r.pos,
+		seq: cablastp.NewOriginalSeq(r.pos, r.name, r.residues),
+	}
+}
+
+// record computes the sort key of an input sequence.
+func (ord *orderer) record(in inputSeq) *orderRecord {
+	r := &orderRecord{
+		pos:      in.pos,
+		name:     in.seq.Name,
+		residues: in.seq.Residues,
+	}
+	longest := ^uint64(in.seq.Len())
+	switch ord.strategy {
+	case orderLongest:
+		r.primary = longest
+	case orderSignature:
+		r.primary = ord.signature(in.seq)
+		r.secondary = longest
+	case orderRandom:
+		r.primary = ord.rng.Uint64()
+	}
+	return r
+}
+
+// signature returns the K-mer signature of an input sequence.
+func (ord *orderer) signature(oseq *cablastp.OriginalSeq) uint64 {
+	return kmerSignature(ord.alpha, ord.kmerSize, oseq)
+}
+
+// kmerSignature returns the smallest hash of all K-mers in the sequence
+// reduced with 'alpha'. (This is a MinHash of the K-mers, so sequences that
+// share many K-mers are likely to have the same signature.)
+func kmerSignature(alpha *cablastp.Alphabet, kmerSize int,
+	oseq *cablastp.OriginalSeq) uint64 {
+
+	const fnvOffset, fnvPrime = 14695981039346656037, 1099511628211
+
+	rseq := alpha.Reduce(oseq.Residues)
+	sig := ^uint64(0)
+	for i := 0; i+kmerSize <= len(rseq); i++ {
+		kmer := rseq[i : i+kmerSize]
+		if alpha.HasWildcard(kmer) {
+			continue
+		}
+		h := uint64(fnvOffset)
+		for _, letter := range kmer {
+			h ^= uint64(letter)
+			h *= fnvPrime
+		}
+		if h < sig {
+			sig = h
+		}
+	}
+	return sig
+}
+
+// sort reads all of 'in' and returns a channel that the sequences are sent
+// to in sorted order. If all sequences fit in a single chunk, they are sorted
+// in memory. Signatures use the reduced alphabet and map seed size of 'db'.
+func (ord *orderer) sort(
+	in <-chan inputSeq, db *cablastp.DB) (<-chan inputSeq, error) {
+
+	if ord.strategy == orderInput {
+		return in, nil
+	}
+	ord.alpha, ord.kmerSize = db.Alphabet, db.MapSeedSize
+
+	var spills []*spillReader
+	chunk := make([]*orderRecord, 0, ord.chunkSize)
+	for s := range in {
+		if s.err != nil {
+			removeSpills(spills)
+			return nil, s.err
+		}
+		chunk = append(chunk, ord.record(s))
+		if len(chunk) == ord.chunkSize {
+			spill, err := ord.spill(chunk)
+			if err != nil {
+				removeSpills(spills)
+				return nil, err
+			}
+			spills = append(spills, spill)
+			chunk = make([]*orderRecord, 0, ord.chunkSize)
+		}
+	}
+
+	out := make(chan inputSeq, 200)
+	sortRecords(chunk)
+	if len(spills) == 0 {
+		go func() {
+			for _, r := range chunk {
+				out <- r.inputSeq()
+			}
+			close(out)
+		}()
+		return out, nil
+	}
+	if len(chunk) > 0 {
+		spill, err := ord.spill(chunk)
+		if err != nil {
+			removeSpills(spills)
+			return nil, err
+		}
+		spills = append(spills, spill)
+	}
+	go mergeSpills(spills, out)
+	return out, nil
+}
+
+func sortRecords(records []*orderRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].less(records[j])
+	})
+}
+
+// spillHeader is the fixed size part of a record in a spill file. It is
+// followed by the sequence name and residues.
+type spillHeader struct {
+	Primary, Secondary uint64
+	Pos                uint64
+	NameLen, ResLen    uint32
+}
+
+// spill sorts a chunk of records and writes them to a new temporary file.
+// The file is removed as soon as it is created, so that it doesn't outlive
+// the process (even when compression is interrupted). It stays readable
+// until it is closed.
+func (ord *orderer) spill(chunk []*orderRecord) (*spillReader, error) {
+	sortRecords(chunk)
+
+	f, err := ioutil.TempFile(ord.tmpDir, "cablastp-order")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create spill file: %s", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not remove spill file '%s': %s",
+			f.Name(), err)
+	}
+	spill := &spillReader{file: f}
+	w := bufio.NewWriter(f)
+	for _, r := range chunk {
+		head := spillHeader{
+			Primary:   r.primary,
+			Secondary: r.secondary,
+			Pos:       uint64(r.pos),
+			NameLen:   uint32(len(r.name)),
+			ResLen:    uint32(len(r.residues)),
+		}
+		if err = binary.Write(w, binary.BigEndian, head); err != nil {
+			break
+		}
+		if _, err = w.WriteString(r.name); err != nil {
+			break
+		}
+		if _, err = w.Write(r.residues); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		spill.remove()
+		return nil, fmt.Errorf("Could not write spill file '%s': %s",
+			f.Name(), err)
+	}
+	spill.r = bufio.NewReader(f)
+	return spill, nil
+}
+
+// spillReader reads the records of a spill file in order. 'cur' is the
+// record that was read last.
+type spillReader struct {
+	file *os.File
+	r    *bufio.Reader
+	cur  *orderRecord
+}
+
+// next reads the next record into 'cur'. It returns io.EOF when there are no
+// more records.
+func (spill *spillReader) next() error {
+	var head spillHeader
+	if err := binary.Read(spill.r, binary.BigEndian, &head); err != nil {
+		return err
+	}
+	buf := make([]byte, int(head.NameLen)+int(head.ResLen))
+	if _, err := io.ReadFull(spill.r, buf); err != nil {
+		return err
+	}
+	spill.cur = &orderRecord{
+		primary:   head.Primary,
+		secondary: head.Secondary,
+		pos:       int(head.Pos),
+		name:      string(buf[:head.NameLen]),
+		residues:  buf[head.NameLen:],
+	}
+	return nil
+}
+
+// remove closes the spill file, which frees its space on disk.
+func (spill *spillReader) remove() {
+	spill.file.Close()
+}
+
+func removeSpills(spills []*spillReader) {
+	for _, spill := range spills {
+		spill.remove()
+	}
+}
+
+// spillHeap is a min-heap of spill files, ordered by their current records.
+type spillHeap []*spillReader
+
+func (h spillHeap) Len() int            { return len(h) }
+func (h spillHeap) Less(i, j int) bool  { return h[i].cur.less(h[j].cur) }
+func (h spillHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spillHeap) Push(x interface{}) { *h = append(*h, x.(*spillReader)) }
+func (h *spillHeap) Pop() interface{} {
+	old := *h
+	spill := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return spill
+}
+
+// mergeSpills merges sorted spill files into 'out', and removes them once
+// they have been read.
+func mergeSpills(spills []*spillReader, out chan<- inputSeq) {
+	defer close(out)
+	defer removeSpills(spills)
+
+	h := make(spillHeap, 0, len(spills))
+	for _, spill := range spills {
+		if err := spill.next(); err != nil {
+			out <- inputSeq{err: spillError(spill, err)}
+			return
+		}
+		h = append(h, spill)
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		spill := h[0]
+		out <- spill.cur.inputSeq()
+
+		err := spill.next()
+		switch {
+		case err == io.EOF:
+			heap.Pop(&h)
+		case err != nil:
+			out <- inputSeq{err: spillError(spill, err)}
+			return
+		default:
+			heap.Fix(&h, 0)
+		}
+	}
+}
+
+func spillError(spill *spillReader, err error) error {
+	return fmt.Errorf("Could not read spill file '%s': %s",
+		spill.file.Name(), err)
+}
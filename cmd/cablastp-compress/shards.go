@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+// A shard is one of the databases of a sharded database being compressed.
+// Every shard compresses the sequences sent to it with its own pool of
+// workers, so that shards are compressed concurrently.
+type shard struct {
+	db       *cablastp.DB
+	pool     compressPool
+	dups     *dedup
+	orgSeqId int
+
+	input chan *cablastp.OriginalSeq
+	done  chan struct{}
+}
+
+// startShard starts compressing the sequences sent to a shard.
+func startShard(db *cablastp.DB, eviction cablastp.EvictionPolicy) *shard {
+	if flagDiagnostics {
+		if err := db.StartDiagnostics(); err != nil {
+			fatalf("%s\n", err)
+		}
+	}
+	sh := &shard{
+		db:    db,
+		pool:  StartCompressWorkers(db, flagDeterministic, eviction),
+		input: make(chan *cablastp.OriginalSeq, 200),
+		done:  make(chan struct{}),
+	}
+	if flagDedup {
+		sh.dups = newDedup()
+	}
+	go sh.run(eviction)
+	return sh
+}
+
+// run compresses every sequence sent to the shard, the same way main does
+// for an unsharded database.
+func (sh *shard) run(eviction cablastp.EvictionPolicy) {
+	for seq := range sh.input {
+		sh.db.BlastDBSize += uint64(seq.Len())
+		if sh.dups == nil {
+			sh.orgSeqId = sh.pool.Compress(sh.orgSeqId, seq)
+		} else if aliasOf, ok := sh.dups.add(sh.orgSeqId, seq); ok {
+			sh.orgSeqId = sh.pool.Alias(sh.orgSeqId, seq, aliasOf)
+		} else {
+			sh.orgSeqId = sh.pool.Compress(sh.orgSeqId, seq)
+		}
+		if !flagDeterministic &&
+			flagMaxSeedsGB > 0 && sh.orgSeqId%10000 == 0 {
+			evictSeeds(sh.db, eviction)
+		}
+	}
+	close(sh.done)
+}
+
+// compressShards compresses every sequence in 'files' into a new sharded
+// database with 'n' shards in 'dir', configured with 'conf'. Every sequence
+// is sent to the shard given by its K-mer signature, so that exact
+// duplicates (and likely similar sequences) are compressed in the same shard.
+func compressShards(conf *cablastp.DBConf, dir string, files []string,
+	n int, eviction cablastp.EvictionPolicy) {
+
+	dbs, err := cablastp.NewWriteShards(conf, dir, n)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	cablastp.Vprintln("")
+
+	shards := make([]*shard, n)
+	for i, db := range dbs {
+		shards[i] = startShard(db, eviction)
+	}
+	mainQuit := make(chan struct{}, 0)
+	attachSignalHandler(mainQuit, func() { cleanupShards(shards) })
+
+	alpha, kmerSize := dbs[0].Alphabet, dbs[0].MapSeedSize
+	startCPUProfile()
+	timer = time.Now()
+	numSeqs := 0
+	for in := range readInput(files, 0, nil) {
+		select {
+		case <-mainQuit:
+			<-mainQuit
+			return
+		default:
+		}
+
+		if in.err != nil {
+			log.Fatal(in.err)
+		}
+		sig := kmerSignature(alpha, kmerSize, in.seq)
+		sh := shards[sig%uint64(n)]
+		sh.input <- in.seq
+		numSeqs++
+		verboseOutput(sh.db, numSeqs)
+	}
+	cablastp.Vprintln("\n")
+
+	cleanupShards(shards)
+	cablastp.Vprintf("Compressed %d sequences into %d shards.\n", numSeqs, n)
+}
+
+// cleanupShards waits for every shard to finish compressing, and saves the
+// shards concurrently.
+func cleanupShards(shards []*shard) {
+	stopProfiles()
+	for _, sh := range shards {
+		close(sh.input)
+	}
+	wg := &sync.WaitGroup{}
+	for _, sh := range shards {
+		<-sh.done
+		wg.Add(1)
+		go func(sh *shard) {
+			defer wg.Done()
+			sh.pool.done()
+			if err := sh.db.Save(); err != nil {
+				fatalf("Could not save shard '%s': %s\n", sh.db.Path, err)
+			}
+			sh.db.WriteClose()
+		}(sh)
+	}
+	wg.Wait()
+
+	duplicates := 0
+	for _, sh := range shards {
+		if sh.dups != nil {
+			duplicates += sh.dups.duplicates
+		}
+	}
+	if duplicates > 0 {
+		cablastp.Vprintf("Stored %d exact duplicates as aliases.\n",
+			duplicates)
+	}
+}
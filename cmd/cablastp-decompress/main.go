@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 
 	"github.com/TuftsBCB/io/fasta"
 
@@ -23,6 +27,14 @@ var (
 	flagQuiet      = false
 	flagCpuProfile = ""
 	flagMemProfile = ""
+	flagExact      = false
+	flagIds        = ""
+	flagName       = ""
+	flagMinLength  = 0
+	flagMaxLength  = 0
+	flagCoarse     = ""
+	flagFrom       = 0
+	flagTo         = 0
 )
 
 func init() {
@@ -36,6 +48,31 @@ func init() {
 		"When set, a CPU profile will be written to the file specified.")
 	flag.StringVar(&flagMemProfile, "memprofile", flagMemProfile,
 		"When set, a memory profile will be written to the file specified.")
+	flag.BoolVar(&flagExact, "exact", flagExact,
+		"When set, the input FASTA files of a lossless database are\n"+
+			"\treproduced byte for byte, in input order.")
+	flag.StringVar(&flagIds, "ids", flagIds,
+		"When set, only the sequences with these ids are decompressed.\n"+
+			"\tIds and id ranges are separated by commas, e.g., '0-9,15'.")
+	flag.StringVar(&flagName, "name", flagName,
+		"When set, only the sequences whose FASTA header matches this\n"+
+			"\tregular expression are decompressed.")
+	flag.IntVar(&flagMinLength, "min-length", flagMinLength,
+		"When set, sequences with fewer residues are skipped.")
+	flag.IntVar(&flagMaxLength, "max-length", flagMaxLength,
+		"When set, sequences with more residues are skipped.")
+	flag.StringVar(&flagCoarse, "coarse", flagCoarse,
+		"When set, only the sequences linked to these coarse sequence\n"+
+			"\tids are decompressed. Ids are given as in -ids.")
+	flag.IntVar(&flagFrom, "from", flagFrom,
+		"When set, only residues from this (0-based) position on are\n"+
+			"\twritten. Only the links that are needed are decompressed,\n"+
+			"\talong with the range coded links before them in the same\n"+
+			"\tblock of 16 links.")
+	flag.IntVar(&flagTo, "to", flagTo,
+		"When set, only residues before this (0-based, exclusive)\n"+
+			"\tposition are written. Only the links that are needed are\n"+
+			"\tdecompressed, as with -from.")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -44,7 +81,7 @@ func init() {
 }
 
 func main() {
-	if flag.NArg() < 2 {
+	if flag.NArg() < 1 || flag.NArg() > 2 {
 		flag.Usage()
 	}
 
@@ -53,13 +90,32 @@ func main() {
 		cablastp.Verbose = true
 	}
 
-	// Open the fasta file specified for writing.
-	outFasta, err := os.Create(flag.Arg(1))
-	if err != nil {
-		fatalf("Could not write to '%s': %s\n", flag.Arg(1), err)
+	var nameRegexp *regexp.Regexp
+	if len(flagName) > 0 {
+		var err error
+		if nameRegexp, err = regexp.Compile(flagName); err != nil {
+			fatalf("Invalid -name regular expression: %s\n", err)
+		}
+	}
+	filtered := len(flagIds) > 0 || nameRegexp != nil || flagMinLength > 0 ||
+		flagMaxLength > 0 || len(flagCoarse) > 0 || flagFrom > 0 || flagTo > 0
+	if flagExact && filtered {
+		fatalf("-exact cannot be used with -ids, -name, -min-length, " +
+			"-max-length, -coarse, -from or -to.\n")
+	}
+	if flagFrom < 0 || flagTo < 0 || (flagTo > 0 && flagTo < flagFrom) {
+		fatalf("Invalid residue range [%d, %d).\n", flagFrom, flagTo)
+	}
+
+	// Open the fasta file specified for writing. If there isn't one, or it
+	// is '-', the sequences are written to stdout.
+	outFasta := os.Stdout
+	if flag.NArg() == 2 && flag.Arg(1) != "-" {
+		var err error
+		if outFasta, err = os.Create(flag.Arg(1)); err != nil {
+			fatalf("Could not write to '%s': %s\n", flag.Arg(1), err)
+		}
 	}
-	fastaWriter := fasta.NewWriter(outFasta)
-	fastaWriter.Asterisk = true
 
 	// Create a new database for writing. If we're appending, we load
 	// the coarse database into memory, and setup the database for writing.
@@ -78,19 +134,78 @@ func main() {
 		pprof.StartCPUProfile(f)
 	}
 
-	numSeqs := db.ComDB.NumSequences()
-	for orgSeqId := 0; orgSeqId < numSeqs; orgSeqId++ {
-		oseq, err := db.ComDB.ReadSeq(db.CoarseDB, orgSeqId)
-		if err != nil {
-			fatalf("Error reading seq id '%d': %s\n", orgSeqId, err)
+	if flagExact {
+		if err := db.WriteExact(outFasta); err != nil {
+			fatalf("%s\n", err)
+		}
+		cleanup(db)
+		if err = outFasta.Close(); err != nil {
+			fatalf("%s\n", err)
+		}
+		return
+	}
+
+	ids, err := selectIds(db)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+
+	// Sequences are decompressed by flagGoMaxProcs workers, and written in
+	// the order of their ids.
+	jobs := make(chan job, flagGoMaxProcs*4)
+	results := make(chan result, flagGoMaxProcs*4)
+	go func() {
+		for i, id := range ids {
+			jobs <- job{i, id}
+		}
+		close(jobs)
+	}()
+	done := make(chan struct{})
+	for i := 0; i < flagGoMaxProcs; i++ {
+		go func() {
+			for j := range jobs {
+				entry, err := decompress(db, nameRegexp, j.orgSeqId)
+				results <- result{j.index, j.orgSeqId, entry, err}
+			}
+			done <- struct{}{}
+		}()
+	}
+	go func() {
+		for i := 0; i < flagGoMaxProcs; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	out := bufio.NewWriter(outFasta)
+	written, next := 0, 0
+	pending := make(map[int]result)
+	for r := range results {
+		if r.err != nil {
+			fatalf("Error reading seq id '%d': %s\n", r.orgSeqId, r.err)
 		}
-		if err := fastaWriter.Write(oseq.FastaSeq()); err != nil {
-			cablastp.Vprintf("Error writing seq '%s': %s\n", oseq.Name, err)
+		pending[r.index] = r
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if r.entry == nil {
+				continue
+			}
+			if _, err := out.Write(r.entry); err != nil {
+				fatalf("%s\n", err)
+			}
+			written++
 		}
 	}
+	cablastp.Vprintf("Wrote %d of %d sequences.\n",
+		written, db.ComDB.NumSequences())
 
 	cleanup(db)
-	if err = fastaWriter.Flush(); err != nil {
+	if err = out.Flush(); err != nil {
 		fatalf("%s\n", err)
 	}
 	if err = outFasta.Close(); err != nil {
@@ -98,6 +213,126 @@ func main() {
 	}
 }
 
+// job is a sequence to decompress. 'index' is its position in the output.
+type job struct {
+	index, orgSeqId int
+}
+
+// result is a decompressed sequence, as a FASTA entry. If the sequence was
+// filtered out, 'entry' is nil.
+type result struct {
+	index, orgSeqId int
+	entry           []byte
+	err             error
+}
+
+// selectIds returns the ids of the sequences to decompress, in increasing
+// order, as chosen by the -ids and -coarse flags.
+func selectIds(db *cablastp.DB) ([]int, error) {
+	numSeqs := db.ComDB.NumSequences()
+	ids := make([]int, numSeqs)
+	for i := range ids {
+		ids[i] = i
+	}
+	if len(flagIds) > 0 {
+		var err error
+		if ids, err = cablastp.ParseIdRanges(flagIds, numSeqs); err != nil {
+			return nil, err
+		}
+		sort.Ints(ids)
+	}
+	if len(flagCoarse) > 0 {
+		coarseIds, err := cablastp.ParseIdRanges(
+			flagCoarse, db.CoarseDB.NumSequences())
+		if err != nil {
+			return nil, err
+		}
+		linked := make(map[int]bool)
+		for _, coarseId := range coarseIds {
+			orgSeqIds, err := db.CoarseDB.LinkedSeqIds(db.ComDB, coarseId)
+			if err != nil {
+				return nil, err
+			}
+			for _, orgSeqId := range orgSeqIds {
+				linked[orgSeqId] = true
+			}
+		}
+		var inCoarse []int
+		for _, id := range ids {
+			if linked[id] {
+				inCoarse = append(inCoarse, id)
+			}
+		}
+		ids = inCoarse
+	}
+
+	// Drop duplicate ids from overlapping ranges.
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+// decompress decompresses the sequence with id 'orgSeqId' into a FASTA entry.
+// If the sequence is filtered out by the -name or length flags, nil is
+// returned.
+func decompress(
+	db *cablastp.DB, nameRegexp *regexp.Regexp, orgSeqId int) ([]byte, error) {
+
+	if flagMinLength > 0 || flagMaxLength > 0 {
+		length, err := db.ComDB.SeqLen(orgSeqId)
+		if err != nil {
+			return nil, err
+		}
+		if length < flagMinLength ||
+			(flagMaxLength > 0 && length > flagMaxLength) {
+			return nil, nil
+		}
+	}
+	if nameRegexp != nil {
+		name, err := db.ComDB.ReadName(orgSeqId)
+		if err != nil {
+			return nil, err
+		}
+		if !nameRegexp.MatchString(name) {
+			return nil, nil
+		}
+	}
+
+	var oseq cablastp.OriginalSeq
+	var err error
+	if flagFrom > 0 || flagTo > 0 {
+		to := flagTo
+		if to == 0 {
+			to = int(^uint(0) >> 1)
+		}
+		oseq, err = db.ComDB.ReadSeqRange(
+			db.CoarseDB, orgSeqId, flagFrom, to)
+	} else {
+		oseq, err = db.ComDB.ReadSeq(db.CoarseDB, orgSeqId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := oseq.LoadName(); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	fastaWriter := fasta.NewWriter(buf)
+	fastaWriter.Asterisk = true
+	if err := fastaWriter.Write(oseq.FastaSeq()); err != nil {
+		return nil, err
+	}
+	if err := fastaWriter.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func cleanup(db *cablastp.DB) {
 	if len(flagCpuProfile) > 0 {
 		pprof.StopCPUProfile()
@@ -126,7 +361,7 @@ func usage() {
 	fmt.Fprintf(os.Stderr,
 		"\nUsage: %s [flags] "+
 			"database-directory "+
-			"out-fasta-file\n",
+			"[out-fasta-file | -]\n",
 		path.Base(os.Args[0]))
 	cablastp.PrintFlagDefaults()
 	os.Exit(1)
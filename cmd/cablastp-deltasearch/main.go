@@ -36,6 +36,7 @@ var (
   flagMakeBlastDB = "makeblastdb"
   flagDeltaBlast  = "deltablast"
   flagBlastn      = "blastn"
+  flagBlastp      = "blastp"
   flagRPSPath     = ""
   flagGoMaxProcs  = runtime.NumCPU()
   flagQuiet       = false
@@ -60,6 +61,10 @@ func init() {
   flag.StringVar(&flagBlastn, "blastn",
     flagBlastn,
     "The location of the 'blastn' executable.")
+  flag.StringVar(&flagBlastp, "blastp",
+    flagBlastp,
+    "The location of the 'blastp' executable. It is used for the coarse\n"+
+      "\tsearch when the reduced alphabet has more than four classes.")
   flag.StringVar(&flagRPSPath, "rpspath",
     flagRPSPath,
     "The location of the 'rps' database.")
@@ -116,23 +121,22 @@ func main() {
     fatalf("Could not read input fasta query: %s\n", err)
   }
 
-  db, err := cablastp.NewReadDB(flag.Arg(0))
+  // Every shard of a sharded database is searched, with the size of the
+  // whole database.
+  shards, err := cablastp.NewReadShards(flag.Arg(0))
   if err != nil {
     fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
   }
+  dbSize := cablastp.ShardsBlastDBSize(shards)
   
-  reducedFasta, err := cablastp.ReduceQuerySeqs(inputFastaQuery)
+  reducedFasta, err := cablastp.ReduceQuerySeqs(
+    shards[0].Alphabet, inputFastaQuery)
   if err != nil {
     fatalf("Could not reduce alphabet of input query: %s\n", err)
   }
 
   cablastp.Vprintln("\nBlasting query on coarse database...")
-  if err := blastCoarse(db, reducedFasta, buf); err != nil {
-    fatalf("Error blasting coarse database: %s\n", err)
-  }
-
-  cablastp.Vprintln("Decompressing blast hits...")
-  expandedSequences, err := expandBlastHits(db, buf)
+  expandedSequences, err := searchCoarse(shards, reducedFasta, dbSize)
   if err != nil {
     fatalf("%s\n", err)
   }
@@ -146,7 +150,7 @@ func main() {
 
   // Create the fine blast db in a temporary directory
   cablastp.Vprintln("Building fine BLAST database...")
-  tmpDir, err := makeFineBlastDB(db, buf)
+  tmpDir, err := makeFineBlastDB(buf)
   if err != nil {
     fatalf("Could not create fine database to search on: %s\n", err)
   }
@@ -157,7 +161,7 @@ func main() {
   if _, err := inputFastaQuery.Seek(0, os.SEEK_SET); err != nil {
     fatalf("Could not seek to start of query fasta input: %s\n", err)
   }
-  if err := blastFine(db, tmpDir, inputFastaQuery); err != nil {
+  if err := blastFine(dbSize, tmpDir, inputFastaQuery); err != nil {
     fatalf("Error blasting fine database: %s\n", err)
   }
 
@@ -168,7 +172,7 @@ func main() {
     }
   }
 
-  cleanup(db)
+  cleanup(shards)
 }
 
 func s(i int) string {
@@ -180,7 +184,7 @@ func su(i uint64) string {
 }
 
 func blastFine(
-  db *cablastp.DB, blastFineDir string, stdin *bytes.Reader) error {
+  dbSize uint64, blastFineDir string, stdin *bytes.Reader) error {
 
   // We pass our own "-db" flag to blastp, but the rest come from user
   // defined flags.
@@ -188,7 +192,7 @@ func blastFine(
   flags := []string{
     "-db", path.Join(blastFineDir, cablastp.FileBlastFine),
     "-rpsdb", flagRPSPath,
-    "-dbsize", su(db.BlastDBSize),
+    "-dbsize", su(dbSize),
     "-num_threads", s(flagGoMaxProcs),
   }
   flags = append(flags, blastArgs...)
@@ -200,7 +204,7 @@ func blastFine(
   return cablastp.Exec(cmd)
 }
 
-func makeFineBlastDB(db *cablastp.DB, stdin *bytes.Buffer) (string, error) {
+func makeFineBlastDB(stdin *bytes.Buffer) (string, error) {
   tmpDir, err := ioutil.TempDir("", "cablastp-fine-search-db")
   if err != nil {
     return "", fmt.Errorf("Could not create temporary directory: %s\n", err)
@@ -220,8 +224,11 @@ func makeFineBlastDB(db *cablastp.DB, stdin *bytes.Buffer) (string, error) {
 
 func writeFasta(oseqs []cablastp.OriginalSeq, buf *bytes.Buffer) error {
   for _, oseq := range oseqs {
-    _, err := fmt.Fprintf(buf, "> %s\n%s\n",
-      oseq.Name, string(oseq.Residues))
+    name, err := oseq.LoadName()
+    if err != nil {
+      return fmt.Errorf("Could not read name of sequence %d: %s", oseq.Id, err)
+    }
+    _, err = fmt.Fprintf(buf, "> %s\n%s\n", name, string(oseq.Residues))
     if err != nil {
       return fmt.Errorf("Could not write to buffer: %s", err)
     }
@@ -229,6 +236,36 @@ func writeFasta(oseqs []cablastp.OriginalSeq, buf *bytes.Buffer) error {
   return nil
 }
 
+// searchCoarse blasts the reduced query against the coarse database of every
+// shard, and returns the original sequences that the hits of all shards
+// expand to.
+func searchCoarse(shards []*cablastp.DB, reducedFasta *bytes.Reader,
+  dbSize uint64) ([]cablastp.OriginalSeq, error) {
+
+  query, err := ioutil.ReadAll(reducedFasta)
+  if err != nil {
+    return nil, fmt.Errorf("Could not read reduced query: %s", err)
+  }
+  oseqs, err := cablastp.SearchShards(shards, flagGoMaxProcs,
+    func(db *cablastp.DB, _ int) ([]cablastp.OriginalSeq, error) {
+      buf := new(bytes.Buffer)
+      err := blastCoarse(db, bytes.NewReader(query), buf, dbSize)
+      if err != nil {
+        return nil, fmt.Errorf("Error blasting coarse database: %s", err)
+      }
+      return expandBlastHits(db, buf)
+    })
+  if err != nil {
+    return nil, err
+  }
+  if len(oseqs) == 0 {
+    return nil, fmt.Errorf("No hits from coarse search\n")
+  }
+  cablastp.Vprintf("Decompressed blast hits into %d sequences.\n",
+    len(oseqs))
+  return oseqs, nil
+}
+
 func expandBlastHits(
   db *cablastp.DB, blastOut *bytes.Buffer) ([]cablastp.OriginalSeq, error) {
 
@@ -263,19 +300,21 @@ func expandBlastHits(
       }
     }
   }
-  if len(oseqs) == 0 {
-    return nil, fmt.Errorf("No hits from coarse search\n")
-  }
   return oseqs, nil
 }
 
-func blastCoarse(
-  db *cablastp.DB, stdin *bytes.Reader, stdout *bytes.Buffer) error {
+func blastCoarse(db *cablastp.DB,
+  stdin *bytes.Reader, stdout *bytes.Buffer, dbSize uint64) error {
 
+  // Reduced alphabets with more than four classes are searched with blastp.
+  coarseBlast := flagBlastn
+  if !db.Alphabet.IsNucleotide() {
+    coarseBlast = flagBlastp
+  }
   cmd := exec.Command(
-    flagBlastn,
+    coarseBlast,
     "-db", path.Join(db.Path, cablastp.FileBlastCoarse),
-    "-outfmt", "5", "-dbsize", su(db.BlastDBSize))
+    "-outfmt", "5", "-dbsize", su(dbSize))
   cmd.Stdin = stdin
   cmd.Stdout = stdout
   return cablastp.Exec(cmd)
@@ -293,14 +332,14 @@ func getInputFasta() (*bytes.Reader, error) {
   return bytes.NewReader(bs), nil
 }
 
-func cleanup(db *cablastp.DB) {
+func cleanup(shards []*cablastp.DB) {
   if len(flagCpuProfile) > 0 {
     pprof.StopCPUProfile()
   }
   if len(flagMemProfile) > 0 {
     writeMemProfile(fmt.Sprintf("%s.last", flagMemProfile))
   }
-  db.ReadClose()
+  cablastp.ReadCloseShards(shards)
 }
 
 func fatalf(format string, v ...interface{}) {
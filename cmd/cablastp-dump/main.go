@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+var (
+	flagQuiet = false
+)
+
+func init() {
+	log.SetFlags(0)
+
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	db, err := cablastp.NewReadDB(flag.Arg(0))
+	if err != nil {
+		fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
+	}
+	defer db.ReadClose()
+
+	if err := db.DumpPlain(flag.Arg(1)); err != nil {
+		fatalf("Could not dump '%s' database: %s\n", flag.Arg(0), err)
+	}
+	cablastp.Vprintf("Done dumping %s to %s.\n", flag.Arg(0), flag.Arg(1))
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"database-directory "+
+			"dump-directory\n\n"+
+			"Every component of the database is written to a new directory\n"+
+			"as plain text. (cablastp-load creates a database from it.)\n",
+		path.Base(os.Args[0]))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
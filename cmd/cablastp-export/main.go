@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+// The formats that a database can be exported to.
+const (
+	formatFasta    = "fasta"
+	formatClusters = "clusters"
+	formatMCL      = "mcl"
+	formatLinks    = "links"
+	formatJSON     = "jsonl"
+	formatBlastDB  = "blastdb"
+)
+
+var formats = []string{
+	formatFasta, formatClusters, formatMCL, formatLinks, formatJSON,
+	formatBlastDB,
+}
+
+var (
+	flagNames       = false
+	flagDBType      = "prot"
+	flagMakeBlastDB = ""
+	flagQuiet       = false
+)
+
+func init() {
+	log.SetFlags(0)
+
+	flag.BoolVar(&flagNames, "names", flagNames,
+		"When set, original sequences are labeled by the first word of\n"+
+			"\ttheir FASTA header instead of their id in the 'clusters' and\n"+
+			"\t'mcl' formats.")
+	flag.StringVar(&flagDBType, "dbtype", flagDBType,
+		"The type of BLAST database ('prot' or 'nucl') to create in the\n"+
+			"\t'blastdb' format.")
+	flag.StringVar(&flagMakeBlastDB, "makeblastdb", flagMakeBlastDB,
+		"The location of the 'makeblastdb' executable. By default, the\n"+
+			"\tone the database was created with is used.")
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 2 || flag.NArg() > 3 {
+		flag.Usage()
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	format := flag.Arg(1)
+	known := false
+	for _, f := range formats {
+		known = known || f == format
+	}
+	if !known {
+		fatalf("Unknown format '%s'. Available formats: %s.\n",
+			format, strings.Join(formats, ", "))
+	}
+
+	db, err := cablastp.NewReadDB(flag.Arg(0))
+	if err != nil {
+		fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
+	}
+	defer db.ReadClose()
+
+	// A BLAST database is written by makeblastdb, so it needs somewhere to
+	// go that isn't stdout.
+	if format == formatBlastDB {
+		if flag.NArg() < 3 || flag.Arg(2) == "-" {
+			fatalf("The '%s' format needs the path of the BLAST database "+
+				"to create.\n", formatBlastDB)
+		}
+		if err := exportBlastDB(db, flag.Arg(2)); err != nil {
+			fatalf("%s\n", err)
+		}
+		return
+	}
+
+	outFile := os.Stdout
+	if flag.NArg() == 3 && flag.Arg(2) != "-" {
+		if outFile, err = os.Create(flag.Arg(2)); err != nil {
+			fatalf("Could not write to '%s': %s\n", flag.Arg(2), err)
+		}
+	}
+	out := bufio.NewWriter(outFile)
+
+	switch format {
+	case formatFasta:
+		err = db.ExportFasta(out)
+	case formatClusters, formatMCL:
+		err = db.ExportClusters(out, format == formatMCL, flagNames)
+	case formatLinks:
+		err = db.ExportLinks(out)
+	case formatJSON:
+		err = db.ExportJSON(out)
+	}
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	if err = out.Flush(); err != nil {
+		fatalf("%s\n", err)
+	}
+	if err = outFile.Close(); err != nil {
+		fatalf("%s\n", err)
+	}
+}
+
+// exportBlastDB creates an uncompressed BLAST database of every original
+// sequence at 'out', by streaming them to makeblastdb as FASTA.
+func exportBlastDB(db *cablastp.DB, out string) error {
+	makeblastdb := flagMakeBlastDB
+	if len(makeblastdb) == 0 {
+		makeblastdb = db.BlastMakeBlastDB
+	}
+	cmd := exec.Command(
+		makeblastdb, "-dbtype", flagDBType,
+		"-in", "-", "-title", path.Base(out), "-out", out)
+
+	fastaPipe, w := io.Pipe()
+	cmd.Stdin = fastaPipe
+	go func() {
+		bw := bufio.NewWriter(w)
+		err := db.ExportFasta(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		w.CloseWithError(err)
+	}()
+
+	cablastp.Vprintf("Creating %s...\n", out)
+	err := cablastp.Exec(cmd)
+
+	// Stop streaming if makeblastdb quit before reading everything.
+	fastaPipe.Close()
+	if err != nil {
+		return err
+	}
+	cablastp.Vprintf("Done creating %s.\n", out)
+	return nil
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"database-directory "+
+			"format "+
+			"[out-file | -]\n\n"+
+			"Available formats: %s\n",
+		path.Base(os.Args[0]), strings.Join(formats, ", "))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/TuftsBCB/io/fasta"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+var (
+	flagEntry      = ""
+	flagEntryBatch = ""
+	flagRange      = ""
+	flagOut        = ""
+	flagQuiet      = false
+)
+
+func init() {
+	log.SetFlags(0)
+
+	flag.StringVar(&flagEntry, "entry", flagEntry,
+		"A comma separated list of names or accessions to retrieve, or\n"+
+			"\t'all' to retrieve every original sequence.")
+	flag.StringVar(&flagEntryBatch, "entry_batch", flagEntryBatch,
+		"A file of names or accessions to retrieve, one per line.")
+	flag.StringVar(&flagRange, "range", flagRange,
+		"A comma separated list of original sequence ids or id ranges\n"+
+			"\tto retrieve, e.g., '0-9,15'. (Ranges include both ends.)")
+	flag.StringVar(&flagOut, "out", flagOut,
+		"When set, sequences are written to the file specified instead\n"+
+			"\tof stdout.")
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	db, err := cablastp.NewReadDB(flag.Arg(0))
+	if err != nil {
+		fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
+	}
+	defer db.ReadClose()
+
+	var entries []string
+	if len(flagEntry) > 0 {
+		entries = append(entries, strings.Split(flagEntry, ",")...)
+	}
+	if len(flagEntryBatch) > 0 {
+		batch, err := readEntryBatch(flagEntryBatch)
+		if err != nil {
+			fatalf("Could not read '%s': %s\n", flagEntryBatch, err)
+		}
+		entries = append(entries, batch...)
+	}
+	entries = append(entries, flag.Args()[1:]...)
+	if len(entries) == 0 && len(flagRange) == 0 {
+		fatalf("Nothing to retrieve. Use 'entry', 'entry_batch' or " +
+			"'range'.\n")
+	}
+
+	ids, notFound, err := entryIds(db, entries)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	if len(flagRange) > 0 {
+		rangeIds, err := cablastp.ParseIdRanges(
+			flagRange, db.ComDB.NumSequences())
+		if err != nil {
+			fatalf("%s\n", err)
+		}
+		ids = append(ids, rangeIds...)
+	}
+
+	var out io.Writer = os.Stdout
+	if len(flagOut) > 0 {
+		f, err := os.Create(flagOut)
+		if err != nil {
+			fatalf("Could not write to '%s': %s\n", flagOut, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	fastaWriter := fasta.NewWriter(out)
+	for _, id := range ids {
+		oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+		if err != nil {
+			fatalf("Error reading seq id '%d': %s\n", id, err)
+		}
+		if _, err := oseq.LoadName(); err != nil {
+			fatalf("Error reading name of seq id '%d': %s\n", id, err)
+		}
+		if err := fastaWriter.Write(oseq.FastaSeq()); err != nil {
+			fatalf("Error writing seq '%s': %s\n", oseq.Name, err)
+		}
+	}
+	if err := fastaWriter.Flush(); err != nil {
+		fatalf("%s\n", err)
+	}
+
+	for _, entry := range notFound {
+		fmt.Fprintf(os.Stderr, "Entry not found: %s\n", entry)
+	}
+	if len(notFound) > 0 {
+		db.ReadClose()
+		os.Exit(1)
+	}
+}
+
+// entryIds looks up the ids of the original sequences with the given names,
+// in the order given. Names that aren't found are returned separately.
+func entryIds(db *cablastp.DB, entries []string) ([]int, []string, error) {
+	var ids []int
+	var notFound []string
+	var names *cablastp.NameIndex
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "all" {
+			for id := 0; id < db.ComDB.NumSequences(); id++ {
+				ids = append(ids, id)
+			}
+			continue
+		}
+		if names == nil {
+			var err error
+			if names, err = cablastp.OpenNameIndex(db); err != nil {
+				return nil, nil, err
+			}
+			if names == nil {
+				return nil, nil, fmt.Errorf("The database has no name " +
+					"table, so sequences can only be retrieved by id.")
+			}
+			defer names.Close()
+		}
+		found, err := names.Lookup(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(found) == 0 {
+			notFound = append(notFound, entry)
+		}
+		ids = append(ids, found...)
+	}
+	return ids, notFound, nil
+}
+
+// readEntryBatch reads every name in a file with a name on each line. Blank
+// lines and lines starting with '#' are skipped.
+func readEntryBatch(fileName string) ([]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"database-directory "+
+			"[entry ...]\n",
+		path.Base(os.Args[0]))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
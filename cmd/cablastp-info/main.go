@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+var (
+	flagJSON  = false
+	flagQuick = false
+	flagQuiet = false
+)
+
+// dataFiles are the files of a database that its sequences are restored
+// from. The true compression ratio is their size over the size of the
+// original sequences. (The seeds table, the name table and the BLAST database
+// are only needed to search.)
+var dataFiles = []string{
+	cablastp.FileCompressed, cablastp.FileIndex, cablastp.FileAliases,
+	cablastp.FileHeaders, cablastp.FileHeadersIndex,
+	cablastp.FileCoarsePacked, cablastp.FileCoarsePackedIndex,
+	cablastp.FileCoarseFasta, cablastp.FileCoarseFastaIndex,
+	cablastp.FileCoarseLinks, cablastp.FileCoarseLinksIndex,
+	cablastp.FileInputOrder,
+	cablastp.FileExceptions, cablastp.FileExceptionsIndex,
+}
+
+func init() {
+	log.SetFlags(0)
+
+	flag.BoolVar(&flagJSON, "json", flagJSON,
+		"When set, the report is written as JSON.")
+	flag.BoolVar(&flagQuick, "quick", flagQuick,
+		"When set, only the statistics stored when the database was saved\n"+
+			"\tare reported, and the database isn't read. (Distributions\n"+
+			"\tand the residues of aliases aren't reported.)")
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+// report is everything cablastp-info reports about a database.
+type report struct {
+	Path  string
+	Stats cablastp.DBStats
+
+	// The residues of aliases are only known if the database was read.
+	AliasResidues *int64 `json:",omitempty"`
+
+	// The original size is the number of residues in every original
+	// sequence, including aliases if their residues are known, plus the
+	// bytes of their headers.
+	OriginalSize int64
+
+	// The residue ratio is the number of coarse residues over the number of
+	// original residues. The true ratio is the size of the data files over
+	// the original size.
+	DataSize     int64
+	ResidueRatio float64
+	TrueRatio    float64
+	NovelPercent float64
+
+	LinksPerCoarse   *cablastp.Distribution `json:",omitempty"`
+	FragmentLengths  *cablastp.Distribution `json:",omitempty"`
+	LinksPerOriginal *cablastp.Distribution `json:",omitempty"`
+
+	Files map[string]int64
+	Conf  *cablastp.DBConf
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	db, err := cablastp.NewReadDB(flag.Arg(0))
+	if err != nil {
+		fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
+	}
+	defer db.ReadClose()
+
+	r := report{Path: db.Path, Conf: db.DBConf}
+	if r.Files, err = db.FileSizes(); err != nil {
+		fatalf("%s\n", err)
+	}
+
+	residues := int64(0)
+	if flagQuick {
+		if db.Stats == nil {
+			fatalf("The database '%s' has no stored statistics. Run "+
+				"without -quick to compute them.\n", flag.Arg(0))
+		}
+		r.Stats = *db.Stats
+		residues = r.Stats.OriginalResidues
+	} else {
+		scan, err := db.Scan()
+		if err != nil {
+			fatalf("Could not read '%s' database: %s\n", flag.Arg(0), err)
+		}
+		r.Stats = scan.DBStats
+		r.AliasResidues = &scan.AliasResidues
+		residues = r.Stats.OriginalResidues + scan.AliasResidues
+
+		linksPerCoarse := scan.LinksPerCoarse.Distribution()
+		fragmentLengths := scan.FragmentLengths.Distribution()
+		linksPerOriginal := scan.LinksPerOriginal.Distribution()
+		r.LinksPerCoarse = &linksPerCoarse
+		r.FragmentLengths = &fragmentLengths
+		r.LinksPerOriginal = &linksPerOriginal
+	}
+
+	for _, name := range dataFiles {
+		r.DataSize += r.Files[name]
+	}
+	r.OriginalSize = residues + r.Stats.HeaderBytes
+	r.ResidueRatio = ratio(r.Stats.CoarseResidues, residues)
+	r.TrueRatio = ratio(r.DataSize, r.OriginalSize)
+	r.NovelPercent = 100 * ratio(r.Stats.NovelSeqs,
+		r.Stats.OriginalSeqs-r.Stats.AliasSeqs)
+
+	if flagJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fatalf("%s\n", err)
+		}
+		return
+	}
+	if err := writeText(r); err != nil {
+		fatalf("%s\n", err)
+	}
+}
+
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// writeText writes the report in a human readable form.
+func writeText(r report) error {
+	s := r.Stats
+	fmt.Printf("Database: %s\n\n", r.Path)
+	fmt.Printf("Original sequences:  %d\n", s.OriginalSeqs)
+	fmt.Printf("  aliases:           %d\n", s.AliasSeqs)
+	fmt.Printf("  novel:             %d (%.2f%% of non-aliases)\n",
+		s.NovelSeqs, r.NovelPercent)
+	fmt.Printf("Original residues:   %d (excluding aliases)\n",
+		s.OriginalResidues)
+	if r.AliasResidues != nil {
+		fmt.Printf("  in aliases:        %d\n", *r.AliasResidues)
+	}
+	fmt.Printf("Header bytes:        %d\n", s.HeaderBytes)
+	fmt.Printf("Coarse sequences:    %d\n", s.CoarseSeqs)
+	fmt.Printf("Coarse residues:     %d\n", s.CoarseResidues)
+	fmt.Printf("Fragments:           %d\n", s.Fragments)
+	fmt.Printf("Coarse links:        %d\n\n", s.CoarseLinks)
+
+	fmt.Printf("Residue ratio:       %.2f%%\n", 100*r.ResidueRatio)
+	fmt.Printf("True ratio:          %.2f%% (%d data bytes / "+
+		"%d original bytes)\n\n", 100*r.TrueRatio, r.DataSize, r.OriginalSize)
+
+	if r.LinksPerCoarse != nil {
+		fmt.Printf("Links per coarse sequence:\n  %s\n", r.LinksPerCoarse)
+		fmt.Printf("Fragment lengths:\n  %s\n", r.FragmentLengths)
+		fmt.Printf("Links per original sequence:\n  %s\n\n",
+			r.LinksPerOriginal)
+	}
+
+	names := make([]string, 0, len(r.Files))
+	for name := range r.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Files:\n")
+	for _, name := range names {
+		fmt.Printf("  %-32s %d\n", name, r.Files[name])
+	}
+
+	fmt.Printf("\nConfiguration:\n")
+	var conf strings.Builder
+	if err := r.Conf.Write(&conf); err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(conf.String()), "\n")
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+	return nil
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"database-directory\n",
+		path.Base(os.Args[0]))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+var (
+	flagOriginal = ""
+	flagId       = -1
+	flagCoarse   = -1
+	flagCheck    = false
+	flagWidth    = 60
+	flagQuiet    = false
+)
+
+func init() {
+	log.SetFlags(0)
+
+	flag.StringVar(&flagOriginal, "original", flagOriginal,
+		"The name of an original sequence to show the links of. If it\n"+
+			"\tmatches several sequences, all of them are shown. Names are\n"+
+			"\tlooked up in the name table, even if they are numbers.")
+	flag.IntVar(&flagId, "id", flagId,
+		"The id of an original sequence to show the links of.")
+	flag.IntVar(&flagCoarse, "coarse", flagCoarse,
+		"The id of a coarse sequence to show, with every original\n"+
+			"\tsequence that links to it.")
+	flag.BoolVar(&flagCheck, "check", flagCheck,
+		"When set, the links from original sequences to coarse sequences\n"+
+			"\tare checked against the links back. Every problem found is\n"+
+			"\tprinted, and the exit status is 1 if there are any.")
+	flag.IntVar(&flagWidth, "width", flagWidth,
+		"The number of residues on each line of output.")
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if len(flagOriginal) == 0 && flagId < 0 && flagCoarse < 0 && !flagCheck {
+		fatalf("Nothing to inspect. Use 'original', 'id', 'coarse' or " +
+			"'check'.\n")
+	}
+	if flagWidth < 1 {
+		fatalf("The width must be at least 1.\n")
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	db, err := cablastp.NewReadDB(flag.Arg(0))
+	if err != nil {
+		fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
+	}
+	defer db.ReadClose()
+
+	if len(flagOriginal) > 0 {
+		ids, err := originalIds(db, flagOriginal)
+		if err != nil {
+			fatalf("%s\n", err)
+		}
+		for _, id := range ids {
+			if err := showOriginal(db, id); err != nil {
+				fatalf("%s\n", err)
+			}
+		}
+	}
+	if flagId >= 0 {
+		if numSeqs := db.ComDB.NumSequences(); flagId >= numSeqs {
+			fatalf("Original sequence id %d is not in [0, %d).\n",
+				flagId, numSeqs)
+		}
+		if err := showOriginal(db, flagId); err != nil {
+			fatalf("%s\n", err)
+		}
+	}
+	if flagCoarse >= 0 {
+		if err := showCoarse(db, flagCoarse); err != nil {
+			fatalf("%s\n", err)
+		}
+	}
+	if flagCheck {
+		cablastp.Vprintln("Checking links...")
+		problems, err := db.CheckLinks()
+		if err != nil {
+			fatalf("%s\n", err)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			db.ReadClose()
+			os.Exit(1)
+		}
+		cablastp.Vprintln("Every link has a link back.")
+	}
+}
+
+// originalIds returns the ids of the original sequences with the name
+// 'entry' in the name table.
+func originalIds(db *cablastp.DB, entry string) ([]int, error) {
+	names, err := cablastp.OpenNameIndex(db)
+	if err != nil {
+		return nil, err
+	}
+	if names == nil {
+		return nil, fmt.Errorf("The database has no name table, so " +
+			"sequences can only be inspected with 'id'.")
+	}
+	defer names.Close()
+
+	ids, err := names.Lookup(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("Entry not found: %s", entry)
+	}
+	return ids, nil
+}
+
+// showOriginal prints every link of an original sequence, with the part of
+// the coarse sequence it links to aligned to its residues.
+func showOriginal(db *cablastp.DB, id int) error {
+	cseq, err := db.ComDB.ReadCompressedSeq(id)
+	if err != nil {
+		return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+	}
+	if _, err := cseq.LoadName(); err != nil {
+		return fmt.Errorf("Error reading name of seq id '%d': %s", id, err)
+	}
+	fmt.Printf("Original sequence %d: %s\n", id, cseq.Name)
+	if cseq.IsAlias() {
+		fmt.Printf("  alias of original sequence %d\n\n", cseq.AliasOf)
+		return nil
+	}
+
+	length, err := cseq.Len()
+	if err != nil {
+		return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+	}
+	alns, err := db.AlignLinks(cseq)
+	if err != nil {
+		return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+	}
+	fmt.Printf("  %d residues in %d links\n\n", length, len(alns))
+	for i, aln := range alns {
+		fmt.Printf("  link %d: coarse sequence %d [%d, %d), "+
+			"original [%d, %d)\n", i, aln.Link.CoarseSeqId,
+			aln.Link.CoarseStart, aln.Link.CoarseEnd,
+			aln.OrigStart, aln.OrigEnd)
+		for start := 0; start < len(aln.Coarse); start += flagWidth {
+			end := start + flagWidth
+			if end > len(aln.Coarse) {
+				end = len(aln.Coarse)
+			}
+			fmt.Printf("    coarse    %s\n", aln.Coarse[start:end])
+			fmt.Printf("    reduced   %s\n", aln.Reduced[start:end])
+			fmt.Printf("    original  %s\n\n", aln.Original[start:end])
+		}
+		if len(aln.Coarse) == 0 {
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+// showCoarse prints the residues of a coarse sequence, and every link from it
+// to an original sequence.
+func showCoarse(db *cablastp.DB, id int) error {
+	if id >= db.CoarseDB.NumSequences() {
+		return fmt.Errorf("Coarse sequence id %d is not in [0, %d).",
+			id, db.CoarseDB.NumSequences())
+	}
+	seq, err := db.CoarseDB.ReadCoarseSeq(id)
+	if err != nil {
+		return fmt.Errorf("Error reading coarse seq id '%d': %s", id, err)
+	}
+	links, err := db.CoarseDB.ReadLinks(id)
+	if err != nil {
+		return fmt.Errorf("Could not read links of coarse sequence %d: %s",
+			id, err)
+	}
+
+	fmt.Printf("Coarse sequence %d: %d residues, %d links\n",
+		id, len(seq.Residues), len(links))
+	for start := 0; start < len(seq.Residues); start += flagWidth {
+		end := start + flagWidth
+		if end > len(seq.Residues) {
+			end = len(seq.Residues)
+		}
+		fmt.Printf("  %6d  %s\n", start, seq.Residues[start:end])
+	}
+	fmt.Println()
+
+	for _, lk := range links {
+		orgId := int(lk.OrgSeqId)
+		cseq, err := db.ComDB.ReadCompressedSeq(orgId)
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", orgId, err)
+		}
+		name, err := cseq.LoadName()
+		if err != nil {
+			return fmt.Errorf("Error reading name of seq id '%d': %s",
+				orgId, err)
+		}
+		fmt.Printf("  %s, original range: %s\n    %s\n",
+			lk, originalRange(cseq, id, lk), name)
+	}
+	return nil
+}
+
+// originalRange describes the range of an original sequence that a link from
+// the coarse sequence 'coarseId' covers, by finding the matching link of the
+// original sequence.
+func originalRange(
+	cseq cablastp.CompressedSeq, coarseId int,
+	lk *cablastp.LinkToCompressed) string {
+
+	ranges, err := cseq.OriginalRanges()
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", err)
+	}
+	for i, back := range cseq.Links {
+		if int(back.CoarseSeqId) == coarseId &&
+			back.CoarseStart == lk.CoarseStart &&
+			back.CoarseEnd == lk.CoarseEnd {
+			return fmt.Sprintf("(%d, %d)", ranges[i][0], ranges[i][1])
+		}
+	}
+	return "none (the original sequence has no link back)"
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"database-directory\n",
+		path.Base(os.Args[0]))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+var (
+	flagMakeBlastDB = ""
+	flagQuiet       = false
+)
+
+func init() {
+	log.SetFlags(0)
+
+	flag.StringVar(&flagMakeBlastDB, "makeblastdb", flagMakeBlastDB,
+		"The location of the 'makeblastdb' executable. By default, the\n"+
+			"\tone in the dumped configuration is used.")
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	conf, err := cablastp.LoadPlainConf(flag.Arg(0))
+	if err != nil {
+		fatalf("Could not read the configuration of '%s': %s\n",
+			flag.Arg(0), err)
+	}
+	if len(flagMakeBlastDB) > 0 {
+		conf.BlastMakeBlastDB = flagMakeBlastDB
+	}
+
+	db, err := cablastp.NewWriteDB(conf, flag.Arg(1))
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	if err := db.LoadPlain(flag.Arg(0)); err != nil {
+		// Don't leave a partial database behind.
+		db.WriteClose()
+		os.RemoveAll(flag.Arg(1))
+		fatalf("Could not load '%s': %s\n", flag.Arg(0), err)
+	}
+	if err := db.Save(); err != nil {
+		fatalf("Could not save database: %s\n", err)
+	}
+	db.WriteClose()
+	cablastp.Vprintf("Done loading %s into %s.\n", flag.Arg(0), flag.Arg(1))
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"dump-directory "+
+			"database-directory\n\n"+
+			"A new database is created from a plain text dump written by\n"+
+			"cablastp-dump.\n",
+		path.Base(os.Args[0]))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ndaniels/cablastp2"
+)
+
+var (
+	flagMakeBlastDB = ""
+	flagRecompress  = false
+	flagQuiet       = false
+)
+
+func init() {
+	log.SetFlags(0)
+
+	flag.StringVar(&flagMakeBlastDB, "makeblastdb", flagMakeBlastDB,
+		"The location of the 'makeblastdb' executable. By default, the\n"+
+			"\tone in the configuration of the first database is used.")
+	flag.BoolVar(&flagRecompress, "recompress", flagRecompress,
+		"When set, the coarse sequences of every database after the first\n"+
+			"\tare re-compressed against the coarse sequences of the first.\n"+
+			"\tThose that align from end to end are dropped, and their links\n"+
+			"\tare moved to the first database.")
+	flag.BoolVar(&flagQuiet, "quiet", flagQuiet,
+		"When set, the only outputs will be errors echoed to stderr.")
+
+	flag.Usage = usage
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+	}
+
+	// If the quiet flag isn't set, enable verbose output.
+	if !flagQuiet {
+		cablastp.Verbose = true
+	}
+
+	outDir, inDirs := flag.Arg(0), flag.Args()[1:]
+	inputs := make([]*cablastp.DB, len(inDirs))
+	for i, dir := range inDirs {
+		db, err := cablastp.NewReadDB(dir)
+		if err != nil {
+			fatalf("Could not open '%s' database: %s\n", dir, err)
+		}
+		defer db.ReadClose()
+		if i > 0 {
+			err := cablastp.CheckMerge(inputs[0].DBConf, db.DBConf)
+			if err != nil {
+				fatalf("Could not merge '%s' into '%s': %s\n",
+					dir, inDirs[0], err)
+			}
+		}
+		inputs[i] = db
+	}
+
+	// The merged database is configured like the first database.
+	conf := *inputs[0].DBConf
+	conf.BlastDBSize = 0
+	if len(flagMakeBlastDB) > 0 {
+		conf.BlastMakeBlastDB = flagMakeBlastDB
+	}
+
+	db, err := cablastp.NewWriteDB(&conf, outDir)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	merger, err := cablastp.NewMerger(db, flagRecompress)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+	for i, input := range inputs {
+		cablastp.Vprintf("Merging %s...\n", inDirs[i])
+		if err := merger.Add(input); err != nil {
+			// Don't leave a partial database behind.
+			merger.Close()
+			db.WriteClose()
+			os.RemoveAll(outDir)
+			fatalf("Could not merge '%s': %s\n", inDirs[i], err)
+		}
+	}
+	if err := merger.Close(); err != nil {
+		fatalf("%s\n", err)
+	}
+	if err := db.Save(); err != nil {
+		fatalf("Could not save database: %s\n", err)
+	}
+	db.WriteClose()
+	if flagRecompress {
+		cablastp.Vprintf("%d coarse sequences were re-compressed.\n",
+			merger.Recompressed)
+	}
+	cablastp.Vprintf("Done merging %d databases into %s.\n",
+		len(inputs), outDir)
+}
+
+func fatalf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, v...)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr,
+		"\nUsage: %s [flags] "+
+			"output-database-directory "+
+			"database-directory [database-directory ...]\n\n"+
+			"A new database is created with every sequence of the given\n"+
+			"databases, in order. Original and coarse sequence ids of each\n"+
+			"database follow those of the databases before it.\n",
+		path.Base(os.Args[0]))
+	cablastp.PrintFlagDefaults()
+	os.Exit(1)
+}
@@ -113,23 +113,22 @@ func main() {
     fatalf("Could not read input fasta query: %s\n", err)
   }
 
-  db, err := cablastp.NewReadDB(flag.Arg(0))
+  // Every shard of a sharded database is searched, with the size of the
+  // whole database.
+  shards, err := cablastp.NewReadShards(flag.Arg(0))
   if err != nil {
     fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
   }
+  dbSize := cablastp.ShardsBlastDBSize(shards)
   
-  reducedFasta, err := cablastp.ReduceQuerySeqs(inputFastaQuery)
+  reducedFasta, err := cablastp.ReduceQuerySeqs(
+    shards[0].Alphabet, inputFastaQuery)
   if err != nil {
     fatalf("Could not reduce alphabet of input query: %s\n", err)
   }
 
   cablastp.Vprintln("\nBlasting query on coarse database...")
-  if err := blastCoarse(db, reducedFasta, buf); err != nil {
-    fatalf("Error blasting coarse database: %s\n", err)
-  }
-
-  cablastp.Vprintln("Decompressing blast hits...")
-  expandedSequences, err := expandBlastHits(db, buf)
+  expandedSequences, err := searchCoarse(shards, reducedFasta, dbSize)
   if err != nil {
     fatalf("%s\n", err)
   }
@@ -143,7 +142,7 @@ func main() {
 
   // Create the fine blast db in a temporary directory
   cablastp.Vprintln("Building fine BLAST database...")
-  tmpDir, err := makeFineBlastDB(db, buf)
+  tmpDir, err := makeFineBlastDB(buf)
   if err != nil {
     fatalf("Could not create fine database to search on: %s\n", err)
   }
@@ -154,7 +153,7 @@ func main() {
   if _, err := inputFastaQuery.Seek(0, os.SEEK_SET); err != nil {
     fatalf("Could not seek to start of query fasta input: %s\n", err)
   }
-  if err := blastFine(db, tmpDir, inputFastaQuery); err != nil {
+  if err := blastFine(dbSize, tmpDir, inputFastaQuery); err != nil {
     fatalf("Error blasting fine database: %s\n", err)
   }
 
@@ -165,7 +164,7 @@ func main() {
     }
   }
 
-  cleanup(db)
+  cleanup(shards)
 }
 
 func s(i int) string {
@@ -177,13 +176,13 @@ func su(i uint64) string {
 }
 
 func blastFine(
-  db *cablastp.DB, blastFineDir string, stdin *bytes.Reader) error {
+  dbSize uint64, blastFineDir string, stdin *bytes.Reader) error {
 
   // We pass our own "-db" flag to blastp, but the rest come from user
   // defined flags.
   flags := []string{
     "-db", path.Join(blastFineDir, cablastp.FileBlastFine),
-    "-dbsize", su(db.BlastDBSize),
+    "-dbsize", su(dbSize),
     "-num_threads", s(flagGoMaxProcs),
   }
   flags = append(flags, blastArgs...)
@@ -195,7 +194,7 @@ func blastFine(
   return cablastp.Exec(cmd)
 }
 
-func makeFineBlastDB(db *cablastp.DB, stdin *bytes.Buffer) (string, error) {
+func makeFineBlastDB(stdin *bytes.Buffer) (string, error) {
   tmpDir, err := ioutil.TempDir("", "cablastp-fine-search-db")
   if err != nil {
     return "", fmt.Errorf("Could not create temporary directory: %s\n", err)
@@ -215,8 +214,11 @@ func makeFineBlastDB(db *cablastp.DB, stdin *bytes.Buffer) (string, error) {
 
 func writeFasta(oseqs []cablastp.OriginalSeq, buf *bytes.Buffer) error {
   for _, oseq := range oseqs {
-    _, err := fmt.Fprintf(buf, "> %s\n%s\n",
-      oseq.Name, string(oseq.Residues))
+    name, err := oseq.LoadName()
+    if err != nil {
+      return fmt.Errorf("Could not read name of sequence %d: %s", oseq.Id, err)
+    }
+    _, err = fmt.Fprintf(buf, "> %s\n%s\n", name, string(oseq.Residues))
     if err != nil {
       return fmt.Errorf("Could not write to buffer: %s", err)
     }
@@ -224,6 +226,37 @@ func writeFasta(oseqs []cablastp.OriginalSeq, buf *bytes.Buffer) error {
   return nil
 }
 
+// searchCoarse blasts the reduced query against the coarse database of every
+// shard, and returns the original sequences that the hits of all shards
+// expand to.
+func searchCoarse(shards []*cablastp.DB, reducedFasta *bytes.Reader,
+  dbSize uint64) ([]cablastp.OriginalSeq, error) {
+
+  query, err := ioutil.ReadAll(reducedFasta)
+  if err != nil {
+    return nil, fmt.Errorf("Could not read reduced query: %s", err)
+  }
+  oseqs, err := cablastp.SearchShards(shards, flagGoMaxProcs,
+    func(db *cablastp.DB, threads int) ([]cablastp.OriginalSeq, error) {
+      buf := new(bytes.Buffer)
+      err := blastCoarse(db, bytes.NewReader(query), buf,
+        dbSize, threads)
+      if err != nil {
+        return nil, fmt.Errorf("Error blasting coarse database: %s", err)
+      }
+      return expandBlastHits(db, buf)
+    })
+  if err != nil {
+    return nil, err
+  }
+  if len(oseqs) == 0 {
+    return nil, fmt.Errorf("No hits from coarse search\n")
+  }
+  cablastp.Vprintf("Decompressed blast hits into %d sequences.\n",
+    len(oseqs))
+  return oseqs, nil
+}
+
 func expandBlastHits(
   db *cablastp.DB, blastOut *bytes.Buffer) ([]cablastp.OriginalSeq, error) {
 
@@ -258,20 +291,22 @@ func expandBlastHits(
       }
     }
   }
-  if len(oseqs) == 0 {
-    return nil, fmt.Errorf("No hits from coarse search\n")
-  }
   return oseqs, nil
 }
 
-func blastCoarse(
-  db *cablastp.DB, stdin *bytes.Reader, stdout *bytes.Buffer) error {
+func blastCoarse(db *cablastp.DB, stdin *bytes.Reader, stdout *bytes.Buffer,
+  dbSize uint64, threads int) error {
 
+  // Reduced alphabets with more than four classes are searched with blastp.
+  coarseBlast := flagBlastn
+  if !db.Alphabet.IsNucleotide() {
+    coarseBlast = flagBlastp
+  }
   cmd := exec.Command(
-    flagBlastn,
+    coarseBlast,
     "-db", path.Join(db.Path, cablastp.FileBlastCoarse),
-    "-num_threads", s(flagGoMaxProcs),
-    "-outfmt", "5", "-dbsize", su(db.BlastDBSize))
+    "-num_threads", s(threads),
+    "-outfmt", "5", "-dbsize", su(dbSize))
   cmd.Stdin = stdin
   cmd.Stdout = stdout
   return cablastp.Exec(cmd)
@@ -289,14 +324,14 @@ func getInputFasta() (*bytes.Reader, error) {
   return bytes.NewReader(bs), nil
 }
 
-func cleanup(db *cablastp.DB) {
+func cleanup(shards []*cablastp.DB) {
   if len(flagCpuProfile) > 0 {
     pprof.StopCPUProfile()
   }
   if len(flagMemProfile) > 0 {
     writeMemProfile(fmt.Sprintf("%s.last", flagMemProfile))
   }
-  db.ReadClose()
+  cablastp.ReadCloseShards(shards)
 }
 
 func fatalf(format string, v ...interface{}) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/xml"
 	"flag"
@@ -13,7 +14,7 @@ import (
 	"path"
 	"runtime"
 	"runtime/pprof"
-	// "strings"
+	"strings"
 
 	"github.com/TuftsBCB/io/fasta"
 	"github.com/TuftsBCB/seq"
@@ -37,18 +38,22 @@ var (
 	flagMakeBlastDB    = "makeblastdb"
 	flagBlastx         = "blastx"
 	flagBlastn         = "blastn"
+	flagBlastp         = "blastp"
 	flagGoMaxProcs     = runtime.NumCPU()
 	flagQuiet          = false
 	flagCpuProfile     = ""
 	flagMemProfile     = ""
 	flagCoarseEval     = 1000.0
-  flagCoarseBitScore = 0.0
+	flagCoarseBitScore = 0.0
 	flagNoCleanup      = false
 	flagCompressQuery  = false
 	flagBatchQueries   = false
 	flagIterativeQuery = false
-  flagShortQueries   = true
-  flagQueryChunkSize = 100
+	flagShortQueries   = true
+	flagQueryChunkSize = 100
+	flagQueryGenCode   = cablastp.DefaultGeneticCode
+	flagMinORFLen      = 10
+	flagFrameReport    = false
 )
 
 // blastArgs are all the arguments after "--blast-args".
@@ -68,6 +73,10 @@ func init() {
 	flag.StringVar(&flagBlastn, "blastn",
 		flagBlastn,
 		"The location of the 'blastn' executable.")
+	flag.StringVar(&flagBlastp, "blastp",
+		flagBlastp,
+		"The location of the 'blastp' executable. It is used for the coarse\n"+
+			"\tsearch when the reduced alphabet has more than four classes.")
 	flag.Float64Var(&flagCoarseEval, "coarse-eval", flagCoarseEval,
 		"The e-value threshold for the coarse search. This will NOT\n"+
 			"\tbe used on the fine search. The fine search e-value threshold\n"+
@@ -95,6 +104,17 @@ func init() {
 		"When set, will process compress queries before search.")
 	flag.BoolVar(&flagShortQueries, "short-queries", flagShortQueries,
 		"When set, will assume query sequences are short, adjusting blast args.")
+	flag.IntVar(&flagQueryGenCode, "query_gencode", flagQueryGenCode,
+		"The NCBI genetic code used to translate queries. The same code\n"+
+			"\tis passed on to 'blastx' in the fine search.")
+	flag.IntVar(&flagMinORFLen, "min-orf-len", flagMinORFLen,
+		"Translated queries are split at stop codons. Open reading frames\n"+
+			"\tshorter than this (in residues) are not searched.")
+	flag.BoolVar(&flagFrameReport, "frame-report", flagFrameReport,
+		"When set, the fine search results are written as a tab separated\n"+
+			"\treport instead of BLAST's own output. Every HSP is given with\n"+
+			"\tthe frame and nucleotide range of the query that it covers.\n"+
+			"\t'-outfmt' cannot be used in 'blast-args' with this flag.")
 
 	// compress options
 
@@ -175,13 +195,30 @@ func main() {
 		cablastp.Verbose = true
 	}
 
-	queryDBConf := argDBConf.DeepCopy() // deep copy of the default DBConf 
-                                      // updated by the args
+	gc, err := cablastp.GetGeneticCode(flagQueryGenCode)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
+
+	if flagFrameReport {
+		for _, arg := range blastArgs {
+			if arg == "-outfmt" {
+				fatalf("'-outfmt' cannot be used with 'frame-report'.\n")
+			}
+		}
+		fmt.Printf("query\tframe\tnt_start\tnt_end\thit\tevalue\tbitscore\n")
+	}
+
+	// deep copy of the default DBConf updated by the args
+	queryDBConf := argDBConf.DeepCopy()
 	inputFastaQueryName := flag.Arg(1)
-	db, err := cablastp.NewReadDB(flag.Arg(0))
+	// Every shard of a sharded database is searched, with the size of the
+	// whole database.
+	shards, err := cablastp.NewReadShards(flag.Arg(0))
 	if err != nil {
 		fatalf("Could not open '%s' database: %s\n", flag.Arg(0), err)
 	}
+	dbSize := cablastp.ShardsBlastDBSize(shards)
 	// For query-compression mode, we first run compression on the query file
 	// then coarse-coarse search, decompress both, fine-fine search.
 	// otherwise, just coarse search, decompress results, fine search.
@@ -190,51 +227,57 @@ func main() {
 
 	if flagCompressQuery {
 
-		processCompressedQueries(db, queryDBConf, inputFastaQueryName, searchBuf)
+		processCompressedQueries(shards, dbSize,
+			gc, queryDBConf, inputFastaQueryName, searchBuf)
 
 	} else {
 
 		queryBuf := new(bytes.Buffer) // might need more than 1 buffer
+		nuclBuf := new(bytes.Buffer)
 		inputFastaQuery, err := getInputFasta(inputFastaQueryName)
 		handleFatalError("Could not read input fasta query", err)
 
 		f := fasta.NewWriter(queryBuf)
+		nuclWriter := fasta.NewWriter(nuclBuf)
 		reader := fasta.NewReader(inputFastaQuery)
 
-		for i := 0; true; i++ {
-      
-      if flagIterativeQuery {
-
-        for j := 0; j < flagQueryChunkSize; j++ {
-    			translateQueries(reader, f)
-        }
-				
-				transQueries := bytes.NewReader(queryBuf.Bytes())
-				processQueries(db, transQueries, searchBuf)
+		for numQueries := 1; true; numQueries++ {
+			err := translateQueries(
+				gc, shards[0].Alphabet, reader, f, nuclWriter)
+			if err == io.EOF {
+				break
+			}
+			if flagIterativeQuery && numQueries%flagQueryChunkSize == 0 {
+				processQueries(shards, dbSize,
+					bytes.NewReader(queryBuf.Bytes()),
+					bytes.NewReader(nuclBuf.Bytes()), searchBuf)
 				queryBuf.Reset()
-      
-      } else {
-        translateQueries(reader, f)
-      }
-			
+				nuclBuf.Reset()
+			}
 		}
 
-		if !flagIterativeQuery {
-			cablastp.Vprintln("\nProcessing Queries in one batch...")
-			f.Flush()
-			transQueries := bytes.NewReader(queryBuf.Bytes())
-			processQueries(db, transQueries, searchBuf)
+		if queryBuf.Len() > 0 {
+			if !flagIterativeQuery {
+				cablastp.Vprintln("\nProcessing Queries in one batch...")
+			}
+			processQueries(shards, dbSize, bytes.NewReader(queryBuf.Bytes()),
+				bytes.NewReader(nuclBuf.Bytes()), searchBuf)
 		}
 	}
 
-	cleanup(db)
+	cleanup(shards)
 }
 
-func translateQueries(reader *fasta.Reader, f *fasta.Writer) error {
-  
+// translateQueries reads the next query from 'reader', and writes its
+// six-frame translation, reduced with 'alpha', to 'f'. The untranslated query
+// is written to 'nucl' so that it can be used in the fine search. io.EOF is
+// returned when there are no more queries.
+func translateQueries(gc *cablastp.GeneticCode, alpha *cablastp.Alphabet,
+	reader *fasta.Reader, f, nucl *fasta.Writer) error {
+
 	sequence, err := reader.Read()
 	if err == io.EOF {
-		return nil
+		return err
 	}
 	if err != nil {
 		fatalf("Could not read input fasta query: %s\n", err)
@@ -242,22 +285,35 @@ func translateQueries(reader *fasta.Reader, f *fasta.Writer) error {
 
 	origSeq := sequence.Bytes()
 	n := sequence.Name
-	// generate 6 ORFs
-	transSeqs := cablastp.Translate(origSeq)
-
-	for _, s := range transSeqs {
-		// reduce each one
-		result := seq.NewSequenceString(n, string(cablastp.Reduce(s)))
-
-		f.Write(result)
+	// generate 6 frames, and split each one into ORFs
+	frames, ambiguous := gc.Translate(origSeq)
+	if ambiguous > 0 {
+		cablastp.Vprintf("Query '%s' has %d ambiguous bases.\n", n, ambiguous)
+	}
+	writeORFs(f, alpha, n, frames)
+	nucl.Write(sequence)
+	f.Flush()
+	nucl.Flush()
+	return nil
+}
 
+// writeORFs writes every open reading frame in 'frames' that is at least
+// 'flagMinORFLen' residues long to 'f', reduced with 'alpha'. Each ORF is
+// named after the frame and nucleotide range it came from, so that coarse
+// hits can be traced back to the query.
+func writeORFs(f *fasta.Writer, alpha *cablastp.Alphabet, name string,
+	frames []cablastp.TranslatedFrame) {
+	for _, frame := range frames {
+		for _, orf := range frame.ORFs(flagMinORFLen) {
+			result := seq.NewSequenceString(
+				orf.Name(name), string(alpha.Reduce(orf.Residues)))
+			f.Write(result)
+		}
 	}
-  f.Flush()
-  return nil
 }
 
-func processQueries(
-	db *cablastp.DB, transQueries *bytes.Reader, searchBuf *bytes.Buffer) error {
+func processQueries(shards []*cablastp.DB, dbSize uint64,
+	transQueries, nuclQueries *bytes.Reader, searchBuf *bytes.Buffer) error {
 	// now we will read from queryBuf!
 	// I think we create a NewReader from queryBuf?
 	// this now needs to become the replacement for inputFastaQuery
@@ -266,50 +322,47 @@ func processQueries(
 	// and a buffer for coarse blast results
 
 	cablastp.Vprintln("\nBlasting query on coarse database...")
-	err := blastCoarse(db, transQueries, searchBuf)
-	handleFatalError("Error blasting coarse database", err)
-
-	cablastp.Vprintln("Decompressing blast hits...")
-	expandedSequences, err := expandBlastHits(db, searchBuf)
-	handleFatalError("Error decompressing blast hits", err)
-  if len(expandedSequences) == 0 {
-    cablastp.Vprintln("No results from coarse search")
-  } else {
-  
-  	// Write the contents of the expanded sequences to a fasta file.
-  	// It is then indexed using makeblastdb.
-  	searchBuf.Reset()
-  	err = writeFasta(expandedSequences, searchBuf)
-  	handleFatalError("Could not create FASTA input from coarse hits", err)
-
-  	// Create the fine blast db in a temporary directory
-  	cablastp.Vprintln("Building fine BLAST database...")
-  	tmpDir, err := makeFineBlastDB(db, searchBuf)
-  	handleFatalError("Could not create fine database to search on", err)
-
-  	// retrieve the cluster members for the original representative query seq
-
-  	// pass them to blastx on the expanded (fine) db
-
-  	// Finally, run the query against the fine fasta database and pass on the
-  	// stdout and stderr...
-  	cablastp.Vprintln("Blasting query on fine database...")
-  	_, err = transQueries.Seek(0, 0) // First 0 is amount to offset, Second 0 
-                                     // is code for absolute
-  	handleFatalError("Could not seek to start of query fasta input", err)
-
-  	err = blastFine(db, tmpDir, transQueries)
-  	handleFatalError("Error blasting fine database", err)
-  	// Delete the temporary fine database.
-  	if !flagNoCleanup {
-  		err := os.RemoveAll(tmpDir)
-  		handleFatalError("Could not delete fine BLAST database", err)
-  	}
-  }
+	expandedSequences, err := searchCoarse(shards, transQueries, dbSize)
+	handleFatalError("Error searching coarse database", err)
+	if len(expandedSequences) == 0 {
+		cablastp.Vprintln("No results from coarse search")
+	} else {
+
+		// Write the contents of the expanded sequences to a fasta file.
+		// It is then indexed using makeblastdb.
+		searchBuf.Reset()
+		err = writeFasta(expandedSequences, searchBuf)
+		handleFatalError("Could not create FASTA input from coarse hits", err)
+
+		// Create the fine blast db in a temporary directory
+		cablastp.Vprintln("Building fine BLAST database...")
+		tmpDir, err := makeFineBlastDB(searchBuf)
+		handleFatalError("Could not create fine database to search on", err)
+
+		// retrieve the cluster members for the original representative query seq
+
+		// pass them to blastx on the expanded (fine) db
+
+		// Finally, run the query against the fine fasta database and pass on the
+		// stdout and stderr...
+		// The fine search is done with blastx on the untranslated queries,
+		// using the same genetic code as the coarse search.
+		cablastp.Vprintln("Blasting query on fine database...")
+		err = blastFine(dbSize, tmpDir, nuclQueries)
+		handleFatalError("Error blasting fine database", err)
+		// Delete the temporary fine database.
+		if !flagNoCleanup {
+			err := os.RemoveAll(tmpDir)
+			handleFatalError("Could not delete fine BLAST database", err)
+		}
+	}
 	return nil
 }
 
-func processCompressedQueries(db *cablastp.DB, queryDBConf *cablastp.DBConf, inputQueryFilename string, searchBuf *bytes.Buffer) error {
+func processCompressedQueries(shards []*cablastp.DB, dbSize uint64,
+	gc *cablastp.GeneticCode, queryDBConf *cablastp.DBConf,
+	inputQueryFilename string, searchBuf *bytes.Buffer) error {
+
 	cablastp.Vprintln("Compressing queries into a database...")
 	dbDirLoc, err := ioutil.TempDir("", "cablastp-tmp-query-db")
 	if err != nil {
@@ -321,9 +374,9 @@ func processCompressedQueries(db *cablastp.DB, queryDBConf *cablastp.DBConf, inp
 	qDB, err := cablastp.NewReadDB(qDBDirLoc)
 	handleFatalError("Error opening query database", err)
 	cablastp.Vprintln("Opening compressed queries for search...")
-	compQueryFilename := qDB.CoarseFastaLocation()
-	compQueries, err := getInputFasta(compQueryFilename)
-	handleFatalError("Error opening compressed query file", err)
+	compQueries := new(bytes.Buffer)
+	err = qDB.CoarseDB.WriteFasta(compQueries)
+	handleFatalError("Error reading compressed queries", err)
 
 	queryBuf := new(bytes.Buffer)
 	f := fasta.NewWriter(queryBuf)
@@ -342,61 +395,52 @@ func processCompressedQueries(db *cablastp.DB, queryDBConf *cablastp.DBConf, inp
 
 		origSeq := sequence.Bytes()
 		n := sequence.Name
-		// generate 6 ORFs
-		transSeqs := cablastp.Translate(origSeq)
-		for _, s := range transSeqs {
-			// reduce each one
-			result := seq.NewSequenceString(n, string(cablastp.Reduce(s)))
-
-			f.Write(result)
-
-		}
+		// generate 6 frames, and split each one into ORFs
+		frames, _ := gc.Translate(origSeq)
+		writeORFs(f, shards[0].Alphabet, n, frames)
 
 		f.Flush()
 		transCoarseQueries := bytes.NewReader(queryBuf.Bytes())
 
 		cablastp.Vprintln("\nBlasting query on coarse database...")
-		err = blastCoarse(db, transCoarseQueries, searchBuf)
-		handleFatalError("Error blasting coarse database", err)
-
-		cablastp.Vprintln("Decompressing coarse blast hits...")
-		expandedSequences, err := expandBlastHits(db, searchBuf)
-		handleFatalError("Error decompressing coarse blast hits", err)
-    if len(expandedSequences) == 0 {
-      cablastp.Vprintln("No results from coarse search")
-    } else {
-  		cablastp.Vprintln("Making FASTA from coarse blast hits...")
-  		searchBuf.Reset()
-  		err = writeFasta(expandedSequences, searchBuf)
-  		handleFatalError("Could not create FASTA input from coarse hits", err)
-
-  		cablastp.Vprintln("Expanding coarse query...")
-  		expQuery, err := expandCoarseSequence(qDB, origSeqID, &sequence)
-  		handleFatalError("Could not expand coarse queries", err)
-
-  		fineQueryBuf := new(bytes.Buffer)
-  		fineWriter := fasta.NewWriter(fineQueryBuf)
-  		for _, fineQuery := range expQuery {
-  			fineQueryBytes := fineQuery.FastaSeq().Bytes() // <- Is This the same as fineQuery.Residues()?
-  			fineName := fineQuery.Name
-  			writeSeq := seq.NewSequenceString(fineName, string(fineQueryBytes))
-  			fineWriter.Write(writeSeq)
-  		}
-  		fineWriter.Flush()
-  		transFineQueries := bytes.NewReader(fineQueryBuf.Bytes())
-
-  		cablastp.Vprintln("Building fine BLAST target database...")
-  		targetTmpDir, err := makeFineBlastDB(db, searchBuf)
-  		handleFatalError("Could not create fine database to search on", err)
-
-  		cablastp.Vprintln("Blasting original query on fine database...")
-  		err = blastFine(db, targetTmpDir, transFineQueries)
-  		handleFatalError("Error blasting fine database", err)
-    	if !flagNoCleanup {
-    		err := os.RemoveAll(targetTmpDir)
-    		handleFatalError("Could not delete fine database", err)
-    	}
-    }
+		expandedSequences, err := searchCoarse(
+			shards, transCoarseQueries, dbSize)
+		handleFatalError("Error searching coarse database", err)
+		if len(expandedSequences) == 0 {
+			cablastp.Vprintln("No results from coarse search")
+		} else {
+			cablastp.Vprintln("Making FASTA from coarse blast hits...")
+			searchBuf.Reset()
+			err = writeFasta(expandedSequences, searchBuf)
+			handleFatalError("Could not create FASTA input from coarse hits", err)
+
+			cablastp.Vprintln("Expanding coarse query...")
+			expQuery, err := expandCoarseSequence(qDB, origSeqID, &sequence)
+			handleFatalError("Could not expand coarse queries", err)
+
+			fineQueryBuf := new(bytes.Buffer)
+			fineWriter := fasta.NewWriter(fineQueryBuf)
+			for _, fineQuery := range expQuery {
+				fineQueryBytes := fineQuery.FastaSeq().Bytes() // <- Is This the same as fineQuery.Residues()?
+				fineName := fineQuery.Name
+				writeSeq := seq.NewSequenceString(fineName, string(fineQueryBytes))
+				fineWriter.Write(writeSeq)
+			}
+			fineWriter.Flush()
+			transFineQueries := bytes.NewReader(fineQueryBuf.Bytes())
+
+			cablastp.Vprintln("Building fine BLAST target database...")
+			targetTmpDir, err := makeFineBlastDB(searchBuf)
+			handleFatalError("Could not create fine database to search on", err)
+
+			cablastp.Vprintln("Blasting original query on fine database...")
+			err = blastFine(dbSize, targetTmpDir, transFineQueries)
+			handleFatalError("Error blasting fine database", err)
+			if !flagNoCleanup {
+				err := os.RemoveAll(targetTmpDir)
+				handleFatalError("Could not delete fine database", err)
+			}
+		}
 		queryBuf.Reset()
 	}
 	cablastp.Vprintln("Cleaning up...")
@@ -416,7 +460,7 @@ func su(i uint64) string {
 }
 
 func sf(f float64) string {
-  return fmt.Sprintf("%.2f", f)
+	return fmt.Sprintf("%.2f", f)
 }
 
 func compressQueries(queryFileName string, queryDBConf *cablastp.DBConf, dbDirLoc string) (string, error) {
@@ -480,25 +524,89 @@ func compressQueries(queryFileName string, queryDBConf *cablastp.DBConf, dbDirLo
 // return db, nil
 
 func blastFine(
-	db *cablastp.DB, blastFineDir string, stdin *bytes.Reader) error {
+	dbSize uint64, blastFineDir string, stdin *bytes.Reader) error {
 
 	// We pass our own "-db" flag to blastp, but the rest come from user
 	// defined flags.
 	flags := []string{
 		"-db", path.Join(blastFineDir, cablastp.FileBlastFine),
-		"-dbsize", su(db.BlastDBSize),
+		"-dbsize", su(dbSize),
 		"-num_threads", s(flagGoMaxProcs),
+		"-query_gencode", s(flagQueryGenCode),
 	}
 	flags = append(flags, blastArgs...)
+	if flagFrameReport {
+		flags = append(flags, "-outfmt", "5")
+	}
 
 	cmd := exec.Command(flagBlastx, flags...)
 	cmd.Stdin = stdin
-	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cablastp.Exec(cmd)
+	if !flagFrameReport {
+		cmd.Stdout = os.Stdout
+		return cablastp.Exec(cmd)
+	}
+
+	blastOut := new(bytes.Buffer)
+	cmd.Stdout = blastOut
+	if err := cablastp.Exec(cmd); err != nil {
+		return err
+	}
+	return writeFrameReport(os.Stdout, blastOut)
+}
+
+// writeFrameReport writes a line to 'w' for every HSP of the fine search
+// results in 'blastOut', giving the frame and nucleotide range of the query
+// that it covers.
+func writeFrameReport(w io.Writer, blastOut *bytes.Buffer) error {
+	results := fineBlast{}
+	if err := xml.NewDecoder(blastOut).Decode(&results); err != nil {
+		return fmt.Errorf("Could not parse BLAST search results: %s", err)
+	}
+
+	buf := bufio.NewWriter(w)
+	for _, iter := range results.Iterations {
+		for _, hit := range iter.Hits {
+			for _, hsp := range hit.Hsps {
+				id, frame, ntStart, ntEnd := queryFrame(iter.QueryDef, hsp)
+				fmt.Fprintf(buf, "%s\t%+d\t%d\t%d\t%s\t%g\t%g\n",
+					id, frame, ntStart+1, ntEnd, firstWord(hit.Def),
+					hsp.Evalue, hsp.BitScore)
+			}
+		}
+	}
+	return buf.Flush()
+}
+
+// queryFrame returns the id of the query of an HSP, along with its frame and
+// the half-open range of nucleotides (on the forward strand) that the HSP
+// covers. A query named by TranslatedFrame.Name is a translated ORF, so the
+// residue coordinates of the HSP are mapped back through the ORF's frame.
+// Any other query is a nucleotide sequence searched with blastx, which
+// reports the frame and nucleotide coordinates itself.
+func queryFrame(queryDef string, hs hsp) (string, int, int, int) {
+	from, to := hs.QueryFrom, hs.QueryTo
+	if from > to {
+		from, to = to, from
+	}
+	id, frame, start, end, err := cablastp.ParseFrameName(queryDef)
+	if err != nil {
+		return firstWord(queryDef), hs.QueryFrame, from - 1, to
+	}
+	orf := cablastp.TranslatedFrame{Frame: frame, NucStart: start, NucEnd: end}
+	ntStart, ntEnd := orf.NucRange(from-1, to)
+	return id, frame, ntStart, ntEnd
 }
 
-func makeFineBlastDB(db *cablastp.DB, stdin *bytes.Buffer) (string, error) {
+// firstWord returns 'name' up to its first space or tab.
+func firstWord(name string) string {
+	if i := strings.IndexAny(name, " \t"); i > -1 {
+		return name[:i]
+	}
+	return name
+}
+
+func makeFineBlastDB(stdin *bytes.Buffer) (string, error) {
 	tmpDir, err := ioutil.TempDir("", "cablastp-fine-search-db")
 	if err != nil {
 		return "", fmt.Errorf("Could not create temporary directory: %s\n", err)
@@ -518,8 +626,12 @@ func makeFineBlastDB(db *cablastp.DB, stdin *bytes.Buffer) (string, error) {
 
 func writeFasta(oseqs []cablastp.OriginalSeq, buf *bytes.Buffer) error {
 	for _, oseq := range oseqs {
-		_, err := fmt.Fprintf(buf, "> %s\n%s\n",
-			oseq.Name, string(oseq.Residues))
+		name, err := oseq.LoadName()
+		if err != nil {
+			return fmt.Errorf("Could not read name of sequence %d: %s",
+				oseq.Id, err)
+		}
+		_, err = fmt.Fprintf(buf, "> %s\n%s\n", name, string(oseq.Residues))
 		if err != nil {
 			return fmt.Errorf("Could not write to buffer: %s", err)
 		}
@@ -527,6 +639,28 @@ func writeFasta(oseqs []cablastp.OriginalSeq, buf *bytes.Buffer) error {
 	return nil
 }
 
+// searchCoarse blasts the translated queries against the coarse database of
+// every shard, and returns the original sequences that the hits of all shards
+// expand to.
+func searchCoarse(shards []*cablastp.DB, transQueries *bytes.Reader,
+	dbSize uint64) ([]cablastp.OriginalSeq, error) {
+
+	query, err := ioutil.ReadAll(transQueries)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read translated queries: %s", err)
+	}
+	return cablastp.SearchShards(shards, flagGoMaxProcs,
+		func(db *cablastp.DB, threads int) ([]cablastp.OriginalSeq, error) {
+			buf := new(bytes.Buffer)
+			err := blastCoarse(db, bytes.NewReader(query), buf, dbSize, threads)
+			if err != nil {
+				return nil,
+					fmt.Errorf("Error blasting coarse database: %s", err)
+			}
+			return expandBlastHits(db, buf)
+		})
+}
+
 func expandBlastHits(
 	db *cablastp.DB, blastOut *bytes.Buffer) ([]cablastp.OriginalSeq, error) {
 
@@ -537,28 +671,30 @@ func expandBlastHits(
 
 	used := make(map[int]bool, 100) // prevent original sequence duplicates
 	oseqs := make([]cablastp.OriginalSeq, 0, 100)
-	for _, hit := range results.Hits {
-
-		for _, hsp := range hit.Hsps {
-			someOseqs, err := db.CoarseDB.Expand(db.ComDB,
-				hit.Accession, hsp.HitFrom, hsp.HitTo)
-			if err != nil {
-				errorf("Could not decompress coarse sequence %d (%d, %d): %s\n",
-					hit.Accession, hsp.HitFrom, hsp.HitTo, err)
-				continue
-			}
-
-			// Make sure this hit is above the coarse bit score threshold.
-			if hsp.BitScore < flagCoarseBitScore {
-				continue
-			}
+	for _, iter := range results.Iterations {
+		for _, hit := range iter.Hits {
+			for _, hsp := range hit.Hsps {
+				someOseqs, err := db.CoarseDB.Expand(db.ComDB,
+					hit.Accession, hsp.HitFrom, hsp.HitTo)
+				if err != nil {
+					errorf("Could not decompress coarse sequence %d "+
+						"(%d, %d): %s\n",
+						hit.Accession, hsp.HitFrom, hsp.HitTo, err)
+					continue
+				}
 
-			for _, oseq := range someOseqs {
-				if used[oseq.Id] {
+				// Make sure this hit is above the coarse bit score threshold.
+				if hsp.BitScore < flagCoarseBitScore {
 					continue
 				}
-				used[oseq.Id] = true
-				oseqs = append(oseqs, oseq)
+
+				for _, oseq := range someOseqs {
+					if used[oseq.Id] {
+						continue
+					}
+					used[oseq.Id] = true
+					oseqs = append(oseqs, oseq)
+				}
 			}
 		}
 	}
@@ -588,27 +724,30 @@ func expandCoarseSequence(db *cablastp.DB, seqId int, coarseSequence *seq.Sequen
 	return originalSeqs, nil
 }
 
-func blastCoarse(
-	db *cablastp.DB, stdin *bytes.Reader, stdout *bytes.Buffer) error {
-  var cmd *exec.Cmd
-
-  if flagShortQueries {
-  	cmd = exec.Command(
-  		flagBlastn,
-  		"-db", path.Join(db.Path, cablastp.FileBlastCoarse),
-  		"-num_threads", s(flagGoMaxProcs),
-      "-max_target_seqs", "100000",
-      "-task", "blastn-short", "-evalue", sf(flagCoarseEval), "-penalty", "-1",
-  		"-outfmt", "5", "-dbsize", su(db.BlastDBSize))
-  } else {
-  	cmd = exec.Command(
-  		flagBlastn,
-  		"-db", path.Join(db.Path, cablastp.FileBlastCoarse),
-  		"-num_threads", s(flagGoMaxProcs),
-      "-max_target_seqs", "100000",
-      "-evalue", sf(flagCoarseEval),
-  		"-outfmt", "5", "-dbsize", su(db.BlastDBSize))
-  }
+func blastCoarse(db *cablastp.DB, stdin *bytes.Reader, stdout *bytes.Buffer,
+	dbSize uint64, threads int) error {
+
+	args := []string{
+		"-db", path.Join(db.Path, cablastp.FileBlastCoarse),
+		"-num_threads", s(threads),
+		"-max_target_seqs", "100000",
+		"-evalue", sf(flagCoarseEval),
+		"-outfmt", "5", "-dbsize", su(dbSize),
+	}
+
+	// Reduced alphabets with more than four classes are searched with blastp.
+	var cmd *exec.Cmd
+	if db.Alphabet.IsNucleotide() {
+		if flagShortQueries {
+			args = append(args, "-task", "blastn-short", "-penalty", "-1")
+		}
+		cmd = exec.Command(flagBlastn, args...)
+	} else {
+		if flagShortQueries {
+			args = append(args, "-task", "blastp-short")
+		}
+		cmd = exec.Command(flagBlastp, args...)
+	}
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 	return cablastp.Exec(cmd)
@@ -626,14 +765,14 @@ func getInputFasta(inputFilename string) (*bytes.Reader, error) {
 	return bytes.NewReader(bs), nil
 }
 
-func cleanup(db *cablastp.DB) {
+func cleanup(shards []*cablastp.DB) {
 	if len(flagCpuProfile) > 0 {
 		pprof.StopCPUProfile()
 	}
 	if len(flagMemProfile) > 0 {
 		writeMemProfile(fmt.Sprintf("%s.last", flagMemProfile))
 	}
-	db.ReadClose()
+	cablastp.ReadCloseShards(shards)
 }
 
 func fatalf(format string, v ...interface{}) {
@@ -5,8 +5,14 @@ import (
 )
 
 type blast struct {
-	XMLName xml.Name `xml:"BlastOutput"`
-	Hits    []hit    `xml:"BlastOutput_iterations>Iteration>Iteration_hits>Hit"`
+	XMLName    xml.Name    `xml:"BlastOutput"`
+	Iterations []iteration `xml:"BlastOutput_iterations>Iteration"`
+}
+
+type iteration struct {
+	XMLName  xml.Name `xml:"Iteration"`
+	QueryDef string   `xml:"Iteration_query-def"`
+	Hits     []hit    `xml:"Iteration_hits>Hit"`
 }
 
 type hit struct {
@@ -17,14 +23,36 @@ type hit struct {
 }
 
 type hsp struct {
-	XMLName   xml.Name `xml:"Hsp"`
-	Num       int      `xml:"Hsp_num"`
-	Evalue    float64  `xml:"Hsp_evalue"`
-  BitScore  float64  `xml:"Hsp_bit-score"`
-  NumIdent  int      `xml:"Hsp_identity"`
-  AlnLen    int      `xml:"Hsp_align-len"`
-	QueryFrom int      `xml:"Hsp_query-from"`
-	QueryTo   int      `xml:"Hsp_query-to"`
-	HitFrom   int      `xml:"Hsp_hit-from"`
-	HitTo     int      `xml:"Hsp_hit-to"`
+	XMLName    xml.Name `xml:"Hsp"`
+	Num        int      `xml:"Hsp_num"`
+	Evalue     float64  `xml:"Hsp_evalue"`
+	BitScore   float64  `xml:"Hsp_bit-score"`
+	NumIdent   int      `xml:"Hsp_identity"`
+	AlnLen     int      `xml:"Hsp_align-len"`
+	QueryFrom  int      `xml:"Hsp_query-from"`
+	QueryTo    int      `xml:"Hsp_query-to"`
+	QueryFrame int      `xml:"Hsp_query-frame"`
+	HitFrom    int      `xml:"Hsp_hit-from"`
+	HitTo      int      `xml:"Hsp_hit-to"`
+}
+
+// fineBlast is the output of the fine search. The sequences in the fine
+// database are named by their original headers rather than by coarse
+// sequence ids, so its hits are identified by their definition lines.
+type fineBlast struct {
+	XMLName    xml.Name        `xml:"BlastOutput"`
+	Iterations []fineIteration `xml:"BlastOutput_iterations>Iteration"`
+}
+
+type fineIteration struct {
+	XMLName  xml.Name  `xml:"Iteration"`
+	QueryDef string    `xml:"Iteration_query-def"`
+	Hits     []fineHit `xml:"Iteration_hits>Hit"`
+}
+
+type fineHit struct {
+	XMLName xml.Name `xml:"Hit"`
+	Num     int      `xml:"Hit_num"`
+	Def     string   `xml:"Hit_def"`
+	Hsps    []hsp    `xml:"Hit_hsps>Hsp"`
 }
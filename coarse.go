@@ -3,11 +3,16 @@ package cablastp
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"sync"
 )
 
 // Hard-coded file names for different pieces of a cablastp database.
+//
+// N.B. coarse.fasta and its index are only read from databases created before
+// coarse sequences were packed. (See packed.go.)
 const (
 	FileCoarseFasta      = "coarse.fasta"
 	FileCoarseFastaIndex = "coarse.fasta.index"
@@ -24,24 +29,45 @@ const (
 type CoarseDB struct {
 	Seqs        []*CoarseSeq
 	ReducedSeqs []*CoarseSeq
-	Seeds       Seeds
+
+	// The seeds table of every coarse sequence added. It is only built for
+	// a database opened for writing.
+	Seeds Seeds
+
+	// The reduced alphabet of the coarse sequences.
+	alpha *Alphabet
 
 	// The fastaCache is used during decompression. Namely, once a coarse
 	// sequence is decompressed, it is cached into this map.
 	fastaCache map[int]*CoarseSeq
 
+	// readLock serializes reading coarse sequences and links from disk, so
+	// that they can be read concurrently.
+	readLock sync.Mutex
+
+	// blockSize is the number of sequences in each block when the coarse
+	// sequences are block compressed, and 0 otherwise. When reading a block
+	// compressed database, 'blocks' finds sequences by their addresses in
+	// the index. (See blocks.go.)
+	blockSize int
+	blocks    *blockReader
+
 	// The size of the coarse database index in bytes. This can be used to
 	// quickly compute the number of sequences in the coarse database.
 	// (Since each sequence is represented by a 64-bit integer offset, simply
 	// divide by 8.)
-	fastaIndexSize int64
+	indexSize int64
 
 	// File pointers to each file in the "coarse" part of a cablastp database.
-	FileFasta      *os.File
-	FileFastaIndex *os.File
-	FileSeeds      *os.File
-	FileLinks      *os.File
-	FileLinksIndex *os.File
+	// (FileFasta and FileFastaIndex are only set when reading a database
+	// without a packed coarse store.)
+	FilePacked      *os.File
+	FilePackedIndex *os.File
+	FileFasta       *os.File
+	FileFastaIndex  *os.File
+	FileSeeds       *os.File
+	FileLinks       *os.File
+	FileLinksIndex  *os.File
 
 	// Ensures that adding a sequence to the coarse database is atomic.
 	seqLock *sync.RWMutex
@@ -56,9 +82,8 @@ type CoarseDB struct {
 	// write the new ones.)
 	seqsRead int
 
-	// plain is a debugging feature that writes the links and seeds table (when
-	// not read only) in a human readable format, rather than the default binary
-	// format.
+	// plain is a debugging feature that also writes the links and the seeds
+	// table in a human readable format. (See plain.go.)
 	plain bool
 
 	// File pointers to use when 'plain' is true.
@@ -73,26 +98,29 @@ func newWriteCoarseDB(db *DB) (*CoarseDB, error) {
 	Vprintln("\tOpening coarse database...")
 
 	coarsedb := &CoarseDB{
-		Seqs:           make([]*CoarseSeq, 0, 10000000),
-		ReducedSeqs:    make([]*CoarseSeq, 0, 10000000),
-		seqsRead:       0,
-		Seeds:          NewSeeds(db.MapSeedSize, db.SeedLowComplexity),
-		FileFasta:      nil,
-		FileFastaIndex: nil,
-		fastaIndexSize: 0,
-		FileSeeds:      nil,
-		FileLinks:      nil,
-		FileLinksIndex: nil,
-		seqLock:        &sync.RWMutex{},
-		readOnly:       db.ReadOnly,
-		plain:          db.SavePlain,
-		plainSeeds:     nil,
+		Seqs:        make([]*CoarseSeq, 0, 10000000),
+		ReducedSeqs: make([]*CoarseSeq, 0, 10000000),
+		seqsRead:    0,
+		Seeds: NewSeeds(
+			db.Alphabet, db.SeedShape, db.SeedLowComplexity),
+		alpha:           db.Alphabet,
+		FilePacked:      nil,
+		FilePackedIndex: nil,
+		indexSize:       0,
+		FileSeeds:       nil,
+		FileLinks:       nil,
+		FileLinksIndex:  nil,
+		seqLock:         &sync.RWMutex{},
+		readOnly:        db.ReadOnly,
+		plain:           db.SavePlain,
+		plainSeeds:      nil,
+		blockSize:       db.CompressBlockSize,
 	}
-	coarsedb.FileFasta, err = db.openWriteFile(FileCoarseFasta)
+	coarsedb.FilePacked, err = db.openWriteFile(FileCoarsePacked)
 	if err != nil {
 		return nil, err
 	}
-	coarsedb.FileFastaIndex, err = db.openWriteFile(FileCoarseFastaIndex)
+	coarsedb.FilePackedIndex, err = db.openWriteFile(FileCoarsePackedIndex)
 	if err != nil {
 		return nil, err
 	}
@@ -109,11 +137,11 @@ func newWriteCoarseDB(db *DB) (*CoarseDB, error) {
 		return nil, err
 	}
 
-	info, err := coarsedb.FileFastaIndex.Stat()
+	info, err := coarsedb.FilePackedIndex.Stat()
 	if err != nil {
 		return nil, err
 	}
-	coarsedb.fastaIndexSize = info.Size()
+	coarsedb.indexSize = info.Size()
 
 	if coarsedb.plain {
 		coarsedb.plainLinks, err = db.openWriteFile(FileCoarsePlainLinks)
@@ -140,26 +168,42 @@ func newReadCoarseDB(db *DB) (*CoarseDB, error) {
 	coarsedb := &CoarseDB{
 		Seqs:           make([]*CoarseSeq, 0, 100000),
 		ReducedSeqs:    make([]*CoarseSeq, 0, 100000),
-		Seeds:          NewSeeds(db.MapSeedSize, db.SeedLowComplexity),
-		FileFasta:      nil,
+		alpha:          db.Alphabet,
 		fastaCache:     make(map[int]*CoarseSeq, 200),
-		FileFastaIndex: nil,
-		fastaIndexSize: 0,
+		indexSize:      0,
 		FileSeeds:      nil,
 		FileLinks:      nil,
 		FileLinksIndex: nil,
 		seqLock:        nil,
 		readOnly:       false,
 		plain:          db.SavePlain,
+		blockSize:      db.CompressBlockSize,
+	}
+
+	packed, err := packedStoreExists(db)
+	if err != nil {
+		return nil, err
+	}
+	store, index := FileCoarsePacked, FileCoarsePackedIndex
+	if !packed {
+		store, index = FileCoarseFasta, FileCoarseFastaIndex
 	}
-	coarsedb.FileFasta, err = db.openReadFile(FileCoarseFasta)
+	storeFile, err := db.openReadFile(store)
 	if err != nil {
 		return nil, err
 	}
-	coarsedb.FileFastaIndex, err = db.openReadFile(FileCoarseFastaIndex)
+	indexFile, err := db.openReadFile(index)
 	if err != nil {
 		return nil, err
 	}
+	if packed {
+		coarsedb.FilePacked, coarsedb.FilePackedIndex = storeFile, indexFile
+	} else {
+		coarsedb.FileFasta, coarsedb.FileFastaIndex = storeFile, indexFile
+	}
+	if coarsedb.blockSize > 0 {
+		coarsedb.blocks = newBlockReader(storeFile)
+	}
 	coarsedb.FileLinks, err = db.openReadFile(FileCoarseLinks)
 	if err != nil {
 		return nil, err
@@ -169,11 +213,11 @@ func newReadCoarseDB(db *DB) (*CoarseDB, error) {
 		return nil, err
 	}
 
-	info, err := coarsedb.FileFastaIndex.Stat()
+	info, err := indexFile.Stat()
 	if err != nil {
 		return nil, err
 	}
-	coarsedb.fastaIndexSize = info.Size()
+	coarsedb.indexSize = info.Size()
 
 	Vprintln("\tDone opening coarse database.")
 	return coarsedb, nil
@@ -183,16 +227,29 @@ func newReadCoarseDB(db *DB) (*CoarseDB, error) {
 // adds it as a new coarse sequence to the coarse database. Seeds are
 // also generated for each K-mer in the sequence. The resulting coarse
 // sequence is returned along with its sequence identifier.
-func (coarsedb *CoarseDB) Add(oseq []byte) (int, *CoarseSeq) {
+//
+// If the seeds table is full, the coarse sequence is still added, but an
+// error is returned with it.
+func (coarsedb *CoarseDB) Add(oseq []byte) (int, *CoarseSeq, error) {
 	coarsedb.seqLock.Lock()
 	id := len(coarsedb.Seqs)
 	corSeq := NewCoarseSeq(id, "", oseq)
 	coarsedb.Seqs = append(coarsedb.Seqs, corSeq)
 	coarsedb.seqLock.Unlock()
 
-	coarsedb.Seeds.Add(id, corSeq)
+	err := coarsedb.Seeds.Add(id, corSeq)
 
-	return id, corSeq
+	return id, corSeq, err
+}
+
+// Len is a thread-safe way to get the number of coarse sequences in memory.
+// Unlike NumSequences, it includes sequences that haven't been saved yet.
+func (coarsedb *CoarseDB) Len() int {
+	coarsedb.seqLock.RLock()
+	n := len(coarsedb.Seqs)
+	coarsedb.seqLock.RUnlock()
+
+	return n
 }
 
 // CoarseSeqGet is a thread-safe way to retrieve a sequence with index `i`
@@ -210,9 +267,61 @@ func (coarsedb *CoarseDB) CoarseSeqGet(i uint) *CoarseSeq {
 func (coarsedb *CoarseDB) Expand(
 	comdb *CompressedDB, id, start, end int) ([]OriginalSeq, error) {
 
+	links, err := coarsedb.readLinksOf(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// We use a map as a set of original sequence ids for eliminating
+	// duplicates (since a coarse sequence can point to different pieces of the
+	// same compressed sequence).
+	ids := make(map[uint32]bool, len(links))
+	oseqs := make([]OriginalSeq, 0, len(links))
+	s, e := uint16(start), uint16(end)
+	for _, compLink := range links {
+		// We only use this link if the match is in the range.
+		if e < compLink.CoarseStart || s > compLink.CoarseEnd {
+			continue
+		}
+
+		// Don't decompress the same original sequence more than once.
+		if ids[compLink.OrgSeqId] {
+			continue
+		}
+
+		oseq, err := comdb.ReadSeq(coarsedb, int(compLink.OrgSeqId))
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Could not read compressed sequence: %s", err)
+		}
+		ids[compLink.OrgSeqId] = true
+		oseqs = append(oseqs, oseq)
+
+		// Exact duplicates of the original sequence are expanded too.
+		for _, aliasId := range comdb.AliasesOf(int(compLink.OrgSeqId)) {
+			name, err := comdb.ReadName(aliasId)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Could not read compressed sequence: %s", err)
+			}
+			oseqs = append(oseqs,
+				*NewOriginalSeq(aliasId, name, oseq.Residues))
+		}
+	}
+
+	return oseqs, nil
+}
+
+// readLinksOf reads the links of the coarse sequence with id 'id' to the
+// original sequences that were compressed against it. It is safe for
+// concurrent use.
+func (coarsedb *CoarseDB) readLinksOf(id int) ([]*LinkToCompressed, error) {
+	coarsedb.readLock.Lock()
+	defer coarsedb.readLock.Unlock()
+
 	// Calculate the byte offset into the coarse links file where the links
 	// for the coarse sequence `i` starts.
-  // Vprintf("id: %d\n", id)
+	// Vprintf("id: %d\n", id)
 	off, err := coarsedb.linkOffset(id)
 	if err != nil {
 		return nil, fmt.Errorf("Could not get link offset: %s", err)
@@ -236,53 +345,70 @@ func (coarsedb *CoarseDB) Expand(
 		return nil, fmt.Errorf("Could not read number of links: %s", err)
 	}
 
-	// We use a map as a set of original sequence ids for eliminating
-	// duplicates (since a coarse sequence can point to different pieces of the
-	// same compressed sequence).
-	ids := make(map[uint32]bool, numLinks)
-	oseqs := make([]OriginalSeq, 0, numLinks)
-	s, e := uint16(start), uint16(end)
-	for i := uint32(0); i < numLinks; i++ {
-		compLink, err := coarsedb.readLink()
+	links := make([]*LinkToCompressed, numLinks)
+	for i := range links {
+		links[i], err = coarsedb.readLink()
 		if err != nil {
 			return nil, fmt.Errorf("Could not read link: %s", err)
 		}
+	}
+	return links, nil
+}
 
-		// We only use this link if the match is in the range.
-		if e < compLink.CoarseStart || s > compLink.CoarseEnd {
-			continue
-		}
+// ReadLinks reads the links of the coarse sequence with id 'id' to original
+// sequences, in the order they were added. It is safe for concurrent use.
+func (coarsedb *CoarseDB) ReadLinks(id int) ([]*LinkToCompressed, error) {
+	return coarsedb.readLinksOf(id)
+}
 
-		// Don't decompress the same original sequence more than once.
-		if ids[compLink.OrgSeqId] {
+// LinkedSeqIds returns the ids of every original sequence that has a link to
+// the coarse sequence with id 'id', including their aliases, in increasing
+// order. It is safe for concurrent use.
+func (coarsedb *CoarseDB) LinkedSeqIds(
+	comdb *CompressedDB, id int) ([]int, error) {
+
+	links, err := coarsedb.readLinksOf(id)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool, len(links))
+	var ids []int
+	for _, link := range links {
+		orgSeqId := int(link.OrgSeqId)
+		if seen[orgSeqId] {
 			continue
 		}
-
-		oseq, err := comdb.ReadSeq(coarsedb, int(compLink.OrgSeqId))
-		if err != nil {
-			return nil, fmt.Errorf(
-				"Could not read compressed sequence: %s", err)
+		seen[orgSeqId] = true
+		ids = append(ids, orgSeqId)
+		for _, aliasId := range comdb.AliasesOf(orgSeqId) {
+			if !seen[aliasId] {
+				seen[aliasId] = true
+				ids = append(ids, aliasId)
+			}
 		}
-		ids[compLink.OrgSeqId] = true
-		oseqs = append(oseqs, oseq)
 	}
-
-	return oseqs, nil
+	sort.Ints(ids)
+	return ids, nil
 }
 
 // NumRequences returns the number of sequences in the coarse database based
 // on the file size of the coarse database index.
 func (coarsedb *CoarseDB) NumSequences() int {
-	return int(coarsedb.fastaIndexSize / 8)
+	return int(coarsedb.indexSize / 8)
 }
 
 // ReadCoarseSeq reads the coarse sequence with identifier 'id' from disk, using
-// the fasta index. (If a coarse sequence has already been read, it is returned
-// from cache to save trips to disk.)
+// the index of the packed store. (If a coarse sequence has already been read,
+// it is returned from cache to save trips to disk.)
 //
 // TODO: Note that this does *not* recover links typically found in a coarse
 // sequence, although it probably should to avoid doing it in CoarseDB.Expand.
+//
+// ReadCoarseSeq is safe for concurrent use.
 func (coarsedb *CoarseDB) ReadCoarseSeq(id int) (*CoarseSeq, error) {
+	coarsedb.readLock.Lock()
+	defer coarsedb.readLock.Unlock()
+
 	// Prevent reading the same coarse sequence over and over.
 	if coarseSeq, ok := coarsedb.fastaCache[id]; ok {
 		return coarseSeq, nil
@@ -293,19 +419,38 @@ func (coarsedb *CoarseDB) ReadCoarseSeq(id int) (*CoarseSeq, error) {
 		return nil, fmt.Errorf("Could not get coarse offset: %s", err)
 	}
 
-	newOff, err := coarsedb.FileFasta.Seek(off, os.SEEK_SET)
-	if err != nil {
-		return nil, fmt.Errorf("Could not seek in coarse fasta: %s", err)
-	} else if newOff != off {
-		return nil,
-			fmt.Errorf("Tried to seek to offset %d in the coarse fasta file, "+
-				"but seeked to %d instead.", off, newOff)
+	if coarsedb.FilePacked != nil {
+		residues, err := coarsedb.readPackedSeq(off)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read coarse sequence %d: %s",
+				id, err)
+		}
+		coarseSeq := NewCoarseSeq(id, "", residues)
+		coarsedb.fastaCache[id] = coarseSeq
+		return coarseSeq, nil
+	}
+
+	// Databases without a packed store have a FASTA file instead.
+	var r io.Reader = coarsedb.FileFasta
+	if coarsedb.blocks != nil {
+		if r, err = coarsedb.blocks.record(off); err != nil {
+			return nil, err
+		}
+	} else {
+		newOff, err := coarsedb.FileFasta.Seek(off, os.SEEK_SET)
+		if err != nil {
+			return nil, fmt.Errorf("Could not seek in coarse fasta: %s", err)
+		} else if newOff != off {
+			return nil,
+				fmt.Errorf("Tried to seek to offset %d in the coarse fasta "+
+					"file, but seeked to %d instead.", off, newOff)
+		}
 	}
 
 	// Read in the sequence.
 	var corSeqId int
 	var residues string
-	n, err := fmt.Fscanf(coarsedb.FileFasta, "> %d\n%s\n", &corSeqId, &residues)
+	n, err := fmt.Fscanf(r, "> %d\n%s\n", &corSeqId, &residues)
 	if err != nil {
 		return nil, fmt.Errorf("Could not scan coarse sequence %d: %s", id, err)
 	} else if n != 2 {
@@ -327,8 +472,13 @@ func (coarsedb *CoarseDB) ReadCoarseSeq(id int) (*CoarseSeq, error) {
 //
 // An error is returned if the file seek fails.
 func (coarsedb *CoarseDB) coarseOffset(id int) (seqOff int64, err error) {
+	index := coarsedb.FilePackedIndex
+	if index == nil {
+		index = coarsedb.FileFastaIndex
+	}
+
 	tryOff := int64(id) * 8
-	realOff, err := coarsedb.FileFastaIndex.Seek(tryOff, os.SEEK_SET)
+	realOff, err := index.Seek(tryOff, os.SEEK_SET)
 	if err != nil {
 		return
 	} else if tryOff != realOff {
@@ -336,7 +486,7 @@ func (coarsedb *CoarseDB) coarseOffset(id int) (seqOff int64, err error) {
 			fmt.Errorf("Tried to seek to offset %d in the coarse index, "+
 				"but seeked to %d instead.", tryOff, realOff)
 	}
-	err = binary.Read(coarsedb.FileFastaIndex, binary.BigEndian, &seqOff)
+	err = binary.Read(index, binary.BigEndian, &seqOff)
 	return
 }
 
@@ -361,16 +511,21 @@ func (coarsedb *CoarseDB) linkOffset(id int) (seqOff int64, err error) {
 
 // readClose closes all files necessary for reading the coarse database.
 func (coarsedb *CoarseDB) readClose() {
-	coarsedb.FileFasta.Close()
-	coarsedb.FileFastaIndex.Close()
+	if coarsedb.FilePacked != nil {
+		coarsedb.FilePacked.Close()
+		coarsedb.FilePackedIndex.Close()
+	} else {
+		coarsedb.FileFasta.Close()
+		coarsedb.FileFastaIndex.Close()
+	}
 	coarsedb.FileLinks.Close()
 	coarsedb.FileLinksIndex.Close()
 }
 
 // writeClose closes all files necessary for writing the coarse database.
 func (coarsedb *CoarseDB) writeClose() {
-	coarsedb.FileFasta.Close()
-	coarsedb.FileFastaIndex.Close()
+	coarsedb.FilePacked.Close()
+	coarsedb.FilePackedIndex.Close()
 	coarsedb.FileSeeds.Close()
 	coarsedb.FileLinks.Close()
 	coarsedb.FileLinksIndex.Close()
@@ -380,7 +535,7 @@ func (coarsedb *CoarseDB) writeClose() {
 	}
 }
 
-// save will save the coarse database as a FASTA file and a binary
+// save will save the coarse database as packed sequences and a binary
 // encoding of all coarse links.
 func (coarsedb *CoarseDB) save() error {
 	coarsedb.seqLock.RLock()
@@ -391,7 +546,7 @@ func (coarsedb *CoarseDB) save() error {
 
 	wg.Add(1)
 	go func() {
-		if err := coarsedb.saveFasta(); err != nil {
+		if err := coarsedb.savePacked(); err != nil {
 			errc <- err
 		}
 		wg.Done()
@@ -413,6 +568,14 @@ func (coarsedb *CoarseDB) save() error {
 			}
 			wg.Done()
 		}()
+
+		wg.Add(1)
+		go func() {
+			if err := coarsedb.saveSeedsPlain(); err != nil {
+				errc <- err
+			}
+			wg.Done()
+		}()
 	}
 	wg.Wait()
 
@@ -1,15 +1,19 @@
 package cablastp
 
 import (
+	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 )
 
 const (
 	FileCompressed = "compressed"
 	FileIndex      = "compressed.index"
+	FileAliases    = "compressed.aliases"
 )
 
 // A CompressedDB corresponds to a list of all original sequences compressed
@@ -27,6 +31,24 @@ type CompressedDB struct {
 	File  *os.File
 	Index *os.File
 
+	// Aliases lists every alias in the compressed database as a pair of
+	// big-endian uint32s: the id of the alias and the id of the sequence it
+	// is a duplicate of.
+	Aliases *os.File
+
+	// headers holds the FASTA header of every original sequence, or is nil
+	// if the database stores headers in the compressed records instead.
+	// When the database has a header store, reading a sequence doesn't read
+	// its header; the name is only read by LoadName or ReadName.
+	headers *headerStore
+
+	// blockSize is the number of records in each block when the compressed
+	// database is block compressed, and 0 otherwise. When reading a block
+	// compressed database, 'blocks' finds records by their addresses in the
+	// index. (See blocks.go.)
+	blockSize int
+	blocks    *blockReader
+
 	// The size of the compressed database index in bytes. Since the index
 	// contains precisely one 64-bit integer byte offset for every sequence
 	// in the compressed database, the index size can be used to quickly
@@ -39,8 +61,22 @@ type CompressedDB struct {
 	writerChan chan CompressedSeq
 	writerDone chan struct{}
 
+	// Sorts the names of every original sequence written into the name
+	// table when the database is saved, or nil if the database doesn't keep
+	// a name table.
+	names *nameSorter
+
+	// Statistics of the sequences written, which are finished and stored
+	// when the database is saved.
+	stats DBStats
+
+	// Writes the diagnostics of every compressed sequence if they were
+	// started. (See diagnostics.go.)
+	diagnostics *diagnosticsWriter
+
 	// A compressed database is stored in CSV format. Each CSV record contains
-	// the original sequence's header, followed by a list of quadruples, where
+	// the original sequence's header (which is empty if the database has a
+	// header store), followed by a list of quadruples, where
 	// each quadruple is a pointer to a region ina the coarse database: a coarse
 	// sequence identifier, the start/end of the coarse sequence, and an edit
 	// script. Combined, this information can recover the original sequence
@@ -49,6 +85,14 @@ type CompressedDB struct {
 
 	// Caches already read sequences from the compressed database while reading.
 	seqCache map[int]OriginalSeq
+
+	// Maps the id of every sequence with duplicates to the ids of its
+	// aliases while reading.
+	aliases map[int][]int
+
+	// readLock serializes reading records, so that sequences can be read
+	// concurrently.
+	readLock sync.Mutex
 }
 
 // newWriteCompressedDB creates a new compressed database ready for writing.
@@ -63,6 +107,7 @@ func newWriteCompressedDB(db *DB) (*CompressedDB, error) {
 		Index:      nil,
 		writerChan: make(chan CompressedSeq, 500),
 		writerDone: make(chan struct{}, 0),
+		blockSize:  db.CompressBlockSize,
 	}
 
 	fileFlags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
@@ -74,6 +119,16 @@ func newWriteCompressedDB(db *DB) (*CompressedDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	cdb.Aliases, err = os.OpenFile(db.filePath(FileAliases), fileFlags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if cdb.headers, err = newWriteHeaderStore(db); err != nil {
+		return nil, err
+	}
+	if db.NameTable {
+		cdb.names = newNameSorter(db.Path)
+	}
 
 	info, err := cdb.Index.Stat()
 	if err != nil {
@@ -100,15 +155,25 @@ func newReadCompressedDB(db *DB) (*CompressedDB, error) {
 		writerChan: nil,
 		writerDone: nil,
 		csvReader:  nil,
+		blockSize:  db.CompressBlockSize,
 	}
 	cdb.File, err = db.openReadFile(FileCompressed)
 	if err != nil {
 		return nil, err
 	}
+	if cdb.blockSize > 0 {
+		cdb.blocks = newBlockReader(cdb.File)
+	}
 	cdb.Index, err = db.openReadFile(FileIndex)
 	if err != nil {
 		return nil, err
 	}
+	if cdb.aliases, err = readAliases(db); err != nil {
+		return nil, fmt.Errorf("Could not read aliases: %s", err)
+	}
+	if cdb.headers, err = newReadHeaderStore(db); err != nil {
+		return nil, fmt.Errorf("Could not open headers: %s", err)
+	}
 
 	info, err := cdb.Index.Stat()
 	if err != nil {
@@ -124,6 +189,40 @@ func newReadCompressedDB(db *DB) (*CompressedDB, error) {
 	return cdb, nil
 }
 
+// readAliases reads the aliases of a database, if it has any. (Databases
+// created before aliases existed don't have an aliases file.)
+func readAliases(db *DB) (map[int][]int, error) {
+	aliases := make(map[int][]int)
+	f, err := os.Open(db.filePath(FileAliases))
+	if os.IsNotExist(err) {
+		return aliases, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pair [2]uint32
+	for {
+		err := binary.Read(f, binary.BigEndian, &pair)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		target := int(pair[1])
+		aliases[target] = append(aliases[target], int(pair[0]))
+	}
+	return aliases, nil
+}
+
+// AliasesOf returns the ids of the sequences that are exact duplicates of
+// the sequence with id 'orgSeqId', in increasing order.
+//
+// AliasesOf only works when the compressed database is open for reading.
+func (comdb *CompressedDB) AliasesOf(orgSeqId int) []int {
+	return comdb.aliases[orgSeqId]
+}
+
 // SeqGet reads a sequence from the compressed database, and decompressed it
 // using the coarse database provided. The decompressed sequence is then added
 // to cache.
@@ -132,7 +231,7 @@ func newReadCompressedDB(db *DB) (*CompressedDB, error) {
 // from cache is returned.
 //
 // SeqGet will panic if it is called while a compressed database is open for
-// writing.
+// writing. Unlike ReadSeq, it is not safe for concurrent use.
 func (comdb *CompressedDB) SeqGet(
 	coarsedb *CoarseDB, orgSeqId int) (OriginalSeq, error) {
 
@@ -161,14 +260,37 @@ func (comdb *CompressedDB) NumSequences() int {
 func (comdb *CompressedDB) readClose() {
 	comdb.File.Close()
 	comdb.Index.Close()
+	if comdb.headers != nil {
+		comdb.headers.readClose()
+	}
 }
 
 // writeClose closes all appropriate files used in writing a compressed
 // database. It will also wait for the writer goroutine to finish.
 func (comdb *CompressedDB) writeClose() {
+	comdb.finishWriting()
+}
+
+// finishWriting waits for every queued compressed sequence to be written,
+// after which nothing else can be written.
+func (comdb *CompressedDB) finishWriting() {
+	if comdb.writerDone == nil {
+		return
+	}
 	close(comdb.writerChan) // will close comdb.File
 	// Wait for the writer goroutine to finish.
 	<-comdb.writerDone
+	comdb.writerDone = nil
+
+	// Diagnostics are only a by-product, so failing to write them doesn't
+	// stop the database from being saved.
+	if comdb.diagnostics != nil {
+		if err := comdb.diagnostics.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write %s: %s\n",
+				FileDiagnostics, err)
+		}
+		comdb.diagnostics = nil
+	}
 }
 
 // Write queues a new compressed sequence to be written to disk.
@@ -181,34 +303,80 @@ type CompressedSeq struct {
 	// A sequence number.
 	Id int
 
-	// Name is an uncompressed string from the original FASTA header.
+	// Name is an uncompressed string from the original FASTA header. When
+	// read from a database with a header store, it is only set by LoadName.
 	Name string
 
 	// Links is an ordered lists of links to portions of the reference
 	// database. When all links are followed, the concatenation of each
 	// sequence corresponding to each link equals the entire original sequence.
 	Links []LinkToCoarse
+
+	// AliasOf is the id of the sequence that this sequence is an exact
+	// duplicate of, or -1 if it isn't an alias. An alias has no links; it
+	// only has its own name.
+	AliasOf int
+
+	// names is the compressed database that the name is loaded from, if it
+	// hasn't been read yet.
+	names *CompressedDB
+
+	// coder range codes the residues of links added with DB.EncodeOrigSeq.
+	coder *ResidueCoder
 }
 
 // NewCompressedSeq creates a CompressedSeq value using the name provided.
 // The Link slice is initialized but empty.
 func NewCompressedSeq(id int, name string) CompressedSeq {
 	return CompressedSeq{
-		Id:    id,
-		Name:  name,
-		Links: make([]LinkToCoarse, 0, 10),
+		Id:      id,
+		Name:    name,
+		Links:   make([]LinkToCoarse, 0, 10),
+		AliasOf: -1,
+	}
+}
+
+// NewAliasSeq creates a CompressedSeq value for a sequence named 'name' that
+// has the same residues as the sequence with id 'aliasOf'.
+func NewAliasSeq(id int, name string, aliasOf int) CompressedSeq {
+	return CompressedSeq{
+		Id:      id,
+		Name:    name,
+		AliasOf: aliasOf,
 	}
 }
 
+// IsAlias returns true if the compressed sequence is an exact duplicate of
+// another compressed sequence.
+func (cseq CompressedSeq) IsAlias() bool {
+	return cseq.AliasOf >= 0
+}
+
 func (cseq CompressedSeq) String() string {
+	if cseq.IsAlias() {
+		return fmt.Sprintf("alias of: %d", cseq.AliasOf)
+	}
 	lines := make([]string, len(cseq.Links))
 	for i, link := range cseq.Links {
 		lines[i] = fmt.Sprintf("coarse id: %d, start: %d, end: %d\n%s",
-			link.CoarseSeqId, link.CoarseStart, link.CoarseEnd)
+			link.CoarseSeqId, link.CoarseStart, link.CoarseEnd, link.OrigSeq)
 	}
 	return strings.Join(lines, "\n")
 }
 
+// LoadName returns the name of the compressed sequence, and reads it from the
+// header store of its database if it hasn't been read yet.
+func (cseq *CompressedSeq) LoadName() (string, error) {
+	if cseq.names != nil {
+		name, err := cseq.names.ReadName(cseq.Id)
+		if err != nil {
+			return "", err
+		}
+		cseq.Name, cseq.names = name, nil
+	}
+	return cseq.Name, nil
+}
+
 // Add will add a LinkToCoarse to the end of the CompressedSeq's Links list.
 func (cseq *CompressedSeq) Add(link LinkToCoarse) {
 
@@ -220,26 +388,136 @@ func (cseq *CompressedSeq) Add(link LinkToCoarse) {
 // subsequences are appended.
 func (cseq CompressedSeq) Decompress(coarse *CoarseDB) (OriginalSeq, error) {
 	residues := make([]byte, 0, 20)
+	rc := NewResidueCoder(coarse.alpha)
 	for _, lk := range cseq.Links {
-		if lk.CoarseSeqId < 0 || lk.CoarseSeqId >= uint(coarse.NumSequences()) {
-			return OriginalSeq{},
-				fmt.Errorf("Cannot decompress compressed sequence (id: %d), "+
-					"because a link refers to an invalid coarse sequence "+
-					"id: %d.", cseq.Id, lk.CoarseSeqId)
+		linkResidues, err := cseq.linkResidues(coarse, rc, lk)
+		if err != nil {
+			return OriginalSeq{}, err
 		}
+		residues = append(residues, linkResidues...)
+	}
+	oseq := NewOriginalSeq(cseq.Id, cseq.Name, residues)
+	oseq.names = cseq.names
+	return *oseq, nil
+}
+
+// DecompressRange is like Decompress, except that only the residues in
+// [from, to) are decompressed, and only the links that overlap them are
+// followed. (Range coded links before them in the same block of
+// residueCodingBlock links are decoded too, since the links of a block can
+// only be decoded in order.) The range is clamped to the length of the
+// sequence.
+func (cseq CompressedSeq) DecompressRange(
+	coarse *CoarseDB, from, to int) (OriginalSeq, error) {
+
+	ranges, err := cseq.OriginalRanges()
+	if err != nil {
+		return OriginalSeq{}, err
+	}
+	first := 0
+	for first < len(ranges) && ranges[first][1] <= from {
+		first++
+	}
+	residues := make([]byte, 0, 20)
+	if first == len(ranges) || ranges[first][0] >= to {
+		oseq := NewOriginalSeq(cseq.Id, cseq.Name, residues)
+		oseq.names = cseq.names
+		return *oseq, nil
+	}
 
-		// if len(lk.OrigSeq) == 0 {
-		//   residues = append(residues, lk.OrigSeq...)
-		// } else {
-		//   coarseSeq, err := coarse.ReadCoarseSeq(int(lk.CoarseSeqId))
-		//   if err != nil {
-		//     return OriginalSeq{}, err
-		//   }
-		//   subCorres := coarseSeq.Residues[lk.CoarseStart:lk.CoarseEnd]
-		//   residues = append(residues, subCorres...)
-		// }
+	rc := NewResidueCoder(coarse.alpha)
+	block := first - first%residueCodingBlock
+	rc.seek(block)
+	for i := block; i < len(cseq.Links) && ranges[i][0] < to; i++ {
+		lk := cseq.Links[i]
+		if i < first && !IsEncodedResidues(lk.OrigSeq) {
+			rc.next()
+			continue
+		}
+		linkResidues, err := cseq.linkResidues(coarse, rc, lk)
+		if err != nil {
+			return OriginalSeq{}, err
+		}
+		if i >= first {
+			pos := ranges[i][0]
+			start, end := max(from-pos, 0), min(to-pos, len(linkResidues))
+			residues = append(residues, linkResidues[start:end]...)
+		}
+	}
+	oseq := NewOriginalSeq(cseq.Id, cseq.Name, residues)
+	oseq.names = cseq.names
+	return *oseq, nil
+}
 
-		residues = append(residues, lk.OrigSeq...)
+// Len returns the number of residues in the compressed sequence without
+// decompressing it. (An alias has no residues of its own.)
+func (cseq CompressedSeq) Len() (int, error) {
+	length := 0
+	for _, lk := range cseq.Links {
+		n, err := cseq.linkLen(lk)
+		if err != nil {
+			return 0, err
+		}
+		length += n
+	}
+	return length, nil
+}
+
+// OriginalRanges returns the range [start, end) of original residues that
+// each link of the compressed sequence decompresses to.
+func (cseq CompressedSeq) OriginalRanges() ([][2]int, error) {
+	ranges := make([][2]int, len(cseq.Links))
+	pos := 0
+	for i, lk := range cseq.Links {
+		n, err := cseq.linkLen(lk)
+		if err != nil {
+			return nil, err
+		}
+		ranges[i] = [2]int{pos, pos + n}
+		pos += n
+	}
+	return ranges, nil
+}
+
+// linkLen returns the number of original residues of a link.
+func (cseq CompressedSeq) linkLen(lk LinkToCoarse) (int, error) {
+	if !IsEncodedResidues(lk.OrigSeq) {
+		return len(lk.OrigSeq), nil
+	}
+	if lk.CoarseStart > lk.CoarseEnd {
+		return 0, fmt.Errorf("Compressed sequence %d has a link that ends "+
+			"before it starts.", cseq.Id)
+	}
+	return encodedLen(int(lk.CoarseEnd-lk.CoarseStart), lk.OrigSeq)
+}
+
+// linkResidues returns the original residues of a link. Range coded residues
+// are decoded with 'rc', which must have decoded every link before it in its
+// block.
+func (cseq CompressedSeq) linkResidues(
+	coarse *CoarseDB, rc *ResidueCoder, lk LinkToCoarse) ([]byte, error) {
+
+	if lk.CoarseSeqId < 0 || lk.CoarseSeqId >= uint(coarse.NumSequences()) {
+		return nil, fmt.Errorf("Cannot decompress compressed sequence "+
+			"(id: %d), because a link refers to an invalid coarse sequence "+
+			"id: %d.", cseq.Id, lk.CoarseSeqId)
+	}
+	if !IsEncodedResidues(lk.OrigSeq) {
+		return rc.Decode(nil, lk.OrigSeq)
+	}
+
+	// Range coded residues are decoded against the part of the coarse
+	// sequence that the link points to.
+	coarseSeq, err := coarse.ReadCoarseSeq(int(lk.CoarseSeqId))
+	if err != nil {
+		return nil, err
+	}
+	if lk.CoarseStart > lk.CoarseEnd ||
+		int(lk.CoarseEnd) > len(coarseSeq.Residues) {
+		return nil, fmt.Errorf("Cannot decompress compressed sequence "+
+			"(id: %d), because a link ends past the end of coarse "+
+			"sequence %d.", cseq.Id, lk.CoarseSeqId)
 	}
-	return *NewOriginalSeq(cseq.Id, cseq.Name, residues), nil
+	subCorres := coarseSeq.Residues[lk.CoarseStart:lk.CoarseEnd]
+	return rc.Decode(subCorres, lk.OrigSeq)
 }
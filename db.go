@@ -2,6 +2,7 @@ package cablastp
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -35,6 +36,19 @@ type DB struct {
 	// The coarse database component.
 	CoarseDB *CoarseDB
 
+	// The reduced alphabet named by the configuration. Every sequence in the
+	// coarse database, and every query searched against it, is reduced with
+	// this alphabet.
+	Alphabet *Alphabet
+
+	// The shape of the seeds used to find matches in the coarse database,
+	// as described by the configuration.
+	SeedShape SeedShape
+
+	// Statistics of the database, which are stored when it is saved. When
+	// reading a database saved before statistics were stored, Stats is nil.
+	Stats *DBStats
+
 	// File pointers.
 	coarseFasta, coarseSeeds, coarseLinks, compressed, index, params *os.File
 }
@@ -44,7 +58,6 @@ type DB struct {
 // An error is returned if there is a problem accessing any of the files in
 // the database.
 //
-//
 // 'conf' should be a database configuration, typically defined (initially) from
 // command line parameters.
 func NewWriteDB(conf *DBConf, dir string) (*DB, error) {
@@ -82,6 +95,23 @@ func NewWriteDB(conf *DBConf, dir string) (*DB, error) {
 		Path:   dir,
 		params: nil,
 	}
+	if db.Alphabet, err = ParseAlphabet(conf.ReducedAlphabet); err != nil {
+		return nil, err
+	}
+	if err = checkResidueCoding(conf.ResidueCoding); err != nil {
+		return nil, err
+	}
+	if conf.CompressBlockSize < 0 {
+		return nil, fmt.Errorf("The block size must not be negative.")
+	}
+	if db.SeedShape, err = NewSeedShape(conf); err != nil {
+		return nil, err
+	}
+	db.MapSeedSize = db.SeedShape.Span
+	_, err = SeedTableSize(db.Alphabet, db.SeedShape.Weight())
+	if err != nil {
+		return nil, err
+	}
 
 	// Do a sanity check and make sure we can access the `makeblastdb`
 	// executable. Otherwise we might do a lot of work for nothing...
@@ -147,6 +177,11 @@ func NewReadDB(dir string) (*DB, error) {
 		return nil, fmt.Errorf("Could not open '%s' for reading "+
 			"because: %s.", dir, err)
 	}
+	if IsSharded(dir) {
+		return nil, fmt.Errorf("'%s' is a sharded database. Each of its "+
+			"shards (listed in '%s') must be opened on its own.",
+			dir, FileShards)
+	}
 
 	db := &DB{
 		Name:        path.Base(dir),
@@ -165,6 +200,20 @@ func NewReadDB(dir string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err = db.params.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	if db.Stats, err = LoadDBStats(db.params); err != nil {
+		return nil, err
+	}
+	db.Alphabet, err = ParseAlphabet(db.ReducedAlphabet)
+	if err != nil {
+		return nil, err
+	}
+	db.SeedShape, err = NewSeedShape(db.DBConf)
+	if err != nil {
+		return nil, err
+	}
 
 	// Do a sanity check and make sure we can access the `makeblastdb`
 	// and `blastp` executables. Otherwise we might do a lot of work for
@@ -203,9 +252,10 @@ func (db *DB) openReadFile(name string) (*os.File, error) {
 // database.
 //
 // N.B. The compressed database is written as each sequence is processed, so
-// this call will only save the coarse database. This may take a *very* long
-// time if the database is not read only (since the seeds table has to be
-// written).
+// this call will only save the coarse database and the name table of the
+// compressed database. This may take a *very* long time if the database is
+// not read only (since the seeds table has to be written). No sequences can
+// be compressed after the database is saved.
 func (db *DB) Save() error {
 	var err error
 	// Make sure the params file is truncated so that we overwrite any
@@ -227,26 +277,46 @@ func (db *DB) Save() error {
 		return err
 	}
 
-	// Now we need to construct a blastp database from the coarse fasta file.
-	// e.g., `makeblastdb -dbtype nucl -in coarse.fasta`
+	// The name table can only be sorted once every compressed sequence has
+	// been written, so nothing can be compressed after saving.
+	db.ComDB.finishWriting()
+	if err = db.ComDB.saveNames(db); err != nil {
+		return err
+	}
+
+	// Statistics are stored after the configuration in the params file.
+	if err = db.saveStats(); err != nil {
+		return err
+	}
+
+	// Now we need to construct a BLAST database from the coarse sequences.
+	// They are streamed to makeblastdb as FASTA, since coarse.fasta isn't
+	// stored in the database.
+	// e.g., `makeblastdb -dbtype nucl -in - -title coarse.fasta`
+	// The type of the database depends on the reduced alphabet.
 	cmd := exec.Command(
-		db.BlastMakeBlastDB, "-dbtype", "nucl",
-		"-in", FileCoarseFasta, "-out", FileBlastCoarse)
+		db.BlastMakeBlastDB, "-dbtype", db.Alphabet.BlastDBType(),
+		"-in", "-", "-title", FileCoarseFasta, "-out", FileBlastCoarse)
 	cmd.Dir = db.Path
 
+	fastaPipe, w := io.Pipe()
+	cmd.Stdin = fastaPipe
+	go func() {
+		w.CloseWithError(db.CoarseDB.writePlainFasta(w))
+	}()
+
 	Vprintf("Creating %s...\n", FileBlastCoarse)
-	if err = Exec(cmd); err != nil {
+	err = Exec(cmd)
+
+	// Stop streaming if makeblastdb quit before reading everything.
+	fastaPipe.Close()
+	if err != nil {
 		return err
 	}
 	Vprintf("Done creating %s.\n", FileBlastCoarse)
 	return nil
 }
 
-func (db *DB) CoarseFastaLocation() string {
-	s := db.CoarseDB.FileFasta.Name()
-	return s
-}
-
 // ReadClose closes all appropriate files after reading from a database.
 func (db *DB) ReadClose() {
 	db.params.Close()
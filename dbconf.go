@@ -24,6 +24,14 @@ type DBConf struct {
 	ReadOnly            bool
 	BlastMakeBlastDB    string
 	BlastDBSize         uint64
+	ReducedAlphabet     string
+	SeedPattern         string
+	SeedSampling        string
+	SeedWindow          int
+	ResidueCoding       string
+	CompressBlockSize   int
+	Lossless            bool
+	NameTable           bool
 }
 
 var DefaultDBConf = &DBConf{
@@ -42,6 +50,14 @@ var DefaultDBConf = &DBConf{
 	ReadOnly:            true,
 	BlastMakeBlastDB:    "makeblastdb",
 	BlastDBSize:         0,
+	ReducedAlphabet:     DefaultAlphabet,
+	SeedPattern:         "",
+	SeedSampling:        "all",
+	SeedWindow:          8,
+	ResidueCoding:       CodingPlain,
+	CompressBlockSize:   0,
+	Lossless:            false,
+	NameTable:           true,
 }
 
 func (conf *DBConf) DeepCopy() *DBConf {
@@ -62,6 +78,14 @@ func (conf *DBConf) DeepCopy() *DBConf {
 		ReadOnly:            conf.ReadOnly,
 		BlastMakeBlastDB:    conf.BlastMakeBlastDB,
 		BlastDBSize:         conf.BlastDBSize,
+		ReducedAlphabet:     conf.ReducedAlphabet,
+		SeedPattern:         conf.SeedPattern,
+		SeedSampling:        conf.SeedSampling,
+		SeedWindow:          conf.SeedWindow,
+		ResidueCoding:       conf.ResidueCoding,
+		CompressBlockSize:   conf.CompressBlockSize,
+		Lossless:            conf.Lossless,
+		NameTable:           conf.NameTable,
 	}
 	return &copied
 }
@@ -93,6 +117,23 @@ func (flagConf *DBConf) FlagMerge(fileConf *DBConf) (*DBConf, error) {
 		return flagConf, fmt.Errorf("The read-only setting cannot be changed " +
 			"for an existing database.")
 	}
+	if only["reduced-alphabet"] {
+		return flagConf, fmt.Errorf("The reduced alphabet cannot be changed " +
+			"for an existing database.")
+	}
+	if only["seed-pattern"] || only["seed-sampling"] || only["seed-window"] {
+		return flagConf, fmt.Errorf("The seed pattern and sampling cannot " +
+			"be changed for an existing database.")
+	}
+
+	if only["block-size"] {
+		return flagConf, fmt.Errorf("The block size cannot be changed for " +
+			"an existing database.")
+	}
+	if only["lossless"] {
+		return flagConf, fmt.Errorf("The lossless setting cannot be changed " +
+			"for an existing database.")
+	}
 
 	if !only["min-match-len"] {
 		flagConf.MinMatchLen = fileConf.MinMatchLen
@@ -136,6 +177,18 @@ func (flagConf *DBConf) FlagMerge(fileConf *DBConf) (*DBConf, error) {
 	if !only["dbsize"] {
 		flagConf.BlastDBSize = fileConf.BlastDBSize
 	}
+	if !only["residue-coding"] {
+		flagConf.ResidueCoding = fileConf.ResidueCoding
+	}
+	if !only["name-table"] {
+		flagConf.NameTable = fileConf.NameTable
+	}
+	flagConf.ReducedAlphabet = fileConf.ReducedAlphabet
+	flagConf.SeedPattern = fileConf.SeedPattern
+	flagConf.SeedSampling = fileConf.SeedSampling
+	flagConf.SeedWindow = fileConf.SeedWindow
+	flagConf.CompressBlockSize = fileConf.CompressBlockSize
+	flagConf.Lossless = fileConf.Lossless
 	return flagConf, nil
 }
 
@@ -0,0 +1,134 @@
+package cablastp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// FileDiagnostics is an optional table of how every original sequence was
+// compressed, as tab separated values with a header line.
+const FileDiagnostics = "compressed.diagnostics"
+
+// SeqDiagnostics records how an original sequence was compressed.
+type SeqDiagnostics struct {
+	OrgSeqId int
+
+	// The id of the sequence this one is an exact duplicate of, or -1. Only
+	// Residues is set for an alias.
+	AliasOf int
+
+	Residues int
+
+	// The number of K-mers looked up in the seeds table, and the number of
+	// seed locations that a match was extended from.
+	SeedLookups int
+	SeedsTried  int
+
+	// The number of matches to coarse sequences that were accepted, and the
+	// number of residues they cover.
+	Matches        int
+	LinkedResidues int
+
+	// The number of residues that matched nothing, and were added to the
+	// coarse database as new coarse sequences.
+	NovelResidues int
+
+	// The time spent extending seeds into matches.
+	ExtensionTime time.Duration
+}
+
+// NewSeqDiagnostics returns empty diagnostics for the original sequence with
+// id 'orgSeqId' and 'residues' residues.
+func NewSeqDiagnostics(orgSeqId, residues int) SeqDiagnostics {
+	return SeqDiagnostics{
+		OrgSeqId: orgSeqId,
+		AliasOf:  -1,
+		Residues: residues,
+	}
+}
+
+// diagnosticsHeader names the columns of the diagnostics table.
+const diagnosticsHeader = "#original_id\talias_of\tresidues\tseed_lookups\t" +
+	"seeds_tried\tmatches\tlinked_residues\tnovel_residues\textension_ms\n"
+
+// diagnosticsWriter writes the diagnostics table in its own goroutine, in the
+// order of original sequence ids.
+type diagnosticsWriter struct {
+	file *os.File
+	rows chan SeqDiagnostics
+	done chan error
+}
+
+// StartDiagnostics creates the diagnostics table of a database that is open
+// for writing. Once it is started, the diagnostics of every compressed
+// sequence must be written with CompressedDB.WriteDiagnostics.
+func (db *DB) StartDiagnostics() error {
+	f, err := db.openWriteFile(FileDiagnostics)
+	if err != nil {
+		return err
+	}
+	dw := &diagnosticsWriter{
+		file: f,
+		rows: make(chan SeqDiagnostics, 500),
+		done: make(chan error, 1),
+	}
+	go dw.writer(db.ComDB.NumSequences())
+	db.ComDB.diagnostics = dw
+	return nil
+}
+
+// Diagnosing returns true if diagnostics are being written.
+func (comdb *CompressedDB) Diagnosing() bool {
+	return comdb.diagnostics != nil
+}
+
+// WriteDiagnostics queues the diagnostics of a compressed sequence to be
+// written. If diagnostics aren't being written, it does nothing.
+func (comdb *CompressedDB) WriteDiagnostics(diag SeqDiagnostics) {
+	if comdb.diagnostics != nil {
+		comdb.diagnostics.rows <- diag
+	}
+}
+
+// writer writes rows as soon as every row before them has been written.
+// 'next' is the id of the first original sequence.
+func (dw *diagnosticsWriter) writer(next int) {
+	w := bufio.NewWriter(dw.file)
+	_, err := w.WriteString(diagnosticsHeader)
+
+	waiting := make(map[int]SeqDiagnostics)
+	for diag := range dw.rows {
+		waiting[diag.OrgSeqId] = diag
+		for ready, ok := waiting[next]; ok; ready, ok = waiting[next] {
+			delete(waiting, next)
+			next++
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.3f\n",
+				ready.OrgSeqId, ready.AliasOf, ready.Residues,
+				ready.SeedLookups, ready.SeedsTried, ready.Matches,
+				ready.LinkedResidues, ready.NovelResidues,
+				ready.ExtensionTime.Seconds()*1000)
+		}
+	}
+	if err == nil && len(waiting) > 0 {
+		err = fmt.Errorf("The diagnostics of sequence %d were never written.",
+			next)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := dw.file.Close(); err == nil {
+		err = cerr
+	}
+	dw.done <- err
+}
+
+// close waits for every queued row to be written, and closes the table.
+func (dw *diagnosticsWriter) close() error {
+	close(dw.rows)
+	return <-dw.done
+}
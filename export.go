@@ -0,0 +1,175 @@
+package cablastp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/TuftsBCB/io/fasta"
+)
+
+// ExportFasta writes every original sequence of a database that is open for
+// reading as FASTA.
+func (db *DB) ExportFasta(out io.Writer) error {
+	fastaWriter := fasta.NewWriter(out)
+	for id := 0; id < db.ComDB.NumSequences(); id++ {
+		oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+		}
+		if _, err := oseq.LoadName(); err != nil {
+			return fmt.Errorf("Error reading name of seq id '%d': %s", id, err)
+		}
+		if err := fastaWriter.Write(oseq.FastaSeq()); err != nil {
+			return err
+		}
+	}
+	return fastaWriter.Flush()
+}
+
+// ExportClusters writes the original sequences linked to each coarse
+// sequence. As TSV, every line is a coarse sequence id and the label of one
+// of its original sequences. In the MCL cluster format, every line is the
+// tab separated labels of the original sequences of one coarse sequence.
+// Coarse sequences without links aren't written in the MCL format.
+//
+// Original sequences are labeled by their id, or by the first word of their
+// FASTA header if 'names' is set.
+func (db *DB) ExportClusters(out io.Writer, mcl, names bool) error {
+	for coarseId := 0; coarseId < db.CoarseDB.NumSequences(); coarseId++ {
+		ids, err := db.CoarseDB.LinkedSeqIds(db.ComDB, coarseId)
+		if err != nil {
+			return fmt.Errorf("Could not read links of coarse sequence %d: %s",
+				coarseId, err)
+		}
+		labels := make([]string, len(ids))
+		for i, id := range ids {
+			if labels[i], err = db.clusterLabel(id, names); err != nil {
+				return err
+			}
+		}
+		if mcl {
+			if len(labels) == 0 {
+				continue
+			}
+			_, err = fmt.Fprintln(out, strings.Join(labels, "\t"))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, l := range labels {
+			if _, err := fmt.Fprintf(out, "%d\t%s\n", coarseId, l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clusterLabel returns how the original sequence with id 'id' is labeled in
+// clusters.
+func (db *DB) clusterLabel(id int, names bool) (string, error) {
+	if !names {
+		return strconv.Itoa(id), nil
+	}
+	name, err := db.ComDB.ReadName(id)
+	if err != nil {
+		return "", fmt.Errorf("Error reading name of seq id '%d': %s", id, err)
+	}
+	if words := strings.Fields(name); len(words) > 0 {
+		return words[0], nil
+	}
+	return strconv.Itoa(id), nil
+}
+
+// readWithTarget reads the compressed sequence with id 'id'. If it is an
+// alias, the sequence it is an alias of is returned too, since aliases have
+// no links of their own.
+func (db *DB) readWithTarget(
+	id int) (cseq, target CompressedSeq, err error) {
+
+	if cseq, err = db.ComDB.ReadCompressedSeq(id); err != nil {
+		return
+	}
+	target = cseq
+	if cseq.IsAlias() {
+		target, err = db.ComDB.ReadCompressedSeq(cseq.AliasOf)
+	}
+	return
+}
+
+// ExportLinks writes a table of the links of every original sequence. Every
+// line is an original sequence id, the coarse sequence id of one of its
+// links, and the ranges of the coarse and original sequences that the link
+// covers. Ranges are half open.
+func (db *DB) ExportLinks(out io.Writer) error {
+	_, err := fmt.Fprintln(out, "#original_id\tcoarse_id\tcoarse_start\t"+
+		"coarse_end\toriginal_start\toriginal_end")
+	if err != nil {
+		return err
+	}
+	for id := 0; id < db.ComDB.NumSequences(); id++ {
+		_, target, err := db.readWithTarget(id)
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+		}
+		ranges, err := target.OriginalRanges()
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+		}
+		for i, lk := range target.Links {
+			_, err := fmt.Fprintf(out, "%d\t%d\t%d\t%d\t%d\t%d\n",
+				id, lk.CoarseSeqId, lk.CoarseStart, lk.CoarseEnd,
+				ranges[i][0], ranges[i][1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonRecord is a summary of an original sequence in the JSON Lines format.
+type jsonRecord struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	Length  int    `json:"length"`
+	Links   int    `json:"links"`
+	AliasOf *int   `json:"alias_of,omitempty"`
+}
+
+// ExportJSON writes a JSON object summarizing every original sequence, one
+// per line.
+func (db *DB) ExportJSON(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	for id := 0; id < db.ComDB.NumSequences(); id++ {
+		cseq, target, err := db.readWithTarget(id)
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+		}
+		name, err := db.ComDB.ReadName(id)
+		if err != nil {
+			return fmt.Errorf("Error reading name of seq id '%d': %s", id, err)
+		}
+		length, err := target.Len()
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+		}
+		record := jsonRecord{
+			Id:     id,
+			Name:   name,
+			Length: length,
+			Links:  len(target.Links),
+		}
+		if cseq.IsAlias() {
+			record.AliasOf = &cseq.AliasOf
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package cablastp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db := createNamedTestDB(t, filepath.Join(tmpDir, "db"), nil)
+	defer db.ReadClose()
+
+	tests := []struct {
+		name   string
+		export func(out *bytes.Buffer) error
+		want   string
+	}{
+		{
+			"fasta",
+			func(out *bytes.Buffer) error { return db.ExportFasta(out) },
+			">gi|1|ref|NP_1.1| first\x01gi|2|gb|AB_2.3| first copy\n" +
+				testSeqA[:60] + "\n" + testSeqA[60:] +
+				"\n>sp|P69905|HBA_HUMAN second\n" +
+				testSeqB[:60] + "\n" + testSeqB[60:] +
+				"\n>gi|3|ref|NP_1.2| third\n" +
+				testSeqA[:60] + "\n" + testSeqA[60:] +
+				"\n>12345 variant\n" + testSeqC[:60] + "\n" + testSeqC[60:] +
+				"\n",
+		},
+		{
+			"clusters",
+			func(out *bytes.Buffer) error {
+				return db.ExportClusters(out, false, false)
+			},
+			"0\t0\n0\t2\n0\t3\n1\t0\n1\t2\n1\t3\n2\t1\n3\t1\n",
+		},
+		{
+			"clusters with names",
+			func(out *bytes.Buffer) error {
+				return db.ExportClusters(out, false, true)
+			},
+			"0\tgi|1|ref|NP_1.1|\n0\tgi|3|ref|NP_1.2|\n0\t12345\n" +
+				"1\tgi|1|ref|NP_1.1|\n1\tgi|3|ref|NP_1.2|\n1\t12345\n" +
+				"2\tsp|P69905|HBA_HUMAN\n3\tsp|P69905|HBA_HUMAN\n",
+		},
+		{
+			"mcl",
+			func(out *bytes.Buffer) error {
+				return db.ExportClusters(out, true, false)
+			},
+			"0\t2\t3\n0\t2\t3\n1\n1\n",
+		},
+		{
+			"links",
+			func(out *bytes.Buffer) error { return db.ExportLinks(out) },
+			"#original_id\tcoarse_id\tcoarse_start\tcoarse_end\t" +
+				"original_start\toriginal_end\n" +
+				"0\t0\t0\t40\t0\t40\n0\t1\t0\t26\t40\t66\n" +
+				"1\t2\t0\t40\t0\t40\n1\t3\t0\t25\t40\t65\n" +
+				"2\t0\t0\t40\t0\t40\n2\t1\t0\t26\t40\t66\n" +
+				"3\t0\t0\t40\t0\t40\n3\t1\t0\t26\t40\t66\n",
+		},
+		{
+			"jsonl",
+			func(out *bytes.Buffer) error { return db.ExportJSON(out) },
+			`{"id":0,"name":"gi|1|ref|NP_1.1| first\u0001gi|2|gb|AB_2.3| ` +
+				`first copy","length":66,"links":2}` + "\n" +
+				`{"id":1,"name":"sp|P69905|HBA_HUMAN second","length":65,` +
+				`"links":2}` + "\n" +
+				`{"id":2,"name":"gi|3|ref|NP_1.2| third","length":66,` +
+				`"links":2,"alias_of":0}` + "\n" +
+				`{"id":3,"name":"12345 variant","length":66,"links":2}` +
+				"\n",
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := test.export(&out); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if out.String() != test.want {
+			t.Fatalf("Exporting %s wrote\n%s\nbut should have written\n%s",
+				test.name, out.String(), test.want)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package cablastp
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
 	"strings"
-	"bytes"
 
 	"github.com/TuftsBCB/io/fasta"
 	"github.com/TuftsBCB/seq"
@@ -16,6 +18,35 @@ import (
 type ReadOriginalSeq struct {
 	Seq *OriginalSeq
 	Err error
+
+	// Exceptions are only set when reading with ReadOriginalSeqsLossless.
+	Exceptions *Exceptions
+}
+
+// openFasta opens a FASTA file, which is decompressed if it ends in '.gz'.
+func openFasta(fileName string) (io.Reader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(fileName, ".gz") {
+		return gzip.NewReader(f)
+	}
+	return f, nil
+}
+
+// newReadSeq substitutes every residue in 'ignore' with an 'X', and creates
+// an original sequence.
+func newReadSeq(id int, sequence seq.Sequence, ignore []byte) *OriginalSeq {
+	for i, residue := range sequence.Residues {
+		for _, toignore := range ignore {
+			if toignore == byte(residue) {
+				sequence.Residues[i] = 'X'
+				break
+			}
+		}
+	}
+	return NewFastaOriginalSeq(id, sequence)
 }
 
 // ReadOriginalSeqs reads a FASTA formatted file and returns a channel that
@@ -24,19 +55,10 @@ func ReadOriginalSeqs(
 	fileName string,
 	ignore []byte,
 ) (chan ReadOriginalSeq, error) {
-	var f io.Reader
-	var err error
-
-	f, err = os.Open(fileName)
+	f, err := openFasta(fileName)
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasSuffix(fileName, ".gz") {
-		f, err = gzip.NewReader(f)
-		if err != nil {
-			return nil, err
-		}
-	}
 
 	reader := fasta.NewReader(f)
 	seqChan := make(chan ReadOriginalSeq, 200)
@@ -55,16 +77,8 @@ func ReadOriginalSeqs(
 				close(seqChan)
 				break
 			}
-			for i, residue := range sequence.Residues {
-				for _, toignore := range ignore {
-					if toignore == byte(residue) {
-						sequence.Residues[i] = 'X'
-						break
-					}
-				}
-			}
 			seqChan <- ReadOriginalSeq{
-				Seq: NewFastaOriginalSeq(i, sequence),
+				Seq: newReadSeq(i, sequence, ignore),
 				Err: nil,
 			}
 		}
@@ -72,26 +86,115 @@ func ReadOriginalSeqs(
 	return seqChan, nil
 }
 
-func ReduceQuerySeqs(
-	query *bytes.Reader) (*bytes.Reader, error) {
-		buf := new(bytes.Buffer)
-		f := fasta.NewWriter(buf)
-		reader := fasta.NewReader(query)
+// ReadOriginalSeqsLossless is like ReadOriginalSeqs, except that the
+// exceptions of every sequence are sent along with it, so that its FASTA
+// entry can be restored exactly. (Anything before the first header is part
+// of the entry of the first sequence.)
+func ReadOriginalSeqsLossless(
+	fileName string,
+	ignore []byte,
+) (chan ReadOriginalSeq, error) {
+	f, err := openFasta(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := newFastaEntries(f)
+	seqChan := make(chan ReadOriginalSeq, 200)
+	go func() {
+		defer close(seqChan)
 		for i := 0; true; i++ {
-			sequence, err := reader.Read()
+			entry, err := entries.next()
 			if err == io.EOF {
 				break
 			}
 			if err != nil {
-				return nil, err
+				seqChan <- ReadOriginalSeq{Err: err}
+				break
 			}
-			rs := Reduce(sequence.Bytes())
-			n := sequence.Name
 
-			result := seq.NewSequenceString(n, string(rs))
-			f.Write(result)
+			// Every entry is parsed on its own, the same way that
+			// ReadOriginalSeqs parses the whole file.
+			sequence, err := fasta.NewReader(bytes.NewReader(entry)).Read()
+			if err == io.EOF {
+				// There are no more sequences in the file.
+				break
+			}
+			if err != nil {
+				seqChan <- ReadOriginalSeq{Err: fmt.Errorf(
+					"Error in sequence %d: %s", i+1, err)}
+				break
+			}
+			oseq := newReadSeq(i, sequence, ignore)
+			seqChan <- ReadOriginalSeq{
+				Seq:        oseq,
+				Exceptions: NewExceptions(entry, oseq.Name, oseq.Residues),
+			}
+		}
+	}()
+	return seqChan, nil
+}
+
+// fastaEntries splits a FASTA file into the raw bytes of its entries. An entry
+// starts at a header line, and ends just before the next header line.
+type fastaEntries struct {
+	r          *bufio.Reader
+	nextHeader []byte
+}
+
+func newFastaEntries(r io.Reader) *fastaEntries {
+	return &fastaEntries{r: bufio.NewReader(r)}
+}
+
+func (fe *fastaEntries) next() ([]byte, error) {
+	entry := fe.nextHeader
+	seenHeader := entry != nil
+	fe.nextHeader = nil
+	for {
+		line, err := fe.r.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 &&
+			trimmed[0] == '>' {
+			if seenHeader {
+				fe.nextHeader = line
+				return entry, nil
+			}
+			seenHeader = true
+		}
+		entry = append(entry, line...)
+		if err == io.EOF {
+			if len(entry) == 0 {
+				return nil, io.EOF
+			}
+			return entry, nil
+		}
+		if err != nil {
+			return nil, err
 		}
-		f.Flush()
-		
-		return bytes.NewReader(buf.Bytes()), nil
 	}
+}
+
+// ReduceQuerySeqs reduces every protein query in 'query' with the alphabet
+// 'alpha'.
+func ReduceQuerySeqs(
+	alpha *Alphabet, query *bytes.Reader) (*bytes.Reader, error) {
+	buf := new(bytes.Buffer)
+	f := fasta.NewWriter(buf)
+	reader := fasta.NewReader(query)
+	for i := 0; true; i++ {
+		sequence, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rs := alpha.Reduce(sequence.Bytes())
+		n := sequence.Name
+
+		result := seq.NewSequenceString(n, string(rs))
+		f.Write(result)
+	}
+	f.Flush()
+
+	return bytes.NewReader(buf.Bytes()), nil
+}
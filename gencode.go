@@ -0,0 +1,147 @@
+package cablastp
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultGeneticCode is the NCBI identifier of the standard genetic code.
+const DefaultGeneticCode = 1
+
+// GeneticCode is a translation table from codons to amino acids. Every table
+// corresponds to one of the genetic codes published by NCBI, and is
+// identified by the same integer that NCBI uses (and that BLAST+ accepts with
+// its '-query_gencode' flag).
+type GeneticCode struct {
+	Id   int
+	Name string
+
+	// aminos is the amino acid for each of the 64 codons, in the order used
+	// by NCBI: the bases of each codon position vary in the order T, C, A, G
+	// with the first position varying slowest.
+	aminos string
+}
+
+// GeneticCodes is the registry of all known genetic codes, keyed by their
+// NCBI translation table identifier.
+var GeneticCodes = map[int]*GeneticCode{}
+
+func init() {
+	tables := []GeneticCode{
+		{1, "Standard",
+			"FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{2, "Vertebrate Mitochondrial",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSS**VVVVAAAADDEEGGGG"},
+		{3, "Yeast Mitochondrial",
+			"FFLLSSSSYY**CCWWTTTTPPPPHHQQRRRRIIMMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{4, "Mold, Protozoan, and Coelenterate Mitochondrial and " +
+			"Mycoplasma/Spiroplasma",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{5, "Invertebrate Mitochondrial",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSSSVVVVAAAADDEEGGGG"},
+		{6, "Ciliate, Dasycladacean and Hexamita Nuclear",
+			"FFLLSSSSYYQQCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{9, "Echinoderm and Flatworm Mitochondrial",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+		{10, "Euplotid Nuclear",
+			"FFLLSSSSYY**CCCWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{11, "Bacterial, Archaeal and Plant Plastid",
+			"FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{12, "Alternative Yeast Nuclear",
+			"FFLLSSSSYY**CC*WLLLSPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{13, "Ascidian Mitochondrial",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSGGVVVVAAAADDEEGGGG"},
+		{14, "Alternative Flatworm Mitochondrial",
+			"FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+		{16, "Chlorophycean Mitochondrial",
+			"FFLLSSSSYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{21, "Trematode Mitochondrial",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+		{22, "Scenedesmus obliquus Mitochondrial",
+			"FFLLSS*SYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{23, "Thraustochytrium Mitochondrial",
+			"FF*LSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{24, "Rhabdopleuridae Mitochondrial",
+			"FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG"},
+		{25, "Candidate Division SR1 and Gracilibacteria",
+			"FFLLSSSSYY**CCGWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{26, "Pachysolen tannophilus Nuclear",
+			"FFLLSSSSYY**CC*WLLLAPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{27, "Karyorelict Nuclear",
+			"FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{28, "Condylostoma Nuclear",
+			"FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{29, "Mesodinium Nuclear",
+			"FFLLSSSSYYYYCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{30, "Peritrich Nuclear",
+			"FFLLSSSSYYEECC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{31, "Blastocrithidia Nuclear",
+			"FFLLSSSSYYEECCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{33, "Cephalodiscidae Mitochondrial",
+			"FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG"},
+	}
+	for i := range tables {
+		GeneticCodes[tables[i].Id] = &tables[i]
+	}
+}
+
+// GetGeneticCode returns the genetic code with the given NCBI translation
+// table identifier. An error is returned if no such table is known.
+func GetGeneticCode(id int) (*GeneticCode, error) {
+	gc, ok := GeneticCodes[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown genetic code %d. Valid genetic codes "+
+			"are: %v.", id, GeneticCodeIds())
+	}
+	return gc, nil
+}
+
+// GeneticCodeIds returns the identifiers of all known genetic codes in
+// ascending order.
+func GeneticCodeIds() []int {
+	ids := make([]int, 0, len(GeneticCodes))
+	for id := range GeneticCodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (gc *GeneticCode) String() string {
+	return fmt.Sprintf("%d (%s)", gc.Id, gc.Name)
+}
+
+// translate1 translates a single codon, which may contain IUPAC ambiguity
+// codes. The codon is expanded into every codon it could stand for, and the
+// common amino acid is returned if they all agree. If they don't, or if the
+// codon contains something other than a nucleotide code, 'X' is returned.
+func (gc *GeneticCode) translate1(codon []byte) byte {
+	m1, m2, m3 := iupacMasks[codon[0]], iupacMasks[codon[1]],
+		iupacMasks[codon[2]]
+	if m1 == 0 || m2 == 0 || m3 == 0 {
+		return 'X'
+	}
+
+	amino := byte(0)
+	for b1 := 0; b1 < 4; b1++ {
+		if m1&(1<<uint(b1)) == 0 {
+			continue
+		}
+		for b2 := 0; b2 < 4; b2++ {
+			if m2&(1<<uint(b2)) == 0 {
+				continue
+			}
+			for b3 := 0; b3 < 4; b3++ {
+				if m3&(1<<uint(b3)) == 0 {
+					continue
+				}
+				a := gc.aminos[b1*16+b2*4+b3]
+				if amino != 0 && amino != a {
+					return 'X'
+				}
+				amino = a
+			}
+		}
+	}
+	return amino
+}
@@ -0,0 +1,253 @@
+package cablastp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// FileHeaders holds the FASTA header of every original sequence,
+	// tokenized and block compressed. (Databases created before it existed
+	// store headers in the 'compressed' file.)
+	FileHeaders = "compressed.headers"
+
+	// FileHeadersIndex holds the block address of the header of every
+	// original sequence.
+	FileHeadersIndex = "compressed.headers.index"
+
+	// headerBlockSize is the number of headers in each block of the header
+	// store, unless the database has its own block size.
+	headerBlockSize = 64
+)
+
+// Header tokenization.
+//
+// Headers of the big protein databases are mostly made of the same few
+// strings: database prefixes like 'gi|' and 'ref|', species in brackets and
+// descriptions like 'hypothetical protein'. Before headers are compressed,
+// every one of the strings in headerTokens is replaced with a single byte
+// from headerTokenFirst up. Since headers are text, those bytes are rarely in
+// a header. When one is, it is escaped with headerEscape.
+//
+// Every block of tokenized headers is then compressed with headerDict as a
+// preset dictionary, so that even the first headers of a block are
+// compressed well.
+const (
+	headerTokenFirst = 0x02
+	headerEscape     = 0x1f
+)
+
+// headerTokens may have at most headerEscape - headerTokenFirst tokens, and
+// cannot change without making existing header stores unreadable.
+var headerTokens = []string{
+	"\x01gi|", "gi|", "|ref|", "|gb|", "|emb|", "|dbj|", "|sp|", "|tr|",
+	"|pdb|", "|pir|", "|prf|", "|tpg|", "ref|", "sp|", "tr|",
+	" [", "] ", "]",
+	"hypothetical protein", "uncharacterized protein", "PREDICTED: ",
+	"putative ", "protein",
+	" OS=", " OX=", " GN=", " PE=", " SV=",
+	"Homo sapiens",
+}
+
+// headerDict is the preset dictionary of the header store. Flate prefers
+// matches near the end of the dictionary, so the most common strings are
+// last.
+var headerDict = []byte("Bacillus Streptomyces Pseudomonas Arabidopsis " +
+	"thaliana Saccharomyces cerevisiae Escherichia coli Mus musculus " +
+	"Drosophila melanogaster Rattus norvegicus Bos taurus " +
+	"complete genome partial sequence chromosome isoform X1 isoform X2 " +
+	"transcriptional regulator ATP-binding ABC transporter " +
+	"domain-containing family subunit kinase receptor binding factor " +
+	"ribosomal dehydrogenase synthase reductase membrane ")
+
+// tokenizeHeader appends the tokenized 'header' to 'dst'.
+func tokenizeHeader(dst []byte, header string) []byte {
+	for i := 0; i < len(header); {
+		token := -1
+		for t, tok := range headerTokens {
+			if strings.HasPrefix(header[i:], tok) &&
+				(token == -1 || len(tok) > len(headerTokens[token])) {
+				token = t
+			}
+		}
+		if token >= 0 {
+			dst = append(dst, byte(headerTokenFirst+token))
+			i += len(headerTokens[token])
+			continue
+		}
+		if c := header[i]; c >= headerTokenFirst && c <= headerEscape {
+			dst = append(dst, headerEscape)
+		}
+		dst = append(dst, header[i])
+		i++
+	}
+	return dst
+}
+
+// detokenizeHeader reverses tokenizeHeader.
+func detokenizeHeader(tokenized []byte) (string, error) {
+	header := make([]byte, 0, 2*len(tokenized))
+	for i := 0; i < len(tokenized); i++ {
+		c := tokenized[i]
+		switch {
+		case c == headerEscape:
+			i++
+			if i == len(tokenized) {
+				return "", fmt.Errorf("A tokenized header ends with an " +
+					"escape.")
+			}
+			header = append(header, tokenized[i])
+		case c >= headerTokenFirst && c < headerEscape:
+			token := int(c - headerTokenFirst)
+			if token >= len(headerTokens) {
+				return "", fmt.Errorf("Invalid header token: %d.", c)
+			}
+			header = append(header, headerTokens[token]...)
+		default:
+			header = append(header, c)
+		}
+	}
+	return string(header), nil
+}
+
+// A headerStore holds the headers of the original sequences of a database,
+// apart from their residues. Every header is stored as a record of its
+// tokenized length (as a uvarint) followed by the tokenized header.
+type headerStore struct {
+	File  *os.File
+	Index *os.File
+
+	// Used while writing.
+	blocks *blockWriter
+	index  *bufio.Writer
+	record []byte
+
+	// Used while reading.
+	reader    *blockReader
+	indexSize int64
+	readLock  sync.Mutex
+}
+
+// newWriteHeaderStore creates an empty header store.
+func newWriteHeaderStore(db *DB) (*headerStore, error) {
+	var err error
+
+	hs := &headerStore{}
+	fileFlags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	hs.File, err = os.OpenFile(db.filePath(FileHeaders), fileFlags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	hs.Index, err = os.OpenFile(db.filePath(FileHeadersIndex), fileFlags, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	perBlock := headerBlockSize
+	if db.CompressBlockSize > 0 {
+		perBlock = db.CompressBlockSize
+	}
+	hs.blocks = newBlockWriterDict(hs.File, 0, perBlock, headerDict)
+	hs.index = bufio.NewWriter(hs.Index)
+	return hs, nil
+}
+
+// newReadHeaderStore opens the header store of a database for reading. If the
+// database doesn't have one, nil is returned.
+func newReadHeaderStore(db *DB) (*headerStore, error) {
+	var err error
+
+	if _, err = os.Stat(db.filePath(FileHeaders)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	hs := &headerStore{}
+	if hs.File, err = db.openReadFile(FileHeaders); err != nil {
+		return nil, err
+	}
+	if hs.Index, err = db.openReadFile(FileHeadersIndex); err != nil {
+		return nil, err
+	}
+	info, err := hs.Index.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hs.indexSize = info.Size()
+	hs.reader = newBlockReaderDict(hs.File, headerDict)
+	return hs, nil
+}
+
+// add writes the header of the next original sequence.
+func (hs *headerStore) add(header string) error {
+	tokenized := tokenizeHeader(nil, header)
+	hs.record = binary.AppendUvarint(hs.record[:0], uint64(len(tokenized)))
+	hs.record = append(hs.record, tokenized...)
+	addr, err := hs.blocks.add(hs.record)
+	if err != nil {
+		return err
+	}
+	return binary.Write(hs.index, binary.BigEndian, addr)
+}
+
+// read returns the header of the original sequence with id 'orgSeqId'. It is
+// safe for concurrent use.
+func (hs *headerStore) read(orgSeqId int) (string, error) {
+	hs.readLock.Lock()
+	defer hs.readLock.Unlock()
+
+	if orgSeqId < 0 || int64(orgSeqId) >= hs.indexSize/8 {
+		return "", fmt.Errorf("There is no header for sequence %d.", orgSeqId)
+	}
+	var addrBytes [8]byte
+	if _, err := hs.Index.ReadAt(addrBytes[:], int64(orgSeqId)*8); err != nil {
+		return "", err
+	}
+	r, err := hs.reader.record(int64(binary.BigEndian.Uint64(addrBytes[:])))
+	if err != nil {
+		return "", err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", headerError(orgSeqId, err)
+	}
+	if length > uint64(r.Len()) {
+		return "", headerError(orgSeqId, io.ErrUnexpectedEOF)
+	}
+	tokenized := make([]byte, length)
+	if _, err := io.ReadFull(r, tokenized); err != nil {
+		return "", headerError(orgSeqId, err)
+	}
+	return detokenizeHeader(tokenized)
+}
+
+func headerError(orgSeqId int, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Could not read the header of sequence %d: %s",
+		orgSeqId, err)
+}
+
+// writeClose writes the last block of headers, and closes the header store.
+func (hs *headerStore) writeClose() error {
+	if err := hs.blocks.flush(); err != nil {
+		return err
+	}
+	if err := hs.index.Flush(); err != nil {
+		return err
+	}
+	if err := hs.Index.Close(); err != nil {
+		return err
+	}
+	return hs.File.Close()
+}
+
+// readClose closes the header store.
+func (hs *headerStore) readClose() {
+	hs.File.Close()
+	hs.Index.Close()
+}
@@ -0,0 +1,182 @@
+package cablastp
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A LinkAlignment shows how a link of an original sequence is stored: the
+// residues of the coarse sequence it links to, aligned to the original
+// residues of the link and to their reduction. Gaps are '-'.
+type LinkAlignment struct {
+	Link LinkToCoarse
+
+	// The range [OrigStart, OrigEnd) of the original sequence that the link
+	// decompresses to.
+	OrigStart, OrigEnd int
+
+	Coarse, Reduced, Original []byte
+}
+
+// AlignLinks aligns every link of the compressed sequence 'cseq' to the
+// coarse sequence it links to. 'cseq' must not be an alias.
+func (db *DB) AlignLinks(cseq CompressedSeq) ([]LinkAlignment, error) {
+	ranges, err := cseq.OriginalRanges()
+	if err != nil {
+		return nil, err
+	}
+	alns := make([]LinkAlignment, len(cseq.Links))
+	rc := NewResidueCoder(db.Alphabet)
+	for i, lk := range cseq.Links {
+		orig, err := cseq.linkResidues(db.CoarseDB, rc, lk)
+		if err != nil {
+			return nil, err
+		}
+		coarseSeq, err := db.CoarseDB.ReadCoarseSeq(int(lk.CoarseSeqId))
+		if err != nil {
+			return nil, err
+		}
+		start, end := int(lk.CoarseStart), int(lk.CoarseEnd)
+		if start > end || end > len(coarseSeq.Residues) {
+			return nil, fmt.Errorf("Compressed sequence %d links to [%d, %d) "+
+				"of coarse sequence %d, which has %d residues.", cseq.Id,
+				start, end, lk.CoarseSeqId, len(coarseSeq.Residues))
+		}
+
+		reduced := db.Alphabet.Reduce(orig)
+		aligned := alignEdits(coarseSeq.Residues[start:end], reduced)
+		original := make([]byte, len(aligned[1]))
+		j := 0
+		for k, letter := range aligned[1] {
+			if letter == '-' {
+				original[k] = '-'
+				continue
+			}
+			original[k] = orig[j]
+			j++
+		}
+		alns[i] = LinkAlignment{
+			Link:      lk,
+			OrigStart: ranges[i][0],
+			OrigEnd:   ranges[i][1],
+			Coarse:    aligned[0],
+			Reduced:   aligned[1],
+			Original:  original,
+		}
+	}
+	return alns, nil
+}
+
+// linkKey identifies a link between an original and a coarse sequence in
+// either direction.
+type linkKey struct {
+	orgSeqId, coarseSeqId  uint32
+	coarseStart, coarseEnd uint16
+}
+
+// CheckLinks checks that the links from original sequences to coarse
+// sequences and the links from coarse sequences back to original sequences
+// agree: every link in one direction must have exactly one link in the
+// other. Links must also be within their coarse sequences, and aliases must
+// be of sequences before them. A description of every problem found is
+// returned.
+func (db *DB) CheckLinks() ([]string, error) {
+	var problems []string
+	problem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+	comdb, coarsedb := db.ComDB, db.CoarseDB
+	numSeqs, numCoarse := comdb.NumSequences(), coarsedb.NumSequences()
+
+	// Count the links from coarse sequences, and take away every link from
+	// an original sequence.
+	counts := make(map[linkKey]int)
+	coarseLens := make([]int, numCoarse)
+	for id := 0; id < numCoarse; id++ {
+		seq, err := coarsedb.ReadCoarseSeq(id)
+		if err != nil {
+			return nil, err
+		}
+		coarseLens[id] = len(seq.Residues)
+
+		links, err := coarsedb.readLinksOf(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, lk := range links {
+			if int(lk.OrgSeqId) >= numSeqs {
+				problem("Coarse sequence %d links to original sequence %d, "+
+					"which doesn't exist.", id, lk.OrgSeqId)
+			}
+			counts[linkKey{lk.OrgSeqId, uint32(id),
+				lk.CoarseStart, lk.CoarseEnd}]++
+		}
+	}
+
+	for id := 0; id < numSeqs; id++ {
+		cseq, err := comdb.ReadCompressedSeq(id)
+		if err != nil {
+			return nil, err
+		}
+		if cseq.IsAlias() {
+			if cseq.AliasOf >= id {
+				problem("Original sequence %d is an alias of sequence %d, "+
+					"which isn't before it.", id, cseq.AliasOf)
+			}
+			continue
+		}
+		for _, lk := range cseq.Links {
+			if lk.CoarseSeqId >= uint(numCoarse) {
+				problem("Original sequence %d links to coarse sequence %d, "+
+					"which doesn't exist.", id, lk.CoarseSeqId)
+				continue
+			}
+			if lk.CoarseStart > lk.CoarseEnd ||
+				int(lk.CoarseEnd) > coarseLens[lk.CoarseSeqId] {
+				problem("Original sequence %d links to [%d, %d) of coarse "+
+					"sequence %d, which has %d residues.", id, lk.CoarseStart,
+					lk.CoarseEnd, lk.CoarseSeqId, coarseLens[lk.CoarseSeqId])
+			}
+			key := linkKey{uint32(id), uint32(lk.CoarseSeqId),
+				lk.CoarseStart, lk.CoarseEnd}
+			if counts[key] == 0 {
+				problem("Original sequence %d links to [%d, %d) of coarse "+
+					"sequence %d, but there is no link back.", id,
+					lk.CoarseStart, lk.CoarseEnd, lk.CoarseSeqId)
+				continue
+			}
+			counts[key]--
+		}
+	}
+
+	var extra []linkKey
+	for key, count := range counts {
+		for ; count > 0; count-- {
+			extra = append(extra, key)
+		}
+	}
+	sortLinkKeys(extra)
+	for _, key := range extra {
+		problem("Coarse sequence %d links [%d, %d) to original sequence %d, "+
+			"but there is no link back.", key.coarseSeqId, key.coarseStart,
+			key.coarseEnd, key.orgSeqId)
+	}
+	return problems, nil
+}
+
+// sortLinkKeys sorts links by coarse sequence, then by original sequence and
+// then by range.
+func sortLinkKeys(keys []linkKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch {
+		case a.coarseSeqId != b.coarseSeqId:
+			return a.coarseSeqId < b.coarseSeqId
+		case a.orgSeqId != b.orgSeqId:
+			return a.orgSeqId < b.orgSeqId
+		case a.coarseStart != b.coarseStart:
+			return a.coarseStart < b.coarseStart
+		}
+		return a.coarseEnd < b.coarseEnd
+	})
+}
@@ -0,0 +1,87 @@
+package cablastp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "data/small.fasta"
+	codings := []string{CodingPlain, CodingRange}
+	for _, coding := range codings {
+		conf := DefaultDBConf.DeepCopy()
+		conf.ResidueCoding = coding
+		dbDir := filepath.Join(tmpDir, coding)
+		createTestDB(t, dbDir, fasta, conf)
+
+		db, err := NewReadDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, err := db.CheckLinks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) > 0 {
+			t.Fatalf("The links of a new database with %s coding have "+
+				"problems:\n%s", coding, strings.Join(problems, "\n"))
+		}
+
+		ungap := func(row []byte) []byte {
+			return bytes.Replace(row, []byte("-"), nil, -1)
+		}
+		for id := 0; id < db.ComDB.NumSequences(); id++ {
+			cseq, err := db.ComDB.ReadCompressedSeq(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cseq.IsAlias() {
+				continue
+			}
+			oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alns, err := db.AlignLinks(cseq)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var original []byte
+			for _, aln := range alns {
+				if len(aln.Coarse) != len(aln.Reduced) ||
+					len(aln.Coarse) != len(aln.Original) {
+					t.Fatalf("The rows of an alignment of sequence %d have "+
+						"different lengths.", id)
+				}
+				coarseSeq, err := db.CoarseDB.ReadCoarseSeq(
+					int(aln.Link.CoarseSeqId))
+				if err != nil {
+					t.Fatal(err)
+				}
+				lk := aln.Link
+				want := coarseSeq.Residues[lk.CoarseStart:lk.CoarseEnd]
+				if got := ungap(aln.Coarse); !bytes.Equal(got, want) {
+					t.Fatalf("A link of sequence %d aligns coarse residues "+
+						"\n%s\nbut links to\n%s", id, got, want)
+				}
+				original = append(original, ungap(aln.Original)...)
+			}
+			if !bytes.Equal(original, oseq.Residues) {
+				t.Fatalf("The links of sequence %d align\n%s\nbut it is\n%s",
+					id, original, oseq.Residues)
+			}
+		}
+		db.ReadClose()
+	}
+}
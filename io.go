@@ -1,6 +1,7 @@
 package cablastp
 
 import (
+	"bufio"
 	"bytes"
 	// "compress/gzip"
 	"encoding/binary"
@@ -9,68 +10,10 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/TuftsBCB/io/fasta"
 )
 
-func (coarsedb *CoarseDB) readFasta() error {
-	Vprintf("\t\tReading %s...\n", FileCoarseFasta)
-	timer := time.Now()
-
-	fastaReader := fasta.NewReader(coarsedb.FileFasta)
-	for i := 0; true; i++ {
-		seq, err := fastaReader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		coarsedb.Seqs = append(coarsedb.Seqs, NewFastaCoarseSeq(i, seq))
-	}
-	coarsedb.seqsRead = len(coarsedb.Seqs)
-
-	Vprintf("\t\tDone reading %s (%s).\n", FileCoarseFasta, time.Since(timer))
-	return nil
-}
-
-func (coarsedb *CoarseDB) saveFasta() (err error) {
-	Vprintf("Writing %s...\n", FileCoarseFasta)
-	Vprintf("Writing %s...\n", FileCoarseFastaIndex)
-	timer := time.Now()
-
-	byteOff := int64(0)
-	buf := new(bytes.Buffer)
-
-	if coarsedb.fastaIndexSize > 0 {
-		info, err := coarsedb.FileFasta.Stat()
-		if err != nil {
-			return err
-		}
-		byteOff = info.Size()
-	}
-
-	for i := coarsedb.seqsRead; i < len(coarsedb.Seqs); i++ {
-		buf.Reset()
-		fmt.Fprintf(buf, "> %d\n%s\n", i, string(coarsedb.Seqs[i].Residues))
-
-		if _, err = coarsedb.FileFasta.Write(buf.Bytes()); err != nil {
-			return
-		}
-		err = binary.Write(coarsedb.FileFastaIndex, binary.BigEndian, byteOff)
-		if err != nil {
-			return
-		}
-
-		byteOff += int64(buf.Len())
-	}
-
-	Vprintf("Done writing %s (%s).\n", FileCoarseFasta, time.Since(timer))
-	Vprintf("Done writing %s (%s).\n", FileCoarseFastaIndex, time.Since(timer))
-	return nil
-}
-
 func (coarsedb *CoarseDB) readLinks() error {
 	Vprintf("\t\tReading %s...\n", FileCoarseLinks)
 	timer := time.Now()
@@ -174,90 +117,299 @@ func (coarsedb *CoarseDB) saveLinks() (err error) {
 	return nil
 }
 
+// writePlainFasta writes every coarse sequence in memory to 'w' as plain
+// FASTA, in the same format as an uncompressed coarse.fasta.
+func (coarsedb *CoarseDB) writePlainFasta(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i, seq := range coarsedb.Seqs {
+		_, err := fmt.Fprintf(bw, "> %d\n%s\n", i, seq.Residues)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
 func (coarsedb *CoarseDB) saveLinksPlain() error {
 	Vprintf("Writing %s...\n", FileCoarsePlainLinks)
 	timer := time.Now()
 
 	csvWriter := csv.NewWriter(coarsedb.plainLinks)
-	record := make([]string, 0, 10)
-	for _, seq := range coarsedb.Seqs {
-		record = record[:0]
+	var links []*LinkToCompressed
+	for id, seq := range coarsedb.Seqs {
+		links = links[:0]
 		for link := seq.Links; link != nil; link = link.Next {
-			record = append(record,
-				fmt.Sprintf("%d", link.OrgSeqId),
-				fmt.Sprintf("%d", link.CoarseStart),
-				fmt.Sprintf("%d", link.CoarseEnd))
+			links = append(links, link)
 		}
-		if err := csvWriter.Write(record); err != nil {
+		if err := csvWriter.Write(linksPlainRecord(id, links)); err != nil {
 			return err
 		}
 	}
 	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
 
 	Vprintf("Done writing %s (%s).\n", FileCoarsePlainLinks, time.Since(timer))
 	return nil
 }
 
+// linksPlainRecord returns the CSV record of the links of a coarse sequence
+// in coarse.links.plain: the id of the coarse sequence followed by
+// three-tuples of links: (original-seq-id, coarse-start, coarse-end).
+func linksPlainRecord(id int, links []*LinkToCompressed) []string {
+	record := make([]string, 0, 1+3*len(links))
+	record = append(record, fmt.Sprintf("%d", id))
+	for _, link := range links {
+		record = append(record,
+			fmt.Sprintf("%d", link.OrgSeqId),
+			fmt.Sprintf("%d", link.CoarseStart),
+			fmt.Sprintf("%d", link.CoarseEnd))
+	}
+	return record
+}
+
+func (coarsedb *CoarseDB) saveSeedsPlain() error {
+	Vprintf("Writing %s...\n", FileCoarsePlainSeeds)
+	timer := time.Now()
+
+	if err := coarsedb.Seeds.WritePlain(coarsedb.plainSeeds); err != nil {
+		return err
+	}
+
+	Vprintf("Done writing %s (%s).\n", FileCoarsePlainSeeds, time.Since(timer))
+	return nil
+}
+
+// ReadSeq reads and decompresses the sequence with id 'orgSeqId'.
+//
+// ReadSeq (like ReadCompressedSeq, ReadSeqRange, SeqLen and ReadName) is safe
+// for concurrent use. Only reading from disk is serialized, so sequences are
+// decompressed in parallel.
 func (comdb *CompressedDB) ReadSeq(
 	coarsedb *CoarseDB, orgSeqId int) (OriginalSeq, error) {
 
-	off, err := comdb.orgSeqOffset(orgSeqId)
+	cseq, err := comdb.ReadCompressedSeq(orgSeqId)
 	if err != nil {
 		return OriginalSeq{}, err
 	}
+	return comdb.decompressSeq(coarsedb, cseq)
+}
 
-	newOff, err := comdb.File.Seek(off, os.SEEK_SET)
+// ReadNextSeq reads the sequence whose record starts at the current position
+// of the compressed database file. (In a block compressed database, the
+// record is found by its id instead.) ReadNextSeq is not safe for concurrent
+// use.
+func (comdb *CompressedDB) ReadNextSeq(
+	coarsedb *CoarseDB, orgSeqId int) (OriginalSeq, error) {
+
+	if comdb.blocks != nil {
+		return comdb.ReadSeq(coarsedb, orgSeqId)
+	}
+	record, err := readRecord(comdb.File)
+	if err != nil {
+		return OriginalSeq{}, err
+	}
+	cseq, err := comdb.newCompressedSeq(orgSeqId, record)
 	if err != nil {
 		return OriginalSeq{}, err
-	} else if newOff != off {
-		return OriginalSeq{},
-			fmt.Errorf("Tried to seek to offset %d in the compressed "+
-				"database, but seeked to %d instead.", off, newOff)
 	}
-	return comdb.ReadNextSeq(coarsedb, orgSeqId)
+	return comdb.decompressSeq(coarsedb, cseq)
 }
 
-func (comdb *CompressedDB) ReadNextSeq(
-	coarsedb *CoarseDB, orgSeqId int) (OriginalSeq, error) {
+// ReadCompressedSeq reads the compressed sequence with id 'orgSeqId' without
+// decompressing it. The sequence may be an alias.
+func (comdb *CompressedDB) ReadCompressedSeq(
+	orgSeqId int) (CompressedSeq, error) {
+
+	comdb.readLock.Lock()
+	r, err := comdb.seqRecord(orgSeqId)
+	var record []string
+	if err == nil {
+		record, err = readRecord(r)
+	}
+	comdb.readLock.Unlock()
+	if err != nil {
+		return CompressedSeq{}, err
+	}
+	return comdb.newCompressedSeq(orgSeqId, record)
+}
 
-	csvReader := csv.NewReader(comdb.File)
+// readRecord reads the CSV record of a compressed sequence.
+func readRecord(r io.Reader) ([]string, error) {
+	csvReader := csv.NewReader(r)
 	csvReader.LazyQuotes = true
 	csvReader.Comma = ','
 	csvReader.FieldsPerRecord = -1
 
 	record, err := csvReader.Read()
 	if err == io.EOF && len(record) == 0 {
-		return OriginalSeq{}, fmt.Errorf("[csv reader]: id out of range")
+		return nil, fmt.Errorf("[csv reader]: id out of range")
 	} else if err != nil && err != io.EOF {
-		return OriginalSeq{}, fmt.Errorf("[csv reader]: %s", err)
+		return nil, fmt.Errorf("[csv reader]: %s", err)
 	}
+	return record, nil
+}
+
+func (comdb *CompressedDB) newCompressedSeq(
+	orgSeqId int, record []string) (CompressedSeq, error) {
 
 	cseq, err := readCompressedSeq(orgSeqId, record)
 	if err != nil {
-		return OriginalSeq{}, err
+		return CompressedSeq{}, err
+	}
+	if comdb.headers != nil {
+		cseq.names = comdb
+	}
+	return cseq, nil
+}
+
+// resolveAlias returns the compressed sequence that 'cseq' is an alias of, or
+// 'cseq' itself if it isn't an alias.
+func (comdb *CompressedDB) resolveAlias(
+	cseq CompressedSeq) (CompressedSeq, error) {
+
+	if !cseq.IsAlias() {
+		return cseq, nil
+	}
+	return comdb.ReadCompressedSeq(cseq.AliasOf)
+}
+
+// decompressSeq decompresses a compressed sequence, which may be an alias.
+func (comdb *CompressedDB) decompressSeq(
+	coarsedb *CoarseDB, cseq CompressedSeq) (OriginalSeq, error) {
+
+	if cseq.IsAlias() {
+		oseq, err := comdb.ReadSeq(coarsedb, cseq.AliasOf)
+		if err != nil {
+			return OriginalSeq{}, err
+		}
+		alias := NewOriginalSeq(cseq.Id, cseq.Name, oseq.Residues)
+		alias.names = cseq.names
+		return *alias, nil
 	}
 	return cseq.Decompress(coarsedb)
 }
 
+// ReadSeqRange reads the residues in [from, to) of the sequence with id
+// 'orgSeqId'. Only the links that overlap the range are decompressed. The
+// range is clamped to the length of the sequence.
+func (comdb *CompressedDB) ReadSeqRange(coarsedb *CoarseDB,
+	orgSeqId, from, to int) (OriginalSeq, error) {
+
+	cseq, err := comdb.ReadCompressedSeq(orgSeqId)
+	if err != nil {
+		return OriginalSeq{}, err
+	}
+	target, err := comdb.resolveAlias(cseq)
+	if err != nil {
+		return OriginalSeq{}, err
+	}
+	oseq, err := target.DecompressRange(coarsedb, from, to)
+	if err != nil {
+		return OriginalSeq{}, err
+	}
+	if cseq.IsAlias() {
+		alias := NewOriginalSeq(cseq.Id, cseq.Name, oseq.Residues)
+		alias.names = cseq.names
+		return *alias, nil
+	}
+	return oseq, nil
+}
+
+// SeqLen returns the number of residues in the sequence with id 'orgSeqId',
+// without decompressing it.
+func (comdb *CompressedDB) SeqLen(orgSeqId int) (int, error) {
+	cseq, err := comdb.ReadCompressedSeq(orgSeqId)
+	if err != nil {
+		return 0, err
+	}
+	if cseq, err = comdb.resolveAlias(cseq); err != nil {
+		return 0, err
+	}
+	return cseq.Len()
+}
+
+// ReadName reads only the name of the sequence with id 'orgSeqId' from the
+// compressed database.
+func (comdb *CompressedDB) ReadName(orgSeqId int) (string, error) {
+	if comdb.headers != nil {
+		return comdb.headers.read(orgSeqId)
+	}
+	comdb.readLock.Lock()
+	defer comdb.readLock.Unlock()
+
+	r, err := comdb.seqRecord(orgSeqId)
+	if err != nil {
+		return "", err
+	}
+
+	csvReader := csv.NewReader(r)
+	csvReader.LazyQuotes = true
+	csvReader.FieldsPerRecord = -1
+	record, err := csvReader.Read()
+	if err != nil {
+		return "", fmt.Errorf("[csv reader]: %s", err)
+	}
+	return record[0], nil
+}
+
+// seqRecord returns a reader that starts at the record of the sequence with
+// id 'orgSeqId'.
+func (comdb *CompressedDB) seqRecord(orgSeqId int) (io.Reader, error) {
+	off, err := comdb.orgSeqOffset(orgSeqId)
+	if err != nil {
+		return nil, err
+	}
+	if comdb.blocks != nil {
+		return comdb.blocks.record(off)
+	}
+
+	newOff, err := comdb.File.Seek(off, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	} else if newOff != off {
+		return nil,
+			fmt.Errorf("Tried to seek to offset %d in the compressed "+
+				"database, but seeked to %d instead.", off, newOff)
+	}
+	return comdb.File, nil
+}
+
 func readCompressedSeq(id int, record []string) (CompressedSeq, error) {
+	if len(record) == 2 && strings.HasPrefix(record[1], "=") {
+		aliasOf, err := strconv.Atoi(record[1][1:])
+		if err != nil || aliasOf < 0 || aliasOf >= id {
+			return CompressedSeq{}, fmt.Errorf("Compressed sequence %d is "+
+				"an alias of an invalid sequence: '%s'.", id, record[1])
+		}
+		return NewAliasSeq(id, string([]byte(record[0])), aliasOf), nil
+	}
+
 	cseq := CompressedSeq{
-		Id:    id,
-		Name:  string([]byte(record[0])),
-		Links: make([]LinkToCoarse, (len(record)-1)/4),
+		Id:      id,
+		Name:    string([]byte(record[0])),
+		Links:   make([]LinkToCoarse, 0, (len(record)-1)/4),
+		AliasOf: -1,
 	}
 
+	if (len(record)-1)%4 != 0 {
+		return CompressedSeq{}, fmt.Errorf("Compressed sequence %d has %d "+
+			"fields after its name, which isn't a multiple of four.",
+			id, len(record)-1)
+	}
 	for i := 1; i < len(record); i += 4 {
-		coarseSeqId64, err := strconv.Atoi(record[i+0])
+		coarseSeqId64, err := strconv.ParseUint(record[i+0], 10, 32)
 		if err != nil {
-			return CompressedSeq{}, nil
+			return CompressedSeq{}, linkFieldError(id, record[i+0], err)
 		}
-		coarseStart64, err := strconv.Atoi(record[i+1])
+		coarseStart64, err := strconv.ParseUint(record[i+1], 10, 16)
 		if err != nil {
-			return CompressedSeq{}, nil
+			return CompressedSeq{}, linkFieldError(id, record[i+1], err)
 		}
-		coarseEnd64, err := strconv.Atoi(record[i+2])
+		coarseEnd64, err := strconv.ParseUint(record[i+2], 10, 16)
 		if err != nil {
-			return CompressedSeq{}, nil
+			return CompressedSeq{}, linkFieldError(id, record[i+2], err)
 		}
     origSeq := string([]byte(record[i+3]))
 		lk := NewLinkToCoarse(
@@ -268,6 +420,13 @@ func readCompressedSeq(id int, record []string) (CompressedSeq, error) {
 	return cseq, nil
 }
 
+// linkFieldError describes a field of a link of compressed sequence 'id' that
+// isn't a valid number.
+func linkFieldError(id int, field string, err error) error {
+	return fmt.Errorf("Compressed sequence %d has an invalid link field "+
+		"'%s': %s", id, field, err)
+}
+
 func (comdb *CompressedDB) orgSeqOffset(id int) (seqOff int64, err error) {
 	tryOff := int64(id) * 8
 	realOff, err := comdb.Index.Seek(tryOff, os.SEEK_SET)
@@ -299,6 +458,26 @@ func nextSeqToWrite(
 	return nil, saved
 }
 
+// compressedRecord returns the CSV record of a compressed sequence named
+// 'name'. A record is a sequence name followed by four-tuples of links:
+// (coarse-seq-id, coarse-start, coarse-end, diff). The record of an alias is
+// its name followed by '=' and the id of the sequence it duplicates.
+func compressedRecord(cseq *CompressedSeq, name string) []string {
+	record := make([]string, 0, 1+4*len(cseq.Links))
+	record = append(record, name)
+	for _, link := range cseq.Links {
+		record = append(record,
+			fmt.Sprintf("%d", link.CoarseSeqId),
+			fmt.Sprintf("%d", link.CoarseStart),
+			fmt.Sprintf("%d", link.CoarseEnd),
+			link.OrigSeq)
+	}
+	if cseq.IsAlias() {
+		record = append(record, fmt.Sprintf("=%d", cseq.AliasOf))
+	}
+	return record
+}
+
 func (comdb *CompressedDB) writer() {
 	var record []string
 	var err error
@@ -312,6 +491,8 @@ func (comdb *CompressedDB) writer() {
 
 	saved := make([]CompressedSeq, 0, 1000)
 	nextIndex := comdb.NumSequences()
+	aliases := bufio.NewWriter(comdb.Aliases)
+	var blocks *blockWriter
 
 	// If we're appending to the index, set the byteOffset to be at the end
 	// of the current compressed database.
@@ -323,6 +504,9 @@ func (comdb *CompressedDB) writer() {
 		}
 		byteOffset = info.Size()
 	}
+	if comdb.blockSize > 0 {
+		blocks = newBlockWriter(comdb.File, byteOffset, comdb.blockSize)
+	}
 
 	for possible := range comdb.writerChan {
 		// We have to preserve the order of compressed sequences, so we don't
@@ -339,17 +523,29 @@ func (comdb *CompressedDB) writer() {
 			// the next record we're writing.
 			buf.Reset()
 
-			// Allocate memory for creating the next record.
-			// A record is a sequence name followed by four-tuples of links:
-			// (coarse-seq-id, coarse-start, coarse-end, diff).
-			record = make([]string, 0, 1+4*len(cseq.Links))
-			record = append(record, cseq.Name)
-			for _, link := range cseq.Links {
-				record = append(record,
-					fmt.Sprintf("%d", link.CoarseSeqId),
-					fmt.Sprintf("%d", link.CoarseStart),
-					fmt.Sprintf("%d", link.CoarseEnd),
-					link.OrigSeq)
+			// The name is left empty, since it goes in the header store.
+			record = compressedRecord(cseq, "")
+			if err = comdb.headers.add(cseq.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			if err = comdb.stats.addWritten(cseq); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			if comdb.names != nil {
+				if err = comdb.names.add(cseq.Name, cseq.Id); err != nil {
+					fmt.Fprintf(os.Stderr, "%s\n", err)
+					os.Exit(1)
+				}
+			}
+			if cseq.IsAlias() {
+				pair := [2]uint32{uint32(cseq.Id), uint32(cseq.AliasOf)}
+				err = binary.Write(aliases, binary.BigEndian, pair)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s\n", err)
+					os.Exit(1)
+				}
 			}
 
 			// Write the record to our *buffer* and flush it.
@@ -359,8 +555,15 @@ func (comdb *CompressedDB) writer() {
 			}
 			csvWriter.Flush()
 
-			// Pass the bytes on to the compressed file.
-			if _, err = comdb.File.Write(buf.Bytes()); err != nil {
+			// Pass the bytes on to the compressed file. (Or to the current
+			// block, in which case the record's address is indexed instead
+			// of its byte offset.)
+			if blocks != nil {
+				byteOffset, err = blocks.add(buf.Bytes())
+			} else {
+				_, err = comdb.File.Write(buf.Bytes())
+			}
+			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err)
 				os.Exit(1)
 			}
@@ -373,12 +576,29 @@ func (comdb *CompressedDB) writer() {
 			}
 
 			// Increment the byte offset to be at the end of this record.
-			byteOffset += int64(buf.Len())
+			if blocks == nil {
+				byteOffset += int64(buf.Len())
+			}
 
 			nextIndex++
 			cseq, saved = nextSeqToWrite(nextIndex, saved)
 		}
 	}
+	if blocks != nil {
+		if err = blocks.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+	if err = aliases.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if err = comdb.headers.writeClose(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	comdb.Aliases.Close()
 	comdb.Index.Close()
 	comdb.File.Close()
 	comdb.writerDone <- struct{}{}
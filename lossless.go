@@ -0,0 +1,533 @@
+package cablastp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// FileExceptions holds, for every input sequence of a lossless database,
+	// whatever is needed to turn its decompressed residues back into the
+	// exact bytes of its FASTA entry.
+	FileExceptions = "compressed.exceptions"
+
+	// FileExceptionsIndex holds the byte offset of the exceptions of every
+	// input sequence, by input position.
+	FileExceptionsIndex = "compressed.exceptions.index"
+)
+
+// Exceptions are the differences between the FASTA entry of a sequence as it
+// was read, and the entry that would be written from its name and residues
+// alone.
+//
+// Sequences are stored upper cased, without stop characters ('*'), and with
+// residues that aren't in the alphabet substituted with 'X'. The exceptions of
+// a sequence record the lower case residues as runs, the substituted residues
+// and the positions of stop characters, along with the width of its lines and
+// its header line if it isn't just '>' followed by the name. Anything else
+// (e.g., blank lines or carriage returns) makes the whole entry an exception,
+// and it is stored as is.
+//
+// Exceptions are written as a record of:
+//
+//	a byte of flags (excHeader, excWidths or excRaw)
+//	if excRaw: the length of the entry as a uvarint, and the entry
+//	otherwise:
+//	    if excWidths: the number of lines followed by the width of every
+//	        line, as uvarints. Otherwise the width of every line but the
+//	        last as a uvarint.
+//	    if excHeader: the length of the header line as a uvarint, and the
+//	        header line (without the trailing newline)
+//	    the number of lower case runs, and for every run: the number of
+//	        residues since the end of the previous run and the length of the
+//	        run, as uvarints
+//	    the number of substituted residues, and for every substitution: the
+//	        number of residues since the previous one as a uvarint, and the
+//	        original residue
+//	    the number of stop characters, and for every stop character: its
+//	        position in the line residues, minus the position of the previous
+//	        one, as uvarints
+type Exceptions struct {
+	raw      []byte
+	header   []byte
+	width    int
+	widths   []int
+	lower    [][2]int
+	subs     []substitution
+	stops    []int
+	explicit bool
+}
+
+type substitution struct {
+	pos     int
+	residue byte
+}
+
+const (
+	excHeader = 1 << iota
+	excWidths
+	excRaw
+)
+
+// NewExceptions computes the exceptions of a FASTA entry, given the name and
+// residues of the sequence that was read from it. The entry must include its
+// header line and every line up to the next header.
+func NewExceptions(entry []byte, name string, residues []byte) *Exceptions {
+	exc := findExceptions(entry, name, residues)
+	if exc != nil {
+		restored, err := exc.Restore(name, residues)
+		if err == nil && bytes.Equal(restored, entry) {
+			return exc
+		}
+	}
+	return &Exceptions{raw: append([]byte(nil), entry...)}
+}
+
+// findExceptions returns the exceptions of an entry, or nil if it can only be
+// stored as is. The exceptions returned may still not restore the entry.
+func findExceptions(entry []byte, name string, residues []byte) *Exceptions {
+	if len(entry) == 0 || entry[len(entry)-1] != '\n' {
+		return nil
+	}
+	lines := bytes.Split(entry[:len(entry)-1], []byte{'\n'})
+	exc := &Exceptions{}
+	if string(lines[0]) != ">"+name {
+		exc.header = append([]byte(nil), lines[0]...)
+	}
+
+	// The residues as they appear on the lines, and the width of each line.
+	var inLines []byte
+	for _, line := range lines[1:] {
+		inLines = append(inLines, line...)
+		exc.widths = append(exc.widths, len(line))
+	}
+	exc.explicit = !uniformWidths(exc.widths)
+	if !exc.explicit && len(exc.widths) > 0 {
+		exc.width = exc.widths[0]
+	}
+
+	i := 0
+	for pos, c := range inLines {
+		if c == '*' {
+			exc.stops = append(exc.stops, pos)
+			continue
+		}
+		if i >= len(residues) {
+			return nil
+		}
+		switch {
+		case c == residues[i]:
+		case c >= 'a' && c <= 'z' && c-'a'+'A' == residues[i]:
+			last := len(exc.lower) - 1
+			if last >= 0 && exc.lower[last][1] == i {
+				exc.lower[last][1]++
+			} else {
+				exc.lower = append(exc.lower, [2]int{i, i + 1})
+			}
+		default:
+			exc.subs = append(exc.subs, substitution{i, c})
+		}
+		i++
+	}
+	if i != len(residues) {
+		return nil
+	}
+	return exc
+}
+
+// uniformWidths returns true if every line but the last has the same width,
+// and the last line isn't empty or wider than the others.
+func uniformWidths(widths []int) bool {
+	if len(widths) == 0 {
+		return true
+	}
+	width, last := widths[0], widths[len(widths)-1]
+	for _, w := range widths[:len(widths)-1] {
+		if w != width {
+			return false
+		}
+	}
+	return last > 0 && last <= width
+}
+
+// Restore returns the FASTA entry of a sequence from its name, its residues
+// and its exceptions.
+func (exc *Exceptions) Restore(name string, residues []byte) ([]byte, error) {
+	if exc.raw != nil {
+		return exc.raw, nil
+	}
+
+	restored := append([]byte(nil), residues...)
+	for _, sub := range exc.subs {
+		if sub.pos >= len(restored) {
+			return nil, fmt.Errorf("A substituted residue at %d is past the "+
+				"end of a sequence of length %d.", sub.pos, len(restored))
+		}
+		restored[sub.pos] = sub.residue
+	}
+	for _, run := range exc.lower {
+		if run[1] > len(restored) {
+			return nil, fmt.Errorf("A run of lower case residues ends at %d, "+
+				"past the end of a sequence of length %d.",
+				run[1], len(restored))
+		}
+		for i := run[0]; i < run[1]; i++ {
+			if c := restored[i]; c >= 'A' && c <= 'Z' {
+				restored[i] = c - 'A' + 'a'
+			}
+		}
+	}
+	if len(exc.stops) > 0 {
+		inLines := make([]byte, 0, len(restored)+len(exc.stops))
+		i := 0
+		for _, pos := range exc.stops {
+			if pos-len(inLines) > len(restored)-i {
+				return nil, fmt.Errorf("A stop character at %d is past the "+
+					"end of a sequence.", pos)
+			}
+			j := i + pos - len(inLines)
+			inLines = append(inLines, restored[i:j]...)
+			inLines = append(inLines, '*')
+			i = j
+		}
+		restored = append(inLines, restored[i:]...)
+	}
+
+	entry := make([]byte, 0, len(name)+len(restored)+len(restored)/50+3)
+	if exc.header != nil {
+		entry = append(entry, exc.header...)
+	} else {
+		entry = append(entry, '>')
+		entry = append(entry, name...)
+	}
+	entry = append(entry, '\n')
+
+	widths := exc.widths
+	if !exc.explicit {
+		if exc.width == 0 && len(restored) > 0 {
+			return nil, fmt.Errorf("A sequence of length %d cannot have "+
+				"lines of width 0.", len(restored))
+		}
+		widths = nil
+		for left := len(restored); left > 0; left -= exc.width {
+			widths = append(widths, min(left, exc.width))
+		}
+	}
+	for _, width := range widths {
+		if width > len(restored) {
+			return nil, fmt.Errorf("The lines of a sequence are wider than " +
+				"its residues.")
+		}
+		entry = append(entry, restored[:width]...)
+		entry = append(entry, '\n')
+		restored = restored[width:]
+	}
+	if len(restored) > 0 {
+		return nil, fmt.Errorf("%d residues of a sequence are not on any "+
+			"line.", len(restored))
+	}
+	return entry, nil
+}
+
+// encode appends the record of the exceptions to 'dst'.
+func (exc *Exceptions) encode(dst []byte) []byte {
+	if exc.raw != nil {
+		dst = append(dst, excRaw)
+		dst = binary.AppendUvarint(dst, uint64(len(exc.raw)))
+		return append(dst, exc.raw...)
+	}
+
+	flags := byte(0)
+	if exc.header != nil {
+		flags |= excHeader
+	}
+	if exc.explicit {
+		flags |= excWidths
+	}
+	dst = append(dst, flags)
+	if exc.explicit {
+		dst = binary.AppendUvarint(dst, uint64(len(exc.widths)))
+		for _, width := range exc.widths {
+			dst = binary.AppendUvarint(dst, uint64(width))
+		}
+	} else {
+		dst = binary.AppendUvarint(dst, uint64(exc.width))
+	}
+	if exc.header != nil {
+		dst = binary.AppendUvarint(dst, uint64(len(exc.header)))
+		dst = append(dst, exc.header...)
+	}
+
+	dst = binary.AppendUvarint(dst, uint64(len(exc.lower)))
+	last := 0
+	for _, run := range exc.lower {
+		dst = binary.AppendUvarint(dst, uint64(run[0]-last))
+		dst = binary.AppendUvarint(dst, uint64(run[1]-run[0]))
+		last = run[1]
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(exc.subs)))
+	last = 0
+	for _, sub := range exc.subs {
+		dst = binary.AppendUvarint(dst, uint64(sub.pos-last))
+		dst = append(dst, sub.residue)
+		last = sub.pos
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(exc.stops)))
+	last = 0
+	for _, pos := range exc.stops {
+		dst = binary.AppendUvarint(dst, uint64(pos-last))
+		last = pos
+	}
+	return dst
+}
+
+// decodeExceptions reads a record of exceptions.
+func decodeExceptions(r packedReader) (*Exceptions, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, exceptionsError(err)
+	}
+	uvarint := func() int {
+		if err != nil {
+			return 0
+		}
+		var n uint64
+		if n, err = binary.ReadUvarint(r); err == nil && n > 1<<40 {
+			err = fmt.Errorf("%d is too large.", n)
+		}
+		return int(n)
+	}
+	bytesOf := func(n int) []byte {
+		if err != nil {
+			return nil
+		}
+		bs := make([]byte, n)
+		_, err = io.ReadFull(r, bs)
+		return bs
+	}
+
+	exc := &Exceptions{}
+	if flags&excRaw != 0 {
+		exc.raw = bytesOf(uvarint())
+		if err != nil {
+			return nil, exceptionsError(err)
+		}
+		return exc, nil
+	}
+	if flags&excWidths != 0 {
+		exc.explicit = true
+		exc.widths = make([]int, uvarint())
+		for i := range exc.widths {
+			exc.widths[i] = uvarint()
+		}
+	} else {
+		exc.width = uvarint()
+	}
+	if flags&excHeader != 0 {
+		exc.header = bytesOf(uvarint())
+	}
+
+	last := 0
+	exc.lower = make([][2]int, uvarint())
+	for i := range exc.lower {
+		start := last + uvarint()
+		last = start + uvarint()
+		exc.lower[i] = [2]int{start, last}
+	}
+	last = 0
+	exc.subs = make([]substitution, uvarint())
+	for i := range exc.subs {
+		last += uvarint()
+		exc.subs[i].pos = last
+		if err == nil {
+			exc.subs[i].residue, err = r.ReadByte()
+		}
+	}
+	last = 0
+	exc.stops = make([]int, uvarint())
+	for i := range exc.stops {
+		last += uvarint()
+		exc.stops[i] = last
+	}
+	if err != nil {
+		return nil, exceptionsError(err)
+	}
+	return exc, nil
+}
+
+func exceptionsError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Could not read exceptions: %s", err)
+}
+
+// An ExceptionsWriter appends the exceptions of every input sequence of a
+// lossless database, in input order.
+type ExceptionsWriter struct {
+	file, index *os.File
+	buf, ibuf   *bufio.Writer
+	off         int64
+	record      []byte
+}
+
+// OpenExceptions opens the exceptions of a database for appending. If the
+// database isn't lossless, nil is returned.
+func OpenExceptions(db *DB) (*ExceptionsWriter, error) {
+	if !db.Lossless {
+		return nil, nil
+	}
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	file, err := os.OpenFile(db.filePath(FileExceptions), flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open exceptions: %s", err)
+	}
+	index, err := os.OpenFile(db.filePath(FileExceptionsIndex), flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open exceptions: %s", err)
+	}
+
+	info, err := index.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if numSeqs := db.ComDB.NumSequences(); info.Size() != int64(8*numSeqs) {
+		return nil, fmt.Errorf("The exceptions index '%s' has %d sequences, "+
+			"but the compressed database has %d sequences.",
+			db.filePath(FileExceptionsIndex), info.Size()/8, numSeqs)
+	}
+	if info, err = file.Stat(); err != nil {
+		return nil, err
+	}
+	return &ExceptionsWriter{
+		file:  file,
+		index: index,
+		buf:   bufio.NewWriter(file),
+		ibuf:  bufio.NewWriter(index),
+		off:   info.Size(),
+	}, nil
+}
+
+// Add writes the exceptions of the next input sequence.
+func (ew *ExceptionsWriter) Add(exc *Exceptions) error {
+	if err := binary.Write(ew.ibuf, binary.BigEndian, ew.off); err != nil {
+		return err
+	}
+	ew.record = exc.encode(ew.record[:0])
+	if _, err := ew.buf.Write(ew.record); err != nil {
+		return err
+	}
+	ew.off += int64(len(ew.record))
+	return nil
+}
+
+// AddFrom writes the exceptions of every input sequence of the lossless
+// database 'src', as the exceptions of the next input sequences. (This is
+// used to merge databases.)
+func (ew *ExceptionsWriter) AddFrom(src *DB) error {
+	index, err := src.openReadFile(FileExceptionsIndex)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	offsets, err := ioutil.ReadAll(index)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+8 <= len(offsets); i += 8 {
+		off := ew.off + int64(binary.BigEndian.Uint64(offsets[i:]))
+		if err := binary.Write(ew.ibuf, binary.BigEndian, off); err != nil {
+			return err
+		}
+	}
+
+	f, err := src.openReadFile(FileExceptions)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(ew.buf, f)
+	if err != nil {
+		return err
+	}
+	ew.off += n
+	return nil
+}
+
+// Close flushes and closes the exceptions.
+func (ew *ExceptionsWriter) Close() error {
+	if err := ew.buf.Flush(); err != nil {
+		return err
+	}
+	if err := ew.ibuf.Flush(); err != nil {
+		return err
+	}
+	if err := ew.index.Close(); err != nil {
+		return err
+	}
+	return ew.file.Close()
+}
+
+// WriteExact writes every sequence in the database to 'w' in input order,
+// exactly as it was read. (When the database was compressed from several
+// FASTA files, they are written one after the other.)
+//
+// WriteExact only works when the database is lossless and open for reading.
+func (db *DB) WriteExact(w io.Writer) error {
+	if !db.Lossless {
+		return fmt.Errorf("The database at '%s' is not lossless. (It must "+
+			"be compressed with the 'lossless' flag.)", db.Path)
+	}
+	positions, err := ReadInputOrder(db)
+	if err != nil {
+		return fmt.Errorf("Could not read input order: %s", err)
+	}
+	numSeqs := db.ComDB.NumSequences()
+	ids := make([]int, numSeqs)
+	for id := range ids {
+		ids[id] = id
+	}
+	for id, pos := range positions {
+		if pos < 0 || pos >= numSeqs {
+			return fmt.Errorf("Compressed sequence %d has an invalid input "+
+				"position: %d.", id, pos)
+		}
+		ids[pos] = id
+	}
+
+	f, err := db.openReadFile(FileExceptions)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	bw := bufio.NewWriter(w)
+	for pos, id := range ids {
+		exc, err := decodeExceptions(r)
+		if err != nil {
+			return err
+		}
+		oseq, err := db.ComDB.ReadSeq(db.CoarseDB, id)
+		if err != nil {
+			return err
+		}
+		name, err := oseq.LoadName()
+		if err != nil {
+			return err
+		}
+		entry, err := exc.Restore(name, oseq.Residues)
+		if err != nil {
+			return fmt.Errorf("Could not restore the sequence at input "+
+				"position %d: %s", pos, err)
+		}
+		if _, err := bw.Write(entry); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
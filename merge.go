@@ -0,0 +1,356 @@
+package cablastp
+
+import "fmt"
+
+// mergeCandidates is the number of places in the coarse sequences of the
+// first database that a coarse sequence of a later database is aligned to
+// when it is re-compressed, before it is kept as is.
+const mergeCandidates = 16
+
+// A Merger adds every sequence of several databases to a new database, one
+// database after the other. Original and coarse sequence ids are renumbered
+// to follow the sequences of the databases added before.
+//
+// When re-compressing, every coarse sequence of a later database that aligns
+// from end to end with a coarse sequence of the first database is dropped,
+// and the links to it are moved to the sequence of the first database. This
+// recovers some of the redundancy between databases that were compressed
+// separately.
+type Merger struct {
+	db         *DB
+	recompress bool
+
+	// The number of databases and original sequences added so far.
+	numInputs, numSeqs int
+
+	// The number of coarse sequences of the first database. Only these are
+	// re-compressed against.
+	firstCoarse int
+
+	// The number of coarse sequences that were re-compressed.
+	Recompressed int
+
+	order      *InputOrder
+	exceptions *ExceptionsWriter
+	seedMem    [][2]uint
+}
+
+// NewMerger prepares to merge databases into 'db', which must be a new
+// database open for writing. Its configuration should be the configuration of
+// the first database merged (see CheckMerge), with a BlastDBSize of 0.
+//
+// Once every database has been added, the merger must be closed before 'db'
+// is saved.
+func NewMerger(db *DB, recompress bool) (*Merger, error) {
+	exceptions, err := OpenExceptions(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Merger{
+		db:         db,
+		recompress: recompress,
+		exceptions: exceptions,
+		seedMem:    make([][2]uint, 0, 100),
+	}, nil
+}
+
+// CheckMerge returns an error if a database with the configuration 'conf'
+// can't be merged into a database with the configuration 'into'. The
+// settings that the coarse database and seeds depend on must be the same, and
+// either both or neither must be lossless. (Everything else is taken from the
+// database merged into.)
+func CheckMerge(into, conf *DBConf) error {
+	differs := ""
+	switch {
+	case conf.ReducedAlphabet != into.ReducedAlphabet:
+		differs = "reduced alphabet"
+	case conf.MapSeedSize != into.MapSeedSize:
+		differs = "map seed size"
+	case conf.SeedPattern != into.SeedPattern ||
+		conf.SeedSampling != into.SeedSampling ||
+		conf.SeedWindow != into.SeedWindow:
+		differs = "seed pattern or sampling"
+	case conf.Lossless != into.Lossless:
+		differs = "lossless setting"
+	default:
+		return nil
+	}
+	return fmt.Errorf("The %s of the databases is different.", differs)
+}
+
+// Add adds every coarse and original sequence of the database 'src', which
+// must be open for reading.
+func (m *Merger) Add(src *DB) error {
+	if err := CheckMerge(m.db.DBConf, src.DBConf); err != nil {
+		return err
+	}
+	places, err := m.addCoarse(src)
+	if err != nil {
+		return err
+	}
+	numSeqs := src.ComDB.NumSequences()
+	if err := m.addCompressed(src, places); err != nil {
+		return err
+	}
+	if err := m.addLinks(src, places); err != nil {
+		return err
+	}
+	if err := m.addInputOrder(src); err != nil {
+		return err
+	}
+	if m.exceptions != nil {
+		if err := m.exceptions.AddFrom(src); err != nil {
+			return fmt.Errorf("Could not merge exceptions: %s", err)
+		}
+	}
+
+	if m.numInputs == 0 {
+		m.firstCoarse = len(m.db.CoarseDB.Seqs)
+	}
+	m.numInputs++
+	m.numSeqs += numSeqs
+	m.db.BlastDBSize += src.BlastDBSize
+	return nil
+}
+
+// Close finishes writing the input order and exceptions.
+func (m *Merger) Close() error {
+	if m.order != nil {
+		if err := m.order.Close(); err != nil {
+			return err
+		}
+	}
+	if m.exceptions != nil {
+		return m.exceptions.Close()
+	}
+	return nil
+}
+
+// A coarsePlace is where the residues of a coarse sequence of a merged
+// database ended up: coarse sequence 'id'. If the sequence was
+// re-compressed, residue 'i' of it is aligned to residue 'start+offsets[i]'
+// of coarse sequence 'id'.
+type coarsePlace struct {
+	id       int
+	residues []byte
+	start    int
+	offsets  []int
+}
+
+// coarseRange returns the range of the new coarse sequence that the range
+// [start, end) of the merged coarse sequence is at.
+func (place coarsePlace) coarseRange(start, end int) (uint16, uint16) {
+	if place.offsets == nil {
+		return uint16(start), uint16(end)
+	}
+	return uint16(place.start + place.offsets[start]),
+		uint16(place.start + place.offsets[end])
+}
+
+// addCoarse adds every coarse sequence of 'src', or re-compresses it, and
+// returns where each ended up.
+func (m *Merger) addCoarse(src *DB) ([]coarsePlace, error) {
+	places := make([]coarsePlace, src.CoarseDB.NumSequences())
+	recompressed := 0
+	for id := range places {
+		seq, err := src.CoarseDB.ReadCoarseSeq(id)
+		if err != nil {
+			return nil, err
+		}
+		if m.recompress && m.numInputs > 0 {
+			if place, ok := m.recompressCoarse(seq.Residues); ok {
+				places[id] = place
+				recompressed++
+				continue
+			}
+		}
+		newId, _, err := m.db.CoarseDB.Add(seq.Residues)
+		if err != nil {
+			return nil, err
+		}
+		places[id] = coarsePlace{id: newId, residues: seq.Residues}
+	}
+	if m.recompress && m.numInputs > 0 {
+		Vprintf("Re-compressed %d of %d coarse sequences of %s.\n",
+			recompressed, len(places), src.Path)
+	}
+	m.Recompressed += recompressed
+	return places, nil
+}
+
+// recompressCoarse looks for a part of a coarse sequence of the first
+// database that the coarse sequence 'residues' aligns to from end to end
+// with at least the match sequence identity threshold. Candidates are found
+// with the seeds table, on the diagonal of a seed hit.
+func (m *Merger) recompressCoarse(residues []byte) (coarsePlace, bool) {
+	seeds, coarse := m.db.CoarseDB.Seeds, m.db.CoarseDB.Seqs
+	if len(residues) < m.db.MinMatchLen {
+		return coarsePlace{}, false
+	}
+
+	tried := make(map[[2]int]bool)
+	for i := 0; i+seeds.SeedSize <= len(residues); i++ {
+		kmer := residues[i : i+seeds.SeedSize]
+		if seeds.HasWildcard(kmer) {
+			continue
+		}
+		locs := seeds.LookupBefore(kmer, m.firstCoarse, &m.seedMem)
+		for _, loc := range locs {
+			id, diag := int(loc[0]), int(loc[1])-i
+			if tried[[2]int{id, diag}] {
+				continue
+			}
+			if len(tried) == mergeCandidates {
+				return coarsePlace{}, false
+			}
+			tried[[2]int{id, diag}] = true
+
+			target := coarse[id].Residues
+			start := max(0, diag)
+			end := min(len(target), diag+len(residues))
+			aligned := alignEdits(target[start:end], residues)
+			if SeqIdentity(aligned[0], aligned[1]) < m.db.MatchSeqIdThreshold {
+				continue
+			}
+			return coarsePlace{
+				id:       id,
+				residues: residues,
+				start:    start,
+				offsets:  alignedOffsets(aligned),
+			}, true
+		}
+	}
+	return coarsePlace{}, false
+}
+
+// alignedOffsets returns, for every residue of the second sequence of an
+// alignment and for its end, the number of residues of the first sequence
+// before it.
+func alignedOffsets(aligned [2][]byte) []int {
+	offsets := make([]int, 0, len(aligned[1])+1)
+	from := 0
+	for i := range aligned[0] {
+		if aligned[1][i] != '-' {
+			offsets = append(offsets, from)
+		}
+		if aligned[0][i] != '-' {
+			from++
+		}
+	}
+	return append(offsets, from)
+}
+
+// addCompressed writes every original sequence of 'src' with renumbered ids,
+// and with its links moved to where their coarse sequences ended up.
+func (m *Merger) addCompressed(src *DB, places []coarsePlace) error {
+	coarse := m.db.CoarseDB.Seqs
+	for id := 0; id < src.ComDB.NumSequences(); id++ {
+		cseq, err := src.ComDB.ReadCompressedSeq(id)
+		if err != nil {
+			return fmt.Errorf("Error reading seq id '%d': %s", id, err)
+		}
+		name, err := cseq.LoadName()
+		if err != nil {
+			return fmt.Errorf("Error reading name of seq id '%d': %s", id, err)
+		}
+		if cseq.IsAlias() {
+			m.db.ComDB.Write(
+				NewAliasSeq(m.numSeqs+id, name, m.numSeqs+cseq.AliasOf))
+			continue
+		}
+
+		merged := NewCompressedSeq(m.numSeqs+id, name)
+		for _, lk := range cseq.Links {
+			if lk.CoarseSeqId >= uint(len(places)) {
+				return fmt.Errorf("Original sequence %d links to coarse "+
+					"sequence %d, which doesn't exist.", id, lk.CoarseSeqId)
+			}
+			place := places[lk.CoarseSeqId]
+			start, end := int(lk.CoarseStart), int(lk.CoarseEnd)
+			if start > end || end > len(place.residues) {
+				return fmt.Errorf("Original sequence %d links to [%d, %d) of "+
+					"coarse sequence %d, which has %d residues.", id, start,
+					end, lk.CoarseSeqId, len(place.residues))
+			}
+
+			lk.CoarseSeqId = uint(place.id)
+			lk.CoarseStart, lk.CoarseEnd = place.coarseRange(start, end)
+			if place.offsets != nil && IsEncodedResidues(lk.OrigSeq) {
+				residues := coarse[place.id].Residues
+				recoded, err := rescriptResidues(place.residues[start:end],
+					residues[lk.CoarseStart:lk.CoarseEnd], lk.OrigSeq)
+				if err != nil {
+					return fmt.Errorf("Original sequence %d: %s", id, err)
+				}
+				lk.OrigSeq = recoded
+			}
+			merged.Add(lk)
+		}
+		m.db.ComDB.Write(merged)
+	}
+	return nil
+}
+
+// addLinks adds the links of every coarse sequence of 'src' to where the
+// coarse sequence ended up.
+func (m *Merger) addLinks(src *DB, places []coarsePlace) error {
+	numSeqs := src.ComDB.NumSequences()
+	for id, place := range places {
+		links, err := src.CoarseDB.ReadLinks(id)
+		if err != nil {
+			return fmt.Errorf("Could not read links of coarse sequence %d: %s",
+				id, err)
+		}
+		seq := m.db.CoarseDB.Seqs[place.id]
+		for _, lk := range links {
+			start, end := int(lk.CoarseStart), int(lk.CoarseEnd)
+			if int(lk.OrgSeqId) >= numSeqs ||
+				start > end || end > len(place.residues) {
+				return fmt.Errorf("Coarse sequence %d has an invalid link: %s",
+					id, lk)
+			}
+			start16, end16 := place.coarseRange(start, end)
+			seq.AddLink(NewLinkToCompressed(
+				lk.OrgSeqId+uint32(m.numSeqs), start16, end16))
+		}
+	}
+	return nil
+}
+
+// addInputOrder records the input position of every original sequence of
+// 'src'. Input positions are only written once a database with an input
+// order has been added, and sequences before it keep their positions.
+func (m *Merger) addInputOrder(src *DB) error {
+	positions, err := ReadInputOrder(src)
+	if err != nil {
+		return fmt.Errorf("Could not read input order: %s", err)
+	}
+	numSeqs := src.ComDB.NumSequences()
+	if positions == nil && m.order == nil {
+		return nil
+	}
+	if positions != nil && len(positions) != numSeqs {
+		return fmt.Errorf("The input order has %d sequences, but the "+
+			"compressed database has %d sequences.", len(positions), numSeqs)
+	}
+	if m.order == nil {
+		if m.order, err = OpenInputOrder(m.db, true); err != nil {
+			return err
+		}
+		for pos := 0; pos < m.numSeqs; pos++ {
+			if err := m.order.Add(pos); err != nil {
+				return err
+			}
+		}
+	}
+	for id := 0; id < numSeqs; id++ {
+		pos := id
+		if positions != nil {
+			pos = positions[id]
+		}
+		if err := m.order.Add(m.numSeqs + pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
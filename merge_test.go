@@ -0,0 +1,168 @@
+package cablastp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Split the input in two at the entry closest to the middle.
+	input, err := ioutil.ReadFile("data/small.fasta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middle := len(input) / 2
+	middle += bytes.Index(input[middle:], []byte("\n>")) + 1
+	halves := map[string][]byte{"a": input[:middle], "b": input[middle:]}
+	for name, half := range halves {
+		fasta := filepath.Join(tmpDir, name+".fasta")
+		if err := ioutil.WriteFile(fasta, half, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type test struct {
+		name       string
+		conf       *DBConf
+		inputs     []string
+		recompress bool
+	}
+	lossless := DefaultDBConf.DeepCopy()
+	lossless.ResidueCoding = CodingRange
+	lossless.Lossless = true
+	tests := []test{
+		{"plain", DefaultDBConf.DeepCopy(), []string{"a", "b"}, false},
+		{"lossless", lossless, []string{"a", "b", "a"}, true},
+	}
+	for _, test := range tests {
+		var dbs []*DB
+		var dirs []string
+		var exact []byte
+		for i, name := range test.inputs {
+			dbDir := filepath.Join(tmpDir, fmt.Sprintf("%s-%d", test.name, i))
+			fasta := filepath.Join(tmpDir, name+".fasta")
+			createTestDB(t, dbDir, fasta, test.conf.DeepCopy())
+			db, err := NewReadDB(dbDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.ReadClose()
+			dbs = append(dbs, db)
+			dirs = append(dirs, dbDir)
+			exact = append(exact, halves[name]...)
+		}
+
+		mergedDir := filepath.Join(tmpDir, test.name+"-merged")
+		recompressed := mergeDB(t, mergedDir, test.recompress, dbs)
+		if test.recompress && recompressed == 0 {
+			t.Fatalf("No coarse sequences of a copy of the first database "+
+				"were re-compressed in the %s test.", test.name)
+		}
+		merged, err := NewReadDB(mergedDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, err := merged.CheckLinks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) > 0 {
+			t.Fatalf("The merged %s database has bad links:\n%s",
+				test.name, strings.Join(problems, "\n"))
+		}
+
+		// Every sequence must decompress to the same residues after its id is
+		// renumbered.
+		id := 0
+		numCoarse := 0
+		for i, db := range dbs {
+			numCoarse += db.CoarseDB.NumSequences()
+			for inId := 0; inId < db.ComDB.NumSequences(); inId++ {
+				want, err := db.ComDB.ReadSeq(db.CoarseDB, inId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := merged.ComDB.ReadSeq(merged.CoarseDB, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got.Residues, want.Residues) {
+					t.Fatalf("Sequence %d of %s decompressed to %s after "+
+						"merging, but should be %s.", inId, dirs[i],
+						got.Residues, want.Residues)
+				}
+				id++
+			}
+		}
+		if got := merged.ComDB.NumSequences(); got != id {
+			t.Fatalf("The merged %s database has %d sequences, but should "+
+				"have %d.", test.name, got, id)
+		}
+		want := numCoarse - recompressed
+		if got := merged.CoarseDB.NumSequences(); got != want {
+			t.Fatalf("The merged %s database has %d coarse sequences, but "+
+				"should have %d.", test.name, got, want)
+		}
+
+		if test.conf.Lossless {
+			output := new(bytes.Buffer)
+			if err := merged.WriteExact(output); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(output.Bytes(), exact) {
+				t.Fatalf("The exact output of the merged %s database is not "+
+					"its inputs.", test.name)
+			}
+		}
+		merged.ReadClose()
+	}
+
+	// Databases with different reduced alphabets can't be merged.
+	conf := DefaultDBConf.DeepCopy()
+	conf.ReducedAlphabet = "murphy4"
+	if err := CheckMerge(DefaultDBConf, conf); err == nil {
+		t.Fatal("Databases with different reduced alphabets were merged.")
+	}
+}
+
+// mergeDB merges 'dbs' into a new database in 'dbDir', the same way
+// cablastp-merge does, and returns the number of coarse sequences that were
+// re-compressed.
+func mergeDB(t *testing.T, dbDir string, recompress bool,
+	dbs []*DB) int {
+
+	conf := *dbs[0].DBConf
+	conf.BlastDBSize = 0
+	db, err := NewWriteDB(&conf, dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.WriteClose()
+	merger, err := NewMerger(db, recompress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range dbs {
+		if err := merger.Add(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := merger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return merger.Recompressed
+}
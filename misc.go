@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -36,3 +38,35 @@ func PrintFlagDefaults() {
 		fmt.Printf("--%s=\"%s\"\n\t%s\n", fg.Name, fg.DefValue, fg.Usage)
 	})
 }
+
+// ParseIdRanges parses a comma separated list of ids and id ranges (e.g.,
+// '0-9,15'), and returns every id in order. Every id must be less than
+// 'numSeqs'.
+func ParseIdRanges(ranges string, numSeqs int) ([]int, error) {
+	var ids []int
+	for _, r := range strings.Split(ranges, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid id range '%s'.", r)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("Invalid id range '%s'.", r)
+			}
+		}
+		if start < 0 || end < start || end >= numSeqs {
+			return nil, fmt.Errorf("The id range '%s' is not within the "+
+				"%d sequences of the database.", r, numSeqs)
+		}
+		for id := start; id <= end; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
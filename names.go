@@ -0,0 +1,472 @@
+package cablastp
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// FileNames is a table of every name and accession of every original
+	// sequence, sorted by name.
+	FileNames = "compressed.names"
+
+	// FileNamesIndex holds the byte offset of every record in the name
+	// table, so that it can be binary searched.
+	FileNamesIndex = "compressed.names.index"
+)
+
+// Every record in the name table is the length of a name as a uvarint, the
+// name, and the id of the original sequence it names as a big-endian uint32.
+// Records are sorted by name, and then by id.
+
+// nameKey is a name of an original sequence.
+type nameKey struct {
+	name string
+	id   uint32
+}
+
+// seqIdFields maps the database tags of NCBI FASTA sequence identifiers (as
+// in 'gi|15674171|ref|NP_268346.1|') to the number of fields that follow the
+// tag, and which of them is the accession.
+var seqIdFields = map[string][2]int{
+	"gi":  {1, 0},
+	"bbs": {1, 0},
+	"bbm": {1, 0},
+	"lcl": {1, 0},
+	"gb":  {2, 0},
+	"emb": {2, 0},
+	"dbj": {2, 0},
+	"ref": {2, 0},
+	"sp":  {2, 0},
+	"tr":  {2, 0},
+	"pir": {2, 0},
+	"prf": {2, 0},
+	"pdb": {2, 0},
+	"tpg": {2, 0},
+	"tpe": {2, 0},
+	"tpd": {2, 0},
+	"gpp": {2, 0},
+	"nat": {2, 0},
+	"gnl": {2, 1},
+	"pat": {3, 1},
+}
+
+// ParseSeqIds returns every name that the sequence with FASTA header 'header'
+// can be found by. NR style headers, where the headers of identical sequences
+// are joined with '^A', have the names of every one of those sequences.
+//
+// The first word of each header is a name. If it is an NCBI sequence
+// identifier, the accession of every database is also a name, both with and
+// without its database tag and version (e.g., 'NP_268346.1', 'NP_268346' and
+// 'ref|NP_268346.1'), as is every locus name (e.g., 'HBA_HUMAN').
+func ParseSeqIds(header string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, part := range strings.Split(header, "\x01") {
+		words := strings.Fields(part)
+		if len(words) == 0 {
+			continue
+		}
+		word := words[0]
+		add(word)
+		add(strings.TrimSuffix(word, "|"))
+
+		fields := strings.Split(strings.TrimSuffix(word, "|"), "|")
+		for i := 0; len(fields) > 1 && i < len(fields); {
+			tag := fields[i]
+			spec, ok := seqIdFields[tag]
+			if !ok {
+				break
+			}
+			values := fields[i+1 : min(i+1+spec[0], len(fields))]
+			for j, value := range values {
+				if value == "" {
+					continue
+				}
+				if j != spec[1] {
+					add(value)
+					continue
+				}
+				add(value)
+				add(tag + "|" + value)
+				if dot := strings.LastIndex(value, "."); dot > 0 {
+					add(value[:dot])
+				}
+			}
+			i += 1 + spec[0]
+		}
+	}
+	return names
+}
+
+// nameChunkSize is the number of names that are kept in memory while
+// compressing. Every chunk of names is sorted and spilled to a temporary
+// file, and the spill files are merged into the name table when the
+// database is saved.
+const nameChunkSize = 1 << 20
+
+func (key nameKey) less(key2 nameKey) bool {
+	if key.name != key2.name {
+		return key.name < key2.name
+	}
+	return key.id < key2.id
+}
+
+func sortNameKeys(keys []nameKey) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+}
+
+// appendNameRecord appends the name table record of 'key' to 'record'.
+func appendNameRecord(record []byte, key nameKey) []byte {
+	record = binary.AppendUvarint(record, uint64(len(key.name)))
+	record = append(record, key.name...)
+	return binary.BigEndian.AppendUint32(record, key.id)
+}
+
+// readNameRecord reads the next name table record from 'r'. It returns
+// io.EOF if there are no more records.
+func readNameRecord(r *bufio.Reader) (nameKey, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nameKey{}, err
+	}
+	buf := make([]byte, int(length)+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nameKey{}, err
+	}
+	return nameKey{
+		name: string(buf[:length]),
+		id:   binary.BigEndian.Uint32(buf[length:]),
+	}, nil
+}
+
+// A nameSorter sorts the names of the original sequences that are written
+// out-of-core, the same way cablastp-compress orders its input: names are
+// sorted in chunks of 'chunkSize' names, each chunk is spilled to a
+// temporary file in 'dir', and the spill files are merged when the name
+// table is written.
+type nameSorter struct {
+	dir       string
+	chunkSize int
+	chunk     []nameKey
+	spills    []*nameSpill
+}
+
+func newNameSorter(dir string) *nameSorter {
+	return &nameSorter{dir: dir, chunkSize: nameChunkSize}
+}
+
+// add adds every name of the original sequence with FASTA header 'header'
+// and id 'id'. (See ParseSeqIds.)
+func (ns *nameSorter) add(header string, id int) error {
+	for _, name := range ParseSeqIds(header) {
+		// Names are copied, so that they don't keep the header alive.
+		ns.chunk = append(ns.chunk, nameKey{string([]byte(name)), uint32(id)})
+		if len(ns.chunk) < ns.chunkSize {
+			continue
+		}
+		if err := ns.spill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spill sorts the current chunk of names and writes it to a new temporary
+// file, which is removed as soon as it is created. (It stays readable until
+// it is closed.)
+func (ns *nameSorter) spill() error {
+	sortNameKeys(ns.chunk)
+
+	f, err := ioutil.TempFile(ns.dir, "cablastp-names")
+	if err != nil {
+		return fmt.Errorf("Could not create spill file: %s", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not remove spill file '%s': %s",
+			f.Name(), err)
+	}
+	w := bufio.NewWriter(f)
+	var record []byte
+	for _, key := range ns.chunk {
+		record = appendNameRecord(record[:0], key)
+		if _, err = w.Write(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Could not write spill file '%s': %s",
+			f.Name(), err)
+	}
+	ns.spills = append(ns.spills, &nameSpill{file: f, r: bufio.NewReader(f)})
+	ns.chunk = ns.chunk[:0]
+	return nil
+}
+
+// write writes the name table to 'table', and the offset of every record to
+// 'index'. It returns the number of names written. The spill files are
+// removed afterwards, so nothing can be added after writing.
+func (ns *nameSorter) write(table, index io.Writer) (int, error) {
+	defer ns.remove()
+
+	w, iw := bufio.NewWriter(table), bufio.NewWriter(index)
+	var record []byte
+	count, off := 0, int64(0)
+	put := func(key nameKey) error {
+		record = appendNameRecord(record[:0], key)
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		if err := binary.Write(iw, binary.BigEndian, off); err != nil {
+			return err
+		}
+		off += int64(len(record))
+		count++
+		return nil
+	}
+
+	// If all names fit in a single chunk, they are sorted in memory.
+	if len(ns.spills) == 0 {
+		sortNameKeys(ns.chunk)
+		for _, key := range ns.chunk {
+			if err := put(key); err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		if len(ns.chunk) > 0 {
+			if err := ns.spill(); err != nil {
+				return 0, err
+			}
+		}
+		if err := mergeNameSpills(ns.spills, put); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := iw.Flush(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// remove frees the names in memory and removes the spill files.
+func (ns *nameSorter) remove() {
+	for _, spill := range ns.spills {
+		spill.file.Close()
+	}
+	ns.chunk, ns.spills = nil, nil
+}
+
+// nameSpill reads the names of a spill file in order. 'cur' is the name that
+// was read last.
+type nameSpill struct {
+	file *os.File
+	r    *bufio.Reader
+	cur  nameKey
+}
+
+// next reads the next name into 'cur'. It returns io.EOF when there are no
+// more names.
+func (spill *nameSpill) next() error {
+	key, err := readNameRecord(spill.r)
+	if err == nil {
+		spill.cur = key
+	} else if err != io.EOF {
+		err = fmt.Errorf("Could not read spill file '%s': %s",
+			spill.file.Name(), err)
+	}
+	return err
+}
+
+// nameSpillHeap is a min-heap of spill files, ordered by their current
+// names.
+type nameSpillHeap []*nameSpill
+
+func (h nameSpillHeap) Len() int            { return len(h) }
+func (h nameSpillHeap) Less(i, j int) bool  { return h[i].cur.less(h[j].cur) }
+func (h nameSpillHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nameSpillHeap) Push(x interface{}) { *h = append(*h, x.(*nameSpill)) }
+func (h *nameSpillHeap) Pop() interface{} {
+	old := *h
+	spill := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return spill
+}
+
+// mergeNameSpills merges sorted spill files, and calls 'put' with every name
+// in order.
+func mergeNameSpills(spills []*nameSpill, put func(nameKey) error) error {
+	h := make(nameSpillHeap, 0, len(spills))
+	for _, spill := range spills {
+		if err := spill.next(); err != nil {
+			return err
+		}
+		h = append(h, spill)
+	}
+	heap.Init(&h)
+	for len(h) > 0 {
+		spill := h[0]
+		if err := put(spill.cur); err != nil {
+			return err
+		}
+
+		err := spill.next()
+		switch {
+		case err == io.EOF:
+			heap.Pop(&h)
+		case err != nil:
+			return err
+		default:
+			heap.Fix(&h, 0)
+		}
+	}
+	return nil
+}
+
+// saveNames writes the name table of every original sequence that was
+// written. If the database doesn't keep a name table, nothing is written.
+func (comdb *CompressedDB) saveNames(db *DB) error {
+	if comdb.names == nil {
+		return nil
+	}
+	Vprintf("Writing %s...\n", FileNames)
+	timer := time.Now()
+
+	table, err := db.openWriteFile(FileNames)
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+	index, err := db.openWriteFile(FileNamesIndex)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	count, err := comdb.names.write(table, index)
+	if err != nil {
+		return fmt.Errorf("Could not write %s: %s", FileNames, err)
+	}
+	comdb.names = nil
+
+	Vprintf("Done writing %s (%d names, %s).\n",
+		FileNames, count, time.Since(timer))
+	return nil
+}
+
+// A NameIndex finds original sequences by their names. (See ParseSeqIds.)
+type NameIndex struct {
+	table, index *os.File
+	size         int
+}
+
+// OpenNameIndex opens the name table of a database. If the database doesn't
+// have one, nil is returned.
+func OpenNameIndex(db *DB) (*NameIndex, error) {
+	var err error
+
+	if _, err = os.Stat(db.filePath(FileNames)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	ni := &NameIndex{}
+	if ni.table, err = db.openReadFile(FileNames); err != nil {
+		return nil, err
+	}
+	if ni.index, err = db.openReadFile(FileNamesIndex); err != nil {
+		return nil, err
+	}
+	info, err := ni.index.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ni.size = int(info.Size() / 8)
+	return ni, nil
+}
+
+// Lookup returns the ids of every original sequence named 'name', in
+// increasing order.
+func (ni *NameIndex) Lookup(name string) ([]int, error) {
+	var err error
+
+	// Find the first record whose name isn't less than 'name'.
+	first := sort.Search(ni.size, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var key nameKey
+		key, err = ni.record(i)
+		return key.name >= name
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for i := first; i < ni.size; i++ {
+		key, err := ni.record(i)
+		if err != nil {
+			return nil, err
+		}
+		if key.name != name {
+			break
+		}
+		ids = append(ids, int(key.id))
+	}
+	return ids, nil
+}
+
+// record reads the i'th record of the name table.
+func (ni *NameIndex) record(i int) (nameKey, error) {
+	var offBytes [8]byte
+	if _, err := ni.index.ReadAt(offBytes[:], int64(i)*8); err != nil {
+		return nameKey{}, err
+	}
+	off := int64(binary.BigEndian.Uint64(offBytes[:]))
+	r := bufio.NewReaderSize(io.NewSectionReader(ni.table, off, 1<<62), 64)
+	key, err := readNameRecord(r)
+	if err != nil {
+		return nameKey{}, namesError(err)
+	}
+	return key, nil
+}
+
+func namesError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Could not read name table: %s", err)
+}
+
+// Close closes the name table.
+func (ni *NameIndex) Close() {
+	ni.table.Close()
+	ni.index.Close()
+}
@@ -0,0 +1,136 @@
+package cablastp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNameIndex(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	noNames := DefaultDBConf.DeepCopy()
+	noNames.NameTable = false
+	db := createNamedTestDB(t, filepath.Join(tmpDir, "no-names"), noNames)
+	names, err := OpenNameIndex(db)
+	db.ReadClose()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names != nil {
+		t.Fatal("A name table was written without 'NameTable'.")
+	}
+
+	db = createNamedTestDB(t, filepath.Join(tmpDir, "db"), nil)
+	defer db.ReadClose()
+
+	names, err = OpenNameIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names == nil {
+		t.Fatal("The database has no name table.")
+	}
+	defer names.Close()
+
+	lookups := map[string]string{
+		"NP_1.1":      "[0]",
+		"NP_1":        "[0 2]",
+		"2":           "[0]",
+		"gb|AB_2.3":   "[0]",
+		"HBA_HUMAN":   "[1]",
+		"P69905":      "[1]",
+		"gi|3":        "[2]",
+		"12345":       "[3]",
+		"NP_1.3":      "[]",
+		"":            "[]",
+		"zzz":         "[]",
+		"gi|1|ref|NP": "[]",
+	}
+	for name, want := range lookups {
+		ids, err := names.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(ids); got != want {
+			t.Fatalf("Looking up '%s' found %s, but should have found %s.",
+				name, got, want)
+		}
+	}
+}
+
+func TestNameSorter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	headers := []string{
+		"gi|1|ref|NP_1.1| first\x01gi|2|gb|AB_2.3| first copy",
+		"sp|P69905|HBA_HUMAN second",
+		"gi|3|ref|NP_1.2| third",
+		"zzz", "aaa", "NP_1",
+	}
+	numNames := 0
+	for _, header := range headers {
+		numNames += len(ParseSeqIds(header))
+	}
+
+	// The names are sorted the same way in memory as when they're spilled
+	// in chunks of 3 names.
+	var tables [2]string
+	for i, chunkSize := range []int{nameChunkSize, 3} {
+		ns := newNameSorter(tmpDir)
+		ns.chunkSize = chunkSize
+		for id, header := range headers {
+			if err := ns.add(header, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if spilled := len(ns.spills) > 0; spilled != (i == 1) {
+			t.Fatalf("With chunks of %d names, spilled is %v.",
+				chunkSize, spilled)
+		}
+		table, err := os.Create(filepath.Join(tmpDir, "table"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := os.Create(filepath.Join(tmpDir, "index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := ns.write(table, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != numNames {
+			t.Fatalf("Wrote %d names, but there are %d.", count, numNames)
+		}
+		bs, err := ioutil.ReadFile(table.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[i] = string(bs)
+
+		names := &NameIndex{table: table, index: index, size: count}
+		ids, err := names.Lookup("NP_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids) != "[0 2 5]" {
+			t.Fatalf("Looking up 'NP_1' found %v, but should have found "+
+				"[0 2 5].", ids)
+		}
+		names.Close()
+	}
+	if tables[0] != tables[1] {
+		t.Fatal("The name table is different when names are spilled.")
+	}
+}
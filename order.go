@@ -0,0 +1,99 @@
+package cablastp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// FileInputOrder maps compressed sequences back to their positions in
+	// the input. It only exists if the sequences weren't compressed in the
+	// order they were given.
+	FileInputOrder = "compressed.order"
+)
+
+// An InputOrder records the input position of every compressed sequence, as
+// a big-endian uint32 for each sequence in the compressed database. Input
+// positions are numbered across all input files, starting after the
+// sequences already in the database.
+type InputOrder struct {
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// OpenInputOrder opens the input order file of a database for appending.
+//
+// If the database doesn't have one yet, it is only created if 'create' is
+// set (in which case the sequences already in the database keep their
+// positions). Otherwise, nil is returned.
+func OpenInputOrder(db *DB, create bool) (*InputOrder, error) {
+	numSeqs := db.ComDB.NumSequences()
+	name := db.filePath(FileInputOrder)
+
+	info, err := os.Stat(name)
+	switch {
+	case err == nil:
+		if info.Size() != int64(4*numSeqs) {
+			return nil, fmt.Errorf("The input order '%s' has %d sequences, "+
+				"but the compressed database has %d sequences.",
+				name, info.Size()/4, numSeqs)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	case !create:
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open input order: %s", err)
+	}
+	order := &InputOrder{file: f, buf: bufio.NewWriter(f)}
+	if info == nil {
+		for pos := 0; pos < numSeqs; pos++ {
+			if err := order.Add(pos); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return order, nil
+}
+
+// Add records the input position of the next compressed sequence.
+func (order *InputOrder) Add(pos int) error {
+	return binary.Write(order.buf, binary.BigEndian, uint32(pos))
+}
+
+// Close flushes and closes the input order file.
+func (order *InputOrder) Close() error {
+	if err := order.buf.Flush(); err != nil {
+		return err
+	}
+	return order.file.Close()
+}
+
+// ReadInputOrder returns the input position of every compressed sequence in
+// the database, indexed by compressed sequence id. If the database has no
+// input order, nil is returned, and every sequence is at its own position.
+func ReadInputOrder(db *DB) ([]int, error) {
+	f, err := os.Open(db.filePath(FileInputOrder))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bs, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	positions := make([]int, len(bs)/4)
+	for i := range positions {
+		positions[i] = int(binary.BigEndian.Uint32(bs[4*i:]))
+	}
+	return positions, nil
+}
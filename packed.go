@@ -0,0 +1,293 @@
+package cablastp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// FileCoarsePacked is where coarse sequences are stored, packed with as
+	// few bits per residue as the reduced alphabet allows.
+	FileCoarsePacked = "coarse.packed"
+
+	// FileCoarsePackedIndex holds the byte offset (or the block address, if
+	// the database is block compressed) of every packed coarse sequence.
+	FileCoarsePackedIndex = "coarse.packed.index"
+)
+
+// Packed coarse sequences.
+//
+// Every coarse sequence is a record of:
+//
+//	the number of residues, as a uvarint
+//	the number of wildcard runs, as a uvarint
+//	for every wildcard run: the number of residues since the end of the
+//	    previous run and the length of the run, as uvarints
+//	the class index of every residue, 'bits' bits each, packed from the
+//	    high bits of the first byte (wildcards are packed as class 0)
+//
+// With a four class alphabet, each residue takes 2 bits. Since wildcards
+// are rare, storing them as runs is much smaller than reserving a code for
+// them.
+
+// packBits returns the number of bits needed for the class index of a residue
+// in the alphabet.
+func packBits(alpha *Alphabet) uint {
+	bits := uint(1)
+	for 1<<bits < alpha.Size() {
+		bits++
+	}
+	return bits
+}
+
+// packCoarseSeq appends the record of a coarse sequence to 'dst'.
+func packCoarseSeq(dst []byte, alpha *Alphabet, residues []byte) []byte {
+	var runs [][2]int
+	for i := 0; i < len(residues); i++ {
+		if alpha.Index(residues[i]) != -1 {
+			continue
+		}
+		start := i
+		for i < len(residues) && alpha.Index(residues[i]) == -1 {
+			i++
+		}
+		runs = append(runs, [2]int{start, i})
+	}
+
+	dst = binary.AppendUvarint(dst, uint64(len(residues)))
+	dst = binary.AppendUvarint(dst, uint64(len(runs)))
+	last := 0
+	for _, run := range runs {
+		dst = binary.AppendUvarint(dst, uint64(run[0]-last))
+		dst = binary.AppendUvarint(dst, uint64(run[1]-run[0]))
+		last = run[1]
+	}
+
+	bits := packBits(alpha)
+	packed := make([]byte, (uint(len(residues))*bits+7)/8)
+	for i, residue := range residues {
+		code := alpha.Index(residue)
+		if code == -1 {
+			code = 0
+		}
+		bit := uint(i) * bits
+		for b := uint(0); b < bits; b++ {
+			if code&(1<<(bits-1-b)) != 0 {
+				packed[(bit+b)/8] |= 0x80 >> ((bit + b) % 8)
+			}
+		}
+	}
+	return append(dst, packed...)
+}
+
+// packedReader is what packed coarse sequences are read from.
+type packedReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// unpackCoarseSeq reads the record of a coarse sequence, and returns its
+// residues.
+func unpackCoarseSeq(r packedReader, alpha *Alphabet) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	numRuns, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, packedError(err)
+	}
+	if numRuns > length {
+		return nil, fmt.Errorf("A packed coarse sequence of length %d "+
+			"cannot have %d wildcard runs.", length, numRuns)
+	}
+	runs := make([][2]uint64, numRuns)
+	last := uint64(0)
+	for i := range runs {
+		gap, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, packedError(err)
+		}
+		runLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, packedError(err)
+		}
+		runs[i] = [2]uint64{last + gap, last + gap + runLen}
+		last = runs[i][1]
+		if last > length {
+			return nil, fmt.Errorf("A wildcard run ends at %d, past the end "+
+				"of a packed coarse sequence of length %d.", last, length)
+		}
+	}
+
+	bits := packBits(alpha)
+	packed := make([]byte, (uint(length)*bits+7)/8)
+	if _, err := io.ReadFull(r, packed); err != nil {
+		return nil, packedError(err)
+	}
+	residues := make([]byte, length)
+	for i := range residues {
+		bit := uint(i) * bits
+		code := 0
+		for b := uint(0); b < bits; b++ {
+			code <<= 1
+			if packed[(bit+b)/8]&(0x80>>((bit+b)%8)) != 0 {
+				code |= 1
+			}
+		}
+		if code >= alpha.Size() {
+			return nil, fmt.Errorf("Invalid class %d in a packed coarse "+
+				"sequence.", code)
+		}
+		residues[i] = alpha.Letters[code]
+	}
+	for _, run := range runs {
+		for i := run[0]; i < run[1]; i++ {
+			residues[i] = alpha.Wildcard
+		}
+	}
+	return residues, nil
+}
+
+func packedError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Could not read packed coarse sequence: %s", err)
+}
+
+// savePacked writes the coarse sequences that were added since the database
+// was opened to the packed store, and their offsets to its index.
+func (coarsedb *CoarseDB) savePacked() (err error) {
+	Vprintf("Writing %s...\n", FileCoarsePacked)
+	timer := time.Now()
+
+	byteOff := int64(0)
+	if coarsedb.indexSize > 0 {
+		info, err := coarsedb.FilePacked.Stat()
+		if err != nil {
+			return err
+		}
+		byteOff = info.Size()
+	}
+
+	// In a block compressed database, the index holds the address of every
+	// sequence instead of its byte offset.
+	var blocks *blockWriter
+	if coarsedb.blockSize > 0 {
+		blocks = newBlockWriter(coarsedb.FilePacked, byteOff,
+			coarsedb.blockSize)
+	}
+	w := bufio.NewWriter(coarsedb.FilePacked)
+	index := bufio.NewWriter(coarsedb.FilePackedIndex)
+	var record []byte
+	for i := coarsedb.seqsRead; i < len(coarsedb.Seqs); i++ {
+		record = packCoarseSeq(
+			record[:0], coarsedb.alpha, coarsedb.Seqs[i].Residues)
+		if blocks != nil {
+			byteOff, err = blocks.add(record)
+		} else {
+			_, err = w.Write(record)
+		}
+		if err != nil {
+			return
+		}
+		if err = binary.Write(index, binary.BigEndian, byteOff); err != nil {
+			return
+		}
+		if blocks == nil {
+			byteOff += int64(len(record))
+		}
+	}
+	if blocks != nil {
+		if err = blocks.flush(); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	if err = index.Flush(); err != nil {
+		return
+	}
+
+	Vprintf("Done writing %s (%s).\n", FileCoarsePacked, time.Since(timer))
+	return nil
+}
+
+// readPacked reads every coarse sequence in the packed store into memory.
+func (coarsedb *CoarseDB) readPacked() error {
+	Vprintf("\t\tReading %s...\n", FileCoarsePacked)
+	timer := time.Now()
+
+	var r io.Reader = coarsedb.FilePacked
+	if coarsedb.blockSize > 0 {
+		r = newBlockStream(coarsedb.FilePacked)
+	}
+	br := bufio.NewReader(r)
+	for i := 0; true; i++ {
+		residues, err := unpackCoarseSeq(br, coarsedb.alpha)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		coarsedb.Seqs = append(coarsedb.Seqs, NewCoarseSeq(i, "", residues))
+	}
+	coarsedb.seqsRead = len(coarsedb.Seqs)
+
+	Vprintf("\t\tDone reading %s (%s).\n", FileCoarsePacked, time.Since(timer))
+	return nil
+}
+
+// readPackedSeq reads the packed coarse sequence at offset (or block address)
+// 'off'.
+func (coarsedb *CoarseDB) readPackedSeq(off int64) ([]byte, error) {
+	var r packedReader
+	if coarsedb.blocks != nil {
+		br, err := coarsedb.blocks.record(off)
+		if err != nil {
+			return nil, err
+		}
+		r = br
+	} else {
+		r = bufio.NewReader(io.NewSectionReader(coarsedb.FilePacked, off,
+			1<<62))
+	}
+	return unpackCoarseSeq(r, coarsedb.alpha)
+}
+
+// WriteFasta writes every coarse sequence to 'w' in FASTA format, with the id
+// of each sequence as its name. (This is the FASTA file that the coarse BLAST
+// database is made from.)
+//
+// WriteFasta only works when the coarse database is open for reading.
+func (coarsedb *CoarseDB) WriteFasta(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for id := 0; id < coarsedb.NumSequences(); id++ {
+		seq, err := coarsedb.ReadCoarseSeq(id)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(bw, "> %d\n%s\n", id, seq.Residues)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// packedStoreExists returns true if the database has a packed coarse store.
+// (Databases created before it existed only have coarse.fasta.)
+func packedStoreExists(db *DB) (bool, error) {
+	_, err := os.Stat(db.filePath(FileCoarsePacked))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,515 @@
+package cablastp
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Plain text dumps of a database.
+//
+// A dump is a directory with a human readable file for each binary component
+// of a database:
+//
+//	params                     the configuration and statistics, as is
+//	coarse.fasta.plain         every coarse sequence as FASTA, named by its id
+//	coarse.packed.index.plain  the id and offset of every coarse sequence
+//	coarse.links.plain         a CSV record of the links of every coarse
+//	                           sequence (see linksPlainRecord)
+//	coarse.links.index.plain   the id and offset of the links of every coarse
+//	                           sequence
+//	coarse.seeds.plain         the seeds table of the coarse sequences (see
+//	                           Seeds.WritePlain)
+//	compressed.plain           the id of every original sequence followed by
+//	                           its CSV record, with its name (see
+//	                           compressedRecord)
+//	compressed.index.plain     the id and offset of every compressed record
+//	compressed.order.plain     the id and input position of every original
+//	                           sequence, if the database has an input order
+//
+// (In a block compressed database, offsets are block addresses.) The
+// indexes and the seeds table are derived from the other files, so they're
+// only dumped to be read and diffed. They're rebuilt when a dump is loaded,
+// as are the header store, the name table and the statistics. The exceptions
+// of a lossless database are copied as they are.
+const (
+	FileCoarsePlainFasta      = "coarse.fasta.plain"
+	FileCoarsePlainIndex      = "coarse.packed.index.plain"
+	FileCoarsePlainLinksIndex = "coarse.links.index.plain"
+	FilePlainCompressed       = "compressed.plain"
+	FilePlainIndex            = "compressed.index.plain"
+	FilePlainInputOrder       = "compressed.order.plain"
+)
+
+// copiedFiles are the files of a database that are copied to a dump as they
+// are, if they exist.
+var copiedFiles = []string{FileExceptions, FileExceptionsIndex}
+
+// plainDump is a file of a dump, and the function that writes it.
+type plainDump struct {
+	name string
+	dump func(w io.Writer) error
+}
+
+// DumpPlain writes every component of a database that is open for reading to
+// a new directory 'dir', as plain text.
+func (db *DB) DumpPlain(dir string) error {
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return fmt.Errorf("Could not create directory '%s': %s.", dir, err)
+	}
+
+	order, err := ReadInputOrder(db)
+	if err != nil {
+		return err
+	}
+	dumps := []plainDump{
+		{FileParams, db.dumpParams},
+		{FileCoarsePlainFasta, db.CoarseDB.WriteFasta},
+		{FileCoarsePlainIndex, db.CoarseDB.dumpIndex},
+		{FileCoarsePlainLinks, db.CoarseDB.dumpLinks},
+		{FileCoarsePlainLinksIndex, db.CoarseDB.dumpLinksIndex},
+		{FileCoarsePlainSeeds, db.dumpSeeds},
+		{FilePlainCompressed, db.ComDB.dumpCompressed},
+		{FilePlainIndex, db.ComDB.dumpIndex},
+	}
+	if order != nil {
+		dumps = append(dumps, plainDump{
+			FilePlainInputOrder,
+			func(w io.Writer) error { return dumpInputOrder(w, order) },
+		})
+	}
+	for _, d := range dumps {
+		Vprintf("Writing %s...\n", d.name)
+		if err := writePlainFile(path.Join(dir, d.name), d.dump); err != nil {
+			return fmt.Errorf("Could not write '%s': %s", d.name, err)
+		}
+	}
+	for _, name := range copiedFiles {
+		err := copyFile(db.filePath(name), path.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("Could not copy '%s': %s", name, err)
+		}
+	}
+	return nil
+}
+
+// writePlainFile creates the file 'name' and writes it with 'dump'.
+func writePlainFile(name string, dump func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err := dump(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copyFile copies the file 'from' to 'to'. If 'from' doesn't exist, nothing
+// is done.
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (db *DB) dumpParams(w io.Writer) error {
+	f, err := db.openReadFile(FileParams)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// dumpOffsets writes the id and offset of every sequence in an index.
+func dumpOffsets(w io.Writer, numSeqs int, offset func(int) (int64, error),
+	lock sync.Locker) error {
+
+	for id := 0; id < numSeqs; id++ {
+		lock.Lock()
+		off, err := offset(id)
+		lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%d %d\n", id, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (coarsedb *CoarseDB) dumpIndex(w io.Writer) error {
+	return dumpOffsets(w, coarsedb.NumSequences(), coarsedb.coarseOffset,
+		&coarsedb.readLock)
+}
+
+func (coarsedb *CoarseDB) dumpLinksIndex(w io.Writer) error {
+	return dumpOffsets(w, coarsedb.NumSequences(), coarsedb.linkOffset,
+		&coarsedb.readLock)
+}
+
+func (comdb *CompressedDB) dumpIndex(w io.Writer) error {
+	return dumpOffsets(w, comdb.NumSequences(), comdb.orgSeqOffset,
+		&comdb.readLock)
+}
+
+func (coarsedb *CoarseDB) dumpLinks(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	for id := 0; id < coarsedb.NumSequences(); id++ {
+		links, err := coarsedb.readLinksOf(id)
+		if err != nil {
+			return err
+		}
+		if err := csvWriter.Write(linksPlainRecord(id, links)); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// dumpSeeds writes the seeds table that is made from every coarse sequence.
+// (The seeds table isn't stored, so it is built again.)
+func (db *DB) dumpSeeds(w io.Writer) error {
+	seeds := NewSeeds(db.Alphabet, db.SeedShape, db.SeedLowComplexity)
+	for id := 0; id < db.CoarseDB.NumSequences(); id++ {
+		seq, err := db.CoarseDB.ReadCoarseSeq(id)
+		if err != nil {
+			return err
+		}
+		if err := seeds.Add(id, seq); err != nil {
+			return err
+		}
+	}
+	return seeds.WritePlain(w)
+}
+
+func (comdb *CompressedDB) dumpCompressed(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	for id := 0; id < comdb.NumSequences(); id++ {
+		cseq, err := comdb.ReadCompressedSeq(id)
+		if err != nil {
+			return err
+		}
+		name, err := comdb.ReadName(id)
+		if err != nil {
+			return err
+		}
+		record := append([]string{strconv.Itoa(id)},
+			compressedRecord(&cseq, name)...)
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func dumpInputOrder(w io.Writer, order []int) error {
+	for id, pos := range order {
+		if _, err := fmt.Fprintf(w, "%d %d\n", id, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPlainConf reads the configuration of the database dumped in 'dir'.
+func LoadPlainConf(dir string) (*DBConf, error) {
+	f, err := os.Open(path.Join(dir, FileParams))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadDBConf(f)
+}
+
+// LoadPlain adds every coarse and original sequence dumped in 'dir' by
+// DumpPlain to a new database that is open for writing. The database should
+// be created with the configuration of the dump (see LoadPlainConf), and it
+// must be saved afterwards.
+//
+// Since dumps may be edited by hand, everything loaded is checked: sequences
+// must have consecutive ids, and every link must be within its coarse
+// sequence and decode to original residues.
+func (db *DB) LoadPlain(dir string) error {
+	err := db.CoarseDB.loadFasta(path.Join(dir, FileCoarsePlainFasta))
+	if err != nil {
+		return err
+	}
+	numSeqs, err := db.loadCompressed(path.Join(dir, FilePlainCompressed))
+	if err != nil {
+		return err
+	}
+	err = db.CoarseDB.loadLinks(path.Join(dir, FileCoarsePlainLinks), numSeqs)
+	if err != nil {
+		return err
+	}
+	err = db.loadInputOrder(path.Join(dir, FilePlainInputOrder), numSeqs)
+	if err != nil {
+		return err
+	}
+	for _, name := range copiedFiles {
+		err := copyFile(path.Join(dir, name), db.filePath(name))
+		if err != nil {
+			return fmt.Errorf("Could not copy '%s': %s", name, err)
+		}
+	}
+	return nil
+}
+
+// plainError describes a problem with a file of a dump.
+func plainError(name string, format string, v ...interface{}) error {
+	return fmt.Errorf("%s: %s", path.Base(name), fmt.Sprintf(format, v...))
+}
+
+// openPlainCSV opens a CSV file of a dump.
+func openPlainCSV(name string) (*os.File, *csv.Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	csvReader := csv.NewReader(bufio.NewReader(f))
+	csvReader.FieldsPerRecord = -1
+	return f, csvReader, nil
+}
+
+// loadFasta adds every coarse sequence in a dumped FASTA file. Residues may
+// be split over several lines.
+func (coarsedb *CoarseDB) loadFasta(name string) error {
+	Vprintf("Reading %s...\n", name)
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	alpha := coarsedb.alpha
+	var residues []byte
+	started := false
+	add := func() error {
+		if !started {
+			return nil
+		}
+		_, _, err := coarsedb.Add(residues)
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<26)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '>' {
+			if err := add(); err != nil {
+				return err
+			}
+			id, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+			if err != nil || id != len(coarsedb.Seqs) {
+				return plainError(name, "Expected coarse sequence %d, but "+
+					"found '%s'.", len(coarsedb.Seqs), line)
+			}
+			residues, started = nil, true
+			continue
+		}
+		if !started {
+			return plainError(name, "Residues before the first header.")
+		}
+		for _, residue := range []byte(line) {
+			if alpha.Index(residue) == -1 && residue != alpha.Wildcard {
+				return plainError(name, "Coarse sequence %d has the "+
+					"residue '%c', which isn't a letter of the reduced "+
+					"alphabet '%s'.", len(coarsedb.Seqs), residue, alpha.Name)
+			}
+		}
+		residues = append(residues, line...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return add()
+}
+
+// loadCompressed writes every original sequence in a dump to the compressed
+// database, and returns the number of original sequences.
+func (db *DB) loadCompressed(name string) (int, error) {
+	Vprintf("Reading %s...\n", name)
+	f, csvReader, err := openPlainCSV(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	coarse := db.CoarseDB.Seqs
+	id := 0
+	for ; ; id++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, plainError(name, "%s", err)
+		}
+		if len(record) < 2 || record[0] != strconv.Itoa(id) {
+			return 0, plainError(name, "Expected the record of original "+
+				"sequence %d, but found '%s'.", id, strings.Join(record, ","))
+		}
+		cseq, err := readCompressedSeq(id, record[1:])
+		if err != nil {
+			return 0, plainError(name, "%s", err)
+		}
+		rc := NewResidueCoder(db.Alphabet)
+		for _, lk := range cseq.Links {
+			if lk.CoarseSeqId >= uint(len(coarse)) {
+				return 0, plainError(name, "Original sequence %d links to "+
+					"coarse sequence %d, which doesn't exist.",
+					id, lk.CoarseSeqId)
+			}
+			residues := coarse[lk.CoarseSeqId].Residues
+			if lk.CoarseStart > lk.CoarseEnd ||
+				int(lk.CoarseEnd) > len(residues) {
+				return 0, plainError(name, "Original sequence %d links to "+
+					"[%d, %d) of coarse sequence %d, which has %d residues.",
+					id, lk.CoarseStart, lk.CoarseEnd, lk.CoarseSeqId,
+					len(residues))
+			}
+			_, err := rc.Decode(
+				residues[lk.CoarseStart:lk.CoarseEnd], lk.OrigSeq)
+			if err != nil {
+				return 0, plainError(name, "Original sequence %d: %s",
+					id, err)
+			}
+		}
+		db.ComDB.Write(cseq)
+	}
+	return id, nil
+}
+
+// loadLinks adds every link in a dump to the coarse sequences. There are
+// 'numSeqs' original sequences.
+func (coarsedb *CoarseDB) loadLinks(name string, numSeqs int) error {
+	Vprintf("Reading %s...\n", name)
+	f, csvReader, err := openPlainCSV(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return plainError(name, "%s", err)
+		}
+		id, err := strconv.Atoi(record[0])
+		if err != nil || id < 0 || id >= len(coarsedb.Seqs) {
+			return plainError(name, "Invalid coarse sequence id '%s'.",
+				record[0])
+		}
+		if (len(record)-1)%3 != 0 {
+			return plainError(name, "Coarse sequence %d has %d fields "+
+				"after its id, which isn't a multiple of three.",
+				id, len(record)-1)
+		}
+		seq := coarsedb.Seqs[id]
+		for i := 1; i < len(record); i += 3 {
+			var fields [3]uint64
+			bits := [3]int{32, 16, 16}
+			for j := range fields {
+				fields[j], err = strconv.ParseUint(record[i+j], 10, bits[j])
+				if err != nil {
+					return plainError(name, "Coarse sequence %d has an "+
+						"invalid link field '%s': %s", id, record[i+j], err)
+				}
+			}
+			orgSeqId, start, end := fields[0], fields[1], fields[2]
+			if orgSeqId >= uint64(numSeqs) {
+				return plainError(name, "Coarse sequence %d links to "+
+					"original sequence %d, which doesn't exist.",
+					id, orgSeqId)
+			}
+			if start > end || end > uint64(seq.Len()) {
+				return plainError(name, "Coarse sequence %d has %d "+
+					"residues, but links [%d, %d) to original sequence %d.",
+					id, seq.Len(), start, end, orgSeqId)
+			}
+			seq.AddLink(NewLinkToCompressed(
+				uint32(orgSeqId), uint16(start), uint16(end)))
+		}
+	}
+	return nil
+}
+
+// loadInputOrder writes the input order in a dump, if there is one.
+func (db *DB) loadInputOrder(name string, numSeqs int) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	Vprintf("Reading %s...\n", name)
+
+	order, err := OpenInputOrder(db, true)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	id := 0
+	for ; scanner.Scan(); id++ {
+		var gotId, pos int
+		_, err := fmt.Sscanf(scanner.Text(), "%d %d", &gotId, &pos)
+		if err != nil || gotId != id || pos < 0 {
+			order.Close()
+			return plainError(name, "Expected the input position of "+
+				"original sequence %d, but found '%s'.", id, scanner.Text())
+		}
+		if err := order.Add(pos); err != nil {
+			order.Close()
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		order.Close()
+		return err
+	}
+	if id != numSeqs {
+		order.Close()
+		return plainError(name, "There are input positions for %d "+
+			"sequences, but there are %d sequences.", id, numSeqs)
+	}
+	return order.Close()
+}
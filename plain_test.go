@@ -0,0 +1,138 @@
+package cablastp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlainDump(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "data/small.fasta"
+	confs := map[string]*DBConf{
+		"plain": DefaultDBConf.DeepCopy(),
+		"range": DefaultDBConf.DeepCopy(),
+	}
+	confs["range"].ResidueCoding = CodingRange
+	confs["range"].CompressBlockSize = 16
+	confs["range"].Lossless = true
+
+	for name, conf := range confs {
+		dbDir := filepath.Join(tmpDir, name)
+		createTestDB(t, dbDir, fasta, conf)
+		dump := filepath.Join(tmpDir, name+"-dump")
+		dumpDB(t, dbDir, dump)
+
+		// Loading a dump and dumping it again must give the same dump.
+		loaded := filepath.Join(tmpDir, name+"-loaded")
+		if err := loadDB(loaded, dump); err != nil {
+			t.Fatal(err)
+		}
+		again := filepath.Join(tmpDir, name+"-again")
+		dumpDB(t, loaded, again)
+		files, err := ioutil.ReadDir(dump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range files {
+			want, err := ioutil.ReadFile(filepath.Join(dump, info.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(again, info.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s differs after loading the %s dump.",
+					info.Name(), name)
+			}
+		}
+		if !conf.Lossless {
+			continue
+		}
+
+		// The exceptions of a lossless database are copied too.
+		db, err := NewReadDB(loaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := new(bytes.Buffer)
+		if err := db.WriteExact(output); err != nil {
+			t.Fatal(err)
+		}
+		db.ReadClose()
+		input, err := ioutil.ReadFile(fasta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), input) {
+			t.Fatalf("The exact output of the database loaded from the %s "+
+				"dump is not the input.", name)
+		}
+	}
+
+	// Links out of their coarse sequence are rejected.
+	dump := filepath.Join(tmpDir, "plain-dump")
+	records := filepath.Join(dump, FilePlainCompressed)
+	contents, err := ioutil.ReadFile(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvReader := csv.NewReader(bytes.NewReader(contents))
+	csvReader.FieldsPerRecord = -1
+	all, err := csvReader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all[0][2] = "999999"
+	edited := new(bytes.Buffer)
+	if err := csv.NewWriter(edited).WriteAll(all); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(records, edited.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDB(filepath.Join(tmpDir, "bad"), dump); err == nil {
+		t.Fatal("A link to a coarse sequence that doesn't exist was loaded.")
+	}
+}
+
+// dumpDB dumps the database in 'dbDir' to 'dump'.
+func dumpDB(t *testing.T, dbDir, dump string) {
+	db, err := NewReadDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.ReadClose()
+	if err := db.DumpPlain(dump); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadDB creates a database in 'dbDir' from the dump in 'dump', the same way
+// cablastp-load does.
+func loadDB(dbDir, dump string) error {
+	conf, err := LoadPlainConf(dump)
+	if err != nil {
+		return err
+	}
+	conf.BlastMakeBlastDB = "true"
+	db, err := NewWriteDB(conf, dbDir)
+	if err != nil {
+		return err
+	}
+	defer db.WriteClose()
+	if err := db.LoadPlain(dump); err != nil {
+		return err
+	}
+	return db.Save()
+}
@@ -7,6 +7,7 @@ import (
 	"os"
   // "runtime"
 	"sync"
+	"time"
 )
 
 // redCompressPool represents a pool of workers where each worker is responsible
@@ -79,6 +80,7 @@ func (pool redCompressPool) worker() {
 	for job := range pool.jobs {
 		comSeq := CompressReduced(pool.db, job.redSeqId, job.redSeq, mem)
 		pool.db.ComDB.Write(comSeq)
+		pool.db.ComDB.WriteDiagnostics(mem.diag)
 	}
 	pool.wg.Done()
 }
@@ -105,7 +107,8 @@ func (pool *redCompressPool) done() {
 // sub-sequences to sub-sequences in the coarse database.
 //
 // N.B. `mem` is used in alignment and seed lookups to prevent allocation.
-// Think of them as goroutine-specific memory arenas.
+// Think of them as goroutine-specific memory arenas. The diagnostics of the
+// sequence are left in `mem.diag`.
 func CompressReduced(db *DB, redSeqId int,
 	redSeq *ReducedSeq, mem *memory) CompressedSeq {
 
@@ -122,6 +125,7 @@ func CompressReduced(db *DB, redSeqId int,
 	mapSeedSize := db.MapSeedSize
 	extSeedSize := db.ExtSeedSize
 	olen := redSeq.Len()
+	mem.diag = NewSeqDiagnostics(redSeqId, olen)
 
 	// Keep track of two pointers. 'current' refers to the residue index in the
 	// original sequence that extension is currently originating from.
@@ -130,16 +134,27 @@ func CompressReduced(db *DB, redSeqId int,
 	lastMatch, current := 0, 0
 
 	// Iterate through the original sequence a 'kmer' at a time.
+	// If the coarse sequences are sampled, then only the same samples of the
+	// original sequence can match, but every position must be considered.
 	skipSize := 4
+	var sampled []bool
+	if db.SeedShape.Sampling != SampleAll {
+		skipSize = 1
+		sampled = coarsedb.Seeds.Sample(redSeq.Residues)
+	}
 	limit := olen - mapSeedSize - extSeedSize - skipSize
 	for current = 0; current <= limit; current += skipSize {
+		if sampled != nil && !sampled[current] {
+			continue
+		}
 		kmer := redSeq.Residues[current : current+mapSeedSize]
 		// skip wildcard-containing kmers
-		if bytes.IndexByte(kmer, 'N') > -1 {
+		if coarsedb.Seeds.HasWildcard(kmer) {
 			continue
 		}
 
 		seeds := coarsedb.Seeds.Lookup(kmer, &mem.seeds)
+		mem.diag.SeedLookups++
 
 		// Before trying to extend this with seeds, check to see if there is
 		// a low complexity region within `db.MinMatchLen` residues from
@@ -186,11 +201,14 @@ func CompressReduced(db *DB, redSeqId int,
 			// coarse and reduced sequences FROM the last match TO the current,
 			// and call extendMatch on those as well. Reverse the result, and
 			// prepend it to corMatch and redMatch here.
+			mem.diag.SeedsTried++
+			extStart := time.Now()
 			corMatch, redMatch := extendMatch(
 				corSeq.Residues[corResInd:], redSeq.Residues[current:],
 				db.GappedWindowSize, db.UngappedWindowSize,
 				db.MatchKmerSize, db.ExtSeqIdThreshold,
 				mem)
+			mem.diag.ExtensionTime += time.Since(extStart)
         
 			// TODO if this original (reduced) sequence is overall shorter than the
 			// minimum match length, we should still accept it.
@@ -203,12 +221,14 @@ func CompressReduced(db *DB, redSeqId int,
 
 			// potentially extend this match back as far as the lastMatch (for redSeq)
 			// and beginning of the corSeq
+			extStart = time.Now()
 			backCorMatch, backRedMatch := extendMatch(
 				reverse(corSeq.Residues[0:corResInd]),
 				reverse(redSeq.Residues[lastMatch:current]),
 				db.GappedWindowSize, db.UngappedWindowSize,
 				db.MatchKmerSize, db.ExtSeqIdThreshold,
 				mem)
+			mem.diag.ExtensionTime += time.Since(extStart)
 
 			redMatch = append(reverse(backRedMatch), redMatch...)
 			corMatch = append(reverse(backCorMatch), corMatch...)
@@ -273,6 +293,7 @@ func CompressReduced(db *DB, redSeqId int,
 				redSub := redSeq.NewSubSequence(
 					uint(lastMatch), uint(current))
 				addReducedWithoutMatch(&cseq, coarsedb, redSeqId, redSub)
+				mem.diag.NovelResidues += orgStart - lastMatch
 			}
 
 			// For the given match, add a LinkToCoarse to the portion of
@@ -286,6 +307,9 @@ func CompressReduced(db *DB, redSeqId int,
 				uint(corSeqId), uint(corStart), uint(corEnd), orgMatch))
 			corSeq.AddLink(NewLinkToCompressed(
 				uint32(redSeqId), uint16(corStart), uint16(corEnd)))
+			coarsedb.Seeds.Hit(corSeqId)
+			mem.diag.Matches++
+			mem.diag.LinkedResidues += orgEnd - orgStart
 
 			// Skip the current pointer ahead to the end of this match.
 			// Update the lastMatch pointer to point at the end of this
@@ -305,6 +329,7 @@ func CompressReduced(db *DB, redSeqId int,
 	if redSeq.Len()-lastMatch > 0 {
 		redSub := redSeq.NewSubSequence(uint(lastMatch), uint(redSeq.Len()))
 		addReducedWithoutMatch(&cseq, coarsedb, redSeqId, redSub)
+		mem.diag.NovelResidues += redSeq.Len() - lastMatch
 	}
 
 	return cseq
@@ -443,7 +468,10 @@ func addReducedWithoutMatch(cseq *CompressedSeq,
 	redSubCpy := make([]byte, len(redSub.Residues))
 	copy(redSubCpy, redSub.Residues)
 
-	corSeqId, corSeq := coarsedb.Add(redSubCpy)
+	corSeqId, corSeq, err := coarsedb.Add(redSubCpy)
+	if err != nil {
+		fatalf("%s\n", err)
+	}
 	corSeq.AddLink(
 		NewLinkToCompressed(uint32(redSeqId), 0, uint16(len(redSubCpy))))
 
@@ -491,6 +519,9 @@ type memory struct {
 	table    []int
 	ref, org []byte
 	seeds    [][2]uint
+
+	// diag is the diagnostics of the last sequence compressed.
+	diag SeqDiagnostics
 }
 
 func newMemory() *memory {
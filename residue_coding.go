@@ -0,0 +1,541 @@
+package cablastp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// The ways in which the original residues of a link to the coarse database
+// can be stored.
+const (
+	// CodingPlain stores original residues verbatim.
+	CodingPlain = "plain"
+
+	// CodingRange stores the differences between the reduced original
+	// residues and the coarse residues as an edit script, and then range
+	// codes every original residue given its reduced letter. (Knowing the
+	// class of a residue leaves only a handful of possible residues.) The
+	// models used adapt over blocks of residueCodingBlock links of a
+	// compressed sequence, and links that don't get smaller are stored
+	// plainly.
+	CodingRange = "range"
+)
+
+// encodedMark starts (and separates the parts of) original residues that are
+// range coded: "~<edit script>~<base64 of the range coded residues>".
+// Plain residues never contain it, so both can be read from the same
+// database.
+const encodedMark = '~'
+
+// residueCodingBlock is the number of links of a compressed sequence that
+// are range coded with the same models. The models are reset at the start of
+// every block, so that a range of residues can be decompressed by decoding
+// only the links from the start of the block it begins in.
+const residueCodingBlock = 16
+
+// checkResidueCoding returns an error if 'coding' isn't a residue coding.
+func checkResidueCoding(coding string) error {
+	if coding != CodingPlain && coding != CodingRange {
+		return fmt.Errorf("Unknown residue coding '%s'. Valid codings are "+
+			"'%s' and '%s'.", coding, CodingPlain, CodingRange)
+	}
+	return nil
+}
+
+// EncodeOrigSeq returns the original residues 'orig' of the next link of
+// 'cseq' as they are stored in the database, according to its residue
+// coding. 'coarse' is the part of the coarse sequence that the link points
+// to. The links of a sequence must be encoded in order.
+func (db *DB) EncodeOrigSeq(cseq *CompressedSeq, coarse, orig []byte) string {
+	if db.ResidueCoding != CodingRange {
+		return string(orig)
+	}
+	if cseq.coder == nil {
+		cseq.coder = NewResidueCoder(db.Alphabet)
+	}
+	return cseq.coder.Encode(coarse, orig)
+}
+
+// A ResidueCoder range codes the original residues of the links of a single
+// compressed sequence. Its models keep adapting from one link to the next
+// within a block of residueCodingBlock links, so that short links are coded
+// with what was learned from earlier ones. Hence, the links of a block must
+// be decoded in order with a single ResidueCoder, the same way they were
+// encoded.
+type ResidueCoder struct {
+	alpha *Alphabet
+
+	// The models are created when they're first needed, so that sequences
+	// without range coded links don't pay for them.
+	models *residueModels
+
+	// links is the number of links coded so far.
+	links int
+}
+
+func NewResidueCoder(alpha *Alphabet) *ResidueCoder {
+	return &ResidueCoder{alpha: alpha}
+}
+
+// Encode range codes the original residues 'orig' of the next link
+// conditioned on the reduced coarse residues 'coarse' that they were matched
+// with. If that doesn't take fewer bytes than the residues themselves, 'orig'
+// is returned as it is and the models are left alone.
+func (rc *ResidueCoder) Encode(coarse, orig []byte) string {
+	rc.next()
+	if rc.models == nil {
+		rc.models = newResidueModels(rc.alpha)
+	}
+	models := rc.models.clone()
+	encoded := encodeResidues(models, coarse, orig)
+	if len(encoded) >= len(orig) {
+		return string(orig)
+	}
+	rc.models = models
+	return encoded
+}
+
+// Decode reverses Encode for the next link. The same coarse residues must be
+// given. Residues that aren't range coded are returned as they are.
+func (rc *ResidueCoder) Decode(coarse []byte, stored string) ([]byte, error) {
+	rc.next()
+	if !IsEncodedResidues(stored) {
+		return []byte(stored), nil
+	}
+	if rc.models == nil {
+		rc.models = newResidueModels(rc.alpha)
+	}
+	reduced, data, err := parseEncoded(coarse, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := newRangeDecoder(data)
+	orig := make([]byte, len(reduced))
+	for i, letter := range reduced {
+		orig[i] = rc.models.decode(dec, letter)
+	}
+	return orig, nil
+}
+
+// next counts the link about to be coded, and resets the models if it starts
+// a block.
+func (rc *ResidueCoder) next() {
+	if rc.links%residueCodingBlock == 0 {
+		rc.models = nil
+	}
+	rc.links++
+}
+
+// seek readies the coder to decode the link with index 'link' next, which
+// must start a block.
+func (rc *ResidueCoder) seek(link int) {
+	rc.links = link
+	rc.models = nil
+}
+
+// encodeResidues range codes 'orig' with 'models':
+// "~<edit script>~<base64 of the range coded residues>".
+func encodeResidues(models *residueModels, coarse, orig []byte) string {
+	reduced := models.alpha.Reduce(orig)
+
+	script := ""
+	if !bytes.Equal(coarse, reduced) {
+		script = NewEditScript(alignEdits(coarse, reduced)).String()
+	}
+
+	enc := &rangeEncoder{rng: ^uint32(0)}
+	for i, residue := range orig {
+		models.encode(enc, reduced[i], residue)
+	}
+	return string(encodedMark) + script + string(encodedMark) +
+		base64.RawStdEncoding.EncodeToString(enc.finish())
+}
+
+// IsEncodedResidues returns true if the original residues of a link are
+// range coded.
+func IsEncodedResidues(origSeq string) bool {
+	return len(origSeq) > 0 && origSeq[0] == encodedMark
+}
+
+// parseEncoded returns the reduced original residues of range coded residues
+// (by applying their edit script to 'coarse'), and the range coded bytes.
+func parseEncoded(coarse []byte, encoded string) ([]byte, []byte, error) {
+	parts := strings.SplitN(encoded, string(encodedMark), 3)
+	if len(parts) != 3 || parts[0] != "" {
+		return nil, nil,
+			fmt.Errorf("Invalid range coded residues '%s'.", encoded)
+	}
+	reduced := coarse
+	if len(parts[1]) > 0 {
+		script, err := NewEditScriptParse(parts[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := script.check(len(coarse)); err != nil {
+			return nil, nil, err
+		}
+		reduced = script.Apply(coarse)
+	}
+	data, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid range coded residues '%s': %s",
+			encoded, err)
+	}
+	return reduced, data, nil
+}
+
+// rescriptResidues changes range coded residues that were coded against the
+// coarse residues 'from' so that they are coded against 'to' instead. Only
+// the edit script changes, since the range coded bytes only depend on the
+// original residues.
+func rescriptResidues(from, to []byte, encoded string) (string, error) {
+	reduced, data, err := parseEncoded(from, encoded)
+	if err != nil {
+		return "", err
+	}
+	script := ""
+	if !bytes.Equal(to, reduced) {
+		script = NewEditScript(alignEdits(to, reduced)).String()
+	}
+	return string(encodedMark) + script + string(encodedMark) +
+		base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+// encodedLen returns the number of residues in range coded residues, without
+// decoding them. 'coarseLen' is the length of the coarse residues they were
+// coded against.
+func encodedLen(coarseLen int, encoded string) (int, error) {
+	parts := strings.SplitN(encoded, string(encodedMark), 3)
+	if len(parts) != 3 || parts[0] != "" {
+		return 0, fmt.Errorf("Invalid range coded residues '%s'.", encoded)
+	}
+	if len(parts[1]) == 0 {
+		return coarseLen, nil
+	}
+	script, err := NewEditScriptParse(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	if err := script.check(coarseLen); err != nil {
+		return 0, err
+	}
+	return script.appliedLen(coarseLen), nil
+}
+
+// alignEdits aligns two reduced sequences with as few substitutions,
+// insertions and deletions as possible, and returns the alignment with '-'
+// for gaps. Only alignments within a band around the diagonal are
+// considered, which is plenty for matches found by extension.
+func alignEdits(from, to []byte) [2][]byte {
+	n, m := len(from), len(to)
+	band := 16 + n - m
+	if m > n {
+		band = 16 + m - n
+	}
+
+	// For very long sequences of very different lengths, fall back to
+	// substituting position by position. (It's still a valid alignment.)
+	width := 2*band + 1
+	if (n+1)*width > 1<<22 {
+		return alignPositions(from, to)
+	}
+
+	// dist[i*width + (j-i+band)] is the edit distance between from[:i] and
+	// to[:j]. Cells outside the band are never read.
+	const far = 1 << 30
+	dist := make([]int32, (n+1)*width)
+	at := func(i, j int) int32 {
+		if j < 0 || j > m || j-i > band || i-j > band {
+			return far
+		}
+		return dist[i*width+j-i+band]
+	}
+	for i := 0; i <= n; i++ {
+		for j := max(0, i-band); j <= min(m, i+band); j++ {
+			var d int32
+			switch {
+			case i == 0:
+				d = int32(j)
+			case j == 0:
+				d = int32(i)
+			default:
+				d = at(i-1, j-1)
+				if from[i-1] != to[j-1] {
+					d++
+				}
+				if up := at(i-1, j) + 1; up < d {
+					d = up
+				}
+				if left := at(i, j-1) + 1; left < d {
+					d = left
+				}
+			}
+			dist[i*width+j-i+band] = d
+		}
+	}
+
+	fromAln := make([]byte, 0, n+m)
+	toAln := make([]byte, 0, n+m)
+	i, j := n, m
+	for i > 0 || j > 0 {
+		d := at(i, j)
+		switch {
+		case i > 0 && j > 0 && from[i-1] == to[j-1] && d == at(i-1, j-1):
+			fallthrough
+		case i > 0 && j > 0 && from[i-1] != to[j-1] && d == at(i-1, j-1)+1:
+			i, j = i-1, j-1
+			fromAln, toAln = append(fromAln, from[i]), append(toAln, to[j])
+		case i > 0 && d == at(i-1, j)+1:
+			i--
+			fromAln, toAln = append(fromAln, from[i]), append(toAln, '-')
+		default:
+			j--
+			fromAln, toAln = append(fromAln, '-'), append(toAln, to[j])
+		}
+	}
+	return [2][]byte{reverse(fromAln), reverse(toAln)}
+}
+
+// alignPositions aligns two sequences without gaps, except at the end of the
+// shorter one.
+func alignPositions(from, to []byte) [2][]byte {
+	n := max(len(from), len(to))
+	fromAln := append(append([]byte{}, from...),
+		bytes.Repeat([]byte{'-'}, n-len(from))...)
+	toAln := append(append([]byte{}, to...),
+		bytes.Repeat([]byte{'-'}, n-len(to))...)
+	return [2][]byte{fromAln, toAln}
+}
+
+// residueModels are the adaptive models used to code original residues. For
+// every class of the alphabet, there is a model of the residues in the class
+// plus an escape symbol (for residues that are reduced to the class letter
+// but aren't spelled like its residues, e.g., lowercase residues). Escaped
+// residues, and residues that are reduced to the wildcard, are coded with a
+// model of all bytes.
+type residueModels struct {
+	alpha   *Alphabet
+	classes []*freqModel
+	bytes   *freqModel
+}
+
+func newResidueModels(alpha *Alphabet) *residueModels {
+	models := &residueModels{
+		alpha:   alpha,
+		classes: make([]*freqModel, alpha.Size()),
+		bytes:   newFreqModel(256),
+	}
+	for i, class := range alpha.Classes {
+		models.classes[i] = newFreqModel(len(class) + 1)
+	}
+	return models
+}
+
+func (models *residueModels) clone() *residueModels {
+	c := &residueModels{
+		alpha:   models.alpha,
+		classes: make([]*freqModel, len(models.classes)),
+		bytes:   models.bytes.clone(),
+	}
+	for i, model := range models.classes {
+		c.classes[i] = model.clone()
+	}
+	return c
+}
+
+func (models *residueModels) encode(
+	enc *rangeEncoder, letter, residue byte) {
+
+	classIndex := models.alpha.Index(letter)
+	if classIndex == -1 {
+		models.bytes.encode(enc, int(residue))
+		return
+	}
+	class := models.alpha.Classes[classIndex]
+	model := models.classes[classIndex]
+	if sym := strings.IndexByte(class, residue); sym >= 0 {
+		model.encode(enc, sym)
+		return
+	}
+	model.encode(enc, len(class))
+	models.bytes.encode(enc, int(residue))
+}
+
+func (models *residueModels) decode(dec *rangeDecoder, letter byte) byte {
+	classIndex := models.alpha.Index(letter)
+	if classIndex == -1 {
+		return byte(models.bytes.decode(dec))
+	}
+	class := models.alpha.Classes[classIndex]
+	sym := models.classes[classIndex].decode(dec)
+	if sym < len(class) {
+		return class[sym]
+	}
+	return byte(models.bytes.decode(dec))
+}
+
+// freqModel is an adaptive frequency model of a small set of symbols.
+type freqModel struct {
+	freqs []uint32
+	total uint32
+}
+
+const (
+	freqIncrement = 24
+	freqMaxTotal  = 1 << 13
+)
+
+func newFreqModel(numSymbols int) *freqModel {
+	model := &freqModel{freqs: make([]uint32, numSymbols)}
+	for i := range model.freqs {
+		model.freqs[i] = 1
+	}
+	model.total = uint32(numSymbols)
+	return model
+}
+
+func (model *freqModel) clone() *freqModel {
+	return &freqModel{
+		freqs: append([]uint32(nil), model.freqs...),
+		total: model.total,
+	}
+}
+
+func (model *freqModel) encode(enc *rangeEncoder, sym int) {
+	cum := uint32(0)
+	for _, freq := range model.freqs[:sym] {
+		cum += freq
+	}
+	enc.encode(cum, model.freqs[sym], model.total)
+	model.update(sym)
+}
+
+func (model *freqModel) decode(dec *rangeDecoder) int {
+	target := dec.target(model.total)
+	sym, cum := 0, uint32(0)
+	for ; sym < len(model.freqs)-1; sym++ {
+		if cum+model.freqs[sym] > target {
+			break
+		}
+		cum += model.freqs[sym]
+	}
+	dec.decode(cum, model.freqs[sym], model.total)
+	model.update(sym)
+	return sym
+}
+
+func (model *freqModel) update(sym int) {
+	model.freqs[sym] += freqIncrement
+	model.total += freqIncrement
+	if model.total > freqMaxTotal {
+		model.total = 0
+		for i := range model.freqs {
+			model.freqs[i] = (model.freqs[i] + 1) / 2
+			model.total += model.freqs[i]
+		}
+	}
+}
+
+// The range coder is Subbotin's carry-less range coder. Totals of frequency
+// models must stay below rangeBottom.
+const (
+	rangeTop    = 1 << 24
+	rangeBottom = 1 << 16
+)
+
+type rangeEncoder struct {
+	low, rng uint32
+	out      []byte
+}
+
+func (enc *rangeEncoder) encode(cum, freq, total uint32) {
+	enc.rng /= total
+	enc.low += cum * enc.rng
+	enc.rng *= freq
+	for {
+		if enc.low^(enc.low+enc.rng) >= rangeTop {
+			if enc.rng >= rangeBottom {
+				break
+			}
+			enc.rng = -enc.low & (rangeBottom - 1)
+		}
+		enc.out = append(enc.out, byte(enc.low>>24))
+		enc.low <<= 8
+		enc.rng <<= 8
+	}
+}
+
+// finish writes as few bytes as it takes to pick a value in the final range.
+// (The decoder reads zeros past the end of its input, so the value is padded
+// with zeros.)
+func (enc *rangeEncoder) finish() []byte {
+	end := uint64(enc.low) + uint64(enc.rng)
+	for n := uint(1); n < 4; n++ {
+		shift := 32 - 8*n
+		v := (uint64(enc.low) + 1<<shift - 1) >> shift << shift
+		if v < end {
+			for i := uint(0); i < n; i++ {
+				enc.out = append(enc.out, byte(v>>(24-8*i)))
+			}
+			return enc.out
+		}
+	}
+	for i := 0; i < 4; i++ {
+		enc.out = append(enc.out, byte(enc.low>>24))
+		enc.low <<= 8
+	}
+	return enc.out
+}
+
+type rangeDecoder struct {
+	low, rng, code uint32
+	in             []byte
+}
+
+func newRangeDecoder(in []byte) *rangeDecoder {
+	dec := &rangeDecoder{rng: ^uint32(0), in: in}
+	for i := 0; i < 4; i++ {
+		dec.code = dec.code<<8 | uint32(dec.next())
+	}
+	return dec
+}
+
+// next returns the next input byte. Past the end of the input, zeros are
+// read, so corrupt input decodes to garbage instead of panicking.
+func (dec *rangeDecoder) next() byte {
+	if len(dec.in) == 0 {
+		return 0
+	}
+	b := dec.in[0]
+	dec.in = dec.in[1:]
+	return b
+}
+
+// target returns the cumulative frequency that the next symbol falls into.
+func (dec *rangeDecoder) target(total uint32) uint32 {
+	dec.rng /= total
+	t := (dec.code - dec.low) / dec.rng
+	if t >= total {
+		return total - 1
+	}
+	return t
+}
+
+func (dec *rangeDecoder) decode(cum, freq, total uint32) {
+	dec.low += cum * dec.rng
+	dec.rng *= freq
+	for {
+		if dec.low^(dec.low+dec.rng) >= rangeTop {
+			if dec.rng >= rangeBottom {
+				break
+			}
+			dec.rng = -dec.low & (rangeBottom - 1)
+		}
+		dec.code = dec.code<<8 | uint32(dec.next())
+		dec.low <<= 8
+		dec.rng <<= 8
+	}
+}
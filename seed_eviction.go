@@ -0,0 +1,302 @@
+package cablastp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// seedLocSize is the number of bytes used to store a single seed location,
+// on average. (A packed location is 4 bytes, and the rest is for chunk
+// headers and unused capacity.)
+const seedLocSize = 6
+
+// seedEvictTarget is the fraction of the maximum number of seeds that a
+// seeds table is reduced to when seeds are evicted (except by
+// EvictWipe). Evicting a bit more than necessary means that eviction doesn't
+// have to run again right away.
+const seedEvictTarget = 0.75
+
+// An EvictionPolicy decides which seeds are removed from a seeds table once
+// it exceeds its maximum size.
+type EvictionPolicy int
+
+const (
+	// EvictWipe removes every seed in the table.
+	EvictWipe EvictionPolicy = iota
+
+	// EvictOldest removes the seeds of the oldest coarse sequences first.
+	// Coarse sequences that have produced matches since the last eviction
+	// are skipped, unless there is nothing else left to evict.
+	EvictOldest
+
+	// EvictCap limits the number of locations kept for every K-mer, keeping
+	// the newest ones. The limit is chosen to be as large as possible while
+	// still making enough room.
+	EvictCap
+)
+
+var evictionPolicyNames = map[EvictionPolicy]string{
+	EvictWipe:   "wipe",
+	EvictOldest: "oldest",
+	EvictCap:    "cap",
+}
+
+// ParseEvictionPolicy returns the eviction policy with the given name.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for policy, pname := range evictionPolicyNames {
+		if pname == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown seed eviction policy '%s'. Valid policies "+
+		"are 'wipe', 'oldest' and 'cap'.", name)
+}
+
+func (policy EvictionPolicy) String() string {
+	return evictionPolicyNames[policy]
+}
+
+// EvictionStats records how many seeds have been evicted from a seeds table.
+type EvictionStats struct {
+	// The number of times seeds were evicted.
+	Evictions int64
+
+	// The total number of seed locations evicted.
+	Evicted int64
+
+	// The total number of seed locations that would have been evicted, but
+	// were kept because their coarse sequence produced matches.
+	Protected int64
+}
+
+func (stats EvictionStats) String() string {
+	return fmt.Sprintf("%d seeds evicted in %d evictions "+
+		"(%d protected by matches)",
+		stats.Evicted, stats.Evictions, stats.Protected)
+}
+
+// seedHits counts the number of matches produced by each coarse sequence.
+type seedHits struct {
+	sync.Mutex
+	counts map[uint32]uint32
+}
+
+// Hit records that the seeds of the coarse sequence 'coarseSeqIndex' produced
+// a match. Sequences with matches are less likely to be evicted.
+func (ss Seeds) Hit(coarseSeqIndex int) {
+	ss.hits.Lock()
+	ss.hits.counts[uint32(coarseSeqIndex)]++
+	ss.hits.Unlock()
+}
+
+// EvictionStats returns statistics about every eviction so far.
+func (ss Seeds) EvictionStats() EvictionStats {
+	return EvictionStats{
+		Evictions: atomic.LoadInt64(&ss.stats.Evictions),
+		Evicted:   atomic.LoadInt64(&ss.stats.Evicted),
+		Protected: atomic.LoadInt64(&ss.stats.Protected),
+	}
+}
+
+// MaybeEvict evicts seeds according to 'policy' if the memory of the seeds
+// table exceeds seedTableSizeGB (which is the number of gigabytes). The
+// memory is estimated from the number of seeds. Seeds are also evicted if
+// the memory actually used by seed locations exceeds MaxSeedsGB, so that a
+// table with many short rows doesn't fill up. The number of seed locations
+// evicted is returned.
+func (ss Seeds) MaybeEvict(
+	policy EvictionPolicy, seedTableSizeGB float64) int64 {
+
+	maxSeedBytes := seedTableSizeGB * 1024.0 * 1024.0 * 1024.0
+	maxSeeds := int64(maxSeedBytes) / seedLocSize
+	used := ss.chunks.bytes()
+	if ss.NumSeeds() < maxSeeds && used < maxSeedChunkBytes {
+		return 0
+	}
+
+	// acquire every write lock while changing the seeds table
+	for i := range ss.locks {
+		ss.locks[i].Lock()
+	}
+	defer func() {
+		for i := range ss.locks {
+			ss.locks[i].Unlock()
+		}
+	}()
+
+	target := int64(float64(maxSeeds) * seedEvictTarget)
+	if used >= maxSeedChunkBytes {
+		// Seed locations take more memory than estimated, so fewer of them
+		// are kept.
+		byMem := int64(float64(ss.NumSeeds()) * seedEvictTarget *
+			float64(maxSeedChunkBytes) / float64(used))
+		if byMem < target {
+			target = byMem
+		}
+	}
+	var evicted, protected int64
+	switch policy {
+	case EvictWipe:
+		evicted = ss.evictWipe()
+	case EvictOldest:
+		evicted, protected = ss.evictOldest(target)
+	case EvictCap:
+		evicted = ss.evictCap(target)
+	default:
+		panic(fmt.Sprintf("Unknown eviction policy %d", policy))
+	}
+
+	atomic.AddInt64(ss.numSeeds, -evicted)
+	atomic.AddInt64(&ss.stats.Evictions, 1)
+	atomic.AddInt64(&ss.stats.Evicted, evicted)
+	atomic.AddInt64(&ss.stats.Protected, protected)
+	return evicted
+}
+
+// evictWipe removes every seed from the table.
+// All write locks must be held.
+func (ss Seeds) evictWipe() int64 {
+	for i := range ss.rows {
+		ss.rows[i] = 0
+	}
+	ss.chunks.reset()
+	return atomic.LoadInt64(ss.numSeeds)
+}
+
+// evictOldest removes the seeds of the oldest coarse sequences until there
+// are at most 'target' seeds left. Sequences with matches are skipped if
+// possible, and their match counts are halved so that they don't stay
+// forever.
+// All write locks must be held.
+func (ss Seeds) evictOldest(target int64) (evicted, protected int64) {
+	// Count the seeds of every coarse sequence.
+	counts := make([]int64, 0)
+	blocks := ss.chunks.blocks
+	for _, addr := range ss.rows {
+		for addr != 0 {
+			prev, base, locs := blocks.chunk(addr)
+			for _, loc := range locs {
+				seqInd := int(base + loc>>16)
+				for len(counts) <= seqInd {
+					counts = append(counts, 0)
+				}
+				counts[seqInd]++
+			}
+			addr = prev
+		}
+	}
+
+	ss.hits.Lock()
+	defer ss.hits.Unlock()
+
+	// Pick the oldest sequences without matches first. If that isn't enough
+	// (in which case every sequence without matches has been picked), pick
+	// the oldest sequences with matches too.
+	excess := atomic.LoadInt64(ss.numSeeds) - target
+	evict := make([]bool, len(counts))
+	for seqInd := 0; seqInd < len(counts) && evicted < excess; seqInd++ {
+		if counts[seqInd] == 0 {
+			continue
+		}
+		if ss.hits.counts[uint32(seqInd)] > 0 {
+			protected += counts[seqInd]
+			continue
+		}
+		evict[seqInd] = true
+		evicted += counts[seqInd]
+	}
+	for seqInd := 0; seqInd < len(counts) && evicted < excess; seqInd++ {
+		if !evict[seqInd] && counts[seqInd] > 0 {
+			evict[seqInd] = true
+			evicted += counts[seqInd]
+			protected -= counts[seqInd]
+		}
+	}
+
+	for seqInd, count := range ss.hits.counts {
+		if int(seqInd) < len(evict) && evict[seqInd] {
+			delete(ss.hits.counts, seqInd)
+		} else if count /= 2; count == 0 {
+			delete(ss.hits.counts, seqInd)
+		} else {
+			ss.hits.counts[seqInd] = count
+		}
+	}
+
+	ss.rebuild(func(seqInd uint32, newer int) bool {
+		return !evict[seqInd]
+	})
+	return evicted, protected
+}
+
+// evictCap keeps only the newest L locations of every K-mer, where L is the
+// largest limit that leaves at most 'target' seeds in the table.
+// All write locks must be held.
+func (ss Seeds) evictCap(target int64) int64 {
+	// lengths[n] is the number of rows with exactly n locations.
+	lengths := make([]int64, 0)
+	blocks := ss.chunks.blocks
+	for _, addr := range ss.rows {
+		n := 0
+		for addr != 0 {
+			prev, _, locs := blocks.chunk(addr)
+			n += len(locs)
+			addr = prev
+		}
+		for len(lengths) <= n {
+			lengths = append(lengths, 0)
+		}
+		lengths[n]++
+	}
+
+	// Find the largest limit that fits. Rows longer than the limit are
+	// counted in 'longer'.
+	limit := len(lengths) - 1
+	total := atomic.LoadInt64(ss.numSeeds)
+	longer := int64(0)
+	for ; limit > 0 && total > target; limit-- {
+		longer += lengths[limit]
+		total -= longer
+	}
+
+	return ss.rebuild(func(seqInd uint32, newer int) bool {
+		return newer < limit
+	})
+}
+
+// rebuild copies every seed location that 'keep' accepts into new chunks,
+// and frees the old ones. (Chunks can't be freed one at a time.) 'keep' is
+// called with the sequence index of every location and the number of newer
+// locations in its row. The number of locations that aren't kept is
+// returned.
+// All write locks must be held.
+func (ss Seeds) rebuild(keep func(seqInd uint32, newer int) bool) int64 {
+	old := ss.chunks.reset()
+	evicted := int64(0)
+	row := make([][2]uint32, 0, 100)
+	for i, addr := range ss.rows {
+		row = row[:0]
+		for newer := 0; addr != 0; {
+			prev, base, locs := old.chunk(addr)
+			for j := len(locs) - 1; j >= 0; j-- {
+				seqInd := base + locs[j]>>16
+				if keep(seqInd, newer) {
+					row = append(row, [2]uint32{seqInd, locs[j] & 0xffff})
+				} else {
+					evicted++
+				}
+				newer++
+			}
+			addr = prev
+		}
+
+		// Locations were found newest first.
+		// (They always fit, since they fit before.)
+		ss.rows[i] = 0
+		for j := len(row) - 1; j >= 0; j-- {
+			ss.chunks.add(&ss.rows[i], row[j][0], uint16(row[j][1]))
+		}
+	}
+	return evicted
+}
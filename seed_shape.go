@@ -0,0 +1,222 @@
+package cablastp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SeedSampling decides which positions of a sequence are used as seeds.
+type SeedSampling int
+
+const (
+	// SampleAll uses every position of coarse sequences as a seed.
+	SampleAll SeedSampling = iota
+
+	// SampleMinimizer uses the minimizer of every window of consecutive
+	// K-mers. A match spanning a whole window is guaranteed to share a seed.
+	SampleMinimizer
+
+	// SampleSyncmer uses every closed syncmer: a K-mer whose smallest
+	// s-mer is at its start or its end. Unlike minimizers, whether a K-mer
+	// is a syncmer does not depend on its neighbours.
+	SampleSyncmer
+)
+
+var seedSamplingNames = map[SeedSampling]string{
+	SampleAll:       "all",
+	SampleMinimizer: "minimizer",
+	SampleSyncmer:   "syncmer",
+}
+
+// ParseSeedSampling returns the seed sampling method with the given name.
+func ParseSeedSampling(name string) (SeedSampling, error) {
+	for sampling, sname := range seedSamplingNames {
+		if sname == name {
+			return sampling, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown seed sampling '%s'. Valid sampling "+
+		"methods are 'all', 'minimizer' and 'syncmer'.", name)
+}
+
+func (sampling SeedSampling) String() string {
+	return seedSamplingNames[sampling]
+}
+
+// A SeedShape describes the seeds of a seeds table: which residues of a
+// K-mer make up a seed, and which K-mers of a sequence are used as seeds.
+type SeedShape struct {
+	// Span is the number of residues covered by a seed. (This is the map
+	// seed size.)
+	Span int
+
+	// Care is the offset of every residue in the span that is part of the
+	// seed. For contiguous seeds, this is every offset in the span.
+	Care []int
+
+	// Sampling is the method used to pick seed positions.
+	Sampling SeedSampling
+
+	// Window is the number of consecutive K-mers in a minimizer window, or
+	// the length of the s-mers of a syncmer.
+	Window int
+}
+
+// NewSeedShape creates a seed shape from the configuration 'conf'.
+//
+// If conf.SeedPattern is empty, seeds are contiguous K-mers of length
+// conf.MapSeedSize. Otherwise, it is a spaced seed pattern of '1's (residues
+// that must match) and '0's (residues that are ignored), e.g., "110110111011",
+// and its length is the span of the seed.
+func NewSeedShape(conf *DBConf) (SeedShape, error) {
+	shape := SeedShape{
+		Span:   conf.MapSeedSize,
+		Window: conf.SeedWindow,
+	}
+
+	if len(conf.SeedPattern) == 0 {
+		for i := 0; i < shape.Span; i++ {
+			shape.Care = append(shape.Care, i)
+		}
+	} else {
+		pattern := conf.SeedPattern
+		if strings.Trim(pattern, "01") != "" {
+			return SeedShape{}, fmt.Errorf("The seed pattern '%s' may only "+
+				"contain '0's and '1's.", pattern)
+		}
+		if pattern[0] != '1' || pattern[len(pattern)-1] != '1' {
+			return SeedShape{}, fmt.Errorf("The seed pattern '%s' must start "+
+				"and end with a '1'.", pattern)
+		}
+		shape.Span = len(pattern)
+		for i := 0; i < len(pattern); i++ {
+			if pattern[i] == '1' {
+				shape.Care = append(shape.Care, i)
+			}
+		}
+	}
+	if len(shape.Care) == 0 {
+		return SeedShape{}, fmt.Errorf("Seeds must have at least one residue.")
+	}
+
+	var err error
+	if shape.Sampling, err = ParseSeedSampling(conf.SeedSampling); err != nil {
+		return SeedShape{}, err
+	}
+	switch shape.Sampling {
+	case SampleMinimizer:
+		if shape.Window < 1 {
+			return SeedShape{}, fmt.Errorf("The minimizer window must " +
+				"contain at least one K-mer.")
+		}
+	case SampleSyncmer:
+		if shape.Window < 1 || shape.Window >= shape.Span {
+			return SeedShape{}, fmt.Errorf("The syncmer s-mer length must "+
+				"be between 1 and %d.", shape.Span-1)
+		}
+	}
+	return shape, nil
+}
+
+// Weight returns the number of residues that make up a seed.
+func (shape SeedShape) Weight() int {
+	return len(shape.Care)
+}
+
+// IsContiguous returns true if every residue in the span is part of the
+// seed.
+func (shape SeedShape) IsContiguous() bool {
+	return shape.Weight() == shape.Span
+}
+
+// mixHash scrambles a hash, so that ordering K-mers by their scrambled hash
+// doesn't favor any particular letters. (This is the finalizer of
+// SplitMix64.)
+func mixHash(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// noSeed is the scrambled hash of K-mers that can't be seeds (e.g., because
+// they contain a wildcard).
+const noSeed = ^uint64(0)
+
+// Sample returns the positions of 'residues' that should be used as seeds
+// according to the sampling method of the seeds table. The result has the
+// same length as 'residues'. (With SampleAll, every position is sampled.)
+//
+// Sample is deterministic, so sampling a query sequence picks the same seeds
+// as sampling a coarse sequence in the regions where they are equal.
+func (ss Seeds) Sample(residues []byte) []bool {
+	sampled := make([]bool, len(residues))
+	numKmers := len(residues) - ss.shape.Span + 1
+	if numKmers <= 0 {
+		return sampled
+	}
+
+	switch ss.shape.Sampling {
+	case SampleAll:
+		for i := 0; i < numKmers; i++ {
+			sampled[i] = true
+		}
+	case SampleMinimizer:
+		values := make([]uint64, numKmers)
+		for i := range values {
+			values[i] = noSeed
+			kmer := residues[i : i+ss.shape.Span]
+			if !ss.HasWildcard(kmer) {
+				values[i] = mixHash(uint64(ss.hashKmer(kmer)))
+			}
+		}
+		window := min(ss.shape.Window, numKmers)
+		for start := 0; start+window <= numKmers; start++ {
+			best := start
+			for i := start + 1; i < start+window; i++ {
+				if values[i] < values[best] {
+					best = i
+				}
+			}
+			if values[best] != noSeed {
+				sampled[best] = true
+			}
+		}
+	case SampleSyncmer:
+		s := ss.shape.Window
+		smers := make([]uint64, len(residues)-s+1)
+		for i := range smers {
+			smers[i] = ss.hashSmer(residues[i : i+s])
+		}
+		for i := 0; i < numKmers; i++ {
+			if ss.HasWildcard(residues[i : i+ss.shape.Span]) {
+				continue
+			}
+			best := i
+			last := i + ss.shape.Span - s
+			for j := i + 1; j <= last; j++ {
+				if smers[j] < smers[best] {
+					best = j
+				}
+			}
+			sampled[i] = best == i || best == last
+		}
+	}
+	return sampled
+}
+
+// hashSmer returns the scrambled hash of a contiguous s-mer, or noSeed if it
+// contains a wildcard.
+func (ss Seeds) hashSmer(smer []byte) uint64 {
+	h := uint64(0)
+	for _, letter := range smer {
+		index := ss.alpha.Index(letter)
+		if index == -1 {
+			return noSeed
+		}
+		h = h*uint64(ss.alpha.Size()) + uint64(index)
+	}
+	return mixHash(h)
+}
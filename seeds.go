@@ -1,150 +1,289 @@
 package cablastp
 
 import (
-	"log"
-	"strings"
+	"bufio"
+	"fmt"
+	"io"
 	"sync"
-	"bytes"
+	"sync/atomic"
 )
 
-// SeedAlphaNums is a map to assign *valid* amino acid resiudes contiunous
-// values so that base-N arithmetic can be performed on them. (Where
-// N = SeedAlphaSize.)
-// Invalid amino acid resiudes map to -1 and will produce a panic.
-var (
-	SeedAlphaSize        = 4 // skip k-mers containing 'N'
-	SeedAlphaNums        = make([]int, 26)
-	ReverseSeedAlphaNums = make([]byte, 26)
-)
-
-// Populate SeedAlphaNums and ReverseSeedAlphaNums using the BLOSUM62
-// alphabet data.
-func init() {
-	var base byte
-
-	baseVal := 0
-	for i := byte(0); i < 26; i++ {
-		base = 'A' + i
-		if strings.ContainsRune("ACGT", rune(base)) {
-			SeedAlphaNums[i] = baseVal
-			ReverseSeedAlphaNums[baseVal] = base
-			baseVal += 1
-		} else {
-			SeedAlphaNums[i] = -1
+// MaxSeedTableSize is the largest number of K-mers a seeds table may have.
+// The table has one entry for every possible K-mer in the reduced alphabet,
+// so alphabets with more classes must use smaller seeds.
+const MaxSeedTableSize = 1 << 30
+
+// SeedTableSize returns the number of rows in a seeds table for seeds of
+// weight 'seedSize' (i.e., made of 'seedSize' residues) in the alphabet
+// 'alpha'. If the table would have more than MaxSeedTableSize rows, an error
+// is returned.
+func SeedTableSize(alpha *Alphabet, seedSize int) (int, error) {
+	size := 1
+	for i := 0; i < seedSize; i++ {
+		size *= alpha.Size()
+		if size > MaxSeedTableSize {
+			return 0, fmt.Errorf("A seeds table for the reduced alphabet "+
+				"'%s' (with %d classes) and a seed size of %d is too big. "+
+				"Please use a smaller seed size.",
+				alpha.Name, alpha.Size(), seedSize)
 		}
 	}
+	return size, nil
 }
 
-// SeedLoc represents the information required to translate a seed to a slice
-// of residues from the coarse database. Namely, the index of the sequence
-// in the coarse database and the index of the residue where the seed starts
-// in that sequence.
+// MaxSeedsGB is the largest memory limit (in gigabytes) that seeds may be
+// evicted at (see Seeds.MaybeEvict). Seed locations can take up to 16GB, but
+// seeds are only evicted every so often, so there must be room left for the
+// seeds added in between.
+const MaxSeedsGB = 12.0
+
+// maxSeedChunkBytes is MaxSeedsGB in bytes.
+const maxSeedChunkBytes = int64(MaxSeedsGB * (1 << 30))
+
+// numSeedLocks is the number of locks guarding the rows of a seeds table.
+// Row 'i' is guarded by lock 'i % numSeedLocks', so that sequences can be
+// added to (and looked up in) different rows concurrently.
+const numSeedLocks = 1024
+
+// Seed locations are stored in chunks, which are allocated from large blocks
+// of 32-bit words. Every K-mer has a single word in the seeds table: the
+// address of its newest chunk, or 0 if it has no locations. Each chunk starts
+// with a header of seedChunkHeader words:
 //
-// Every SeedLoc also contains a pointer to the next seed location. This
-// design was chosen so that each SeedLoc is independently allocated (as
-// opposed to using a slice, which incurs a lot of allocation overhead
-// when expanding the slice, and has the potential for pinning memory).
-type SeedLoc struct {
-	// Index into the coarse database sequence slice.
-	SeqInd uint32
+//	the address of the previous (older) chunk of the same K-mer, or 0,
+//	the base sequence index of the chunk, and
+//	the capacity of the chunk (upper 16 bits) and its length (lower 16 bits),
+//
+// followed by its locations. A location is packed into a single word: the
+// index of its coarse sequence minus the base (upper 16 bits) and the index of
+// the residue where the K-mer starts in that sequence (lower 16 bits).
+//
+// Chunks of a K-mer double in capacity (up to seedMaxChunk) as its row grows,
+// so that appending is constant time and rare K-mers don't waste space. A new
+// chunk is also started when a sequence index can't be packed against the
+// base of the newest chunk.
+const (
+	seedBlockBits   = 20
+	seedBlockWords  = 1 << seedBlockBits
+	seedMaxBlocks   = (1 << 32) / seedBlockWords
+	seedChunkHeader = 3
+	seedMinChunk    = 2
+	seedMaxChunk    = 256
+)
+
+// seedBlocks is the storage of every chunk of seed locations. It always has
+// seedMaxBlocks blocks, which are allocated as they are needed. (So that
+// finding a block never races with allocating another.)
+type seedBlocks [][]uint32
+
+// chunk returns the address of the previous chunk, the base sequence index
+// and the packed locations of the chunk at address 'addr'.
+func (blocks seedBlocks) chunk(addr uint32) (uint32, uint32, []uint32) {
+	block, off := blocks[addr>>seedBlockBits], addr&(seedBlockWords-1)
+	header := block[off : off+seedChunkHeader]
+	n := header[2] & 0xffff
+	locs := block[off+seedChunkHeader : off+seedChunkHeader+n]
+	return header[0], header[1], locs
+}
+
+// seedChunks allocates chunks of seed locations. Chunks are written and read
+// while holding the lock of the row they belong to.
+type seedChunks struct {
+	// Guards allocating chunks.
+	sync.Mutex
+
+	blocks seedBlocks
+
+	// The address of the next free word. Address 0 is never used, so that
+	// it can mean "no chunk".
+	next uint64
+}
+
+func newSeedChunks() *seedChunks {
+	return &seedChunks{
+		blocks: make(seedBlocks, seedMaxBlocks),
+		next:   1,
+	}
+}
+
+// alloc returns the address of 'words' free words. A chunk never spans two
+// blocks. If every block is used, false is returned.
+func (c *seedChunks) alloc(words int) (uint32, bool) {
+	c.Lock()
+	off := c.next & (seedBlockWords - 1)
+	addr := c.next
+	if off+uint64(words) > seedBlockWords {
+		addr += seedBlockWords - off
+	}
+	if addr+uint64(words) > 1<<32 {
+		c.Unlock()
+		return 0, false
+	}
+	if c.blocks[addr>>seedBlockBits] == nil {
+		c.blocks[addr>>seedBlockBits] = make([]uint32, seedBlockWords)
+	}
+	c.next = addr + uint64(words)
+	c.Unlock()
+	return uint32(addr), true
+}
+
+// bytes returns the number of bytes used by chunks so far.
+func (c *seedChunks) bytes() int64 {
+	c.Lock()
+	used := int64(c.next) * 4
+	c.Unlock()
+	return used
+}
 
-	// Index into the coarse sequence corresponding to `SeqInd`.
-	ResInd uint16
+// add appends a location to the row whose newest chunk is at '*head'. The
+// lock of the row must be held. If there is no room for a new chunk, the
+// location isn't added and false is returned.
+func (c *seedChunks) add(head *uint32, seqInd uint32, resInd uint16) bool {
+	size := uint32(seedMinChunk)
+	if addr := *head; addr != 0 {
+		block := c.blocks[addr>>seedBlockBits]
+		header := block[addr&(seedBlockWords-1):]
+		base, n := header[1], header[2]&0xffff
+		size = header[2] >> 16
+		if n < size && seqInd >= base && seqInd-base <= 0xffff {
+			header[seedChunkHeader+n] = (seqInd-base)<<16 | uint32(resInd)
+			header[2]++
+			return true
+		}
+		if size < seedMaxChunk {
+			size *= 2
+		}
+	}
 
-	Next *SeedLoc
+	addr, ok := c.alloc(seedChunkHeader + int(size))
+	if !ok {
+		return false
+	}
+	block := c.blocks[addr>>seedBlockBits]
+	chunk := block[addr&(seedBlockWords-1):]
+	chunk[0], chunk[1], chunk[2] = *head, seqInd, size<<16|1
+	chunk[seedChunkHeader] = uint32(resInd)
+	*head = addr
+	return true
 }
 
-func NewSeedLoc(seqInd uint32, resInd uint16) *SeedLoc {
-	return &SeedLoc{seqInd, resInd, nil}
+// reset frees every chunk, and returns the blocks they were stored in.
+// Every row lock must be held.
+func (c *seedChunks) reset() seedBlocks {
+	c.Lock()
+	old := c.blocks
+	c.blocks, c.next = make(seedBlocks, seedMaxBlocks), 1
+	c.Unlock()
+	return old
 }
 
-// Seeds is a list of lists of seed locations. The index into the seeds table
-// corresponds to a hash of particular K-mer. The list found at each
-// row in the seed table corresponds to all locations in the coarse database
-// in which the K-mer occurs.
+// Seeds is a table of seed locations. The index into the seeds table
+// corresponds to a hash of particular K-mer. The row found at each
+// index in the seed table corresponds to all locations in the coarse database
+// in which the K-mer occurs, in the order they were added. A location is the
+// index of a sequence in the coarse database and the index of the residue
+// where the K-mer starts in that sequence.
 type Seeds struct {
-	// Table of lists of seed locations. Its length is always equivalent
-	// to (SeedAlphaSize)^(SeedSize).
-	Locs []*SeedLoc
+	// The address of the newest chunk of every row of seed locations (see
+	// seedChunks). Its length is always equivalent to
+	// (alphabet size)^(seed weight).
+	rows []uint32
+
+	// Storage for the locations of every row.
+	chunks *seedChunks
 
+	// The reduced alphabet that K-mers are written in. K-mers are hashed as
+	// base-N numbers, where N is the number of classes in the alphabet.
+	alpha *Alphabet
+
+	// The shape of seeds. SeedSize is the span of the shape.
+	shape               SeedShape
 	SeedSize            int
 	lowComplexityWindow int // The low complexity region window size.
 
-	// Lock is used to make Seeds.Add and Seeds.Lookup thread safe.
-	lock *sync.RWMutex
+	// Locks used to make Seeds.Add and Seeds.Lookup thread safe. The lock
+	// for a row is given by Seeds.rowLock.
+	locks []sync.RWMutex
 
 	// Cache
-	// (SeedAlphaSize)^0, (SeedAlphaSize)^1 ... (SeedAlphaSize)^(SeedAlphaSize).
+	// N^0, N^1 ... N^(weight), where N is the size of the alphabet.
 	powers []int
 
-	// The total number of seeds in the table.
-	numSeeds int64
+	// The total number of seeds in the table. It must be accessed
+	// atomically.
+	numSeeds *int64
+
+	// The number of matches each coarse sequence has produced. This is used
+	// to protect useful seeds from eviction.
+	hits *seedHits
+
+	// Statistics about every eviction from this table.
+	stats *EvictionStats
 }
 
-// NewSeeds creates a new table of seed location lists. The table is
-// initialized with enough memory to hold lists for all possible K-mers.
-// Namely, the length of seeds is equivalent to 4^(K) where 4 is the
-// size of the reduced alphabet and K is equivalent to the length of
-// each K-mer.
-func NewSeeds(seedSize, lowComplexityWindow int) Seeds {
+// NewSeeds creates a new table of seed locations. The table is
+// initialized with enough memory to hold rows for all possible seeds.
+// Namely, the length of seeds is equivalent to N^(K) where N is the
+// size of the reduced alphabet and K is equivalent to the weight of
+// the seed shape. (Use SeedTableSize to check that this isn't too big.)
+func NewSeeds(alpha *Alphabet, shape SeedShape, lowComplexityWindow int) Seeds {
+	seedSize := shape.Weight()
 	powers := make([]int, seedSize+1)
 	p := 1
 	for i := 0; i < len(powers); i++ {
 		powers[i] = p
-		p *= SeedAlphaSize
+		p *= alpha.Size()
 	}
 
-	locs := make([]*SeedLoc, powers[seedSize])
-
 	return Seeds{
-		Locs:                locs,
-		SeedSize:            seedSize,
+		rows:                make([]uint32, powers[seedSize]),
+		chunks:              newSeedChunks(),
+		alpha:               alpha,
+		shape:               shape,
+		SeedSize:            shape.Span,
 		lowComplexityWindow: lowComplexityWindow,
-		lock:                &sync.RWMutex{},
+		locks:               make([]sync.RWMutex, numSeedLocks),
 		powers:              powers,
-		numSeeds:            0,
+		numSeeds:            new(int64),
+		hits:                &seedHits{counts: make(map[uint32]uint32)},
+		stats:               &EvictionStats{},
 	}
 }
 
-// NumSeeds computes the number of seeds currently in the seeds table.
-// Since the seeds table is typically big, this is an expensive operation.
-func (ss Seeds) NumSeeds() int64 {
-	ss.lock.RLock()
-	defer ss.lock.RUnlock()
-
-	return ss.numSeeds
+// rowLock returns the lock guarding the row for the K-mer with hash
+// 'kmerIndex'.
+func (ss Seeds) rowLock(kmerIndex int) *sync.RWMutex {
+	return &ss.locks[kmerIndex%numSeedLocks]
 }
 
-// MaybeWipe completely wipes the seeds table if the memory of the seeds table
-// exceeds seedTableSizeGB (which is the number of gigabytes).
-func (ss *Seeds) MaybeWipe(seedTableSizeGB float64) {
-	seedLocSize := int64(16)
-	maxSeedBytes := seedTableSizeGB * 1024.0 * 1024.0 * 1024.0
-	maxSeeds := int64(maxSeedBytes) / seedLocSize
-	if ss.NumSeeds() >= maxSeeds {
-		println("Blowing away seeds table...")
-		ss.lock.Lock() // acquire write lock to blow away seeds table
-		defer ss.lock.Unlock()
-
-		for i := range ss.Locs {
-			ss.Locs[i] = nil
-		}
-		ss.numSeeds = 0
-	}
+// NumSeeds returns the number of seeds currently in the seeds table.
+func (ss Seeds) NumSeeds() int64 {
+	return atomic.LoadInt64(ss.numSeeds)
 }
 
-// Add will create seed locations for all K-mers in corSeq and add them to
-// the seeds table.
-func (ss *Seeds) Add(coarseSeqIndex int, corSeq *CoarseSeq) {
-	ss.lock.Lock()
-	// Don't use defer. It comes with a performance penalty in hot spots.
+// Add will create seed locations for all K-mers in corSeq picked by the
+// sampling method of the seed shape, and add them to the seeds table.
+//
+// If the seeds table runs out of memory, an error is returned, and the
+// locations that didn't fit are left out. (Evicting seeds before the table
+// reaches MaxSeedsGB prevents this.)
+func (ss Seeds) Add(coarseSeqIndex int, corSeq *CoarseSeq) error {
+	added := int64(0)
+
+	var sampled []bool
+	if ss.shape.Sampling != SampleAll {
+		sampled = ss.Sample(corSeq.Residues)
+	}
 
-  // possibly increment by ss.SeedSize instead, like in cablast-compress
+	// possibly increment by ss.SeedSize instead, like in cablast-compress
 	for i := 0; i < corSeq.Len()-ss.SeedSize; i++ {
+		if sampled != nil && !sampled[i] {
+			continue
+		}
 
 		kmer := corSeq.Residues[i : i+ss.SeedSize]
-    // skip wildcard-containing kmers
-		if bytes.IndexByte(kmer, 'N') > -1 {
+		// skip wildcard-containing kmers
+		if ss.HasWildcard(kmer) {
 			continue
 		}
 
@@ -153,20 +292,24 @@ func (ss *Seeds) Add(coarseSeqIndex int, corSeq *CoarseSeq) {
 		}
 
 		kmerIndex := ss.hashKmer(kmer)
-		loc := NewSeedLoc(uint32(coarseSeqIndex), uint16(i))
-		ss.numSeeds++
-
-		if ss.Locs[kmerIndex] == nil {
-			ss.Locs[kmerIndex] = loc
-		} else {
-			lk := ss.Locs[kmerIndex]
-			for ; lk.Next != nil; lk = lk.Next {
-			}
-			lk.Next = loc
+		lock := ss.rowLock(kmerIndex)
+
+		// Don't use defer. It comes with a performance penalty in hot spots.
+		lock.Lock()
+		ok := ss.chunks.add(
+			&ss.rows[kmerIndex], uint32(coarseSeqIndex), uint16(i))
+		lock.Unlock()
+		if !ok {
+			atomic.AddInt64(ss.numSeeds, added)
+			return fmt.Errorf("The seeds table is full, so the seeds of "+
+				"coarse sequence %d could not be added. Seeds must be "+
+				"evicted before they use %gGB of memory.",
+				coarseSeqIndex, MaxSeedsGB)
 		}
+		added++
 	}
-
-	ss.lock.Unlock()
+	atomic.AddInt64(ss.numSeeds, added)
+	return nil
 }
 
 // Lookup returns a list of all seed locations corresponding to a particular
@@ -176,60 +319,146 @@ func (ss *Seeds) Add(coarseSeqIndex int, corSeq *CoarseSeq) {
 // a tuple of (sequence index, residue index). `mem` is used to prevent
 // unnecessary allocation. A pointer to thise slice is returned.
 func (ss Seeds) Lookup(kmer []byte, mem *[][2]uint) [][2]uint {
-	ss.lock.RLock()
+	return ss.lookup(ss.hashKmer(kmer), noBound, mem)
+}
+
+// noBound is a bound on coarse sequence indices that every index is below.
+const noBound = int(^uint(0) >> 1)
+
+// LookupBefore is like Lookup, except that it only returns seed locations in
+// coarse sequences with an index less than 'bound'.
+func (ss Seeds) LookupBefore(kmer []byte, bound int, mem *[][2]uint) [][2]uint {
+	return ss.lookup(ss.hashKmer(kmer), bound, mem)
+}
+
+// lookup returns the seed locations of the K-mer with hash 'kmerIndex' in
+// coarse sequences with an index less than 'bound', oldest first.
+func (ss Seeds) lookup(kmerIndex, bound int, mem *[][2]uint) [][2]uint {
+	lock := ss.rowLock(kmerIndex)
+
 	// Don't use defer. It comes with a performance penalty in hot spots.
-	seeds := ss.Locs[ss.hashKmer(kmer)]
-	if seeds == nil {
-		ss.lock.RUnlock()
+	lock.RLock()
+	*mem = (*mem)[:0]
+	blocks := ss.chunks.blocks
+	for addr := ss.rows[kmerIndex]; addr != 0; {
+		prev, base, locs := blocks.chunk(addr)
+		for i := len(locs) - 1; i >= 0; i-- {
+			seqInd := int(base + locs[i]>>16)
+			if seqInd < bound {
+				*mem = append(*mem,
+					[2]uint{uint(seqInd), uint(locs[i] & 0xffff)})
+			}
+		}
+		addr = prev
+	}
+	lock.RUnlock()
+
+	if len(*mem) == 0 {
 		return nil
 	}
-	*mem = (*mem)[:0]
-	for seedLoc := seeds; seedLoc != nil; seedLoc = seedLoc.Next {
-		*mem = append(*mem,
-			[2]uint{uint(seedLoc.SeqInd), uint(seedLoc.ResInd)})
+
+	// Chunks are found newest first.
+	locs := *mem
+	for i, j := 0, len(locs)-1; i < j; i, j = i+1, j-1 {
+		locs[i], locs[j] = locs[j], locs[i]
 	}
-	ss.lock.RUnlock()
+	return locs
+}
 
-	return *mem
+// AddedSince returns true if there is a seed location for 'kmer' in a coarse
+// sequence with an index of at least 'bound'.
+//
+// N.B. This assumes that coarse sequences are added to the seeds table in
+// the order of their indices, so that only the last location of a K-mer
+// needs to be checked.
+func (ss Seeds) AddedSince(kmer []byte, bound int) bool {
+	kmerIndex := ss.hashKmer(kmer)
+	lock := ss.rowLock(kmerIndex)
+
+	lock.RLock()
+	added := false
+	if addr := ss.rows[kmerIndex]; addr != 0 {
+		_, base, locs := ss.chunks.blocks.chunk(addr)
+		last := locs[len(locs)-1]
+		added = int(base+last>>16) >= bound
+	}
+	lock.RUnlock()
+
+	return added
+}
+
+// HasWildcard returns true if any residue of 'kmer' that is part of the seed
+// shape is not a class letter of the seeds table's alphabet.
+func (ss Seeds) HasWildcard(kmer []byte) bool {
+	for _, offset := range ss.shape.Care {
+		if ss.alpha.Index(kmer[offset]) == -1 {
+			return true
+		}
+	}
+	return false
 }
 
-// aminoValue gets the base-20 index of a particular resiude.
-// aminoValue assumes that letter is a valid ASCII character in the
-// inclusive range 'A' ... 'Z'.
-// If the value returned by the SeedAlphaNums map is -1, aminoValue panics.
-// (A value of -1 in this case corresponds to a residue that isn't in
-// BLOSUM62.)
-func aminoValue(letter byte) int {
-	val := SeedAlphaNums[letter-'A']
-	if val == -1 {
-		log.Panicf("Invalid amino acid letter: %c", letter)
+// WritePlain writes the seeds table in a human readable format. Every K-mer
+// with at least one location is written on its own line, in hash order: the
+// residues of the seed, followed by each location as
+// 'coarse-seq-index:residue-index'. (For a spaced seed, only the residues
+// that are part of the seed shape are written.)
+func (ss Seeds) WritePlain(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	mem := make([][2]uint, 0, 100)
+	for kmerIndex := range ss.rows {
+		lock := ss.rowLock(kmerIndex)
+		lock.RLock()
+		empty := ss.rows[kmerIndex] == 0
+		lock.RUnlock()
+		if empty {
+			continue
+		}
+
+		locs := ss.lookup(kmerIndex, noBound, &mem)
+
+		if _, err := bw.Write(ss.unhashKmer(kmerIndex)); err != nil {
+			return err
+		}
+		for _, loc := range locs {
+			_, err := fmt.Fprintf(bw, " %d:%d", loc[0], loc[1])
+			if err != nil {
+				return err
+			}
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
 	}
-	return val
+	return bw.Flush()
 }
 
-// hashKmer returns a unique hash of any 'kmer'. hashKmer assumes that 'kmer'
-// contains only valid upper case residue characters.
-// hashKmer panics if there are any invalid amino acid residues.
+// hashKmer returns a unique hash of the seed in any 'kmer' (which must be as
+// long as the span of the seed shape). hashKmer assumes that the residues of
+// the seed are class letters of the seeds table's alphabet (i.e., no
+// wildcards).
 //
 // hashKmer satisfies this law:
-// Forall a, b in [A..Z]*, hashKmer(a) == hashKmer(b) IFF a == b.
+// Forall a, b in Letters*, hashKmer(a) == hashKmer(b) IFF a and b are equal
+// at every offset of the seed shape.
 func (ss Seeds) hashKmer(kmer []byte) int {
 	hash := 0
-	lastPow := len(kmer) - 1
-	for i, b := range kmer {
-		hash += SeedAlphaNums[b-'A'] * ss.powers[lastPow-i]
+	lastPow := len(ss.shape.Care) - 1
+	for i, offset := range ss.shape.Care {
+		hash += ss.alpha.Index(kmer[offset]) * ss.powers[lastPow-i]
 	}
 	return hash
 }
 
-// unhashKmer reverses hashKmer. (This is used in decompression.)
+// unhashKmer reverses hashKmer, and returns only the residues of the seed.
+// (This is used in decompression.)
 func (ss Seeds) unhashKmer(hash int) []byte {
 	residues := make([]byte, 0)
-	base := SeedAlphaSize
-	for i := 0; i < ss.SeedSize; i++ {
+	base := ss.alpha.Size()
+	for i := 0; i < ss.shape.Weight(); i++ {
 		onesZeroed := (hash / base) * base
 		digit := hash - onesZeroed
-		residues = append(residues, ReverseSeedAlphaNums[digit])
+		residues = append(residues, ss.alpha.Letters[digit])
 		hash /= base
 	}
 	for i, j := 0, len(residues)-1; i < j; i, j = i+1, j-1 {
@@ -116,7 +116,7 @@ func (s *Sequence) FastaSeq() seq.Sequence {
 	for i := range s.Residues {
 		rs[i] = seq.Residue(s.Residues[i])
 	}
-	return seq.Sequence{s.Name, rs}
+	return seq.Sequence{Name: s.Name, Residues: rs}
 }
 
 // Len retuns the number of residues in this Sequence.
@@ -186,6 +186,10 @@ func (rseq *CoarseSeq) addLink(link *LinkToCompressed) {
 // Sequences from the input FASTA file.
 type OriginalSeq struct {
 	*Sequence
+
+	// names is the compressed database that the name of a decompressed
+	// sequence is loaded from, if it hasn't been read yet.
+	names *CompressedDB
 }
 
 func NewOriginalSeq(id int, name string, residues []byte) *OriginalSeq {
@@ -197,7 +201,24 @@ func NewFastaOriginalSeq(id int, s seq.Sequence) *OriginalSeq {
 }
 
 func (oseq *OriginalSeq) NewSubSequence(start, end uint) *OriginalSeq {
-	return &OriginalSeq{oseq.Sequence.newSubSequence(start, end)}
+	return &OriginalSeq{
+		Sequence: oseq.Sequence.newSubSequence(start, end),
+		names:    oseq.names,
+	}
+}
+
+// LoadName returns the name of the original sequence. If the sequence was
+// decompressed from a database with a header store, the name is read the
+// first time LoadName is called.
+func (oseq *OriginalSeq) LoadName() (string, error) {
+	if oseq.names != nil {
+		name, err := oseq.names.ReadName(oseq.Id)
+		if err != nil {
+			return "", err
+		}
+		oseq.Name, oseq.names = name, nil
+	}
+	return oseq.Name, nil
 }
 
 // ReducedSeq embeds a Sequence and serves as a typing mechanism to
@@ -206,11 +227,11 @@ type ReducedSeq struct {
 	*Sequence
 }
 
-//
-func NewReducedSeq(oseq *OriginalSeq) *ReducedSeq {
+// NewReducedSeq reduces an original sequence with the alphabet 'alpha'.
+func NewReducedSeq(alpha *Alphabet, oseq *OriginalSeq) *ReducedSeq {
 	return &ReducedSeq{Sequence: newSeq(oseq.Sequence.Id,
 		oseq.Sequence.Name,
-		Reduce(oseq.Sequence.Residues))}
+		alpha.Reduce(oseq.Sequence.Residues))}
 }
 
 func (rseq *ReducedSeq) NewSubSequence(start, end uint) *ReducedSeq {
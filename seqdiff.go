@@ -182,6 +182,29 @@ func (diff *EditScript) Apply(fromSeq []byte) []byte {
 	return toSeq
 }
 
+// check returns an error if the edit script can't be applied to a sequence
+// of length 'n'. (Apply panics on such scripts.)
+func (diff *EditScript) check(n int) error {
+	lastEnd := 0
+	for _, mod := range diff.mods {
+		if mod.Start < lastEnd || mod.End < mod.Start || mod.End > n {
+			return fmt.Errorf("The edit script '%s' cannot be applied to a "+
+				"sequence of length %d.", diff, n)
+		}
+		lastEnd = mod.End
+	}
+	return nil
+}
+
+// appliedLen returns the length of a sequence of length 'n' after the edit
+// script is applied to it.
+func (diff *EditScript) appliedLen(n int) int {
+	for _, mod := range diff.mods {
+		n += len(mod.Residues) - (mod.End - mod.Start)
+	}
+	return n
+}
+
 func (diff *EditScript) String() string {
 	mods := make([]string, len(diff.mods))
 	lastDist := 0
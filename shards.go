@@ -0,0 +1,210 @@
+package cablastp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	// FileShards is the manifest of a sharded database. It lists the
+	// directory of every shard, one per line. Relative directories are
+	// relative to the sharded database.
+	FileShards = "shards"
+)
+
+// A sharded database is a directory with a manifest of shards, each of which
+// is a normal database. Every original sequence is compressed into exactly
+// one shard, so that each shard has its own (smaller) seeds table while
+// compressing, and its own coarse BLAST database to search.
+
+// ShardName returns the name of the directory of shard 'i' in a sharded
+// database.
+func ShardName(i int) string {
+	return fmt.Sprintf("shard-%03d", i)
+}
+
+// IsSharded returns true if 'dir' is a sharded database.
+func IsSharded(dir string) bool {
+	_, err := os.Stat(path.Join(dir, FileShards))
+	return err == nil
+}
+
+// NewWriteShards creates a new sharded database with 'n' shards in 'dir', and
+// prepares every shard for writing. Each shard gets its own copy of 'conf'.
+// The manifest is written first, and each shard must be saved as usual.
+func NewWriteShards(conf *DBConf, dir string, n int) ([]*DB, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("A sharded database must have at least one " +
+			"shard.")
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("The directory '%s' already exists. A "+
+			"new sharded database cannot be created in the same "+
+			"directory as an existing database.", dir)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("An error occurred when checking if '%s' "+
+			"exists: %s.", dir, err)
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return nil,
+			fmt.Errorf("Could not create directory '%s': %s.", dir, err)
+	}
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = ShardName(i)
+	}
+	manifest := strings.Join(names, "\n") + "\n"
+	f, err := os.Create(path.Join(dir, FileShards))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(manifest); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	shards := make([]*DB, n)
+	for i, name := range names {
+		shards[i], err = NewWriteDB(conf.DeepCopy(), path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+// ReadShards returns the directories of the shards of the sharded database in
+// 'dir', in the order of its manifest.
+func ReadShards(dir string) ([]string, error) {
+	f, err := os.Open(path.Join(dir, FileShards))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if !path.IsAbs(line) {
+			line = path.Join(dir, line)
+		}
+		dirs = append(dirs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("The shards manifest of '%s' is empty.", dir)
+	}
+	return dirs, nil
+}
+
+// NewReadShards opens every shard of the sharded database in 'dir' for
+// reading. If 'dir' is a normal database, it is opened as the only shard, so
+// that both can be searched the same way.
+//
+// Every shard must use the same reduced alphabet.
+func NewReadShards(dir string) ([]*DB, error) {
+	if !IsSharded(dir) {
+		db, err := NewReadDB(dir)
+		if err != nil {
+			return nil, err
+		}
+		return []*DB{db}, nil
+	}
+
+	dirs, err := ReadShards(dir)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]*DB, 0, len(dirs))
+	for _, shardDir := range dirs {
+		db, err := NewReadDB(shardDir)
+		if err == nil && len(shards) > 0 &&
+			db.ReducedAlphabet != shards[0].ReducedAlphabet {
+			db.ReadClose()
+			err = fmt.Errorf("Its reduced alphabet is '%s', but the "+
+				"first shard's is '%s'.",
+				db.ReducedAlphabet, shards[0].ReducedAlphabet)
+		}
+		if err != nil {
+			ReadCloseShards(shards)
+			return nil, fmt.Errorf("Could not open shard '%s': %s",
+				shardDir, err)
+		}
+		shards = append(shards, db)
+	}
+	return shards, nil
+}
+
+// ReadCloseShards closes every shard opened by NewReadShards.
+func ReadCloseShards(shards []*DB) {
+	for _, db := range shards {
+		db.ReadClose()
+	}
+}
+
+// ShardsBlastDBSize returns the database size of all shards together, i.e.,
+// the number of residues in every original sequence. Searches of each shard
+// must use it, so that e-values are the same as for an unsharded database.
+func ShardsBlastDBSize(shards []*DB) uint64 {
+	size := uint64(0)
+	for _, db := range shards {
+		size += db.BlastDBSize
+	}
+	return size
+}
+
+// A ShardSearch searches a single shard with at most 'threads' threads, and
+// returns the original sequences that its hits expand to.
+type ShardSearch func(db *DB, threads int) ([]OriginalSeq, error)
+
+// SearchShards runs 'search' on every shard in parallel, and returns the
+// original sequences found in all of them, in shard order.
+//
+// The 'procs' threads are split between the shards: at most 'procs' shards
+// are searched at once, and each search gets an equal share of the threads
+// (but at least one).
+func SearchShards(
+	shards []*DB, procs int, search ShardSearch) ([]OriginalSeq, error) {
+
+	running := max(1, min(procs, len(shards)))
+	threads := max(1, procs/running)
+
+	found := make([][]OriginalSeq, len(shards))
+	errs := make([]error, len(shards))
+	slots := make(chan struct{}, running)
+	wg := &sync.WaitGroup{}
+	for i, db := range shards {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, db *DB) {
+			found[i], errs[i] = search(db, threads)
+			<-slots
+			wg.Done()
+		}(i, db)
+	}
+	wg.Wait()
+
+	oseqs := make([]OriginalSeq, 0, 100)
+	for i, db := range shards {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("Could not search '%s': %s",
+				db.Path, errs[i])
+		}
+		oseqs = append(oseqs, found[i]...)
+	}
+	return oseqs, nil
+}
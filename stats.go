@@ -0,0 +1,288 @@
+package cablastp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DBStats are counts of what a database holds. They are computed when a
+// database is saved, and stored in the 'Stats' table of its params file.
+type DBStats struct {
+	// The number of original sequences, including aliases.
+	OriginalSeqs int64
+
+	// The number of original sequences that are exact duplicates of an
+	// earlier sequence. (See CompressedSeq.IsAlias.)
+	AliasSeqs int64
+
+	// The number of residues in original sequences that aren't aliases.
+	OriginalResidues int64
+
+	// The number of bytes in the FASTA headers of every original sequence.
+	HeaderBytes int64
+
+	// The number of original sequences that aren't aliases and weren't
+	// matched to any coarse sequence that existed before them, i.e., every
+	// coarse sequence they link to was added for them.
+	NovelSeqs int64
+
+	// The number of coarse sequences and their residues.
+	CoarseSeqs     int64
+	CoarseResidues int64
+
+	// The number of links from original sequences to coarse sequences, i.e.,
+	// the number of fragments that original sequences are split into.
+	Fragments int64
+
+	// The number of links from coarse sequences to original sequences.
+	CoarseLinks int64
+}
+
+// LoadDBStats reads the statistics stored in a params file. If there are
+// none (e.g., for databases saved before they were stored), nil is returned.
+func LoadDBStats(r io.Reader) (*DBStats, error) {
+	var params struct{ Stats *DBStats }
+	if _, err := toml.DecodeReader(r, &params); err != nil {
+		return nil, err
+	}
+	return params.Stats, nil
+}
+
+// write writes the statistics as the 'Stats' table of a params file. It must
+// be written after the database configuration.
+func (stats DBStats) write(w io.Writer) error {
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	return toml.NewEncoder(w).Encode(struct{ Stats DBStats }{stats})
+}
+
+// addWritten adds a compressed sequence that was just written to the
+// statistics.
+func (stats *DBStats) addWritten(cseq *CompressedSeq) error {
+	stats.OriginalSeqs++
+	stats.HeaderBytes += int64(len(cseq.Name))
+	if cseq.IsAlias() {
+		stats.AliasSeqs++
+		return nil
+	}
+	length, err := cseq.Len()
+	if err != nil {
+		return err
+	}
+	stats.OriginalResidues += int64(length)
+	stats.Fragments += int64(len(cseq.Links))
+	return nil
+}
+
+// saveStats finishes the statistics of a database that was just written,
+// and writes them to its params file. The compressed database must be
+// finished writing.
+func (db *DB) saveStats() error {
+	stats := db.ComDB.stats
+	coarsedb := db.CoarseDB
+
+	// An original sequence isn't novel if it links to a coarse sequence that
+	// was added for another one. The first link of every coarse sequence is
+	// to the original sequence it was added for.
+	matched := make([]bool, stats.OriginalSeqs)
+	stats.CoarseSeqs = int64(len(coarsedb.Seqs))
+	for _, seq := range coarsedb.Seqs {
+		stats.CoarseResidues += int64(len(seq.Residues))
+		for lk := seq.Links; lk != nil; lk = lk.Next {
+			stats.CoarseLinks++
+			if lk.OrgSeqId != seq.Links.OrgSeqId &&
+				int64(lk.OrgSeqId) < stats.OriginalSeqs {
+				matched[lk.OrgSeqId] = true
+			}
+		}
+	}
+	stats.NovelSeqs = stats.OriginalSeqs - stats.AliasSeqs
+	for _, m := range matched {
+		if m {
+			stats.NovelSeqs--
+		}
+	}
+
+	db.Stats = &stats
+	return stats.write(db.params)
+}
+
+// A Histogram counts how many times each value occurs.
+type Histogram map[int]int64
+
+// Add counts one more occurrence of 'value'.
+func (h Histogram) Add(value int) {
+	h[value]++
+}
+
+// Distribution summarizes a histogram.
+type Distribution struct {
+	Count                      int64
+	Mean                       float64
+	Min, P25, Median, P75, P90 int
+	P99, Max                   int
+}
+
+// Distribution returns a summary of the values counted by the histogram.
+func (h Histogram) Distribution() Distribution {
+	values := make([]int, 0, len(h))
+	var d Distribution
+	sum := 0.0
+	for value, count := range h {
+		values = append(values, value)
+		d.Count += count
+		sum += float64(value) * float64(count)
+	}
+	if d.Count == 0 {
+		return d
+	}
+	sort.Ints(values)
+	d.Mean = sum / float64(d.Count)
+
+	// quantile returns the smallest value such that at least a fraction 'q'
+	// of all values are no greater than it.
+	quantile := func(q float64) int {
+		rank := int64(math.Ceil(q * float64(d.Count)))
+		seen := int64(0)
+		for _, value := range values {
+			seen += h[value]
+			if seen >= rank {
+				return value
+			}
+		}
+		return values[len(values)-1]
+	}
+	d.Min, d.Max = values[0], values[len(values)-1]
+	d.P25, d.Median, d.P75 = quantile(0.25), quantile(0.5), quantile(0.75)
+	d.P90, d.P99 = quantile(0.9), quantile(0.99)
+	return d
+}
+
+func (d Distribution) String() string {
+	return fmt.Sprintf("n=%d mean=%.2f min=%d p25=%d median=%d p75=%d "+
+		"p90=%d p99=%d max=%d", d.Count, d.Mean, d.Min, d.P25, d.Median,
+		d.P75, d.P90, d.P99, d.Max)
+}
+
+// A DBScan is every statistic of a database that is found by reading all of
+// it.
+type DBScan struct {
+	DBStats
+
+	// The number of residues in aliases, which aren't stored.
+	AliasResidues int64
+
+	// The number of links of each coarse sequence to original sequences.
+	LinksPerCoarse Histogram
+
+	// The number of residues in each fragment of an original sequence.
+	FragmentLengths Histogram
+
+	// The number of links of each original sequence that isn't an alias.
+	LinksPerOriginal Histogram
+}
+
+// Scan reads every sequence and link of a database that is open for reading,
+// and computes its statistics.
+func (db *DB) Scan() (*DBScan, error) {
+	scan := &DBScan{
+		LinksPerCoarse:   make(Histogram),
+		FragmentLengths:  make(Histogram),
+		LinksPerOriginal: make(Histogram),
+	}
+	comdb, coarsedb := db.ComDB, db.CoarseDB
+	numSeqs := comdb.NumSequences()
+
+	// As when the database is saved, an original sequence is novel unless
+	// it links to a coarse sequence that was added for another one.
+	matched := make([]bool, numSeqs)
+	scan.CoarseSeqs = int64(coarsedb.NumSequences())
+	for id := 0; id < coarsedb.NumSequences(); id++ {
+		seq, err := coarsedb.ReadCoarseSeq(id)
+		if err != nil {
+			return nil, err
+		}
+		scan.CoarseResidues += int64(len(seq.Residues))
+
+		links, err := coarsedb.readLinksOf(id)
+		if err != nil {
+			return nil, err
+		}
+		scan.CoarseLinks += int64(len(links))
+		scan.LinksPerCoarse.Add(len(links))
+		for _, lk := range links {
+			if lk.OrgSeqId != links[0].OrgSeqId &&
+				int(lk.OrgSeqId) < numSeqs {
+				matched[lk.OrgSeqId] = true
+			}
+		}
+	}
+
+	lengths := make([]int32, numSeqs)
+	for id := 0; id < numSeqs; id++ {
+		cseq, err := comdb.ReadCompressedSeq(id)
+		if err != nil {
+			return nil, err
+		}
+		name, err := comdb.ReadName(id)
+		if err != nil {
+			return nil, err
+		}
+		scan.OriginalSeqs++
+		scan.HeaderBytes += int64(len(name))
+		if cseq.IsAlias() {
+			if cseq.AliasOf < 0 || cseq.AliasOf >= id {
+				return nil, fmt.Errorf("Sequence %d is an alias of sequence "+
+					"%d, which isn't before it.", id, cseq.AliasOf)
+			}
+			scan.AliasSeqs++
+			scan.AliasResidues += int64(lengths[cseq.AliasOf])
+			lengths[id] = lengths[cseq.AliasOf]
+			continue
+		}
+
+		ranges, err := cseq.OriginalRanges()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranges {
+			scan.FragmentLengths.Add(r[1] - r[0])
+			lengths[id] = int32(r[1])
+		}
+		scan.OriginalResidues += int64(lengths[id])
+		scan.Fragments += int64(len(ranges))
+		scan.LinksPerOriginal.Add(len(ranges))
+		if !matched[id] {
+			scan.NovelSeqs++
+		}
+	}
+	return scan, nil
+}
+
+// FileSizes returns the size in bytes of every file in the database
+// directory, by name.
+func (db *DB) FileSizes() (map[string]int64, error) {
+	dir, err := os.Open(db.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			sizes[info.Name()] = info.Size()
+		}
+	}
+	return sizes, nil
+}
@@ -0,0 +1,59 @@
+package cablastp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cablastp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const fasta = "data/small.fasta"
+	for _, coding := range []string{CodingPlain, CodingRange} {
+		conf := DefaultDBConf.DeepCopy()
+		conf.ResidueCoding = coding
+		dbDir := filepath.Join(tmpDir, coding)
+		createTestDB(t, dbDir, fasta, conf)
+
+		db, err := NewReadDB(dbDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.Stats == nil {
+			t.Fatal("The database has no stored statistics.")
+		}
+		scan, err := db.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *db.Stats != scan.DBStats {
+			t.Fatalf("The stored statistics are\n%+v\nbut reading the "+
+				"database found\n%+v", *db.Stats, scan.DBStats)
+		}
+
+		stats := scan.DBStats
+		if stats.OriginalSeqs != int64(db.ComDB.NumSequences()) ||
+			stats.CoarseSeqs != int64(db.CoarseDB.NumSequences()) {
+			t.Fatalf("The statistics count %d original and %d coarse "+
+				"sequences, but the database has %d and %d.",
+				stats.OriginalSeqs, stats.CoarseSeqs,
+				db.ComDB.NumSequences(), db.CoarseDB.NumSequences())
+		}
+		if stats.NovelSeqs == 0 || stats.NovelSeqs > stats.OriginalSeqs {
+			t.Fatalf("%d of %d sequences are novel.",
+				stats.NovelSeqs, stats.OriginalSeqs)
+		}
+		n := scan.FragmentLengths.Distribution().Count
+		if n != stats.Fragments {
+			t.Fatalf("%d fragment lengths were counted, but there are %d "+
+				"fragments.", n, stats.Fragments)
+		}
+		db.ReadClose()
+	}
+}
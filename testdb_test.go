@@ -0,0 +1,132 @@
+package cablastp
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// testFragmentLen is the length of the pieces that createTestDB splits
+// original sequences into.
+const testFragmentLen = 40
+
+// The sequences in testNamedFasta. testSeqC differs from testSeqA only in
+// a residue that reduces to the same letter.
+const (
+	testSeqA = "MKTAYIAKQRQISFVKSHFSRQLEERLGLIEVQAPILSRVGDGTQDNLSGAEKAVQVKVKALPDAQ"
+	testSeqB = "MSDNGPQNQRNAPRITFGGPSDSTGSNQNGERSGARSKQRRPQGLPNNTASWFTALTQHGKEDLK"
+	testSeqC = "MKTAYIAKQRQISFVKSHFSRQLEERLGLIEVQAPILSRVGDGTQDNLSGAEKAVQVKVKALPEAQ"
+)
+
+// testNamedFasta has an NR style header, NCBI sequence identifiers, a
+// numeric name, and an exact duplicate (the third sequence).
+const testNamedFasta = ">gi|1|ref|NP_1.1| first" +
+	"\x01gi|2|gb|AB_2.3| first copy\n" + testSeqA +
+	"\n>sp|P69905|HBA_HUMAN second\n" + testSeqB +
+	"\n>gi|3|ref|NP_1.2| third\n" + testSeqA +
+	"\n>12345 variant\n" + testSeqC + "\n"
+
+// createNamedTestDB creates a database in 'dbDir' from testNamedFasta with
+// createTestDB, and opens it for reading. If 'conf' is nil, the default
+// configuration is used.
+func createNamedTestDB(t *testing.T, dbDir string, conf *DBConf) *DB {
+	fasta := dbDir + ".fasta"
+	err := ioutil.WriteFile(fasta, []byte(testNamedFasta), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestDB(t, dbDir, fasta, conf)
+	db, err := NewReadDB(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestDB writes every sequence in 'fasta' to a new database in 'dbDir'.
+// If 'conf' is nil, the default configuration is used.
+//
+// Unlike cablastp-compress, no matches are searched for. Exact duplicates
+// are stored as aliases, and every other sequence is split into pieces of
+// testFragmentLen residues. A piece links to the first coarse sequence with
+// the same reduced residues, or is added as a new coarse sequence. This is
+// enough to give databases with shared coarse sequences, aliases and (with
+// range coding) edit scripts.
+func createTestDB(t *testing.T, dbDir, fasta string, conf *DBConf) {
+	if conf == nil {
+		conf = DefaultDBConf.DeepCopy()
+	}
+	conf.BlastMakeBlastDB = "true"
+	db, err := NewWriteDB(conf, dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exceptions, err := OpenExceptions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := ReadOriginalSeqs
+	if exceptions != nil {
+		read = ReadOriginalSeqsLossless
+	}
+	seqChan, err := read(fasta, []byte("JOU"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]int)
+	coarseIds := make(map[string]int)
+	id := 0
+	for readSeq := range seqChan {
+		if readSeq.Err != nil {
+			t.Fatal(readSeq.Err)
+		}
+		if exceptions != nil {
+			if err := exceptions.Add(readSeq.Exceptions); err != nil {
+				t.Fatal(err)
+			}
+		}
+		oseq := readSeq.Seq
+		if aliasOf, ok := seen[string(oseq.Residues)]; ok {
+			db.ComDB.Write(NewAliasSeq(id, oseq.Name, aliasOf))
+			id++
+			continue
+		}
+		seen[string(oseq.Residues)] = id
+
+		cseq := NewCompressedSeq(id, oseq.Name)
+		for start := 0; start < oseq.Len(); start += testFragmentLen {
+			end := start + testFragmentLen
+			if end > oseq.Len() {
+				end = oseq.Len()
+			}
+			orig := oseq.Residues[start:end]
+			reduced := db.Alphabet.Reduce(orig)
+			coarseId, ok := coarseIds[string(reduced)]
+			var corSeq *CoarseSeq
+			if ok {
+				corSeq = db.CoarseDB.CoarseSeqGet(uint(coarseId))
+			} else {
+				coarseId, corSeq, err = db.CoarseDB.Add(reduced)
+				if err != nil {
+					t.Fatal(err)
+				}
+				coarseIds[string(reduced)] = coarseId
+			}
+			corSeq.AddLink(NewLinkToCompressed(
+				uint32(id), 0, uint16(len(reduced))))
+			cseq.Add(NewLinkToCoarse(uint(coarseId), 0, uint(len(reduced)),
+				db.EncodeOrigSeq(&cseq, corSeq.Residues, orig)))
+		}
+		db.ComDB.Write(cseq)
+		id++
+	}
+	if exceptions != nil {
+		if err := exceptions.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+	db.WriteClose()
+}
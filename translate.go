@@ -6,14 +6,21 @@ import (
 	"io"
 	// "os"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/TuftsBCB/io/fasta"
 	"github.com/TuftsBCB/seq"
-	"strings"
 )
 
 type SearchOperator func(*bytes.Reader) (*bytes.Reader, error)
 
-func TranslateQuerySeqs(
+// TranslateQuerySeqs translates every nucleotide query in 'query' in all six
+// frames, and writes each open reading frame with at least 'minORFLen'
+// residues in the reduced alphabet 'alpha'. Each reading frame is named with
+// TranslatedFrame.Name.
+func TranslateQuerySeqs(gc *GeneticCode, alpha *Alphabet, minORFLen int,
 	query *bytes.Reader, action SearchOperator) (*bytes.Reader, error) {
 
 	buf := new(bytes.Buffer)
@@ -30,95 +37,201 @@ func TranslateQuerySeqs(
 		origSeq := sequence.Bytes()
 		n := sequence.Name
 		// generate 6 ORFs
-		transSeqs := Translate(origSeq)
-		for _, s := range transSeqs {
-			result := seq.NewSequenceString(n, string(Reduce(s)))
-			f.Write(result)
+		frames, _ := gc.Translate(origSeq)
+		for _, frame := range frames {
+			for _, orf := range frame.ORFs(minORFLen) {
+				result := seq.NewSequenceString(
+					orf.Name(n), string(alpha.Reduce(orf.Residues)))
+				f.Write(result)
+			}
 		}
 
 	}
+	f.Flush()
 
 	return bytes.NewReader(buf.Bytes()), nil
 }
 
-func Translate(sequence []byte) [][]byte {
+// TranslatedFrame is a translation of a stretch of nucleotides in one of the
+// six reading frames. It records where the translation came from, so that
+// positions in the translated residues can be mapped back to the nucleotide
+// sequence.
+type TranslatedFrame struct {
+	// Frame is 1, 2 or 3 for the forward frames and -1, -2 or -3 for the
+	// reverse complement frames.
+	Frame int
+
+	// NucStart and NucEnd are the half-open range of nucleotides that were
+	// translated. They always refer to the forward strand, even for reverse
+	// complement frames.
+	NucStart, NucEnd int
+
+	// The translated residues. Stop codons are translated to '*'.
+	Residues []byte
+}
+
+// Translate performs a six-frame translation of a nucleotide sequence using
+// the genetic code 'gc'. The three forward frames and the three reverse
+// complement frames are interleaved in the result (+1, -1, +2, -2, +3, -3).
+//
+// The sequence is normalized with NormalizeNucleotides before translation,
+// and the number of ambiguous bases it contains is returned. Codons with
+// ambiguous bases translate to an amino acid only when every possible
+// expansion of the codon agrees; otherwise they translate to 'X'.
+func (gc *GeneticCode) Translate(sequence []byte) ([]TranslatedFrame, int) {
+	sequence, ambiguous := NormalizeNucleotides(sequence)
 	l := len(sequence)
-	results := make([][]byte, 0, 6)
+	results := make([]TranslatedFrame, 0, 6)
 	// three ORFs
 	for orf := 0; orf <= 2; orf++ {
-		var result []byte
+		codons := max(0, (l-orf)/3)
+
 		// forward direction
+		result := make([]byte, 0, codons)
 		for i := orf; i < (l - 2); i += 3 {
-			var codon []byte
-			codon = sequence[i : i+3]
-			trans := translate1(codon)
-			if trans == '_' {
-				// elide stop codons for now?
-				continue
-			}
-			result = append(result, trans)
+			result = append(result, gc.translate1(sequence[i:i+3]))
 		}
-		results = append(results, result)
+		results = append(results, TranslatedFrame{
+			Frame:    orf + 1,
+			NucStart: orf,
+			NucEnd:   orf + 3*codons,
+			Residues: result,
+		})
+
 		// reverse complement
-		result = make([]byte, 0)
+		result = make([]byte, 0, codons)
+		codon := make([]byte, 3)
 		for i := (l - 3 - orf); i >= 0; i -= 3 {
-			codon := make([]byte, 3)
 			rCodon := sequence[i : i+3]
 			codon[0] = complement(rCodon[2])
 			codon[1] = complement(rCodon[1])
 			codon[2] = complement(rCodon[0])
-			trans := translate1(codon)
-			if trans == '_' {
-				// elide stop codons
-				continue
-			}
-			result = append(result, trans)
+			result = append(result, gc.translate1(codon))
 		}
-		results = append(results, result)
+		results = append(results, TranslatedFrame{
+			Frame:    -(orf + 1),
+			NucStart: l - orf - 3*codons,
+			NucEnd:   l - orf,
+			Residues: result,
+		})
 	}
-	return results
+	return results, ambiguous
 }
 
-func translate1(codon []byte) byte {
-	// if code contains an 'N' -> 'X'
-	if strings.ContainsRune(string(codon), 'N') {
-		return 'X'
+// NucRange maps the half-open range of residues [from, to) in this frame to
+// the half-open range of nucleotides (on the forward strand) that they were
+// translated from.
+func (tf TranslatedFrame) NucRange(from, to int) (int, int) {
+	if tf.Frame < 0 {
+		return tf.NucEnd - 3*to, tf.NucEnd - 3*from
 	}
-	// otherwise, look up in hash
-
-	var genCode = map[string]byte{
-		"ATA": 'I', "ATC": 'I', "ATT": 'I', "ATG": 'M',
-		"ACA": 'T', "ACC": 'T', "ACG": 'T', "ACT": 'T',
-		"AAC": 'N', "AAT": 'N', "AAA": 'K', "AAG": 'K',
-		"AGC": 'S', "AGT": 'S', "AGA": 'R', "AGG": 'R',
-		"CTA": 'L', "CTC": 'L', "CTG": 'L', "CTT": 'L',
-		"CCA": 'P', "CCC": 'P', "CCG": 'P', "CCT": 'P',
-		"CAC": 'H', "CAT": 'H', "CAA": 'Q', "CAG": 'Q',
-		"CGA": 'R', "CGC": 'R', "CGG": 'R', "CGT": 'R',
-		"GTA": 'V', "GTC": 'V', "GTG": 'V', "GTT": 'V',
-		"GCA": 'A', "GCC": 'A', "GCG": 'A', "GCT": 'A',
-		"GAC": 'D', "GAT": 'D', "GAA": 'E', "GAG": 'E',
-		"GGA": 'G', "GGC": 'G', "GGG": 'G', "GGT": 'G',
-		"TCA": 'S', "TCC": 'S', "TCG": 'S', "TCT": 'S',
-		"TTC": 'F', "TTT": 'F', "TTA": 'L', "TTG": 'L',
-		"TAC": 'Y', "TAT": 'Y', "TAA": '*', "TAG": '*',
-		"TGC": 'C', "TGT": 'C', "TGA": '*', "TGG": 'W',
+	return tf.NucStart + 3*from, tf.NucStart + 3*to
+}
+
+// sub returns the part of this frame corresponding to residues [from, to).
+func (tf TranslatedFrame) sub(from, to int) TranslatedFrame {
+	start, end := tf.NucRange(from, to)
+	return TranslatedFrame{
+		Frame:    tf.Frame,
+		NucStart: start,
+		NucEnd:   end,
+		Residues: tf.Residues[from:to],
 	}
-	return genCode[string(codon)]
 }
 
-func complement(char byte) byte {
-	switch char {
-	case 'A':
-		return 'T'
-	case 'T':
-		return 'A'
-	case 'C':
-		return 'G'
-	case 'G':
-		return 'C'
-	case 'N':
-		return 'N'
+// ORFs splits this frame at every stop codon, and returns each of the
+// resulting open reading frames with at least 'minLen' residues. The stop
+// codons themselves are not included.
+func (tf TranslatedFrame) ORFs(minLen int) []TranslatedFrame {
+	orfs := make([]TranslatedFrame, 0, 1)
+	start := 0
+	for i := 0; i <= len(tf.Residues); i++ {
+		if i < len(tf.Residues) && tf.Residues[i] != '*' {
+			continue
+		}
+		if i-start > 0 && i-start >= minLen {
+			orfs = append(orfs, tf.sub(start, i))
+		}
+		start = i + 1
 	}
-	panic(fmt.Sprintf("bad letter: %c", char))
+	return orfs
+}
+
+// Name returns a unique name for this translation of the sequence named
+// 'name'. The first word of 'name' is tagged with the frame and the
+// (1-based, inclusive) nucleotide range, so that the tag survives in BLAST
+// output. The tag can be recovered with ParseFrameName.
+func (tf TranslatedFrame) Name(name string) string {
+	id, rest := name, ""
+	if i := strings.IndexAny(name, " \t"); i > -1 {
+		id, rest = name[:i], name[i:]
+	}
+	return fmt.Sprintf("%s_frame%+d_nt%d-%d%s",
+		id, tf.Frame, tf.NucStart+1, tf.NucEnd, rest)
+}
+
+// ParseFrameName reverses TranslatedFrame.Name. It returns the first word of
+// the original sequence name, along with the frame and the half-open range of
+// nucleotides that were translated. If 'name' wasn't created by
+// TranslatedFrame.Name, an error is returned.
+func ParseFrameName(name string) (id string, frame, start, end int, err error) {
+	if i := strings.IndexAny(name, " \t"); i > -1 {
+		name = name[:i]
+	}
+	m := frameNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, 0, 0,
+			fmt.Errorf("'%s' is not the name of a translated frame.", name)
+	}
+	frame, _ = strconv.Atoi(m[2])
+	start, _ = strconv.Atoi(m[3])
+	end, _ = strconv.Atoi(m[4])
+	return m[1], frame, start - 1, end, nil
+}
+
+var frameNameRegexp = regexp.MustCompile(
+	`^(.*)_frame([+-][123])_nt(\d+)-(\d+)$`)
+
+// iupacMasks maps every IUPAC nucleotide code (in either case) to the set
+// of bases it stands for. Each base is a bit, ordered the same way as codons
+// in a GeneticCode: T = 1, C = 2, A = 4 and G = 8. Anything that isn't a
+// nucleotide code maps to 0. 'U' is treated as 'T'.
+var iupacMasks [256]byte
+
+// iupacLetters is the inverse of iupacMasks for upper case codes.
+const iupacLetters = "NTCYAWMHGKSBRDVN"
+
+func init() {
+	for m := 1; m < len(iupacLetters); m++ {
+		iupacMasks[iupacLetters[m]] = byte(m)
+		iupacMasks[iupacLetters[m]-'A'+'a'] = byte(m)
+	}
+	iupacMasks['U'], iupacMasks['u'] = 1, 1
+}
+
+// NormalizeNucleotides returns a copy of 'sequence' with every base upper
+// cased and every 'U' replaced with 'T'. Characters that are not IUPAC
+// nucleotide codes are replaced with 'N'.
+//
+// The number of bases that aren't exactly one of 'A', 'C', 'G' or 'T' (i.e.,
+// ambiguity codes and invalid characters) is also returned.
+func NormalizeNucleotides(sequence []byte) ([]byte, int) {
+	ambiguous := 0
+	normal := make([]byte, len(sequence))
+	for i, b := range sequence {
+		m := iupacMasks[b]
+		if m&(m-1) != 0 || m == 0 {
+			ambiguous++
+		}
+		normal[i] = iupacLetters[m]
+	}
+	return normal, ambiguous
+}
+
+// complement returns the complement of any IUPAC nucleotide code. The result
+// is always upper case, and anything that isn't a nucleotide code is
+// complemented to 'N'.
+func complement(char byte) byte {
+	m := iupacMasks[char]
+	return iupacLetters[(m&1)<<2|(m&4)>>2|(m&2)<<2|(m&8)>>2]
 }